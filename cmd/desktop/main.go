@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/holden/sshmasher/internal/handler"
@@ -9,6 +10,7 @@ import (
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
 	"github.com/wailsapp/wails/v2/pkg/options/assetserver"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 func main() {
@@ -28,10 +30,28 @@ func main() {
 		AssetServer: &assetserver.Options{
 			Handler: handler.WithMiddleware(router),
 		},
-		OnStartup: nil,
+		OnStartup: func(ctx context.Context) {
+			forwardChanges(ctx, dir)
+		},
 		Bind:       []interface{}{},
 	})
 	if err != nil {
 		log.Fatalf("Wails failed: %v", err)
 	}
 }
+
+// forwardChanges re-emits file changes in dir as "ssh:change" runtime
+// events, which the pages use in place of /api/events.
+func forwardChanges(ctx context.Context, dir *ssh.SSHDir) {
+	watcher, err := ssh.Watch(dir)
+	if err != nil {
+		log.Printf("File watching disabled: %v", err)
+		return
+	}
+	changes, _ := watcher.Subscribe()
+	go func() {
+		for ev := range changes {
+			runtime.EventsEmit(ctx, "ssh:change", ev)
+		}
+	}()
+}
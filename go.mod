@@ -4,7 +4,7 @@ go 1.25.3
 
 require (
 	github.com/a-h/templ v0.3.977
-	github.com/kevinburke/ssh_config v1.4.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/wailsapp/wails/v2 v2.11.0
 	golang.org/x/crypto v0.48.0
 )
@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// Agent holds dependencies for the ssh-agent handlers.
+type Agent struct {
+	Dir     *ssh.SSHDir
+	Socket  string            // agent socket; empty uses SSH_AUTH_SOCK
+	Builtin *ssh.BuiltinAgent // the agent SSHmasher serves itself
+}
+
+// List returns the identities loaded into the agent.
+func (a *Agent) List(w http.ResponseWriter, r *http.Request) {
+	keys, err := ssh.AgentKeys(a.Dir, a.Socket)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if isHTMX(r) {
+		view.AgentKeysTable(keys).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+// Add loads a key from the SSH directory into the agent. Form fields: name,
+// passphrase, lifetime (seconds or a duration like 1h30m) and confirm.
+func (a *Agent) Add(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "key name is required", http.StatusBadRequest)
+		return
+	}
+	lifetime, err := parseLifetime(r.FormValue("lifetime"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := ssh.AgentAddOptions{
+		Passphrase: r.FormValue("passphrase"),
+		Lifetime:   lifetime,
+		Confirm:    r.FormValue("confirm") == "on" || r.FormValue("confirm") == "true",
+	}
+	if err := ssh.AddAgentKey(a.Dir, a.Socket, name, opts); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	a.respond(w, r)
+}
+
+// Remove unloads the key with the fingerprint in the path from the agent.
+func (a *Agent) Remove(w http.ResponseWriter, r *http.Request) {
+	if err := ssh.RemoveAgentKey(a.Socket, r.PathValue("fingerprint")); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	a.respond(w, r)
+}
+
+// RemoveAll unloads every key from the agent.
+func (a *Agent) RemoveAll(w http.ResponseWriter, r *http.Request) {
+	if err := ssh.RemoveAllAgentKeys(a.Socket); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	a.respond(w, r)
+}
+
+// Lock locks the agent with the passphrase form field.
+func (a *Agent) Lock(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	if err := ssh.LockAgent(a.Socket, r.FormValue("passphrase")); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	a.respond(w, r)
+}
+
+// Unlock unlocks the agent with the passphrase form field.
+func (a *Agent) Unlock(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	if err := ssh.UnlockAgent(a.Socket, r.FormValue("passphrase")); err != nil {
+		http.Error(w, "unlock failed: wrong passphrase or agent not locked", http.StatusForbidden)
+		return
+	}
+	a.respond(w, r)
+}
+
+// respond re-renders the agent key table for HTMX, or returns 204.
+func (a *Agent) respond(w http.ResponseWriter, r *http.Request) {
+	if !isHTMX(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	keys, err := ssh.AgentKeys(a.Dir, a.Socket)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	view.AgentKeysTable(keys).Render(r.Context(), w)
+}
+
+// BuiltinStatus returns the built-in agent's state, keys and log.
+func (a *Agent) BuiltinStatus(w http.ResponseWriter, r *http.Request) {
+	if isHTMX(r) {
+		a.renderBuiltin(w, r)
+		return
+	}
+	writeJSON(w, a.Builtin.Status())
+}
+
+// BuiltinStart starts the built-in agent on the socket set in the app
+// config, or the default one.
+func (a *Agent) BuiltinStart(w http.ResponseWriter, r *http.Request) {
+	if err := a.Builtin.Start(builtinAgentSocket()); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.respondBuiltin(w, r)
+}
+
+// BuiltinStop stops the built-in agent, dropping its keys.
+func (a *Agent) BuiltinStop(w http.ResponseWriter, r *http.Request) {
+	if err := a.Builtin.Stop(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.respondBuiltin(w, r)
+}
+
+// BuiltinAdd decrypts a key into the built-in agent. Form fields are those
+// of Add, plus any number of hosts the key is limited to.
+func (a *Agent) BuiltinAdd(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "key name is required", http.StatusBadRequest)
+		return
+	}
+	lifetime, err := parseLifetime(r.FormValue("lifetime"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := ssh.AgentAddOptions{
+		Passphrase: r.FormValue("passphrase"),
+		Lifetime:   lifetime,
+		Confirm:    r.FormValue("confirm") == "on" || r.FormValue("confirm") == "true",
+		Hosts:      r.Form["hosts"],
+	}
+	if err := a.Builtin.AddKey(name, opts); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	a.respondBuiltin(w, r)
+}
+
+// BuiltinRemove drops the key with the fingerprint in the path.
+func (a *Agent) BuiltinRemove(w http.ResponseWriter, r *http.Request) {
+	if err := a.Builtin.RemoveKey(r.PathValue("fingerprint")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.respondBuiltin(w, r)
+}
+
+// BuiltinApprove lets a pending signature go ahead.
+func (a *Agent) BuiltinApprove(w http.ResponseWriter, r *http.Request) {
+	a.decide(w, r, true)
+}
+
+// BuiltinDeny refuses a pending signature.
+func (a *Agent) BuiltinDeny(w http.ResponseWriter, r *http.Request) {
+	a.decide(w, r, false)
+}
+
+func (a *Agent) decide(w http.ResponseWriter, r *http.Request, allow bool) {
+	if err := a.Builtin.Decide(r.PathValue("id"), allow); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// The log row updates itself from the event stream
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BuiltinEvents streams signing requests to the built-in agent as
+// Server-Sent Events named "request", sent when each arrives and again when
+// it finishes. With ?html=1 each is the log row instead of the JSON
+// AgentSignRequest.
+func (a *Agent) BuiltinEvents(w http.ResponseWriter, r *http.Request) {
+	html := r.URL.Query().Get("html") == "1"
+	requests, stop := a.Builtin.Subscribe()
+	defer stop()
+
+	rc := startEventStream(w)
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case req, ok := <-requests:
+			if !ok {
+				return
+			}
+			var data []byte
+			if html {
+				var buf bytes.Buffer
+				view.AgentLogRow(req).Render(r.Context(), &buf)
+				data = buf.Bytes()
+			} else {
+				data, _ = json.Marshal(req)
+			}
+			if err := writeEvent(rc, w, "request", string(data)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
+
+// respondBuiltin re-renders the built-in agent panel for HTMX, or returns
+// the status.
+func (a *Agent) respondBuiltin(w http.ResponseWriter, r *http.Request) {
+	if isHTMX(r) {
+		a.renderBuiltin(w, r)
+		return
+	}
+	writeJSON(w, a.Builtin.Status())
+}
+
+func (a *Agent) renderBuiltin(w http.ResponseWriter, r *http.Request) {
+	local, err := ssh.ListKeys(a.Dir)
+	if err != nil {
+		local = nil
+	}
+	hosts, err := ssh.HealthHosts(a.Dir)
+	if err != nil {
+		hosts = nil
+	}
+	view.BuiltinAgentPanel(a.Builtin.Status(), local, hosts).Render(r.Context(), w)
+}
+
+// builtinAgentSocket returns the socket set by agent.socket in the app
+// config, or "" for the default.
+func builtinAgentSocket() string {
+	cfg, err := ssh.LoadAppConfig()
+	if err != nil {
+		return ""
+	}
+	return cfg.AgentSocket
+}
+
+// writeAgentError reports a failed agent call: 503 when there is no agent
+// to talk to and 403 for a passphrase that doesn't open the key.
+func writeAgentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ssh.ErrNoAgent):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ssh.ErrPassphraseRequired), errors.Is(err, ssh.ErrWrongPassphrase):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseLifetime reads a key lifetime the way ssh-add -t does: seconds, or a
+// duration such as 1h30m. Empty means no limit. Durations under a second are
+// refused, as the agent would round them down to 0, meaning no limit, and so
+// are lifetimes longer than the agent protocol's 32-bit count of seconds.
+func parseLifetime(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	tooLong := errors.New("invalid lifetime: must be at most 4294967295 seconds")
+	if secs, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if secs > math.MaxUint32 {
+			return 0, tooLong
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid lifetime: use seconds or a duration like 1h30m")
+	}
+	if d > 0 && d < time.Second {
+		return 0, errors.New("invalid lifetime: must be at least 1s")
+	}
+	if d > math.MaxUint32*time.Second {
+		return 0, tooLong
+	}
+	return d, nil
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// auditedRoutes maps each state-changing route to the action recorded for
+// it in the audit log.
+var auditedRoutes = map[string]string{
+	"POST /api/keys":                  "key.generate",
+	"PUT /api/keys/{name}":            "key.comment",
+	"DELETE /api/keys/{name}":         "key.delete",
+	"PUT /api/keys/{name}/passphrase": "key.passphrase",
+	"POST /api/keys/{name}/rotate":    "key.rotate",
+
+	"POST /api/config/hosts":                         "host.add",
+	"PUT /api/config/hosts/{alias}":                  "host.update",
+	"DELETE /api/config/hosts/{alias}":               "host.delete",
+	"POST /api/config/hosts/{alias}/forwards":        "forward.add",
+	"PUT /api/config/hosts/{alias}/forwards/{id}":    "forward.update",
+	"DELETE /api/config/hosts/{alias}/forwards/{id}": "forward.delete",
+	"POST /api/config/matches":                       "match.add",
+	"PUT /api/config/matches/{id}":                   "match.update",
+	"DELETE /api/config/matches/{id}":                "match.delete",
+	"PUT /api/config/raw":                            "config.raw",
+	"POST /api/knownhosts":                           "knownhost.add",
+	"POST /api/knownhosts/cas":                       "knownhost.ca",
+	"DELETE /api/knownhosts/{line}":                  "knownhost.remove",
+	"POST /api/knownhosts/{line}/revoke":             "knownhost.revoke",
+	"PUT /api/knownhosts/raw":                        "knownhosts.raw",
+	"POST /api/backup":                               "backup.create",
+	"POST /api/backup/{filename}/restore":            "backup.restore",
+	"DELETE /api/backup/{filename}":                  "backup.delete",
+	"POST /api/history/undo":                         "history.undo",
+	"POST /api/history/redo":                         "history.redo",
+	"POST /api/history/{id}/revert":                  "history.revert",
+
+	"POST /api/agent/keys":                    "agent.add",
+	"DELETE /api/agent/keys":                  "agent.clear",
+	"DELETE /api/agent/keys/{fingerprint...}": "agent.remove",
+	"POST /api/agent/lock":                    "agent.lock",
+	"POST /api/agent/unlock":                  "agent.unlock",
+
+	"POST /api/agent/builtin/start":                   "agent.builtin.start",
+	"POST /api/agent/builtin/stop":                    "agent.builtin.stop",
+	"POST /api/agent/builtin/keys":                    "agent.builtin.add",
+	"DELETE /api/agent/builtin/keys/{fingerprint...}": "agent.builtin.remove",
+	"POST /api/agent/builtin/requests/{id}/approve":   "agent.builtin.approve",
+	"POST /api/agent/builtin/requests/{id}/deny":      "agent.builtin.deny",
+
+	"POST /api/certs":              "cert.sign",
+	"DELETE /api/certs/{name}":     "cert.delete",
+	"POST /api/certs/cas":          "ca.mark",
+	"DELETE /api/certs/cas/{name}": "ca.unmark",
+}
+
+// auditActions lists the audited actions for the audit page filter.
+func auditActions() []string {
+	// Signatures by the built-in agent are logged without a route
+	seen := map[string]bool{ssh.AgentSignAction: true}
+	actions := []string{ssh.AgentSignAction}
+	for _, a := range auditedRoutes {
+		if !seen[a] {
+			seen[a] = true
+			actions = append(actions, a)
+		}
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// Audit records every call to an audited route in dir's audit log, along
+// with hashes of the files it changed. Request bodies are never logged.
+// Calls are not serialized, so calls that overlap may each list the other's
+// changes.
+func Audit(dir *ssh.SSHDir, mux *http.ServeMux) http.Handler {
+	snapshots := ssh.NewFileSnapshotter(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		action, ok := auditedRoutes[pattern]
+		if !ok {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		before := snapshots.Snapshot()
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		mux.ServeHTTP(sw, r)
+
+		entry := model.AuditEntry{
+			Time:     time.Now(),
+			Action:   action,
+			Method:   r.Method,
+			Endpoint: r.URL.Path,
+			Target:   auditTarget(r),
+			Client:   r.RemoteAddr,
+			Status:   sw.status,
+			Changes:  ssh.DiffSnapshots(before, snapshots.Snapshot()),
+		}
+		if err := ssh.AppendAudit(dir, entry); err != nil {
+			log.Printf("audit: %v", err)
+		}
+	})
+}
+
+// auditTarget names what a call acted on, from its path values or, for
+// creates, the identifying form field. Only these fields are read; secrets
+// such as passphrases are never touched.
+func auditTarget(r *http.Request) string {
+	if alias := r.PathValue("alias"); alias != "" {
+		if id := r.PathValue("id"); id != "" {
+			return alias + "#" + id
+		}
+		return alias
+	}
+	for _, name := range []string{"name", "filename", "line", "id", "fingerprint"} {
+		if v := r.PathValue(name); v != "" {
+			return v
+		}
+	}
+	for _, name := range []string{"name", "alias", "hostname", "file", "key", "pattern"} {
+		if v := r.Form.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// AuditLog holds dependencies for the audit log handlers.
+type AuditLog struct {
+	Dir *ssh.SSHDir
+}
+
+// List returns a page of the audit log, filtered by ?action= and ?q=.
+func (a *AuditLog) List(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	filter := ssh.AuditFilter{Action: r.URL.Query().Get("action"), Search: r.URL.Query().Get("q")}
+
+	res, err := ssh.ReadAudit(a.Dir, filter, page, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.AuditList(res, filter.Action, filter.Search).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, res)
+}
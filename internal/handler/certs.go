@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// Certs holds dependencies for the certificate authority handlers.
+type Certs struct {
+	Dir *ssh.SSHDir
+}
+
+// List returns the certificates in the SSH directory.
+func (c *Certs) List(w http.ResponseWriter, r *http.Request) {
+	certs, err := ssh.ListCerts(c.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.CertsTable(certs).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, certs)
+}
+
+// Get returns the certificate for the key in the path.
+func (c *Certs) Get(w http.ResponseWriter, r *http.Request) {
+	cert, err := ssh.GetCert(c.Dir, r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, cert)
+}
+
+// Sign signs a certificate and writes it next to the key. Form fields: ca,
+// key, publicKey (to certify a pasted key instead of key.pub), type,
+// keyId, principals (comma or space separated), serial, validAfter and
+// validBefore (RFC 3339 or datetime-local), validFor (a duration from
+// validAfter, or from now), passphrase for the CA and, for user certs,
+// forceCommand, sourceAddress, verifyRequired and any number of extensions.
+func (c *Certs) Sign(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	req, err := certRequestFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.CA == "" || req.Key == "" {
+		http.Error(w, "ca and key are required", http.StatusBadRequest)
+		return
+	}
+
+	cert, err := ssh.SignCert(c.Dir, req)
+	if err != nil {
+		writeCertError(w, err)
+		return
+	}
+	if !isHTMX(r) {
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, cert)
+		return
+	}
+	trigger, _ := json.Marshal(map[string]any{"showAlert": map[string]string{
+		"message": fmt.Sprintf("Signed %s certificate %s-cert.pub", cert.Type, cert.Name),
+	}})
+	w.Header().Set("HX-Trigger", string(trigger))
+	c.List(w, r)
+}
+
+// Delete removes the certificate for the key in the path.
+func (c *Certs) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := ssh.DeleteCert(c.Dir, r.PathValue("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if isHTMX(r) {
+		c.List(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListCAs returns the keys marked as certificate authorities.
+func (c *Certs) ListCAs(w http.ResponseWriter, r *http.Request) {
+	cas, err := ssh.ListCAs(c.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		c.renderCAs(w, r, cas)
+		return
+	}
+	writeJSON(w, cas)
+}
+
+// MarkCA marks the key in the name form field as a certificate authority.
+func (c *Certs) MarkCA(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "key name is required", http.StatusBadRequest)
+		return
+	}
+	if err := ssh.MarkCA(c.Dir, name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ListCAs(w, r)
+}
+
+// UnmarkCA stops treating the key in the path as a certificate authority.
+func (c *Certs) UnmarkCA(w http.ResponseWriter, r *http.Request) {
+	if err := ssh.UnmarkCA(c.Dir, r.PathValue("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.ListCAs(w, r)
+}
+
+func (c *Certs) renderCAs(w http.ResponseWriter, r *http.Request, cas []model.CertAuthority) {
+	local, err := ssh.ListKeys(c.Dir)
+	if err != nil {
+		local = nil
+	}
+	view.CertAuthorities(cas, local).Render(r.Context(), w)
+}
+
+// certRequestFromForm reads the fields described on Sign.
+func certRequestFromForm(r *http.Request) (model.CertRequest, error) {
+	req := model.CertRequest{
+		CA:         r.FormValue("ca"),
+		Key:        strings.TrimSpace(r.FormValue("key")),
+		PublicKey:  strings.TrimSpace(r.FormValue("publicKey")),
+		Type:       r.FormValue("type"),
+		KeyID:      r.FormValue("keyId"),
+		Passphrase: r.FormValue("passphrase"),
+		Principals: strings.FieldsFunc(r.FormValue("principals"), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		}),
+	}
+	if req.Type == "" {
+		req.Type = "user"
+	}
+	if s := r.FormValue("serial"); s != "" {
+		serial, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return req, errors.New("invalid serial: use a non-negative number")
+		}
+		req.Serial = serial
+	}
+
+	var err error
+	if req.ValidAfter, err = parseCertTime(r.FormValue("validAfter")); err != nil {
+		return req, err
+	}
+	if req.ValidBefore, err = parseCertTime(r.FormValue("validBefore")); err != nil {
+		return req, err
+	}
+	if s := r.FormValue("validFor"); s != "" && req.ValidBefore.IsZero() {
+		d, err := parseLifetime(s)
+		if err != nil {
+			return req, errors.New("invalid validFor: use seconds or a duration like 24h")
+		}
+		start := req.ValidAfter
+		if start.IsZero() {
+			start = time.Now()
+		}
+		req.ValidBefore = start.Add(d)
+	}
+
+	// Options and extensions only apply to user certs; the page's form
+	// sends them whichever type is picked
+	if req.Type != "user" {
+		return req, nil
+	}
+	opts := make(map[string]string)
+	if v := r.FormValue("forceCommand"); v != "" {
+		opts["force-command"] = v
+	}
+	if v := strings.Join(strings.Fields(r.FormValue("sourceAddress")), ""); v != "" {
+		opts["source-address"] = v
+	}
+	if v := r.FormValue("verifyRequired"); v == "on" || v == "true" {
+		opts["verify-required"] = ""
+	}
+	if len(opts) > 0 {
+		req.CriticalOptions = opts
+	}
+	// Without an extensions field the defaults apply; the form sends an
+	// empty one so that unticking every box means none
+	if exts, ok := r.Form["extensions"]; ok {
+		req.Extensions = []string{}
+		for _, e := range exts {
+			if e != "" {
+				req.Extensions = append(req.Extensions, e)
+			}
+		}
+	}
+	return req, nil
+}
+
+// parseCertTime reads a validity bound as RFC 3339 or, from a datetime-local
+// input, as local time. Empty means unbounded.
+func parseCertTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339, e.g. 2026-01-02T15:04:05Z", s)
+	}
+	return t, nil
+}
+
+// writeCertError reports a failed signing: 403 for a passphrase that
+// doesn't open the CA key, otherwise 400.
+func writeCertError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ssh.ErrPassphraseRequired) || errors.Is(err, ssh.ErrWrongPassphrase) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
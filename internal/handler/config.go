@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/holden/sshmasher/internal/model"
@@ -12,12 +13,18 @@ import (
 	"github.com/holden/sshmasher/internal/view"
 )
 
+// maxRawConfigSize caps the body of a raw config save.
+const maxRawConfigSize = 1 << 20
+
 // Config holds dependencies for SSH config handlers.
 type Config struct {
 	Dir *ssh.SSHDir
 }
 
+// ListHosts returns the config's hosts, with the config tree's version as
+// the ETag that host edits must send back.
 func (c *Config) ListHosts(w http.ResponseWriter, r *http.Request) {
+	version, _ := ssh.ConfigVersion(c.Dir)
 	hosts, err := ssh.ListHosts(c.Dir)
 	if err != nil {
 		hosts = nil
@@ -42,8 +49,9 @@ func (c *Config) ListHosts(w http.ResponseWriter, r *http.Request) {
 		hosts = filtered
 	}
 
+	w.Header().Set("ETag", strconv.Quote(version))
 	if isHTMX(r) {
-		view.ConfigHostsTable(hosts, keys, c.Dir).Render(r.Context(), w)
+		view.ConfigHostsTable(hosts, keys, c.Dir, version).Render(r.Context(), w)
 		return
 	}
 	writeJSON(w, hosts)
@@ -54,8 +62,12 @@ func (c *Config) NewHost(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		keys = nil
 	}
+	files, err := ssh.ListConfigFiles(c.Dir)
+	if err != nil {
+		files = nil
+	}
 	if isHTMX(r) {
-		view.ConfigAddForm(keys).Render(r.Context(), w)
+		view.ConfigAddForm(keys, files).Render(r.Context(), w)
 		return
 	}
 	writeJSON(w, nil)
@@ -63,6 +75,7 @@ func (c *Config) NewHost(w http.ResponseWriter, r *http.Request) {
 
 func (c *Config) GetHost(w http.ResponseWriter, r *http.Request) {
 	alias := r.PathValue("alias")
+	version, _ := ssh.ConfigVersion(c.Dir)
 	host, err := ssh.GetHost(c.Dir, alias)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -72,8 +85,13 @@ func (c *Config) GetHost(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		keys = nil
 	}
+	files, err := ssh.ListConfigFiles(c.Dir)
+	if err != nil {
+		files = nil
+	}
+	w.Header().Set("ETag", strconv.Quote(version))
 	if isHTMX(r) {
-		view.ConfigEditForm(*host, keys).Render(r.Context(), w)
+		view.ConfigEditForm(*host, keys, files, version).Render(r.Context(), w)
 		return
 	}
 	writeJSON(w, host)
@@ -106,6 +124,8 @@ func (c *Config) AddHost(w http.ResponseWriter, r *http.Request) {
 		User:         r.FormValue("user"),
 		Port:         r.FormValue("port"),
 		IdentityFile: r.FormValue("identityfile"),
+		Options:      ssh.ParseHostOptions(r.FormValue("options")),
+		File:         r.FormValue("file"),
 	}
 
 	if err := ssh.AddHost(c.Dir, host); err != nil {
@@ -129,62 +149,310 @@ func (c *Config) UpdateHost(w http.ResponseWriter, r *http.Request) {
 		User:         r.FormValue("user"),
 		Port:         r.FormValue("port"),
 		IdentityFile: r.FormValue("identityfile"),
+		File:         r.FormValue("file"),
 	}
 
-	if err := ssh.UpdateHost(c.Dir, host); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The options textarea holds the full list of other directives, so any
+	// keyword left out of it is removed. Without the field, options are kept.
+	if _, ok := r.Form["options"]; ok {
+		host.Options = ssh.ParseHostOptions(r.FormValue("options"))
+		if existing, err := ssh.GetHost(c.Dir, alias); err == nil {
+			for _, o := range existing.Options {
+				if !hasOption(host.Options, o.Key) {
+					host.Options = append(host.Options, model.HostOption{Key: o.Key})
+				}
+			}
+		}
+	}
+
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.UpdateHost(c.Dir, host, version); err != nil {
+		writeSaveError(w, err)
 		return
 	}
 
 	c.ListHosts(w, r)
 }
 
+func hasOption(opts []model.HostOption, key string) bool {
+	for _, o := range opts {
+		if strings.EqualFold(o.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) DeleteHost(w http.ResponseWriter, r *http.Request) {
 	alias := r.PathValue("alias")
-	if err := ssh.DeleteHost(c.Dir, alias); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.DeleteHost(c.Dir, alias, version); err != nil {
+		writeSaveError(w, err)
 		return
 	}
 	c.ListHosts(w, r)
 }
 
 func (c *Config) GetRaw(w http.ResponseWriter, r *http.Request) {
-	content, err := os.ReadFile(c.Dir.ConfigPath())
+	file := r.URL.Query().Get("file")
+	path, err := ssh.ConfigFilePath(c.Dir, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	content, err := os.ReadFile(path)
 	if err != nil {
 		content = []byte{}
 	}
+	version, _ := ssh.FileVersion(path)
+	w.Header().Set("ETag", strconv.Quote(version))
 	if isHTMX(r) {
-		view.ConfigRawEditor(string(content)).Render(r.Context(), w)
+		diags, _ := ssh.ValidateConfigFile(c.Dir, file, string(content), lintDisabled())
+		view.ConfigRawEditor(file, string(content), version, diags).Render(r.Context(), w)
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(content)
 }
 
+// PutRaw saves a config file after linting it. Content with lint errors is
+// rejected with 422 and the problems found, unless force is set. The version
+// from GetRaw's ETag, sent as If-Match or the version field, makes a save
+// over a file changed elsewhere fail with 409.
 func (c *Config) PutRaw(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("file")
+	force := r.URL.Query().Get("force") != ""
+	version := ifMatch(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxRawConfigSize)
 	var content string
 	if r.Header.Get("Content-Type") == "application/json" {
-		body, _ := io.ReadAll(r.Body)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		content = string(body)
 	} else {
-		r.ParseForm()
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form data", http.StatusBadRequest)
+			return
+		}
 		content = r.FormValue("content")
+		file = r.FormValue("file")
+		force = force || r.FormValue("force") != ""
+		if v := r.FormValue("version"); v != "" {
+			version = v
+		}
 	}
 
-	if err := ssh.WriteConfig(c.Dir, content); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	diags, err := ssh.ValidateConfigFile(c.Dir, file, content, lintDisabled())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !force && ssh.HasErrors(diags) {
+		if isHTMX(r) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			view.ConfigRawEditor(file, content, version, diags).Render(r.Context(), w)
+			return
+		}
+		writeProblems(w, diags)
+		return
+	}
+
+	if err := ssh.WriteConfigFile(c.Dir, file, content, version); err != nil {
+		writeSaveError(w, err)
 		return
 	}
 
 	if isHTMX(r) {
+		version, _ := ssh.ConfigVersion(c.Dir)
 		hosts, _ := ssh.ListHosts(c.Dir)
 		keys, _ := ssh.ListKeys(c.Dir)
-		view.ConfigHostsTable(hosts, keys, c.Dir).Render(r.Context(), w)
+		view.ConfigHostsTable(hosts, keys, c.Dir, version).Render(r.Context(), w)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (c *Config) ListFiles(w http.ResponseWriter, r *http.Request) {
+	tree, err := ssh.ConfigFileTree(c.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.ConfigFileTree(tree).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, tree)
+}
+
+// Resolve shows the effective configuration ssh would use for ?host=, with
+// the file and line behind every value. Match exec criteria are not run.
+func (c *Config) Resolve(w http.ResponseWriter, r *http.Request) {
+	res, err := ssh.ResolveHost(c.Dir, r.URL.Query().Get("host"), ssh.ResolveOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isHTMX(r) {
+		view.ConfigResolveResult(res).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// Jumps returns the ProxyJump/ProxyCommand graph for all config hosts.
+func (c *Config) Jumps(w http.ResponseWriter, r *http.Request) {
+	graph, err := ssh.AnalyzeJumps(c.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.ConfigJumpGraph(graph).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, graph)
+}
+
+// ListMatches returns every Match block, with the config tree's version as
+// the ETag that edits by ID must send back.
+func (c *Config) ListMatches(w http.ResponseWriter, r *http.Request) {
+	version, _ := ssh.ConfigVersion(c.Dir)
+	matches, err := ssh.ListMatches(c.Dir)
+	if err != nil {
+		matches = nil
+	}
+	w.Header().Set("ETag", strconv.Quote(version))
+	if isHTMX(r) {
+		view.ConfigMatchesTable(matches, version).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, matches)
+}
+
+func (c *Config) NewMatch(w http.ResponseWriter, r *http.Request) {
+	files, err := ssh.ListConfigFiles(c.Dir)
+	if err != nil {
+		files = nil
+	}
+	if isHTMX(r) {
+		view.ConfigMatchAddForm(files).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, nil)
+}
+
+func (c *Config) GetMatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid match id", http.StatusBadRequest)
+		return
+	}
+	version, _ := ssh.ConfigVersion(c.Dir)
+	m, err := ssh.GetMatch(c.Dir, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(version))
+	if isHTMX(r) {
+		view.ConfigMatchEditForm(*m, version).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, m)
+}
+
+func (c *Config) AddMatch(w http.ResponseWriter, r *http.Request) {
+	m, err := matchFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := ssh.ConfigFilePath(c.Dir, m.File); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := ssh.AddMatch(c.Dir, m); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+
+	c.ListMatches(w, r)
+}
+
+func (c *Config) UpdateMatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid match id", http.StatusBadRequest)
+		return
+	}
+	m, err := matchFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.ID = id
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ssh.UpdateMatch(c.Dir, m, version); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+
+	c.ListMatches(w, r)
+}
+
+func (c *Config) DeleteMatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid match id", http.StatusBadRequest)
+		return
+	}
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.DeleteMatch(c.Dir, id, version); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	c.ListMatches(w, r)
+}
+
+// matchFromForm builds a MatchBlock from the "criteria", "options" and "file" form fields.
+// Its errors are the client's, so callers report them with 400 before
+// anything is saved.
+func matchFromForm(r *http.Request) (model.MatchBlock, error) {
+	if err := r.ParseForm(); err != nil {
+		return model.MatchBlock{}, fmt.Errorf("invalid form data")
+	}
+	criteria, err := ssh.ParseMatchCriteria(r.FormValue("criteria"))
+	if err != nil {
+		return model.MatchBlock{}, err
+	}
+	if err := ssh.ValidateMatchCriteria(criteria); err != nil {
+		return model.MatchBlock{}, err
+	}
+	return model.MatchBlock{
+		Criteria: criteria,
+		Options:  ssh.ParseHostOptions(r.FormValue("options")),
+		File:     r.FormValue("file"),
+	}, nil
+}
+
 func (c *Config) OpenTerminal(w http.ResponseWriter, r *http.Request) {
 	alias := r.PathValue("alias")
 
@@ -215,6 +483,26 @@ func (c *Config) OpenTerminal(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// TestHost connects to a host and reports each stage of the connection.
+func (c *Config) TestHost(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	if _, err := ssh.GetHost(c.Dir, alias); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res, err := ssh.TestConnection(c.Dir, alias, ssh.TestOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.ConfigTestResult(res).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, res)
+}
+
 func isValidAliasChar(char rune) bool {
 	return (char >= 'a' && char <= 'z') ||
 		(char >= 'A' && char <= 'Z') ||
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/holden/sshmasher/internal/ssh"
+)
+
+// eventsHeartbeat keeps idle event streams from being closed by proxies.
+const eventsHeartbeat = 25 * time.Second
+
+// Events streams changes made to ~/.ssh outside the app.
+type Events struct {
+	Watcher *ssh.Watcher
+}
+
+// Stream sends each change as a Server-Sent Event named "change" whose data
+// is the JSON FileEvent.
+func (e *Events) Stream(w http.ResponseWriter, r *http.Request) {
+	if e.Watcher == nil {
+		http.Error(w, "file watching is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	changes, stop := e.Watcher.Subscribe()
+	defer stop()
+
+	rc := startEventStream(w)
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(ev)
+			if err := writeEvent(rc, w, "change", string(data)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
+
+// startEventStream sends the headers for a Server-Sent Events response.
+func startEventStream(w http.ResponseWriter) *http.ResponseController {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	return rc
+}
+
+// writeEvent sends one named event, splitting multi-line data across data
+// fields, and flushes it to the client.
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, name, data string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: %s\n", name)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	if _, err := fmt.Fprint(w, b.String()); err != nil {
+		return err
+	}
+	rc.Flush()
+	return nil
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// ListForwards returns a host's forwards, with the config tree's version as
+// the ETag that edits by ID must send back.
+func (c *Config) ListForwards(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	version, _ := ssh.ConfigVersion(c.Dir)
+	forwards, err := ssh.ListForwards(c.Dir, alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(version))
+	if isHTMX(r) {
+		view.ConfigForwards(alias, forwards, version).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, forwards)
+}
+
+func (c *Config) GetForward(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid forward id", http.StatusBadRequest)
+		return
+	}
+	version, _ := ssh.ConfigVersion(c.Dir)
+	forwards, err := ssh.ListForwards(c.Dir, alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if id < 1 || id > len(forwards) {
+		http.Error(w, fmt.Sprintf("forward not found: %d", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(version))
+	if isHTMX(r) {
+		view.ConfigForwardForm(alias, &forwards[id-1], version).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, forwards[id-1])
+}
+
+func (c *Config) AddForward(w http.ResponseWriter, r *http.Request) {
+	f, err := forwardFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ssh.AddForward(c.Dir, r.PathValue("alias"), f); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	c.ListForwards(w, r)
+}
+
+func (c *Config) UpdateForward(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid forward id", http.StatusBadRequest)
+		return
+	}
+	f, err := forwardFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.ID = id
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.UpdateForward(c.Dir, r.PathValue("alias"), f, version); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	c.ListForwards(w, r)
+}
+
+func (c *Config) DeleteForward(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid forward id", http.StatusBadRequest)
+		return
+	}
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.DeleteForward(c.Dir, r.PathValue("alias"), id, version); err != nil {
+		writeSaveError(w, err)
+		return
+	}
+	c.ListForwards(w, r)
+}
+
+// forwardFromForm builds a forward from the type, bind and target fields,
+// parsed exactly as the equivalent config directive would be.
+func forwardFromForm(r *http.Request) (model.Forward, error) {
+	if err := r.ParseForm(); err != nil {
+		return model.Forward{}, fmt.Errorf("invalid form data")
+	}
+	key := ssh.ForwardKey(r.FormValue("type"))
+	if key == "" {
+		return model.Forward{}, fmt.Errorf("unknown forward type: %s", r.FormValue("type"))
+	}
+	value := strings.TrimSpace(r.FormValue("bind") + " " + r.FormValue("target"))
+	return ssh.ParseForward(key, value)
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/holden/sshmasher/internal/model"
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// Health holds dependencies for the host health dashboard handlers.
+type Health struct {
+	Dir *ssh.SSHDir
+}
+
+// History returns the recent health check results for each host.
+func (h *Health) History(w http.ResponseWriter, r *http.Request) {
+	history, err := ssh.HealthHistory(h.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, history)
+}
+
+// Run probes every host and streams each result as a Server-Sent Event
+// named "result", then sends "done". ?auth=1 also tries to authenticate.
+// With ?html=1 each result is the dashboard row for the host instead of
+// the JSON HealthCheck.
+func (h *Health) Run(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := ssh.HealthOptions{Auth: q.Get("auth") == "1"}
+	html := q.Get("html") == "1"
+
+	history, err := ssh.HealthHistory(h.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rc := startEventStream(w)
+	count := 0
+	err = ssh.CheckHosts(r.Context(), h.Dir, opts, func(c model.HealthCheck) {
+		count++
+		checks := append(history[c.Host], c)
+		if len(checks) > ssh.DefaultHealthKeep {
+			checks = checks[len(checks)-ssh.DefaultHealthKeep:]
+		}
+		history[c.Host] = checks
+
+		var data []byte
+		if html {
+			var buf bytes.Buffer
+			view.HealthRow(c.Host, checks).Render(r.Context(), &buf)
+			data = buf.Bytes()
+		} else {
+			data, _ = json.Marshal(c)
+		}
+		writeEvent(rc, w, "result", string(data))
+	})
+	if err != nil && r.Context().Err() == nil {
+		writeEvent(rc, w, "error", err.Error())
+	}
+	writeEvent(rc, w, "done", fmt.Sprint(count))
+}
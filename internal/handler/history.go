@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/holden/sshmasher/internal/model"
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// History holds dependencies for the undo/redo history handlers.
+type History struct {
+	Dir *ssh.SSHDir
+}
+
+func (h *History) List(w http.ResponseWriter, r *http.Request) {
+	entries, err := ssh.ListHistory(h.Dir, r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.HistoryList(entries).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// Get shows a recorded change as a diff.
+func (h *History) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid change id", http.StatusBadRequest)
+		return
+	}
+	entry, err := ssh.GetHistory(h.Dir, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if isHTMX(r) {
+		view.HistoryDiff(*entry, ssh.HunkDiff(entry.Hunks)).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// Undo reverts the latest change to ?file= (the main config by default).
+func (h *History) Undo(w http.ResponseWriter, r *http.Request) {
+	h.step(w, r, ssh.Undo)
+}
+
+// Redo reapplies the change to ?file= most recently undone.
+func (h *History) Redo(w http.ResponseWriter, r *http.Request) {
+	h.step(w, r, ssh.Redo)
+}
+
+func (h *History) step(w http.ResponseWriter, r *http.Request, step func(*ssh.SSHDir, string) (*model.HistoryEntry, error)) {
+	r.ParseForm()
+	file := r.FormValue("file")
+	if file == "" {
+		file = h.Dir.RelPath(h.Dir.ConfigPath())
+	}
+	entry, err := step(h.Dir, file)
+	if err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+	if isHTMX(r) {
+		h.List(w, r)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// Revert undoes a single change, leaving later changes to the file in place.
+func (h *History) Revert(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid change id", http.StatusBadRequest)
+		return
+	}
+	if err := ssh.RevertChange(h.Dir, id); err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+	if isHTMX(r) {
+		h.List(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeHistoryError reports 409 when the file no longer matches the
+// history, and 400 when there is nothing to undo or the change can't be
+// reverted.
+func writeHistoryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ssh.ErrConflict) {
+		http.Error(w, err.Error()+"; it was edited outside SSHmasher", http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
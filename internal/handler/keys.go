@@ -2,6 +2,8 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -43,7 +45,7 @@ func (k *Keys) List(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isHTMX(r) {
-		view.KeysTable(keys, refCount).Render(r.Context(), w)
+		view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
 		return
 	}
 	writeJSON(w, keys)
@@ -107,7 +109,7 @@ func (k *Keys) Generate(w http.ResponseWriter, r *http.Request) {
 		refCount = make(map[string]int)
 	}
 	if isHTMX(r) {
-		view.KeysTable(keys, refCount).Render(r.Context(), w)
+		view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
@@ -131,7 +133,7 @@ func (k *Keys) Delete(w http.ResponseWriter, r *http.Request) {
 		refCount = make(map[string]int)
 	}
 	if isHTMX(r) {
-		view.KeysTable(keys, refCount).Render(r.Context(), w)
+		view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -161,12 +163,129 @@ func (k *Keys) UpdateComment(w http.ResponseWriter, r *http.Request) {
 		refCount = make(map[string]int)
 	}
 	if isHTMX(r) {
-		view.KeysTable(keys, refCount).Render(r.Context(), w)
+		view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// PassphraseForm shows the form for adding, changing or removing a key's
+// passphrase.
+func (k *Keys) PassphraseForm(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	encrypted, err := ssh.KeyEncrypted(k.Dir, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if isHTMX(r) {
+		view.KeyPassphraseForm(name, encrypted).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, map[string]bool{"encrypted": encrypted})
+}
+
+// ChangePassphrase re-encrypts a private key with the "new" passphrase, or
+// removes its passphrase when "new" is empty. Passphrases are only ever read
+// from the form body, never logged.
+func (k *Keys) ChangePassphrase(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	newPassphrase := r.FormValue("new")
+	if confirm, ok := r.Form["confirm"]; ok && confirm[0] != newPassphrase {
+		http.Error(w, "new passphrases do not match", http.StatusBadRequest)
+		return
+	}
+
+	if err := ssh.ChangePassphrase(k.Dir, name, r.FormValue("old"), newPassphrase); err != nil {
+		if errors.Is(err, ssh.ErrPassphraseRequired) || errors.Is(err, ssh.ErrWrongPassphrase) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := ssh.ListKeys(k.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refCount, err := ssh.KeyRefCount(k.Dir)
+	if err != nil {
+		refCount = make(map[string]int)
+	}
+	if isHTMX(r) {
+		view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Rotate replaces a key with a dated successor and repoints the config at
+// it. With dryrun=1 it only returns the plan and the config diff.
+func (k *Keys) Rotate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := r.FormValue("dryrun") == "1" || r.FormValue("dryrun") == "true"
+	plan, err := ssh.RotateKey(k.Dir, name, ssh.RotateOptions{DryRun: dryRun, Passphrase: r.FormValue("passphrase")})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !isHTMX(r) {
+		writeJSON(w, plan)
+		return
+	}
+	if dryRun {
+		view.KeyRotationPlan(*plan).Render(r.Context(), w)
+		return
+	}
+	keys, err := ssh.ListKeys(k.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refCount, err := ssh.KeyRefCount(k.Dir)
+	if err != nil {
+		refCount = make(map[string]int)
+	}
+	trigger, _ := json.Marshal(map[string]any{"showAlert": map[string]string{
+		"message": fmt.Sprintf("Rotated %s to %s; backup %s taken", plan.OldName, plan.NewName, plan.Backup),
+	}})
+	w.Header().Set("HX-Trigger", string(trigger))
+	view.KeysTable(keys, refCount, ssh.ScoreKeys(k.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
+}
+
+// Audit scores every key against the key security policy and returns the
+// report as JSON, for compliance scripts.
+func (k *Keys) Audit(w http.ResponseWriter, r *http.Request) {
+	report, err := ssh.AuditKeys(k.Dir, keyAuditOptions())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// keyAuditOptions returns the key audit policy from the app config.
+func keyAuditOptions() ssh.KeyAuditOptions {
+	cfg, err := ssh.LoadAppConfig()
+	if err != nil {
+		return ssh.KeyAuditOptions{}
+	}
+	return ssh.KeyAuditOptionsFromConfig(cfg)
+}
+
 func isHTMX(r *http.Request) bool {
 	return r.Header.Get("HX-Request") == "true"
 }
@@ -175,3 +294,46 @@ func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(v)
 }
+
+// ifMatch returns the file version from an If-Match header, without quotes.
+func ifMatch(r *http.Request) string {
+	v := r.Header.Get("If-Match")
+	if u, err := strconv.Unquote(v); err == nil {
+		return u
+	}
+	return v
+}
+
+// requireVersion returns the version an edit naming an entry by its line or
+// position was made against, from If-Match or the version field.
+// Without one a stale page could change the wrong entry, so it writes 428
+// and returns false.
+func requireVersion(w http.ResponseWriter, r *http.Request) (string, bool) {
+	version := ifMatch(r)
+	if version == "" {
+		version = r.FormValue("version")
+	}
+	if version == "" {
+		http.Error(w, "version required: send If-Match with the ETag the list was loaded with", http.StatusPreconditionRequired)
+		return "", false
+	}
+	return version, true
+}
+
+// writeSaveError reports a failed write, with 409 when the file changed on
+// disk since the client loaded it.
+func writeSaveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ssh.ErrConflict) {
+		http.Error(w, err.Error()+"; reload and try again", http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeProblems rejects a save with 422 and the line-level problems that
+// blocked it.
+func writeProblems(w http.ResponseWriter, problems []model.Diagnostic) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{"problems": problems})
+}
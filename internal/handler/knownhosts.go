@@ -1,11 +1,14 @@
 package handler
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/holden/sshmasher/internal/model"
 	"github.com/holden/sshmasher/internal/ssh"
 	"github.com/holden/sshmasher/internal/view"
 )
@@ -17,22 +20,39 @@ type KnownHosts struct {
 
 func (kh *KnownHosts) List(w http.ResponseWriter, r *http.Request) {
 	search := r.URL.Query().Get("search")
+	// Read the version first: if the file changes while it is listed, the
+	// version is stale and an edit fails rather than hitting the wrong line.
+	version, _ := ssh.FileVersion(kh.Dir.KnownHostsPath())
 	entries, err := ssh.ListKnownHosts(kh.Dir)
 	if err != nil {
 		entries = nil
 	}
-	configHosts, _ := ssh.ListHosts(kh.Dir)
-	lineToHosts := ssh.MatchConfigHostsToKnownHosts(kh.Dir, configHosts)
 	if search != "" {
 		entries = ssh.FilterKnownHosts(entries, search)
 	}
+	w.Header().Set("ETag", strconv.Quote(version))
 	if isHTMX(r) {
-		view.KnownHostsTable(entries, lineToHosts).Render(r.Context(), w)
+		kh.renderTable(w, r, entries, version)
 		return
 	}
 	writeJSON(w, entries)
 }
 
+// renderTable renders entries as the known_hosts table, with the file
+// version its line-numbered actions send back.
+func (kh *KnownHosts) renderTable(w http.ResponseWriter, r *http.Request, entries []model.KnownHostEntry, version string) {
+	configHosts, _ := ssh.ListHosts(kh.Dir)
+	lineToHosts := ssh.MatchConfigHostsToKnownHosts(kh.Dir, configHosts)
+	view.KnownHostsTable(entries, lineToHosts, version).Render(r.Context(), w)
+}
+
+// renderCurrent renders the whole known_hosts table as it is now on disk.
+func (kh *KnownHosts) renderCurrent(w http.ResponseWriter, r *http.Request) {
+	version, _ := ssh.FileVersion(kh.Dir.KnownHostsPath())
+	entries, _ := ssh.ListKnownHosts(kh.Dir)
+	kh.renderTable(w, r, entries, version)
+}
+
 func (kh *KnownHosts) Delete(w http.ResponseWriter, r *http.Request) {
 	lineStr := r.PathValue("line")
 	line, err := strconv.Atoi(lineStr)
@@ -41,16 +61,17 @@ func (kh *KnownHosts) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := ssh.RemoveKnownHost(kh.Dir, line); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+	if err := ssh.RemoveKnownHost(kh.Dir, line, version); err != nil {
+		writeSaveError(w, err)
 		return
 	}
 
-	entries, _ := ssh.ListKnownHosts(kh.Dir)
-	configHosts, _ := ssh.ListHosts(kh.Dir)
-	lineToHosts := ssh.MatchConfigHostsToKnownHosts(kh.Dir, configHosts)
 	if isHTMX(r) {
-		view.KnownHostsTable(entries, lineToHosts).Render(r.Context(), w)
+		kh.renderCurrent(w, r)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -61,15 +82,22 @@ func (kh *KnownHosts) GetRaw(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		content = []byte{}
 	}
+	version, _ := ssh.FileVersion(kh.Dir.KnownHostsPath())
+	w.Header().Set("ETag", strconv.Quote(version))
 	if isHTMX(r) {
-		view.KnownHostsRawEditor(string(content)).Render(r.Context(), w)
+		view.KnownHostsRawEditor(string(content), version, ssh.ValidateKnownHosts(string(content))).Render(r.Context(), w)
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(content)
 }
 
+// PutRaw saves known_hosts. Content with malformed lines or undecodable keys
+// is rejected with 422 and the problems found, unless force is set. A stale
+// version (If-Match or the version field) fails with 409.
 func (kh *KnownHosts) PutRaw(w http.ResponseWriter, r *http.Request) {
+	force := r.URL.Query().Get("force") != ""
+	version := ifMatch(r)
 	var content string
 	if r.Header.Get("Content-Type") == "application/json" {
 		body, _ := io.ReadAll(r.Body)
@@ -77,18 +105,29 @@ func (kh *KnownHosts) PutRaw(w http.ResponseWriter, r *http.Request) {
 	} else {
 		r.ParseForm()
 		content = r.FormValue("content")
+		force = force || r.FormValue("force") != ""
+		if v := r.FormValue("version"); v != "" {
+			version = v
+		}
 	}
 
-	if err := ssh.WriteKnownHosts(kh.Dir, content); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if problems := ssh.ValidateKnownHosts(content); !force && len(problems) > 0 {
+		if isHTMX(r) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			view.KnownHostsRawEditor(content, version, problems).Render(r.Context(), w)
+			return
+		}
+		writeProblems(w, problems)
+		return
+	}
+
+	if err := ssh.WriteKnownHosts(kh.Dir, content, version); err != nil {
+		writeSaveError(w, err)
 		return
 	}
 
 	if isHTMX(r) {
-		entries, _ := ssh.ListKnownHosts(kh.Dir)
-		configHosts, _ := ssh.ListHosts(kh.Dir)
-		lineToHosts := ssh.MatchConfigHostsToKnownHosts(kh.Dir, configHosts)
-		view.KnownHostsTable(entries, lineToHosts).Render(r.Context(), w)
+		kh.renderCurrent(w, r)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -136,13 +175,87 @@ func (kh *KnownHosts) Add(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return updated list
+	if isHTMX(r) {
+		kh.renderCurrent(w, r)
+		return
+	}
 	entries, _ := ssh.ListKnownHosts(kh.Dir)
-	configHosts, _ := ssh.ListHosts(kh.Dir)
-	lineToHosts := ssh.MatchConfigHostsToKnownHosts(kh.Dir, configHosts)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, entries)
+}
+
+// AddCA trusts a host CA for the hosts matching pattern with an
+// @cert-authority line. Form fields: pattern, and ca (a key marked as a CA
+// on the Certificates page) or publicKey.
+func (kh *KnownHosts) AddCA(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	pattern := strings.TrimSpace(r.FormValue("pattern"))
+	publicKey := strings.TrimSpace(r.FormValue("publicKey"))
+	if name := r.FormValue("ca"); name != "" && publicKey == "" {
+		cas, err := ssh.ListCAs(kh.Dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, ca := range cas {
+			if ca.Name == name {
+				publicKey = ca.PublicKey
+			}
+		}
+		if publicKey == "" {
+			http.Error(w, "unknown CA: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	if pattern == "" || publicKey == "" {
+		http.Error(w, "pattern and a CA key are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := ssh.AddCertAuthority(kh.Dir, pattern, publicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if isHTMX(r) {
-		view.KnownHostsTable(entries, lineToHosts).Render(r.Context(), w)
+		kh.renderCurrent(w, r)
 		return
 	}
+	entries, _ := ssh.ListKnownHosts(kh.Dir)
 	w.WriteHeader(http.StatusCreated)
 	writeJSON(w, entries)
 }
+
+// Revoke marks the entry on the line in the path as @revoked. The file
+// version the line was read from (If-Match or the version field) is
+// required; a stale one fails with 409.
+func (kh *KnownHosts) Revoke(w http.ResponseWriter, r *http.Request) {
+	line, err := strconv.Atoi(r.PathValue("line"))
+	if err != nil {
+		http.Error(w, "invalid line number", http.StatusBadRequest)
+		return
+	}
+	version, ok := requireVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ssh.RevokeKnownHost(kh.Dir, line, version); err != nil {
+		if errors.Is(err, ssh.ErrConflict) {
+			writeSaveError(w, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isHTMX(r) {
+		kh.renderCurrent(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
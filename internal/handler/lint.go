@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/holden/sshmasher/internal/ssh"
+	"github.com/holden/sshmasher/internal/view"
+)
+
+// Lint runs every enabled lint rule over the config and its includes.
+func (c *Config) Lint(w http.ResponseWriter, r *http.Request) {
+	disabled := lintDisabled()
+	diags, err := ssh.LintConfig(c.Dir, ssh.LintOptions{Disabled: disabled})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTMX(r) {
+		view.ConfigLintPanel(diags, ssh.LintRules(disabled)).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, diags)
+}
+
+// LintDraft lints unsaved raw editor content in place of the file it edits,
+// so problems show up before saving.
+func (c *Config) LintDraft(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	diags, err := ssh.ValidateConfigFile(c.Dir, r.FormValue("file"), r.FormValue("content"), lintDisabled())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if isHTMX(r) {
+		view.LintResults(diags, true).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, diags)
+}
+
+// LintRules lists the lint rule catalogue and which rules are enabled.
+func (c *Config) LintRules(w http.ResponseWriter, r *http.Request) {
+	rules := ssh.LintRules(lintDisabled())
+	if isHTMX(r) {
+		view.ConfigLintRules(rules).Render(r.Context(), w)
+		return
+	}
+	writeJSON(w, rules)
+}
+
+// lintDisabled returns the rule IDs turned off by lint.disable in the app
+// config. An unreadable app config disables nothing.
+func lintDisabled() []string {
+	cfg, err := ssh.LoadAppConfig()
+	if err != nil {
+		return nil
+	}
+	return cfg.LintDisabled
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -17,6 +18,30 @@ func SecurityHeaders(next http.Handler) http.Handler {
 	})
 }
 
+// SameOrigin rejects state-changing requests that don't come from the app
+// itself, so another site open in the browser can't approve signatures or
+// edit files through it. A request passes if it carries HX-Request, which a
+// cross-site page can't send without a CORS preflight this server never
+// answers, or an Origin naming this server.
+func SameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("HX-Request") == "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u, err := url.Parse(r.Header.Get("Origin")); err == nil && u.Host != "" && u.Host == r.Host {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+	})
+}
+
 // Logging logs each request with method, path, status, and duration.
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -36,3 +61,9 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.status = code
 	w.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed events.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -3,13 +3,15 @@ package handler
 import (
 	"net/http"
 
+	"github.com/holden/sshmasher/internal/model"
 	"github.com/holden/sshmasher/internal/ssh"
 	"github.com/holden/sshmasher/internal/view"
 )
 
 // Pages holds dependencies for full-page HTML handlers.
 type Pages struct {
-	Dir *ssh.SSHDir
+	Dir     *ssh.SSHDir
+	Builtin *ssh.BuiltinAgent
 }
 
 func (p *Pages) KeysPage(w http.ResponseWriter, r *http.Request) {
@@ -22,10 +24,11 @@ func (p *Pages) KeysPage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		refCount = make(map[string]int)
 	}
-	view.KeysPage(keys, refCount).Render(r.Context(), w)
+	view.KeysPage(keys, refCount, ssh.ScoreKeys(p.Dir, keys, refCount, keyAuditOptions())).Render(r.Context(), w)
 }
 
 func (p *Pages) ConfigPage(w http.ResponseWriter, r *http.Request) {
+	version, _ := ssh.ConfigVersion(p.Dir)
 	hosts, err := ssh.ListHosts(p.Dir)
 	if err != nil {
 		hosts = nil // show empty state if config doesn't exist
@@ -34,10 +37,19 @@ func (p *Pages) ConfigPage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		keys = nil
 	}
-	view.ConfigPage(hosts, keys, p.Dir).Render(r.Context(), w)
+	matches, err := ssh.ListMatches(p.Dir)
+	if err != nil {
+		matches = nil
+	}
+	tree, err := ssh.ConfigFileTree(p.Dir)
+	if err != nil {
+		tree = nil
+	}
+	view.ConfigPage(hosts, matches, tree, keys, p.Dir, version).Render(r.Context(), w)
 }
 
 func (p *Pages) KnownHostsPage(w http.ResponseWriter, r *http.Request) {
+	version, _ := ssh.FileVersion(p.Dir.KnownHostsPath())
 	entries, err := ssh.ListKnownHosts(p.Dir)
 	if err != nil {
 		entries = nil
@@ -48,7 +60,11 @@ func (p *Pages) KnownHostsPage(w http.ResponseWriter, r *http.Request) {
 	}
 	// Build map of line numbers to config host aliases using ssh-keygen -F
 	lineToHosts := ssh.MatchConfigHostsToKnownHosts(p.Dir, configHosts)
-	view.KnownHostsPage(entries, configHosts, lineToHosts).Render(r.Context(), w)
+	cas, err := ssh.ListCAs(p.Dir)
+	if err != nil {
+		cas = nil
+	}
+	view.KnownHostsPage(entries, configHosts, lineToHosts, cas, version).Render(r.Context(), w)
 }
 
 func (p *Pages) BackupPage(w http.ResponseWriter, r *http.Request) {
@@ -58,3 +74,64 @@ func (p *Pages) BackupPage(w http.ResponseWriter, r *http.Request) {
 	}
 	view.BackupPage(backups).Render(r.Context(), w)
 }
+
+func (p *Pages) HistoryPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := ssh.ListHistory(p.Dir, "")
+	if err != nil {
+		entries = nil
+	}
+	view.HistoryPage(entries).Render(r.Context(), w)
+}
+
+func (p *Pages) AuditPage(w http.ResponseWriter, r *http.Request) {
+	res, err := ssh.ReadAudit(p.Dir, ssh.AuditFilter{}, 1, 0)
+	if err != nil {
+		res = &model.AuditPage{}
+	}
+	view.AuditPage(res, auditActions()).Render(r.Context(), w)
+}
+
+func (p *Pages) HealthPage(w http.ResponseWriter, r *http.Request) {
+	hosts, err := ssh.HealthHosts(p.Dir)
+	if err != nil {
+		hosts = nil
+	}
+	history, err := ssh.HealthHistory(p.Dir)
+	if err != nil {
+		history = nil
+	}
+	view.HealthPage(hosts, history).Render(r.Context(), w)
+}
+
+func (p *Pages) AgentPage(w http.ResponseWriter, r *http.Request) {
+	var agentErr string
+	keys, err := ssh.AgentKeys(p.Dir, "")
+	if err != nil {
+		agentErr = err.Error()
+	}
+	local, err := ssh.ListKeys(p.Dir)
+	if err != nil {
+		local = nil
+	}
+	hosts, err := ssh.HealthHosts(p.Dir)
+	if err != nil {
+		hosts = nil
+	}
+	view.AgentPage(ssh.AgentSocket(""), keys, agentErr, local, p.Builtin.Status(), hosts).Render(r.Context(), w)
+}
+
+func (p *Pages) CertsPage(w http.ResponseWriter, r *http.Request) {
+	cas, err := ssh.ListCAs(p.Dir)
+	if err != nil {
+		cas = nil
+	}
+	certs, err := ssh.ListCerts(p.Dir)
+	if err != nil {
+		certs = nil
+	}
+	local, err := ssh.ListKeys(p.Dir)
+	if err != nil {
+		local = nil
+	}
+	view.CertsPage(cas, certs, local).Render(r.Context(), w)
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"io/fs"
+	"log"
 	"net/http"
 
 	"github.com/holden/sshmasher/internal/ssh"
@@ -9,14 +10,37 @@ import (
 
 // NewRouter creates the central HTTP router with all routes wired up.
 // staticFS should contain the static/ directory contents.
-func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) *http.ServeMux {
+func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) http.Handler {
 	mux := http.NewServeMux()
 
-	pages := &Pages{Dir: dir}
+	// The agent SSHmasher serves itself, started now if the app config asks
+	builtinAgent := ssh.NewBuiltinAgent(dir)
+	if cfg, err := ssh.LoadAppConfig(); err == nil && cfg.AgentAutostart {
+		if err := builtinAgent.Start(cfg.AgentSocket); err != nil {
+			log.Printf("Built-in agent not started: %v", err)
+		}
+	}
+
+	pages := &Pages{Dir: dir, Builtin: builtinAgent}
 	keys := &Keys{Dir: dir}
 	config := &Config{Dir: dir}
 	knownhosts := &KnownHosts{Dir: dir}
 	backup := &Backup{Dir: dir}
+	history := &History{Dir: dir}
+	audit := &AuditLog{Dir: dir}
+	health := &Health{Dir: dir}
+	agent := &Agent{Dir: dir, Builtin: builtinAgent}
+	certs := &Certs{Dir: dir}
+
+	// Record config and known_hosts writes so they can be undone
+	ssh.EnableHistory(dir)
+
+	// Watch ~/.ssh so pages can refresh when files are edited elsewhere
+	watcher, err := ssh.Watch(dir)
+	if err != nil {
+		log.Printf("File watching disabled: %v", err)
+	}
+	events := &Events{Watcher: watcher}
 
 	// Static files
 	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(staticFS)))
@@ -33,14 +57,23 @@ func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) *http.ServeMux {
 	mux.HandleFunc("GET /config", pages.ConfigPage)
 	mux.HandleFunc("GET /knownhosts", pages.KnownHostsPage)
 	mux.HandleFunc("GET /backup", pages.BackupPage)
+	mux.HandleFunc("GET /history", pages.HistoryPage)
+	mux.HandleFunc("GET /audit", pages.AuditPage)
+	mux.HandleFunc("GET /health", pages.HealthPage)
+	mux.HandleFunc("GET /agent", pages.AgentPage)
+	mux.HandleFunc("GET /certs", pages.CertsPage)
 
 	// API: Keys
 	mux.HandleFunc("GET /api/keys", keys.List)
 	mux.HandleFunc("GET /api/keys/new", keys.NewKey)
+	mux.HandleFunc("GET /api/keys/audit", keys.Audit)
 	mux.HandleFunc("POST /api/keys", keys.Generate)
 	mux.HandleFunc("GET /api/keys/{name}", keys.Get)
 	mux.HandleFunc("PUT /api/keys/{name}", keys.UpdateComment)
 	mux.HandleFunc("DELETE /api/keys/{name}", keys.Delete)
+	mux.HandleFunc("GET /api/keys/{name}/passphrase", keys.PassphraseForm)
+	mux.HandleFunc("PUT /api/keys/{name}/passphrase", keys.ChangePassphrase)
+	mux.HandleFunc("POST /api/keys/{name}/rotate", keys.Rotate)
 
 	// API: Config
 	mux.HandleFunc("GET /api/config/hosts", config.ListHosts)
@@ -50,6 +83,24 @@ func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) *http.ServeMux {
 	mux.HandleFunc("PUT /api/config/hosts/{alias}", config.UpdateHost)
 	mux.HandleFunc("DELETE /api/config/hosts/{alias}", config.DeleteHost)
 	mux.HandleFunc("POST /api/config/hosts/{alias}/terminal", config.OpenTerminal)
+	mux.HandleFunc("POST /api/config/hosts/{alias}/test", config.TestHost)
+	mux.HandleFunc("GET /api/config/hosts/{alias}/forwards", config.ListForwards)
+	mux.HandleFunc("POST /api/config/hosts/{alias}/forwards", config.AddForward)
+	mux.HandleFunc("GET /api/config/hosts/{alias}/forwards/{id}", config.GetForward)
+	mux.HandleFunc("PUT /api/config/hosts/{alias}/forwards/{id}", config.UpdateForward)
+	mux.HandleFunc("DELETE /api/config/hosts/{alias}/forwards/{id}", config.DeleteForward)
+	mux.HandleFunc("GET /api/config/files", config.ListFiles)
+	mux.HandleFunc("GET /api/config/resolve", config.Resolve)
+	mux.HandleFunc("GET /api/config/jumps", config.Jumps)
+	mux.HandleFunc("GET /api/config/lint", config.Lint)
+	mux.HandleFunc("POST /api/config/lint", config.LintDraft)
+	mux.HandleFunc("GET /api/config/lint/rules", config.LintRules)
+	mux.HandleFunc("GET /api/config/matches", config.ListMatches)
+	mux.HandleFunc("GET /api/config/matches/new", config.NewMatch)
+	mux.HandleFunc("POST /api/config/matches", config.AddMatch)
+	mux.HandleFunc("GET /api/config/matches/{id}", config.GetMatch)
+	mux.HandleFunc("PUT /api/config/matches/{id}", config.UpdateMatch)
+	mux.HandleFunc("DELETE /api/config/matches/{id}", config.DeleteMatch)
 	mux.HandleFunc("GET /api/config/raw", config.GetRaw)
 	mux.HandleFunc("PUT /api/config/raw", config.PutRaw)
 
@@ -57,7 +108,9 @@ func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) *http.ServeMux {
 	mux.HandleFunc("GET /api/knownhosts", knownhosts.List)
 	mux.HandleFunc("POST /api/knownhosts", knownhosts.Add)
 	mux.HandleFunc("GET /api/knownhosts/lookup", knownhosts.Lookup)
+	mux.HandleFunc("POST /api/knownhosts/cas", knownhosts.AddCA)
 	mux.HandleFunc("DELETE /api/knownhosts/{line}", knownhosts.Delete)
+	mux.HandleFunc("POST /api/knownhosts/{line}/revoke", knownhosts.Revoke)
 	mux.HandleFunc("GET /api/knownhosts/raw", knownhosts.GetRaw)
 	mux.HandleFunc("PUT /api/knownhosts/raw", knownhosts.PutRaw)
 
@@ -68,10 +121,52 @@ func NewRouter(dir *ssh.SSHDir, staticFS fs.FS) *http.ServeMux {
 	mux.HandleFunc("POST /api/backup/{filename}/restore", backup.Restore)
 	mux.HandleFunc("DELETE /api/backup/{filename}", backup.Delete)
 
-	return mux
+	// API: History
+	mux.HandleFunc("GET /api/history", history.List)
+	mux.HandleFunc("POST /api/history/undo", history.Undo)
+	mux.HandleFunc("POST /api/history/redo", history.Redo)
+	mux.HandleFunc("GET /api/history/{id}", history.Get)
+	mux.HandleFunc("POST /api/history/{id}/revert", history.Revert)
+
+	// API: Audit
+	mux.HandleFunc("GET /api/audit", audit.List)
+
+	// API: Health
+	mux.HandleFunc("GET /api/health", health.History)
+	mux.HandleFunc("GET /api/health/run", health.Run)
+
+	// API: Agent
+	mux.HandleFunc("GET /api/agent", agent.List)
+	mux.HandleFunc("POST /api/agent/keys", agent.Add)
+	mux.HandleFunc("DELETE /api/agent/keys", agent.RemoveAll)
+	mux.HandleFunc("DELETE /api/agent/keys/{fingerprint...}", agent.Remove)
+	mux.HandleFunc("POST /api/agent/lock", agent.Lock)
+	mux.HandleFunc("POST /api/agent/unlock", agent.Unlock)
+	mux.HandleFunc("GET /api/agent/builtin", agent.BuiltinStatus)
+	mux.HandleFunc("POST /api/agent/builtin/start", agent.BuiltinStart)
+	mux.HandleFunc("POST /api/agent/builtin/stop", agent.BuiltinStop)
+	mux.HandleFunc("POST /api/agent/builtin/keys", agent.BuiltinAdd)
+	mux.HandleFunc("DELETE /api/agent/builtin/keys/{fingerprint...}", agent.BuiltinRemove)
+	mux.HandleFunc("GET /api/agent/builtin/events", agent.BuiltinEvents)
+	mux.HandleFunc("POST /api/agent/builtin/requests/{id}/approve", agent.BuiltinApprove)
+	mux.HandleFunc("POST /api/agent/builtin/requests/{id}/deny", agent.BuiltinDeny)
+
+	// API: Certificates
+	mux.HandleFunc("GET /api/certs", certs.List)
+	mux.HandleFunc("POST /api/certs", certs.Sign)
+	mux.HandleFunc("GET /api/certs/cas", certs.ListCAs)
+	mux.HandleFunc("POST /api/certs/cas", certs.MarkCA)
+	mux.HandleFunc("DELETE /api/certs/cas/{name}", certs.UnmarkCA)
+	mux.HandleFunc("GET /api/certs/{name}", certs.Get)
+	mux.HandleFunc("DELETE /api/certs/{name}", certs.Delete)
+
+	// API: Events
+	mux.HandleFunc("GET /api/events", events.Stream)
+
+	return Audit(dir, mux)
 }
 
 // WithMiddleware wraps a handler with all middleware.
 func WithMiddleware(h http.Handler) http.Handler {
-	return Logging(SecurityHeaders(h))
+	return Logging(SecurityHeaders(SameOrigin(h)))
 }
@@ -4,15 +4,31 @@ import "time"
 
 // SSHKey represents an SSH key pair found in the SSH directory.
 type SSHKey struct {
-	Name        string    `json:"name"`
-	Type        string    `json:"type"`        // rsa, ed25519, ecdsa, dsa
-	Bits        int       `json:"bits"`        // key size
-	Fingerprint string    `json:"fingerprint"` // SHA256 fingerprint
-	PublicKey   string    `json:"publicKey"`
-	Comment     string    `json:"comment"`
-	HasPrivate  bool      `json:"hasPrivate"`
-	ModTime     time.Time `json:"modTime"`
-	Size        int64     `json:"size"` // size in bytes
+	Name           string          `json:"name"`
+	Type           string          `json:"type"`        // rsa, ed25519, ecdsa, dsa
+	Bits           int             `json:"bits"`        // key size
+	Fingerprint    string          `json:"fingerprint"` // SHA256 fingerprint
+	FingerprintMD5 string          `json:"fingerprintMD5,omitempty"`
+	Randomart      string          `json:"randomart,omitempty"` // ssh-keygen -lv visual fingerprint
+	PublicKey      string          `json:"publicKey"`
+	Comment        string          `json:"comment"`
+	HasPrivate     bool            `json:"hasPrivate"`
+	HasPublic      bool            `json:"hasPublic"` // false for a private key with no .pub file
+	Private        *PrivateKeyInfo `json:"private,omitempty"`
+	Certificate    *Certificate    `json:"certificate,omitempty"` // from name-cert.pub
+	ModTime        time.Time       `json:"modTime"`
+	Size           int64           `json:"size"` // size in bytes
+}
+
+// PrivateKeyInfo describes a private key file, read from its header without
+// needing the passphrase.
+type PrivateKeyInfo struct {
+	Format    string `json:"format"` // OpenSSH, PEM PKCS#1, PEM SEC1, PEM DSA, PKCS#8 or PuTTY
+	Encrypted bool   `json:"encrypted"`
+	Cipher    string `json:"cipher,omitempty"`  // e.g. aes256-ctr, AES-128-CBC
+	KDF       string `json:"kdf,omitempty"`     // e.g. bcrypt, pbkdf2, argon2id
+	Rounds    int    `json:"rounds,omitempty"`  // KDF rounds or iterations
+	Matches   *bool  `json:"matches,omitempty"` // private and public halves match; nil when it can't be told without the passphrase
 }
 
 // KeyGenRequest holds parameters for generating a new SSH key.
@@ -24,24 +40,397 @@ type KeyGenRequest struct {
 	Passphrase string `json:"passphrase"`
 }
 
+// KeyFinding is one problem the key audit found with a key.
+type KeyFinding struct {
+	Check    string `json:"check"`    // check ID, e.g. "rsa-size"
+	Severity string `json:"severity"` // error, warning, info
+	Message  string `json:"message"`
+}
+
+// KeyAudit is the security score for one key: 100 less a penalty for each
+// finding.
+type KeyAudit struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Bits        int          `json:"bits"`
+	Fingerprint string       `json:"fingerprint"`
+	Score       int          `json:"score"` // 0-100
+	Grade       string       `json:"grade"` // A to F
+	Findings    []KeyFinding `json:"findings"`
+}
+
+// KeyAuditReport is the result of auditing every key in the SSH directory.
+type KeyAuditReport struct {
+	Time          time.Time      `json:"time"`
+	Score         int            `json:"score"` // average of the key scores
+	Grade         string         `json:"grade"`
+	Keys          []KeyAudit     `json:"keys"`
+	Counts        map[string]int `json:"counts"`     // keys flagged by each check
+	MaxAgeDays    int            `json:"maxAgeDays"` // 0 when the age check is off
+	PreferEd25519 bool           `json:"preferEd25519"`
+}
+
+// KeyRotation is the plan for, or the result of, replacing a key with a
+// freshly generated successor.
+type KeyRotation struct {
+	OldName string         `json:"oldName"`
+	NewName string         `json:"newName"`
+	Type    string         `json:"type"` // type the successor is generated with, e.g. ed25519
+	Bits    int            `json:"bits,omitempty"`
+	Comment string         `json:"comment"`
+	Archive string         `json:"archive"`          // where the old pair is moved, relative to the SSH dir
+	Backup  string         `json:"backup,omitempty"` // backup taken first, to roll back to
+	Files   []RotationFile `json:"files"`            // config files whose IdentityFile lines change
+	DryRun  bool           `json:"dryRun"`
+}
+
+// RotationFile is a config file rewritten by a key rotation.
+type RotationFile struct {
+	File  string     `json:"file"`  // relative to the SSH dir
+	Lines []int      `json:"lines"` // IdentityFile lines that change
+	Diff  []DiffLine `json:"diff"`
+}
+
+// AgentKey is an identity loaded into the ssh-agent.
+type AgentKey struct {
+	Type        string       `json:"type"`
+	Bits        int          `json:"bits"`
+	Fingerprint string       `json:"fingerprint"` // SHA256 fingerprint
+	Comment     string       `json:"comment"`
+	Key         string       `json:"key,omitempty"`    // name of the matching key in the SSH dir
+	Policy      *AgentPolicy `json:"policy,omitempty"` // built-in agent only
+}
+
+// AgentPolicy limits how the built-in agent may use a key.
+type AgentPolicy struct {
+	Confirm bool      `json:"confirm"`           // each signature must be approved in the UI
+	Hosts   []string  `json:"hosts,omitempty"`   // config host aliases the key may sign for; empty allows any
+	Expires time.Time `json:"expires,omitempty"` // when the key is dropped; zero keeps it
+}
+
+// AgentSignRequest is a signature asked of the built-in agent, as shown in
+// its live log.
+type AgentSignRequest struct {
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key"` // key name, or its comment when not from the SSH dir
+	Fingerprint string    `json:"fingerprint"`
+	Purpose     string    `json:"purpose"`           // auth, sshsig (e.g. git commit signing) or other
+	User        string    `json:"user,omitempty"`    // remote user, for auth
+	HostKey     string    `json:"hostKey,omitempty"` // fingerprint of the server the session is bound to
+	Hosts       []string  `json:"hosts,omitempty"`   // config aliases known_hosts matches to HostKey
+	Forwarded   bool      `json:"forwarded"`         // asked through a forwarded agent connection
+	Status      string    `json:"status"`            // pending, signed, denied, refused, failed
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// BuiltinAgentStatus describes the agent served by SSHmasher itself.
+type BuiltinAgentStatus struct {
+	Running bool               `json:"running"`
+	Socket  string             `json:"socket"`
+	Locked  bool               `json:"locked"`
+	Keys    []AgentKey         `json:"keys"`
+	Log     []AgentSignRequest `json:"log"` // newest first
+}
+
+// CertAuthority is a key in the SSH directory marked as a certificate
+// authority, able to sign user and host certificates.
+type CertAuthority struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"publicKey"` // for TrustedUserCAKeys or an @cert-authority line
+	Added       time.Time `json:"added"`
+}
+
+// CertRequest holds parameters for signing a certificate.
+type CertRequest struct {
+	CA              string            `json:"ca"`                  // name of the CA key
+	Key             string            `json:"key"`                 // key to certify; the cert is written to Key-cert.pub
+	PublicKey       string            `json:"publicKey,omitempty"` // authorized_keys line to certify instead of Key.pub
+	Type            string            `json:"type"`                // user or host
+	KeyID           string            `json:"keyId"`               // defaults to Key
+	Principals      []string          `json:"principals"`          // user names, or host names for a host cert
+	Serial          uint64            `json:"serial"`
+	ValidAfter      time.Time         `json:"validAfter"`                // zero: no start
+	ValidBefore     time.Time         `json:"validBefore"`               // zero: forever
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"` // force-command, source-address, verify-required
+	Extensions      []string          `json:"extensions,omitempty"`      // user certs only; nil gives ssh-keygen's defaults
+	Passphrase      string            `json:"passphrase,omitempty"`      // for an encrypted CA key
+}
+
+// Certificate is an OpenSSH certificate found in the SSH directory as
+// Name-cert.pub.
+type Certificate struct {
+	Name            string            `json:"name"`    // key the cert belongs to
+	Type            string            `json:"type"`    // user or host
+	KeyType         string            `json:"keyType"` // e.g. ED25519-CERT
+	KeyID           string            `json:"keyId"`
+	Serial          uint64            `json:"serial"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      time.Time         `json:"validAfter"`  // zero: no start
+	ValidBefore     time.Time         `json:"validBefore"` // zero: forever
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"`
+	Extensions      []string          `json:"extensions,omitempty"`
+	Fingerprint     string            `json:"fingerprint"`   // of the certified key
+	CAFingerprint   string            `json:"caFingerprint"` // of the signing CA
+	CA              string            `json:"ca,omitempty"`  // name of the signing CA when it is marked here
+	Status          string            `json:"status"`        // valid, expiring (within a week), expired or not yet valid
+}
+
 // HostEntry represents a host block in ~/.ssh/config.
 type HostEntry struct {
-	Alias        string            `json:"alias"`
-	HostName     string            `json:"hostName"`
-	User         string            `json:"user"`
-	Port         string            `json:"port"`
-	IdentityFile string            `json:"identityFile"`
-	Options      map[string]string `json:"options"` // all other key=value pairs
+	Alias        string       `json:"alias"`
+	HostName     string       `json:"hostName"`
+	User         string       `json:"user"`
+	Port         string       `json:"port"`
+	IdentityFile string       `json:"identityFile"` // first IdentityFile; further ones are in Options
+	Options      []HostOption `json:"options"`      // all other directives, in file order
+	File         string       `json:"file"`         // config file the block lives in, relative to the SSH dir
+	Line         int          `json:"line"`         // 1-based line number of the Host header
+}
+
+// HostOption is a single directive in a Host block. Keywords such as
+// IdentityFile, LocalForward or SendEnv may repeat, so options are kept as
+// an ordered list rather than a map.
+type HostOption struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Forward is a LocalForward, RemoteForward or DynamicForward directive of a host.
+type Forward struct {
+	ID           int      `json:"id"`                     // 1-based position among the host's forwards
+	Type         string   `json:"type"`                   // local, remote, dynamic
+	BindAddress  string   `json:"bindAddress,omitempty"`  // empty for ssh's default
+	BindPort     int      `json:"bindPort"`               // 0 with BindSocket set, or a server-allocated remote port
+	BindSocket   string   `json:"bindSocket,omitempty"`   // Unix socket path instead of a port
+	TargetHost   string   `json:"targetHost,omitempty"`   // empty for dynamic (SOCKS) forwards
+	TargetPort   int      `json:"targetPort,omitempty"`   // 0 with TargetSocket set
+	TargetSocket string   `json:"targetSocket,omitempty"` // Unix socket path instead of host:port
+	Conflicts    []string `json:"conflicts,omitempty"`    // other forwards binding the same local port, as "alias#id"
+}
+
+// JumpHop is one hop of a host's ProxyJump or ProxyCommand chain.
+type JumpHop struct {
+	Spec     string `json:"spec"`     // as written, e.g. "admin@bastion:2222"
+	Alias    string `json:"alias"`    // host part of the spec
+	Defined  bool   `json:"defined"`  // Alias is a Host in the config
+	HostName string `json:"hostName"` // address ssh connects to for this hop
+	Port     string `json:"port"`
+	Known    bool   `json:"known"` // host key is in known_hosts
+}
+
+// JumpRoute describes how ssh reaches a config host through jump hosts.
+type JumpRoute struct {
+	Host   string    `json:"host"`
+	Via    string    `json:"via,omitempty"`    // ProxyJump or ProxyCommand; empty for a direct connection
+	Source string    `json:"source,omitempty"` // file:line of the directive
+	Hops   []JumpHop `json:"hops"`             // hops as configured for this host
+	Path   []string  `json:"path"`             // full path from the local machine, ending with Host
+	Issues []string  `json:"issues,omitempty"`
+}
+
+// JumpGraph is the jump host analysis for every host in the config.
+type JumpGraph struct {
+	Routes []JumpRoute `json:"routes"`
+	Cycles [][]string  `json:"cycles,omitempty"` // each cycle lists hosts in order, ending where it started
+}
+
+// MatchCriterion is a single condition on a Match line, e.g. "host *.corp" or "!user root".
+type MatchCriterion struct {
+	Keyword string `json:"keyword"` // all, canonical, final, exec, host, originalhost, user, localuser, localnetwork, tagged
+	Negated bool   `json:"negated"` // criterion was prefixed with "!"
+	Value   string `json:"value"`   // pattern list or command; empty for all/canonical/final
+}
+
+// MatchBlock represents a Match block in ~/.ssh/config.
+type MatchBlock struct {
+	ID       int              `json:"id"`   // 1-based position among Match blocks across all config files
+	File     string           `json:"file"` // config file the block lives in, relative to the SSH dir
+	Line     int              `json:"line"` // 1-based line number of the Match header
+	Criteria []MatchCriterion `json:"criteria"`
+	Options  []HostOption     `json:"options"` // directives in file order; keywords may repeat
+}
+
+// ConfigFileNode is a config file and the files it pulls in via Include.
+type ConfigFileNode struct {
+	Path     string           `json:"path"`            // relative to the SSH dir when inside it
+	Line     int              `json:"line"`            // line of the Include in the parent; 0 for the main config
+	Hosts    int              `json:"hosts"`           // number of Host blocks in this file
+	Error    string           `json:"error,omitempty"` // why the file was not loaded (cycle, depth)
+	Children []ConfigFileNode `json:"children"`
+}
+
+// ResolvedOption is one effective setting for a destination and where it was set.
+type ResolvedOption struct {
+	Key   string `json:"key"`   // lowercase keyword, as printed by ssh -G
+	Value string `json:"value"` // effective value
+	File  string `json:"file"`  // config file that set it; empty for built-in defaults
+	Line  int    `json:"line"`  // 1-based line number of the directive
+}
+
+// ResolveStep is one Host or Match block ssh evaluated while resolving a destination.
+type ResolveStep struct {
+	Header   string   `json:"header"`             // e.g. "Host *.corp" or "Match host x"; empty for a file's global section
+	File     string   `json:"file"`               // config file the block lives in
+	Line     int      `json:"line"`               // 1-based line number of the header
+	Matched  bool     `json:"matched"`            // whether the block applied to the destination
+	Final    bool     `json:"final"`              // evaluated during the final (post-canonicalization) pass
+	Note     string   `json:"note,omitempty"`     // e.g. why a criterion could not be evaluated
+	Applied  []string `json:"applied"`            // keywords this block set
+	Shadowed []string `json:"shadowed,omitempty"` // keywords ignored because an earlier block set them
+}
+
+// ResolvedConfig is the effective configuration ssh would use for a destination.
+type ResolvedConfig struct {
+	Host    string           `json:"host"`
+	Options []ResolvedOption `json:"options"`
+	Chain   []ResolveStep    `json:"chain"`
+}
+
+// ConnTestStage is one step of a connection test.
+type ConnTestStage struct {
+	Name     string        `json:"name"`     // dns, tcp, banner, kex, hostkey, auth
+	Status   string        `json:"status"`   // ok, warn, fail, skip
+	Detail   string        `json:"detail"`   // what was found, or why it failed
+	Duration time.Duration `json:"duration"` // time the step took, in nanoseconds
+}
+
+// AuthAttempt is one key offered, or passed over, during a connection test.
+type AuthAttempt struct {
+	Key         string `json:"key"`                   // identity file, or agent key comment
+	Source      string `json:"source"`                // file or agent
+	Fingerprint string `json:"fingerprint,omitempty"` // SHA256 fingerprint
+	Result      string `json:"result"`                // accepted, rejected, skipped, untried
+	Reason      string `json:"reason,omitempty"`
+}
+
+// ConnAlgorithms lists the algorithms offered by a server and, once the
+// handshake completes, the ones negotiated.
+type ConnAlgorithms struct {
+	KeyExchange    string   `json:"keyExchange,omitempty"`
+	HostKey        string   `json:"hostKey,omitempty"`
+	Cipher         string   `json:"cipher,omitempty"`
+	MAC            string   `json:"mac,omitempty"`
+	ServerKex      []string `json:"serverKex,omitempty"`
+	ServerHostKeys []string `json:"serverHostKeys,omitempty"`
+	ServerCiphers  []string `json:"serverCiphers,omitempty"`
+	ServerMACs     []string `json:"serverMacs,omitempty"`
+}
+
+// ConnTestResult reports each stage of connecting to a configured host.
+type ConnTestResult struct {
+	Host          string          `json:"host"` // alias as given
+	HostName      string          `json:"hostName"`
+	Port          string          `json:"port"`
+	User          string          `json:"user"`
+	Address       string          `json:"address,omitempty"`       // address connected to
+	ServerVersion string          `json:"serverVersion,omitempty"` // e.g. SSH-2.0-OpenSSH_9.6
+	Banner        string          `json:"banner,omitempty"`        // pre-auth banner message
+	HostKey       string          `json:"hostKey,omitempty"`       // type and fingerprint
+	Algorithms    ConnAlgorithms  `json:"algorithms"`
+	AuthMethod    string          `json:"authMethod,omitempty"` // method that succeeded
+	Stages        []ConnTestStage `json:"stages"`
+	Auth          []AuthAttempt   `json:"auth"`
+	Notes         []string        `json:"notes,omitempty"`
+	OK            bool            `json:"ok"`
+	Duration      time.Duration   `json:"duration"`
+	Time          time.Time       `json:"time"`
+}
+
+// HealthCheck is the outcome of probing one host in a bulk health check.
+type HealthCheck struct {
+	Host      string        `json:"host"`
+	Time      time.Time     `json:"time"`
+	Reachable bool          `json:"reachable"`       // TCP connect and SSH banner succeeded
+	Latency   time.Duration `json:"latency"`         // TCP connect time
+	HostKey   string        `json:"hostKey"`         // host key stage: ok, warn (unknown), fail, skip
+	Auth      string        `json:"auth,omitempty"`  // auth stage when tested: ok, fail, skip
+	Error     string        `json:"error,omitempty"` // first failure
+	Duration  time.Duration `json:"duration"`
+}
+
+// Diagnostic is a problem found in the SSH config by a lint rule.
+type Diagnostic struct {
+	Rule     string `json:"rule"`     // rule ID, e.g. "unknown-keyword"
+	Severity string `json:"severity"` // error, warning, info
+	File     string `json:"file"`     // config file, relative to the SSH dir
+	Line     int    `json:"line"`     // 1-based line number
+	Message  string `json:"message"`
+}
+
+// LintRule describes a rule in the lint catalogue.
+type LintRule struct {
+	ID          string `json:"id"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"` // false when disabled in the app config
+}
+
+// HistoryEntry is one recorded write to a file in the SSH directory, kept so
+// the change can be undone, redone or reverted. Only the changed lines are
+// kept, with the file's versions on either side of the change.
+type HistoryEntry struct {
+	ID            int        `json:"id"`
+	File          string     `json:"file"` // relative to the SSH dir
+	Time          time.Time  `json:"time"`
+	BeforeVersion string     `json:"beforeVersion"`
+	AfterVersion  string     `json:"afterVersion"`
+	Hunks         []DiffHunk `json:"hunks"`
+	Undone        bool       `json:"undone"`
+}
+
+// DiffLine is a line of a line-based diff.
+type DiffLine struct {
+	Op   string `json:"op"` // " " unchanged, "-" removed, "+" added
+	Text string `json:"text"`
+}
+
+// DiffHunk is a run of changed lines with the unchanged lines around them.
+type DiffHunk struct {
+	Line  int        `json:"line"` // index of the first line in the old text
+	Lines []DiffLine `json:"lines"`
+}
+
+// AuditEntry records one state-changing API call.
+type AuditEntry struct {
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"` // e.g. "key.generate", "host.update"
+	Method   string        `json:"method"`
+	Endpoint string        `json:"endpoint"` // request path
+	Target   string        `json:"target"`   // key name, host alias, file...
+	Client   string        `json:"client"`   // remote address
+	Status   int           `json:"status"`
+	Changes  []AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is a file the call changed, with SHA-256 hashes of its
+// contents, or for backups its size and modification time. An empty value
+// means the file did not exist.
+type AuditChange struct {
+	File   string `json:"file"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// AuditPage is one page of audit entries, newest first.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Page    int          `json:"page"`
+	Limit   int          `json:"limit"`
 }
 
 // KnownHostEntry represents a single line in known_hosts.
 type KnownHostEntry struct {
-	Line        int    `json:"line"`        // 1-based line number
-	Hosts       string `json:"hosts"`       // hostname(s) or IP(s)
-	KeyType     string `json:"keyType"`     // ssh-rsa, ssh-ed25519, etc.
-	Key         string `json:"key"`         // base64-encoded public key
-	Fingerprint string `json:"fingerprint"` // SHA256 fingerprint
-	IsHashed    bool   `json:"isHashed"`    // whether hostnames are hashed
+	Line        int    `json:"line"`             // 1-based line number
+	Marker      string `json:"marker,omitempty"` // @cert-authority, @revoked or empty
+	Hosts       string `json:"hosts"`            // hostname(s) or IP(s)
+	KeyType     string `json:"keyType"`          // ssh-rsa, ssh-ed25519, etc.
+	Key         string `json:"key"`              // base64-encoded public key
+	Fingerprint string `json:"fingerprint"`      // SHA256 fingerprint
+	IsHashed    bool   `json:"isHashed"`         // whether hostnames are hashed
 }
 
 // Backup represents a tar.gz snapshot of ~/.ssh.
@@ -50,3 +439,9 @@ type Backup struct {
 	Size      int64     `json:"size"`
 	CreatedAt time.Time `json:"createdAt"`
 }
+
+// FileEvent reports files in ~/.ssh that changed on disk.
+type FileEvent struct {
+	Kind  string   `json:"kind"`  // config, knownhosts or keys
+	Files []string `json:"files"` // paths relative to ~/.ssh
+}
@@ -0,0 +1,181 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoAgent is returned when SSH_AUTH_SOCK is not set.
+var ErrNoAgent = errors.New("no ssh-agent running: SSH_AUTH_SOCK is not set")
+
+// AgentAddOptions sets the constraints on a key added to the agent.
+type AgentAddOptions struct {
+	Passphrase string        // for an encrypted private key
+	Lifetime   time.Duration // the agent drops the key after this, at least 1s; 0 keeps it
+	Confirm    bool          // the agent asks before each use, like ssh-add -c
+	Hosts      []string      // config aliases the key may sign for; built-in agent only
+}
+
+// AgentSocket returns sock, or SSH_AUTH_SOCK when sock is empty.
+func AgentSocket(sock string) string {
+	if sock == "" {
+		return os.Getenv("SSH_AUTH_SOCK")
+	}
+	return sock
+}
+
+// withAgent connects to the agent at sock (SSH_AUTH_SOCK when empty) and
+// calls fn with a client for it.
+func withAgent(sock string, fn func(agent.ExtendedAgent) error) error {
+	sock = AgentSocket(sock)
+	if sock == "" {
+		return ErrNoAgent
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	return fn(agent.NewClient(conn))
+}
+
+// AgentKeys lists the identities loaded into the agent at sock, each
+// matched by fingerprint to its key in the SSH directory. A locked agent
+// lists no keys.
+func AgentKeys(dir *SSHDir, sock string) ([]model.AgentKey, error) {
+	var loaded []*agent.Key
+	err := withAgent(sock, func(a agent.ExtendedAgent) error {
+		var err error
+		loaded, err = a.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	if keys, err := ListKeys(dir); err == nil {
+		for _, k := range keys {
+			names[k.Fingerprint] = k.Name
+		}
+	}
+
+	result := []model.AgentKey{}
+	for _, k := range loaded {
+		ak := model.AgentKey{
+			Type:        k.Format,
+			Fingerprint: gossh.FingerprintSHA256(k),
+			Comment:     k.Comment,
+		}
+		if pub, err := gossh.ParsePublicKey(k.Blob); err == nil {
+			ak.Bits = keyBits(pub)
+		}
+		ak.Key = names[ak.Fingerprint]
+		result = append(result, ak)
+	}
+	return result, nil
+}
+
+// lifetimeSecs converts a key lifetime to the whole seconds the agent
+// protocol carries. Lifetimes that would become 0, which the agent takes as
+// no limit, or overflow are refused rather than silently dropped.
+func lifetimeSecs(d time.Duration) (uint32, error) {
+	switch {
+	case d == 0:
+		return 0, nil
+	case d < time.Second:
+		return 0, fmt.Errorf("invalid lifetime %v: must be at least 1s", d)
+	case d/time.Second > math.MaxUint32:
+		return 0, fmt.Errorf("invalid lifetime %v: too long", d)
+	}
+	return uint32(d / time.Second), nil
+}
+
+// AddAgentKey decrypts the private key name and loads it into the agent at
+// sock with its .pub comment, like ssh-add. It returns ErrPassphraseRequired
+// or ErrWrongPassphrase when the key is encrypted and opts.Passphrase
+// doesn't open it.
+func AddAgentKey(dir *SSHDir, sock, name string, opts AgentAddOptions) error {
+	lifetime, err := lifetimeSecs(opts.Lifetime)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(dir.Path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("private key not found: %s", name)
+		}
+		return fmt.Errorf("read private key: %w", err)
+	}
+	key, err := decryptPrivateKey(data, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	comment := keyComment(dir, name)
+	if comment == "" {
+		comment = dir.Path(name)
+	}
+	added := agent.AddedKey{
+		PrivateKey:       key,
+		Comment:          comment,
+		LifetimeSecs:     lifetime,
+		ConfirmBeforeUse: opts.Confirm,
+	}
+	return withAgent(sock, func(a agent.ExtendedAgent) error {
+		if err := a.Add(added); err != nil {
+			return fmt.Errorf("add %s to ssh-agent: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// RemoveAgentKey removes the identity with the given SHA256 fingerprint
+// from the agent at sock.
+func RemoveAgentKey(sock, fingerprint string) error {
+	return withAgent(sock, func(a agent.ExtendedAgent) error {
+		keys, err := a.List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if gossh.FingerprintSHA256(k) == fingerprint {
+				return a.Remove(k)
+			}
+		}
+		return fmt.Errorf("key not loaded in ssh-agent: %s", fingerprint)
+	})
+}
+
+// RemoveAllAgentKeys removes every identity from the agent at sock.
+func RemoveAllAgentKeys(sock string) error {
+	return withAgent(sock, func(a agent.ExtendedAgent) error {
+		return a.RemoveAll()
+	})
+}
+
+// LockAgent locks the agent at sock with passphrase. A locked agent lists
+// no keys and refuses to sign until unlocked.
+func LockAgent(sock, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("a passphrase is required to lock the agent")
+	}
+	return withAgent(sock, func(a agent.ExtendedAgent) error {
+		return a.Lock([]byte(passphrase))
+	})
+}
+
+// UnlockAgent unlocks the agent at sock.
+func UnlockAgent(sock, passphrase string) error {
+	return withAgent(sock, func(a agent.ExtendedAgent) error {
+		return a.Unlock([]byte(passphrase))
+	})
+}
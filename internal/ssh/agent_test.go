@@ -0,0 +1,126 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves an in-memory keyring on a temporary Unix socket and
+// returns the socket path.
+func startTestAgent(t *testing.T) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return sock
+}
+
+func TestAgentKeys(t *testing.T) {
+	sock := startTestAgent(t)
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519", Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_rsa", Type: "rsa", Bits: 2048, Comment: "me@test", Passphrase: "secret"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	if err := AddAgentKey(dir, sock, "id_ed25519", AgentAddOptions{}); err != nil {
+		t.Fatalf("AddAgentKey failed: %v", err)
+	}
+	if err := AddAgentKey(dir, sock, "id_rsa", AgentAddOptions{}); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if err := AddAgentKey(dir, sock, "id_rsa", AgentAddOptions{Passphrase: "wrong"}); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	// A sub-second lifetime would reach the agent as 0, meaning no limit
+	if err := AddAgentKey(dir, sock, "id_rsa", AgentAddOptions{Passphrase: "secret", Lifetime: 500 * time.Millisecond}); err == nil {
+		t.Error("expected error for a sub-second lifetime")
+	}
+	if err := AddAgentKey(dir, sock, "id_rsa", AgentAddOptions{Passphrase: "secret", Lifetime: time.Hour}); err != nil {
+		t.Fatalf("AddAgentKey failed: %v", err)
+	}
+
+	keys, err := AgentKeys(dir, sock)
+	if err != nil {
+		t.Fatalf("AgentKeys failed: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 agent keys, got %+v", keys)
+	}
+	local, _ := GetKey(dir, "id_rsa")
+	var rsa model.AgentKey
+	for _, k := range keys {
+		if k.Type == "ssh-rsa" {
+			rsa = k
+		}
+	}
+	if rsa.Key != "id_rsa" || rsa.Fingerprint != local.Fingerprint || rsa.Bits != 2048 || rsa.Comment != "me@test" {
+		t.Errorf("unexpected agent key %+v", rsa)
+	}
+
+	if err := RemoveAgentKey(sock, rsa.Fingerprint); err != nil {
+		t.Fatalf("RemoveAgentKey failed: %v", err)
+	}
+	if err := RemoveAgentKey(sock, rsa.Fingerprint); err == nil {
+		t.Error("expected error removing a key that isn't loaded")
+	}
+	if keys, _ := AgentKeys(dir, sock); len(keys) != 1 || keys[0].Key != "id_ed25519" {
+		t.Errorf("expected only id_ed25519 left, got %+v", keys)
+	}
+
+	// Locking hides the keys until unlocked with the same passphrase
+	if err := LockAgent(sock, "lockpw"); err != nil {
+		t.Fatalf("LockAgent failed: %v", err)
+	}
+	if keys, _ := AgentKeys(dir, sock); len(keys) != 0 {
+		t.Errorf("expected no keys while locked, got %+v", keys)
+	}
+	if err := UnlockAgent(sock, "nope"); err == nil {
+		t.Error("expected unlock with the wrong passphrase to fail")
+	}
+	if err := UnlockAgent(sock, "lockpw"); err != nil {
+		t.Fatalf("UnlockAgent failed: %v", err)
+	}
+
+	if err := RemoveAllAgentKeys(sock); err != nil {
+		t.Fatalf("RemoveAllAgentKeys failed: %v", err)
+	}
+	if keys, _ := AgentKeys(dir, sock); len(keys) != 0 {
+		t.Errorf("expected an empty agent, got %+v", keys)
+	}
+}
+
+func TestAgentUnavailable(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := AgentKeys(NewSSHDir(t.TempDir()), ""); !errors.Is(err, ErrNoAgent) {
+		t.Errorf("expected ErrNoAgent, got %v", err)
+	}
+	if _, err := AgentKeys(NewSSHDir(t.TempDir()), filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Error("expected error for a missing socket")
+	}
+}
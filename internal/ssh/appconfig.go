@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AppConfig holds SSHmasher's own settings, read from a key=value file at
+// ~/.config/sshmasher/config. See docs/CONFIG.md.
+type AppConfig struct {
+	Terminal         string   // terminal=, preferred terminal emulator on Linux
+	LintDisabled     []string // lint.disable=, comma-separated lint rule IDs to skip
+	KeyGen           string   // keygen=, "ssh-keygen" to generate keys with ssh-keygen
+	KeyMaxAgeDays    int      // keyaudit.max-age=, days before a key is flagged as old; -1 for "off"
+	PreferEd25519    bool     // keyaudit.prefer-ed25519=, flag ECDSA keys too
+	KeyAuditDisabled []string // keyaudit.disable=, comma-separated key audit check IDs to skip
+	AgentAutostart   bool     // agent.autostart=, start the built-in agent with the app
+	AgentSocket      string   // agent.socket=, where the built-in agent listens
+}
+
+// AppConfigPath returns the location of the app config file.
+func AppConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "sshmasher", "config"), nil
+}
+
+// LoadAppConfig reads the app config. A missing file yields an empty config.
+func LoadAppConfig() (*AppConfig, error) {
+	path, err := AppConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &AppConfig{}, nil
+		}
+		return nil, err
+	}
+	return parseAppConfig(string(data)), nil
+}
+
+func parseAppConfig(text string) *AppConfig {
+	cfg := &AppConfig{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "terminal":
+			cfg.Terminal = value
+		case "keygen":
+			cfg.KeyGen = value
+		case "lint.disable":
+			cfg.LintDisabled = append(cfg.LintDisabled, splitList(value)...)
+		case "keyaudit.max-age":
+			if value == "off" || value == "0" {
+				cfg.KeyMaxAgeDays = -1
+			} else if days, err := strconv.Atoi(value); err == nil && days > 0 {
+				cfg.KeyMaxAgeDays = days
+			}
+		case "keyaudit.prefer-ed25519":
+			cfg.PreferEd25519 = value == "true" || value == "yes"
+		case "keyaudit.disable":
+			cfg.KeyAuditDisabled = append(cfg.KeyAuditDisabled, splitList(value)...)
+		case "agent.autostart":
+			cfg.AgentAutostart = value == "true" || value == "yes"
+		case "agent.socket":
+			cfg.AgentSocket = value
+		}
+	}
+	return cfg
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,226 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+var auditMu sync.Mutex
+
+// AuditLogPath returns the audit log, a JSON Lines file kept with the
+// history journal outside the SSH dir.
+func AuditLogPath(dir *SSHDir) string {
+	return filepath.Join(dir.HistoryDir(), "audit.jsonl")
+}
+
+// AppendAudit adds an entry to the end of the audit log. The log is only
+// ever appended to.
+func AppendAudit(dir *SSHDir, entry model.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(dir.HistoryDir(), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(AuditLogPath(dir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Action string // exact action, or a prefix ending in "." such as "key."
+	Search string // substring of the target, endpoint or a changed file
+}
+
+// ReadAudit returns one page (1-based) of entries matching filter, newest
+// first.
+func ReadAudit(dir *SSHDir, filter AuditFilter, page, limit int) (*model.AuditPage, error) {
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 50
+	}
+
+	auditMu.Lock()
+	f, err := os.Open(AuditLogPath(dir))
+	if err != nil {
+		auditMu.Unlock()
+		if os.IsNotExist(err) {
+			return &model.AuditPage{Page: page, Limit: limit}, nil
+		}
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	var matched []model.AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e model.AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if auditMatches(e, filter) {
+			matched = append(matched, e)
+		}
+	}
+	err = scanner.Err()
+	f.Close()
+	auditMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("read audit log: %w", err)
+	}
+
+	res := &model.AuditPage{Total: len(matched), Page: page, Limit: limit}
+	for i := len(matched) - 1 - (page-1)*limit; i >= 0 && len(res.Entries) < limit; i-- {
+		res.Entries = append(res.Entries, matched[i])
+	}
+	return res, nil
+}
+
+func auditMatches(e model.AuditEntry, filter AuditFilter) bool {
+	if a := filter.Action; a != "" {
+		if strings.HasSuffix(a, ".") {
+			if !strings.HasPrefix(e.Action, a) {
+				return false
+			}
+		} else if e.Action != a {
+			return false
+		}
+	}
+	q := strings.ToLower(filter.Search)
+	if q == "" {
+		return true
+	}
+	if strings.Contains(strings.ToLower(e.Target), q) || strings.Contains(strings.ToLower(e.Endpoint), q) {
+		return true
+	}
+	for _, c := range e.Changes {
+		if strings.Contains(strings.ToLower(c.File), q) {
+			return true
+		}
+	}
+	return false
+}
+
+// FileSnapshotter records the state of the SSH dir and the backup dir for
+// audit entries, keyed by path relative to the SSH dir. Files in the SSH dir
+// are hashed, and only rehashed when their size or modification time has
+// changed since the last snapshot. Backups are never read: they are recorded
+// by size and modification time. Only hashes are kept, so private keys never
+// leave their files.
+type FileSnapshotter struct {
+	dir   *SSHDir
+	mu    sync.Mutex
+	cache map[string]fileStamp
+}
+
+// fileStamp is a file as last seen by a FileSnapshotter.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// NewFileSnapshotter returns a snapshotter for dir with an empty cache.
+func NewFileSnapshotter(dir *SSHDir) *FileSnapshotter {
+	return &FileSnapshotter{dir: dir, cache: make(map[string]fileStamp)}
+}
+
+// Snapshot returns a hash, or for backups a size and modification time, for
+// every regular file.
+func (s *FileSnapshotter) Snapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := make(map[string]string)
+	seen := make(map[string]fileStamp)
+	filepath.WalkDir(s.dir.Base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st, ok := s.cache[path]
+		if !ok || st.size != info.Size() || !st.modTime.Equal(info.ModTime()) {
+			sum, err := hashFile(path)
+			if err != nil {
+				return nil
+			}
+			st = fileStamp{size: info.Size(), modTime: info.ModTime(), sum: sum}
+		}
+		seen[path] = st
+		snap[s.dir.RelPath(path)] = st.sum
+		return nil
+	})
+	s.cache = seen
+
+	filepath.WalkDir(s.dir.BackupDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			snap[s.dir.RelPath(path)] = fmt.Sprintf("size:%d mtime:%d", info.Size(), info.ModTime().Unix())
+		}
+		return nil
+	})
+	return snap
+}
+
+// SnapshotFiles records dir as a FileSnapshotter with an empty cache does.
+func SnapshotFiles(dir *SSHDir) map[string]string {
+	return NewFileSnapshotter(dir).Snapshot()
+}
+
+// DiffSnapshots lists the files whose hash differs between two snapshots.
+func DiffSnapshots(before, after map[string]string) []model.AuditChange {
+	var changes []model.AuditChange
+	for file, sum := range after {
+		if before[file] != sum {
+			changes = append(changes, model.AuditChange{File: file, Before: before[file], After: sum})
+		}
+	}
+	for file, sum := range before {
+		if _, ok := after[file]; !ok {
+			changes = append(changes, model.AuditChange{File: file, Before: sum})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].File < changes[j].File })
+	return changes
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
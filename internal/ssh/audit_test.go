@@ -0,0 +1,115 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestAuditLogPaging(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+
+	for i := 0; i < 5; i++ {
+		action := "key.generate"
+		if i%2 == 1 {
+			action = "host.add"
+		}
+		entry := model.AuditEntry{Time: time.Now(), Action: action, Target: fmt.Sprintf("t%d", i), Status: 200}
+		if err := AppendAudit(dir, entry); err != nil {
+			t.Fatalf("AppendAudit failed: %v", err)
+		}
+	}
+
+	res, err := ReadAudit(dir, AuditFilter{}, 1, 2)
+	if err != nil {
+		t.Fatalf("ReadAudit failed: %v", err)
+	}
+	if res.Total != 5 || len(res.Entries) != 2 || res.Entries[0].Target != "t4" {
+		t.Fatalf("expected newest 2 of 5, got %+v", res)
+	}
+	res, _ = ReadAudit(dir, AuditFilter{}, 3, 2)
+	if len(res.Entries) != 1 || res.Entries[0].Target != "t0" {
+		t.Fatalf("expected oldest entry on last page, got %+v", res.Entries)
+	}
+
+	res, _ = ReadAudit(dir, AuditFilter{Action: "host."}, 1, 10)
+	if res.Total != 2 {
+		t.Errorf("expected 2 host entries, got %d", res.Total)
+	}
+	res, _ = ReadAudit(dir, AuditFilter{Action: "key.generate", Search: "T2"}, 1, 10)
+	if res.Total != 1 || res.Entries[0].Target != "t2" {
+		t.Errorf("expected search to match t2, got %+v", res.Entries)
+	}
+}
+
+func TestReadAuditMissing(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	res, err := ReadAudit(dir, AuditFilter{}, 0, 0)
+	if err != nil {
+		t.Fatalf("ReadAudit failed: %v", err)
+	}
+	if res.Total != 0 || res.Page != 1 || res.Limit != 50 {
+		t.Errorf("unexpected empty page: %+v", res)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(filepath.Join(dir.Base, "config"), []byte("Host a\n"), 0600)
+	os.WriteFile(filepath.Join(dir.Base, "id_old"), []byte("PRIVATE KEY\n"), 0600)
+
+	before := SnapshotFiles(dir)
+	os.WriteFile(filepath.Join(dir.Base, "config"), []byte("Host b\n"), 0600)
+	os.Remove(filepath.Join(dir.Base, "id_old"))
+	os.WriteFile(filepath.Join(dir.Base, "id_new"), []byte("PRIVATE KEY\n"), 0600)
+
+	changes := DiffSnapshots(before, SnapshotFiles(dir))
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v", changes)
+	}
+	want := map[string][2]bool{"config": {true, true}, "id_new": {false, true}, "id_old": {true, false}}
+	for _, c := range changes {
+		w, ok := want[c.File]
+		if !ok || (c.Before != "") != w[0] || (c.After != "") != w[1] {
+			t.Errorf("unexpected change %+v", c)
+		}
+		if strings.Contains(c.Before+c.After, "PRIVATE") {
+			t.Errorf("change leaks file content: %+v", c)
+		}
+	}
+}
+
+func TestFileSnapshotter(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	config := filepath.Join(dir.Base, "config")
+	os.WriteFile(config, []byte("Host a\n"), 0600)
+	dir.EnsureBackupDir()
+	os.WriteFile(filepath.Join(dir.BackupDir(), "ssh-backup.tar.gz"), []byte("archive"), 0600)
+
+	s := NewFileSnapshotter(dir)
+	first := s.Snapshot()
+	if !strings.HasPrefix(first["config"], "sha256:") {
+		t.Errorf("expected config hashed, got %q", first["config"])
+	}
+	backup := dir.RelPath(filepath.Join(dir.BackupDir(), "ssh-backup.tar.gz"))
+	if !strings.HasPrefix(first[backup], "size:7 mtime:") {
+		t.Errorf("expected backup recorded by size and mtime, got %q", first[backup])
+	}
+
+	// A file whose size and mtime are unchanged keeps its cached hash
+	info, _ := os.Stat(config)
+	os.WriteFile(config, []byte("Host b\n"), 0600)
+	os.Chtimes(config, info.ModTime(), info.ModTime())
+	if got := s.Snapshot()["config"]; got != first["config"] {
+		t.Errorf("expected the cached hash, got %q", got)
+	}
+	os.Chtimes(config, info.ModTime(), info.ModTime().Add(time.Second))
+	if got := s.Snapshot()["config"]; got == first["config"] {
+		t.Error("expected a new hash once the mtime changed")
+	}
+}
@@ -50,8 +50,14 @@ func ListBackups(dir *SSHDir) ([]model.Backup, error) {
 
 // CreateBackup creates a tar.gz snapshot of the SSH directory.
 func CreateBackup(dir *SSHDir) error {
+	_, err := createBackup(dir)
+	return err
+}
+
+// createBackup writes a snapshot and returns its filename.
+func createBackup(dir *SSHDir) (string, error) {
 	if err := dir.EnsureBackupDir(); err != nil {
-		return err
+		return "", err
 	}
 
 	filename := fmt.Sprintf("ssh-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
@@ -59,7 +65,7 @@ func CreateBackup(dir *SSHDir) error {
 
 	outFile, err := os.Create(outPath)
 	if err != nil {
-		return fmt.Errorf("create backup file: %w", err)
+		return "", fmt.Errorf("create backup file: %w", err)
 	}
 	defer outFile.Close()
 
@@ -69,7 +75,7 @@ func CreateBackup(dir *SSHDir) error {
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
-	return filepath.Walk(dir.Base, func(path string, info os.FileInfo, err error) error {
+	return filename, filepath.Walk(dir.Base, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,712 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// DefaultConfirmTimeout is how long a signature waits for approval in
+	// the UI before it is denied.
+	DefaultConfirmTimeout = time.Minute
+
+	// AgentSignAction is the audit log action for signatures made by the
+	// built-in agent.
+	AgentSignAction = "agent.sign"
+
+	// agentLogSize is how many signing requests the live log keeps.
+	agentLogSize = 100
+)
+
+var (
+	ErrAgentRunning    = errors.New("built-in agent is already running")
+	ErrAgentNotRunning = errors.New("built-in agent is not running")
+	errAgentLocked     = errors.New("agent is locked")
+)
+
+// BuiltinAgent is an ssh-agent served by SSHmasher on a Unix socket. It
+// holds keys decrypted through the UI, each with a policy: signatures can
+// require approval in the UI, be limited to certain config hosts, and stop
+// when the key expires. Every signing request goes to a live log and the
+// audit log.
+type BuiltinAgent struct {
+	dir *SSHDir
+	// ConfirmTimeout is how long a signature waits for approval; zero means
+	// DefaultConfirmTimeout.
+	ConfirmTimeout time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	socket   string
+	conns    map[net.Conn]struct{}
+	keys     []*builtinKey
+	lockPass []byte // set while locked
+	log      []model.AgentSignRequest
+	pending  map[string]chan bool
+	subs     map[chan model.AgentSignRequest]struct{}
+}
+
+// builtinKey is a decrypted key held by the built-in agent.
+type builtinKey struct {
+	signer  gossh.Signer
+	name    string
+	comment string
+	policy  model.AgentPolicy
+}
+
+// NewBuiltinAgent returns a stopped agent for dir.
+func NewBuiltinAgent(dir *SSHDir) *BuiltinAgent {
+	return &BuiltinAgent{
+		dir:     dir,
+		conns:   make(map[net.Conn]struct{}),
+		pending: make(map[string]chan bool),
+		subs:    make(map[chan model.AgentSignRequest]struct{}),
+	}
+}
+
+// Start listens on socket (dir.AgentSocketPath() when empty) and serves the
+// agent protocol there until Stop. A stale socket left by a previous run is
+// replaced.
+func (a *BuiltinAgent) Start(socket string) error {
+	if socket == "" {
+		socket = a.dir.AgentSocketPath()
+	}
+	socket = a.dir.ExpandPath(socket)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener != nil {
+		return ErrAgentRunning
+	}
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return fmt.Errorf("another agent is listening on %s", socket)
+		}
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("start agent: %w", err)
+	}
+	// Only this user may ask for signatures
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("start agent: %w", err)
+	}
+	a.listener = l
+	a.socket = socket
+	go a.serve(l)
+	return nil
+}
+
+// Stop closes the socket and every client connection, drops every key and
+// denies pending signatures.
+func (a *BuiltinAgent) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener == nil {
+		return ErrAgentNotRunning
+	}
+	a.listener.Close()
+	os.Remove(a.socket)
+	a.listener = nil
+	for conn := range a.conns {
+		conn.Close()
+		delete(a.conns, conn)
+	}
+	a.keys = nil
+	a.lockPass = nil
+	for id, ch := range a.pending {
+		close(ch)
+		delete(a.pending, id)
+	}
+	return nil
+}
+
+func (a *BuiltinAgent) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		if a.listener != l {
+			// Stopped between Accept and here
+			a.mu.Unlock()
+			conn.Close()
+			return
+		}
+		a.conns[conn] = struct{}{}
+		a.mu.Unlock()
+		go func() {
+			defer func() {
+				a.mu.Lock()
+				delete(a.conns, conn)
+				a.mu.Unlock()
+				conn.Close()
+			}()
+			agent.ServeAgent(&builtinConn{a: a}, conn)
+		}()
+	}
+}
+
+// Status returns whether the agent is running, its keys and the log,
+// newest first.
+func (a *BuiltinAgent) Status() model.BuiltinAgentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expireLocked()
+
+	st := model.BuiltinAgentStatus{
+		Running: a.listener != nil,
+		Socket:  a.socket,
+		Locked:  a.lockPass != nil,
+		Keys:    []model.AgentKey{},
+		Log:     make([]model.AgentSignRequest, 0, len(a.log)),
+	}
+	if st.Socket == "" {
+		st.Socket = a.dir.AgentSocketPath()
+	}
+	for _, k := range a.keys {
+		pub := k.signer.PublicKey()
+		policy := k.policy
+		st.Keys = append(st.Keys, model.AgentKey{
+			Type:        pub.Type(),
+			Bits:        keyBits(pub),
+			Fingerprint: gossh.FingerprintSHA256(pub),
+			Comment:     k.comment,
+			Key:         k.name,
+			Policy:      &policy,
+		})
+	}
+	for i := len(a.log) - 1; i >= 0; i-- {
+		st.Log = append(st.Log, a.log[i])
+	}
+	return st
+}
+
+// AddKey decrypts the private key name and holds it in the agent under the
+// policy in opts. Adding a key the agent already holds replaces its policy.
+func (a *BuiltinAgent) AddKey(name string, opts AgentAddOptions) error {
+	data, err := os.ReadFile(a.dir.Path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("private key not found: %s", name)
+		}
+		return fmt.Errorf("read private key: %w", err)
+	}
+	key, err := decryptPrivateKey(data, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", name, err)
+	}
+	policy := model.AgentPolicy{Confirm: opts.Confirm, Hosts: opts.Hosts}
+	if opts.Lifetime > 0 {
+		policy.Expires = time.Now().Add(opts.Lifetime)
+	}
+	return a.add(&builtinKey{signer: signer, name: name, comment: keyComment(a.dir, name), policy: policy})
+}
+
+func (a *BuiltinAgent) add(k *builtinKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockPass != nil {
+		return errAgentLocked
+	}
+	blob := k.signer.PublicKey().Marshal()
+	a.keys = slices.DeleteFunc(a.keys, func(old *builtinKey) bool {
+		return bytes.Equal(old.signer.PublicKey().Marshal(), blob)
+	})
+	a.keys = append(a.keys, k)
+	return nil
+}
+
+// RemoveKey drops the key with the given SHA256 fingerprint.
+func (a *BuiltinAgent) RemoveKey(fingerprint string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := len(a.keys)
+	a.keys = slices.DeleteFunc(a.keys, func(k *builtinKey) bool {
+		return gossh.FingerprintSHA256(k.signer.PublicKey()) == fingerprint
+	})
+	if len(a.keys) == n {
+		return fmt.Errorf("key not loaded in the built-in agent: %s", fingerprint)
+	}
+	return nil
+}
+
+// Decide approves or denies the pending signing request id.
+func (a *BuiltinAgent) Decide(id string, allow bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch, ok := a.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending signing request %s", id)
+	}
+	delete(a.pending, id)
+	ch <- allow
+	return nil
+}
+
+// Subscribe returns a channel of signing requests, sent when they arrive
+// and again when they finish, and a func to stop receiving them. Requests
+// are dropped for subscribers that fall behind.
+func (a *BuiltinAgent) Subscribe() (<-chan model.AgentSignRequest, func()) {
+	ch := make(chan model.AgentSignRequest, 16)
+	a.mu.Lock()
+	a.subs[ch] = struct{}{}
+	a.mu.Unlock()
+	return ch, func() {
+		a.mu.Lock()
+		if _, ok := a.subs[ch]; ok {
+			delete(a.subs, ch)
+			close(ch)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// recordLocked adds or updates req in the log and tells subscribers. Callers
+// hold a.mu.
+func (a *BuiltinAgent) recordLocked(req model.AgentSignRequest) {
+	i := slices.IndexFunc(a.log, func(r model.AgentSignRequest) bool { return r.ID == req.ID })
+	if i >= 0 {
+		a.log[i] = req
+	} else {
+		a.log = append(a.log, req)
+		if len(a.log) > agentLogSize {
+			a.log = a.log[len(a.log)-agentLogSize:]
+		}
+	}
+	for ch := range a.subs {
+		select {
+		case ch <- req:
+		default:
+		}
+	}
+}
+
+// expireLocked drops keys past their lifetime. Callers hold a.mu.
+func (a *BuiltinAgent) expireLocked() {
+	now := time.Now()
+	a.keys = slices.DeleteFunc(a.keys, func(k *builtinKey) bool {
+		return !k.policy.Expires.IsZero() && now.After(k.policy.Expires)
+	})
+}
+
+// findLocked returns the key for pub, if held. Callers hold a.mu.
+func (a *BuiltinAgent) findLocked(pub gossh.PublicKey) *builtinKey {
+	a.expireLocked()
+	blob := pub.Marshal()
+	for _, k := range a.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), blob) {
+			return k
+		}
+	}
+	return nil
+}
+
+// sign runs a signing request through the key's policy, waiting for
+// approval in the UI when the policy asks for it.
+func (a *BuiltinAgent) sign(c *builtinConn, pub gossh.PublicKey, data []byte, flags agent.SignatureFlags) (*gossh.Signature, error) {
+	a.mu.Lock()
+	if a.lockPass != nil {
+		a.mu.Unlock()
+		return nil, errAgentLocked
+	}
+	k := a.findLocked(pub)
+	if k == nil {
+		a.mu.Unlock()
+		return nil, errors.New("key not found")
+	}
+	req := model.AgentSignRequest{
+		ID:          newRequestID(),
+		Time:        time.Now(),
+		Key:         k.name,
+		Fingerprint: gossh.FingerprintSHA256(pub),
+		Status:      "pending",
+	}
+	if req.Key == "" {
+		req.Key = k.comment
+	}
+	policy := k.policy
+	a.mu.Unlock()
+
+	var sessionID []byte
+	req.Purpose, req.User, sessionID = signPurpose(data)
+	b, latest := c.bindFor(sessionID)
+	if b != nil {
+		req.HostKey = gossh.FingerprintSHA256(b.hostKey)
+		req.Hosts = b.hosts
+		req.Forwarded = b.forwarded
+	}
+
+	// As with OpenSSH's destination constraints, a key limited to certain
+	// hosts only signs logins, and only for the server the connection was
+	// last bound to by the ssh client itself
+	var allowed bool
+	switch {
+	case len(policy.Hosts) > 0 && req.Purpose != "auth":
+		req.Status, req.Reason = "refused", "key is limited to certain hosts and only signs logins"
+	case len(policy.Hosts) > 0 && req.HostKey == "":
+		req.Status, req.Reason = "refused", "key is limited to certain hosts and the destination is unknown"
+	case len(policy.Hosts) > 0 && !latest:
+		req.Status, req.Reason = "refused", "key is limited to certain hosts and the login is not for the connection's latest session"
+	case len(policy.Hosts) > 0 && req.Forwarded:
+		req.Status, req.Reason = "refused", "key is limited to certain hosts and the agent was forwarded"
+	case len(policy.Hosts) > 0 && !slices.ContainsFunc(req.Hosts, func(h string) bool { return slices.Contains(policy.Hosts, h) }):
+		req.Status, req.Reason = "refused", "key is not allowed for this host"
+	case policy.Confirm:
+		allowed = a.confirm(&req)
+	default:
+		allowed = true
+	}
+
+	var sig *gossh.Signature
+	var err error
+	if allowed {
+		sig, err = signWithFlags(k.signer, data, flags)
+		if err != nil {
+			req.Status, req.Reason = "failed", err.Error()
+		} else {
+			req.Status = "signed"
+		}
+	}
+	a.mu.Lock()
+	a.recordLocked(req)
+	socket := a.socket
+	a.mu.Unlock()
+	a.audit(socket, req)
+
+	if req.Status != "signed" {
+		if err == nil {
+			err = fmt.Errorf("signature %s: %s", req.Status, req.Reason)
+		}
+		return nil, err
+	}
+	return sig, nil
+}
+
+// newRequestID returns a random ID for a signing request, so approving one
+// takes more than guessing a counter.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// confirm holds req until it is approved or denied in the UI, or times out.
+func (a *BuiltinAgent) confirm(req *model.AgentSignRequest) bool {
+	ch := make(chan bool, 1)
+	a.mu.Lock()
+	a.pending[req.ID] = ch
+	a.recordLocked(*req)
+	timeout := a.ConfirmTimeout
+	a.mu.Unlock()
+	if timeout == 0 {
+		timeout = DefaultConfirmTimeout
+	}
+
+	select {
+	case allow, ok := <-ch:
+		if !ok {
+			req.Status, req.Reason = "denied", "agent stopped"
+			return false
+		}
+		if !allow {
+			req.Status, req.Reason = "denied", "denied in SSHmasher"
+		}
+		return allow
+	case <-time.After(timeout):
+		a.mu.Lock()
+		delete(a.pending, req.ID)
+		a.mu.Unlock()
+		req.Status, req.Reason = "denied", "not approved in time"
+		return false
+	}
+}
+
+// audit records a finished signing request in the audit log.
+func (a *BuiltinAgent) audit(socket string, req model.AgentSignRequest) {
+	status := 200
+	switch req.Status {
+	case "denied", "refused":
+		status = 403
+	case "failed":
+		status = 500
+	}
+	client := strings.Join(req.Hosts, ",")
+	if client == "" {
+		client = req.HostKey
+	}
+	AppendAudit(a.dir, model.AuditEntry{
+		Time:     req.Time,
+		Action:   AgentSignAction,
+		Method:   "SIGN",
+		Endpoint: socket,
+		Target:   req.Key,
+		Client:   client,
+		Status:   status,
+	})
+}
+
+// signWithFlags signs data, using SHA-2 for RSA keys when the client asks.
+func signWithFlags(signer gossh.Signer, data []byte, flags agent.SignatureFlags) (*gossh.Signature, error) {
+	as, ok := signer.(gossh.AlgorithmSigner)
+	if !ok || signer.PublicKey().Type() != gossh.KeyAlgoRSA {
+		return signer.Sign(rand.Reader, data)
+	}
+	switch {
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		return as.SignWithAlgorithm(rand.Reader, data, gossh.KeyAlgoRSASHA512)
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		return as.SignWithAlgorithm(rand.Reader, data, gossh.KeyAlgoRSASHA256)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// userAuthRequest is the start of the data a client signs to log in with a
+// public key (RFC 4252 section 7).
+type userAuthRequest struct {
+	SessionID []byte
+	Type      byte
+	User      string
+	Service   string
+	Method    string
+	Rest      []byte `ssh:"rest"`
+}
+
+// signPurpose tells what data is being signed: a login (with the remote
+// user and session ID), an SSHSIG signature such as a git commit, or
+// something else.
+func signPurpose(data []byte) (purpose, user string, sessionID []byte) {
+	if bytes.HasPrefix(data, []byte("SSHSIG")) {
+		return "sshsig", "", nil
+	}
+	var req userAuthRequest
+	if err := gossh.Unmarshal(data, &req); err == nil && req.Type == 50 && req.Method == "publickey" {
+		return "auth", req.User, req.SessionID
+	}
+	return "other", "", nil
+}
+
+// hostsForKey returns the config hosts known_hosts says hostKey belongs
+// to.
+func hostsForKey(dir *SSHDir, hostKey gossh.PublicKey) []string {
+	cb, err := knownhosts.New(dir.KnownHostsPath())
+	if err != nil {
+		return nil
+	}
+	aliases, err := HealthHosts(dir)
+	if err != nil {
+		return nil
+	}
+	remote := &net.TCPAddr{IP: net.IPv4zero, Port: 22}
+	var hosts []string
+	for _, alias := range aliases {
+		cfg, err := ResolveHost(dir, alias, ResolveOptions{})
+		if err != nil {
+			continue
+		}
+		name := resolvedValue(cfg, "hostkeyalias")
+		if name == "" {
+			name = resolvedValue(cfg, "hostname")
+		}
+		if name == "" {
+			name = alias
+		}
+		port := resolvedValue(cfg, "port")
+		if port == "" {
+			port = "22"
+		}
+		if cb(net.JoinHostPort(name, port), remote, hostKey) == nil {
+			hosts = append(hosts, alias)
+		}
+	}
+	return hosts
+}
+
+// sessionBind is an OpenSSH session-bind@openssh.com extension request: the
+// client proves which server the connection's signatures are for.
+type sessionBind struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+// agentBind is a verified session binding.
+type agentBind struct {
+	hostKey   gossh.PublicKey
+	hosts     []string // config hosts for hostKey, resolved when bound
+	sessionID []byte
+	forwarded bool
+}
+
+// builtinConn serves one client connection to the built-in agent, keeping
+// the sessions the client has bound it to.
+type builtinConn struct {
+	a     *BuiltinAgent
+	mu    sync.Mutex
+	binds []agentBind
+}
+
+// bindFor returns the binding for sessionID, or the latest binding for
+// data that isn't a login, and whether it is the latest binding on the
+// connection.
+func (c *builtinConn) bindFor(sessionID []byte) (*agentBind, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.binds) - 1; i >= 0; i-- {
+		if sessionID == nil || bytes.Equal(c.binds[i].sessionID, sessionID) {
+			b := c.binds[i]
+			return &b, i == len(c.binds)-1
+		}
+	}
+	return nil, false
+}
+
+func (c *builtinConn) List() ([]*agent.Key, error) {
+	c.a.mu.Lock()
+	defer c.a.mu.Unlock()
+	if c.a.lockPass != nil {
+		return nil, nil
+	}
+	c.a.expireLocked()
+	var keys []*agent.Key
+	for _, k := range c.a.keys {
+		pub := k.signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: pub.Type(), Blob: pub.Marshal(), Comment: k.comment})
+	}
+	return keys, nil
+}
+
+func (c *builtinConn) Sign(key gossh.PublicKey, data []byte) (*gossh.Signature, error) {
+	return c.a.sign(c, key, data, 0)
+}
+
+func (c *builtinConn) SignWithFlags(key gossh.PublicKey, data []byte, flags agent.SignatureFlags) (*gossh.Signature, error) {
+	return c.a.sign(c, key, data, flags)
+}
+
+// Add takes keys from ssh-add, turning its -t and -c constraints into the
+// key's policy.
+func (c *builtinConn) Add(key agent.AddedKey) error {
+	signer, err := gossh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	k := &builtinKey{signer: signer, comment: key.Comment, policy: model.AgentPolicy{Confirm: key.ConfirmBeforeUse}}
+	if key.LifetimeSecs > 0 {
+		k.policy.Expires = time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+	}
+	if keys, err := ListKeys(c.a.dir); err == nil {
+		fp := gossh.FingerprintSHA256(signer.PublicKey())
+		for _, lk := range keys {
+			if lk.Fingerprint == fp {
+				k.name = lk.Name
+			}
+		}
+	}
+	return c.a.add(k)
+}
+
+func (c *builtinConn) Remove(key gossh.PublicKey) error {
+	c.a.mu.Lock()
+	locked := c.a.lockPass != nil
+	c.a.mu.Unlock()
+	if locked {
+		return errAgentLocked
+	}
+	return c.a.RemoveKey(gossh.FingerprintSHA256(key))
+}
+
+func (c *builtinConn) RemoveAll() error {
+	c.a.mu.Lock()
+	defer c.a.mu.Unlock()
+	if c.a.lockPass != nil {
+		return errAgentLocked
+	}
+	c.a.keys = nil
+	return nil
+}
+
+func (c *builtinConn) Lock(passphrase []byte) error {
+	c.a.mu.Lock()
+	defer c.a.mu.Unlock()
+	if c.a.lockPass != nil {
+		return errAgentLocked
+	}
+	c.a.lockPass = append([]byte{}, passphrase...)
+	return nil
+}
+
+func (c *builtinConn) Unlock(passphrase []byte) error {
+	c.a.mu.Lock()
+	defer c.a.mu.Unlock()
+	if c.a.lockPass == nil {
+		return errors.New("agent is not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, c.a.lockPass) != 1 {
+		return errors.New("incorrect passphrase")
+	}
+	c.a.lockPass = nil
+	return nil
+}
+
+// Signers is not part of the agent protocol; ServeAgent never calls it.
+func (c *builtinConn) Signers() ([]gossh.Signer, error) {
+	return nil, errors.New("not supported")
+}
+
+// Extension handles session-bind@openssh.com, which ssh 8.9 and later send
+// before authenticating so the agent knows the destination.
+func (c *builtinConn) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != "session-bind@openssh.com" {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	var req sessionBind
+	if err := gossh.Unmarshal(contents, &req); err != nil {
+		return nil, err
+	}
+	hostKey, err := gossh.ParsePublicKey(req.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	var sig gossh.Signature
+	if err := gossh.Unmarshal(req.Signature, &sig); err != nil {
+		return nil, err
+	}
+	if err := hostKey.Verify(req.SessionID, &sig); err != nil {
+		return nil, fmt.Errorf("session-bind: %w", err)
+	}
+	// Resolve the hosts here rather than on each signature: the config
+	// tree and known_hosts are read once per session
+	hosts := hostsForKey(c.a.dir, hostKey)
+	c.mu.Lock()
+	c.binds = append(c.binds, agentBind{hostKey: hostKey, hosts: hosts, sessionID: req.SessionID, forwarded: req.Forwarding})
+	c.mu.Unlock()
+	return nil, nil
+}
@@ -0,0 +1,298 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startBuiltinAgent runs a built-in agent for dir on a temporary socket and
+// returns it with a client connected to it.
+func startBuiltinAgent(t *testing.T, dir *SSHDir) (*BuiltinAgent, agent.ExtendedAgent) {
+	t.Helper()
+	a := NewBuiltinAgent(dir)
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	if err := a.Start(sock); err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { a.Stop() })
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial agent failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return a, agent.NewClient(conn)
+}
+
+// loginData is what ssh signs to log in as user in the session sessionID.
+func loginData(sessionID []byte, user string) []byte {
+	return gossh.Marshal(userAuthRequest{SessionID: sessionID, Type: 50, User: user, Service: "ssh-connection", Method: "publickey"})
+}
+
+// bindSession sends the session-bind@openssh.com extension for a server
+// with hostKey, as ssh does before logging in, or before forwarding the
+// agent to it.
+func bindSession(t *testing.T, client agent.ExtendedAgent, hostKey gossh.Signer, sessionID []byte, forwarding bool) {
+	t.Helper()
+	sig, err := hostKey.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatalf("sign session ID failed: %v", err)
+	}
+	req := gossh.Marshal(sessionBind{HostKey: hostKey.PublicKey().Marshal(), SessionID: sessionID, Signature: gossh.Marshal(sig), Forwarding: forwarding})
+	if _, err := client.Extension("session-bind@openssh.com", req); err != nil {
+		t.Fatalf("session-bind failed: %v", err)
+	}
+}
+
+func TestBuiltinAgent(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519", Comment: "me@test", Passphrase: "secret"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	a, client := startBuiltinAgent(t, dir)
+
+	if err := a.AddKey("id_ed25519", AgentAddOptions{}); err != ErrPassphraseRequired {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if err := a.AddKey("id_ed25519", AgentAddOptions{Passphrase: "secret", Lifetime: time.Hour}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	keys, err := client.List()
+	if err != nil || len(keys) != 1 || keys[0].Comment != "me@test" {
+		t.Fatalf("expected one key listed, got %v %v", keys, err)
+	}
+
+	data := loginData([]byte("session"), "deploy")
+	sig, err := client.Sign(keys[0], data)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if err := keys[0].Verify(data, sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	st := a.Status()
+	if !st.Running || len(st.Keys) != 1 || st.Keys[0].Key != "id_ed25519" || st.Keys[0].Policy.Expires.IsZero() {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if len(st.Log) != 1 || st.Log[0].Status != "signed" || st.Log[0].Purpose != "auth" || st.Log[0].User != "deploy" {
+		t.Errorf("unexpected log %+v", st.Log)
+	}
+	audit, err := ReadAudit(dir, AuditFilter{Action: AgentSignAction}, 1, 0)
+	if err != nil || audit.Total != 1 || audit.Entries[0].Target != "id_ed25519" {
+		t.Errorf("expected the signature in the audit log, got %+v %v", audit, err)
+	}
+
+	// Locking hides keys and refuses signatures
+	if err := client.Lock([]byte("pw")); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if keys, _ := client.List(); len(keys) != 0 {
+		t.Error("expected no keys while locked")
+	}
+	if _, err := client.Sign(keys[0], data); err == nil {
+		t.Error("expected signing to fail while locked")
+	}
+	if err := client.Unlock([]byte("pw")); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if _, err := client.List(); err == nil {
+		t.Error("expected the client's connection to be closed by Stop")
+	}
+	if st := a.Status(); st.Running || len(st.Keys) != 0 {
+		t.Errorf("expected a stopped, empty agent, got %+v", st)
+	}
+	if _, err := os.Stat(st.Socket); !os.IsNotExist(err) {
+		t.Error("expected the socket to be removed")
+	}
+}
+
+func TestBuiltinAgentConfirm(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_rsa", Type: "rsa", Bits: 2048, Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	a, client := startBuiltinAgent(t, dir)
+	a.ConfirmTimeout = 200 * time.Millisecond
+	if err := a.AddKey("id_rsa", AgentAddOptions{Confirm: true}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	keys, _ := client.List()
+	requests, stop := a.Subscribe()
+	defer stop()
+
+	// Approved in the UI
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.SignWithFlags(keys[0], []byte("data"), agent.SignatureFlagRsaSha256)
+		done <- err
+	}()
+	req := <-requests
+	if req.Status != "pending" || req.Purpose != "other" {
+		t.Fatalf("expected a pending request, got %+v", req)
+	}
+	if len(req.ID) != 32 {
+		t.Errorf("expected a random 128-bit request ID, got %q", req.ID)
+	}
+	if err := a.Decide(req.ID, true); err != nil {
+		t.Fatalf("Decide failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected approved signature, got %v", err)
+	}
+	if req := <-requests; req.Status != "signed" {
+		t.Errorf("expected signed, got %+v", req)
+	}
+
+	// Denied, then left to time out
+	go func() {
+		_, err := client.Sign(keys[0], []byte("data"))
+		done <- err
+	}()
+	req = <-requests
+	a.Decide(req.ID, false)
+	if err := <-done; err == nil {
+		t.Error("expected denied signature to fail")
+	}
+	<-requests
+	if _, err := client.Sign(keys[0], []byte("data")); err == nil {
+		t.Error("expected unapproved signature to time out")
+	}
+	if log := a.Status().Log; len(log) != 3 || log[0].Status != "denied" || log[0].Reason != "not approved in time" {
+		t.Errorf("unexpected log %+v", log)
+	}
+}
+
+func TestBuiltinAgentHosts(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519", Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	webKey, _ := newTestSigner(t)
+	otherKey, _ := newTestSigner(t)
+	config := "Host web\n    HostName web.example.com\n\nHost db\n    HostName db.example.com\n    Port 2222\n"
+	os.WriteFile(dir.ConfigPath(), []byte(config), 0600)
+	knownHosts := "web.example.com " + string(gossh.MarshalAuthorizedKey(webKey.PublicKey())) +
+		"[db.example.com]:2222 " + string(gossh.MarshalAuthorizedKey(otherKey.PublicKey()))
+	os.WriteFile(dir.KnownHostsPath(), []byte(knownHosts), 0600)
+
+	a, client := startBuiltinAgent(t, dir)
+	if err := a.AddKey("id_ed25519", AgentAddOptions{Hosts: []string{"web"}}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	keys, _ := client.List()
+
+	// No session binding: the destination is unknown
+	if _, err := client.Sign(keys[0], loginData([]byte("s0"), "git")); err == nil {
+		t.Error("expected refusal without a session binding")
+	}
+
+	bindSession(t, client, webKey, []byte("s1"), false)
+	if _, err := client.Sign(keys[0], loginData([]byte("s1"), "git")); err != nil {
+		t.Errorf("expected signature for web, got %v", err)
+	}
+	bindSession(t, client, otherKey, []byte("s2"), false)
+	if _, err := client.Sign(keys[0], loginData([]byte("s2"), "git")); err == nil {
+		t.Error("expected refusal for db")
+	}
+
+	log := a.Status().Log
+	if len(log) != 3 {
+		t.Fatalf("expected 3 log entries, got %+v", log)
+	}
+	if log[0].Status != "refused" || len(log[0].Hosts) != 1 || log[0].Hosts[0] != "db" {
+		t.Errorf("unexpected db entry %+v", log[0])
+	}
+	if log[1].Status != "signed" || log[1].HostKey != gossh.FingerprintSHA256(webKey.PublicKey()) {
+		t.Errorf("unexpected web entry %+v", log[1])
+	}
+	if log[2].Status != "refused" || log[2].HostKey != "" {
+		t.Errorf("unexpected unbound entry %+v", log[2])
+	}
+
+	// A binding whose signature doesn't match the host key is rejected
+	sig, _ := otherKey.Sign(rand.Reader, []byte("s3"))
+	req := gossh.Marshal(sessionBind{HostKey: webKey.PublicKey().Marshal(), SessionID: []byte("s3"), Signature: gossh.Marshal(sig)})
+	if _, err := client.Extension("session-bind@openssh.com", req); err == nil {
+		t.Error("expected a forged session-bind to fail")
+	}
+}
+
+func TestBuiltinAgentHostsOnlyLogins(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519", Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	webKey, _ := newTestSigner(t)
+	otherKey, _ := newTestSigner(t)
+	os.WriteFile(dir.ConfigPath(), []byte("Host web\n    HostName web.example.com\n"), 0600)
+	os.WriteFile(dir.KnownHostsPath(), []byte("web.example.com "+string(gossh.MarshalAuthorizedKey(webKey.PublicKey()))), 0600)
+
+	a, client := startBuiltinAgent(t, dir)
+	if err := a.AddKey("id_ed25519", AgentAddOptions{Hosts: []string{"web"}}); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	keys, _ := client.List()
+	bindSession(t, client, webKey, []byte("s1"), false)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"sshsig", []byte("SSHSIG\x00\x00\x00\x03git")},
+		{"arbitrary", []byte("totally arbitrary")},
+	}
+	for _, tt := range tests {
+		if _, err := client.Sign(keys[0], tt.data); err == nil {
+			t.Errorf("%s: expected a host-limited key to refuse", tt.name)
+		}
+	}
+
+	// A login for an earlier session than the latest binding is refused,
+	// even though that session was for an allowed host
+	bindSession(t, client, otherKey, []byte("s2"), false)
+	if _, err := client.Sign(keys[0], loginData([]byte("s1"), "git")); err == nil {
+		t.Error("expected refusal for a session that isn't the latest")
+	}
+
+	// An agent forwarded through web is not web itself
+	bindSession(t, client, webKey, []byte("s3"), true)
+	if _, err := client.Sign(keys[0], loginData([]byte("s3"), "git")); err == nil {
+		t.Error("expected refusal over a forwarded agent")
+	}
+
+	bindSession(t, client, webKey, []byte("s4"), false)
+	if _, err := client.Sign(keys[0], loginData([]byte("s4"), "git")); err != nil {
+		t.Errorf("expected signature for web, got %v", err)
+	}
+
+	log := a.Status().Log
+	if len(log) != 5 {
+		t.Fatalf("expected 5 log entries, got %+v", log)
+	}
+	reasons := []string{
+		"key is limited to certain hosts and the agent was forwarded",
+		"key is limited to certain hosts and the login is not for the connection's latest session",
+		"key is limited to certain hosts and only signs logins",
+		"key is limited to certain hosts and only signs logins",
+	}
+	for i, want := range reasons {
+		if log[i+1].Status != "refused" || log[i+1].Reason != want {
+			t.Errorf("entry %d: expected refused with %q, got %+v", i+1, want, log[i+1])
+		}
+	}
+	if log[0].Status != "signed" {
+		t.Errorf("expected the last login signed, got %+v", log[0])
+	}
+}
@@ -0,0 +1,481 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrNotCA is returned when signing with a key that isn't marked as a CA.
+var ErrNotCA = errors.New("key is not marked as a certificate authority")
+
+// certCriticalOptions are the critical options OpenSSH understands. A
+// server refuses a certificate carrying any other.
+var certCriticalOptions = map[string]bool{
+	"force-command":   true,
+	"source-address":  true,
+	"verify-required": true,
+}
+
+// defaultUserExtensions are the permissions ssh-keygen gives user
+// certificates unless told otherwise.
+var defaultUserExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// CertExpiryWarning is how long before it expires a certificate is
+// flagged as expiring.
+const CertExpiryWarning = 7 * 24 * time.Hour
+
+// casMu serializes reads and writes of the CA list.
+var casMu sync.Mutex
+
+// CAsPath returns the file recording which keys are certificate
+// authorities.
+func CAsPath(dir *SSHDir) string {
+	return filepath.Join(dir.HistoryDir(), "cas.json")
+}
+
+// ListCAs returns the keys marked as certificate authorities, by name.
+// Markings for keys that have since been deleted are skipped.
+func ListCAs(dir *SSHDir) ([]model.CertAuthority, error) {
+	casMu.Lock()
+	marked, err := loadCAs(dir)
+	casMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cas := []model.CertAuthority{}
+	for name, added := range marked {
+		key, err := parseKeyPair(dir, name)
+		if err != nil || !key.HasPrivate {
+			continue
+		}
+		cas = append(cas, model.CertAuthority{
+			Name:        name,
+			Type:        key.Type,
+			Fingerprint: key.Fingerprint,
+			PublicKey:   key.PublicKey,
+			Added:       added,
+		})
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].Name < cas[j].Name })
+	return cas, nil
+}
+
+// MarkCA marks the key name as a certificate authority. It needs the
+// private key, since that is what signs.
+func MarkCA(dir *SSHDir, name string) error {
+	key, err := GetKey(dir, name)
+	if err != nil {
+		return err
+	}
+	if !key.HasPrivate {
+		return fmt.Errorf("key %s has no private key to sign with", name)
+	}
+	if key.Private != nil && key.Private.Format == "PuTTY" {
+		return fmt.Errorf("key %s is a PuTTY key; convert it to OpenSSH format first", name)
+	}
+
+	casMu.Lock()
+	defer casMu.Unlock()
+	marked, err := loadCAs(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := marked[name]; ok {
+		return nil
+	}
+	marked[name] = time.Now()
+	return saveCAs(dir, marked)
+}
+
+// UnmarkCA stops treating the key name as a certificate authority. The key
+// itself and the certificates it signed are left alone.
+func UnmarkCA(dir *SSHDir, name string) error {
+	casMu.Lock()
+	defer casMu.Unlock()
+	marked, err := loadCAs(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := marked[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotCA, name)
+	}
+	delete(marked, name)
+	return saveCAs(dir, marked)
+}
+
+// SignCert signs a user or host certificate for req.Key's public key (or
+// req.PublicKey) with the CA req.CA and writes it to Key-cert.pub, where ssh
+// picks it up alongside the key. An existing certificate is replaced.
+// It returns ErrPassphraseRequired or ErrWrongPassphrase when the CA key is
+// encrypted and req.Passphrase doesn't open it.
+func SignCert(dir *SSHDir, req model.CertRequest) (*model.Certificate, error) {
+	if req.Key == "" || filepath.Base(req.Key) != req.Key {
+		return nil, fmt.Errorf("invalid key name: %q", req.Key)
+	}
+	cert, err := newCertificate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key being certified
+	pubData := []byte(req.PublicKey)
+	if req.PublicKey == "" {
+		if pubData, err = os.ReadFile(dir.Path(req.Key + ".pub")); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("public key not found: %s.pub", req.Key)
+			}
+			return nil, fmt.Errorf("read public key: %w", err)
+		}
+	}
+	pub, comment, _, _, err := gossh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+	if _, ok := pub.(*gossh.Certificate); ok {
+		return nil, errors.New("cannot certify a certificate; give its key instead")
+	}
+	cert.Key = pub
+
+	signer, err := caSigner(dir, req.CA, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, fmt.Errorf("sign certificate: %w", err)
+	}
+
+	line := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(cert)))
+	if comment != "" {
+		line += " " + comment
+	}
+	if err := dir.EnsureDir(); err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(dir.Path(req.Key+"-cert.pub"), []byte(line+"\n"), 0644, keepMode); err != nil {
+		return nil, fmt.Errorf("write certificate: %w", err)
+	}
+	return certInfo(req.Key, cert, map[string]string{gossh.FingerprintSHA256(signer.PublicKey()): req.CA}, time.Now()), nil
+}
+
+// newCertificate checks req and builds the unsigned certificate it asks
+// for.
+func newCertificate(req model.CertRequest) (*gossh.Certificate, error) {
+	cert := &gossh.Certificate{
+		KeyId:           req.KeyID,
+		Serial:          req.Serial,
+		ValidPrincipals: req.Principals,
+		ValidBefore:     gossh.CertTimeInfinity,
+		Permissions: gossh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{},
+		},
+	}
+	if cert.KeyId == "" {
+		cert.KeyId = req.Key
+	}
+	if len(req.Principals) == 0 {
+		return nil, errors.New("at least one principal is required")
+	}
+	for _, p := range req.Principals {
+		if p == "" || strings.ContainsAny(p, " \t,") {
+			return nil, fmt.Errorf("invalid principal: %q", p)
+		}
+	}
+
+	if !req.ValidAfter.IsZero() {
+		cert.ValidAfter = uint64(req.ValidAfter.Unix())
+	}
+	if !req.ValidBefore.IsZero() {
+		cert.ValidBefore = uint64(req.ValidBefore.Unix())
+		if cert.ValidBefore <= cert.ValidAfter {
+			return nil, errors.New("validity ends before it starts")
+		}
+	}
+
+	switch req.Type {
+	case "user":
+		cert.CertType = gossh.UserCert
+		exts := req.Extensions
+		if exts == nil {
+			exts = defaultUserExtensions
+		}
+		for _, e := range exts {
+			cert.Extensions[e] = ""
+		}
+	case "host":
+		cert.CertType = gossh.HostCert
+		if len(req.Extensions) > 0 || len(req.CriticalOptions) > 0 {
+			return nil, errors.New("host certificates take no critical options or extensions")
+		}
+	default:
+		return nil, fmt.Errorf("unknown certificate type %q: use user or host", req.Type)
+	}
+
+	for opt, value := range req.CriticalOptions {
+		if !certCriticalOptions[opt] {
+			return nil, fmt.Errorf("unsupported critical option %q", opt)
+		}
+		switch opt {
+		case "force-command":
+			if value == "" {
+				return nil, errors.New("force-command needs a command")
+			}
+		case "source-address":
+			if err := checkSourceAddress(value); err != nil {
+				return nil, err
+			}
+		case "verify-required":
+			value = ""
+		}
+		cert.CriticalOptions[opt] = value
+	}
+	return cert, nil
+}
+
+// checkSourceAddress checks a source-address option: a comma-separated list
+// of addresses and CIDR ranges.
+func checkSourceAddress(value string) error {
+	if value == "" {
+		return errors.New("source-address needs at least one address")
+	}
+	for _, a := range strings.Split(value, ",") {
+		if net.ParseIP(a) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			return fmt.Errorf("invalid source-address %q: use addresses or CIDR ranges", a)
+		}
+	}
+	return nil
+}
+
+// caSigner decrypts the CA key name into a signer. RSA CAs sign with
+// rsa-sha2-512, as ssh-keygen does.
+func caSigner(dir *SSHDir, name, passphrase string) (gossh.Signer, error) {
+	casMu.Lock()
+	marked, err := loadCAs(dir)
+	casMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := marked[name]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotCA, name)
+	}
+
+	data, err := os.ReadFile(dir.Path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("private key not found: %s", name)
+		}
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+	key, err := decryptPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("CA key %s cannot sign: %w", name, err)
+	}
+	if as, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		return gossh.NewSignerWithAlgorithms(as, []string{gossh.KeyAlgoRSASHA512})
+	}
+	return signer, nil
+}
+
+// ListCerts returns the certificates in the SSH directory, named after the
+// key each belongs to.
+func ListCerts(dir *SSHDir) ([]model.Certificate, error) {
+	entries, err := os.ReadDir(dir.Base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read ssh dir: %w", err)
+	}
+	cas := caNames(dir)
+	now := time.Now()
+
+	var certs []model.Certificate
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), "-cert.pub")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		cert, err := readCert(dir, name)
+		if err != nil {
+			continue // skip files that aren't certificates
+		}
+		certs = append(certs, *certInfo(name, cert, cas, now))
+	}
+	return certs, nil
+}
+
+// GetCert returns the certificate for the key name, read from
+// name-cert.pub.
+func GetCert(dir *SSHDir, name string) (*model.Certificate, error) {
+	cert, err := readCert(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return certInfo(name, cert, caNames(dir), time.Now()), nil
+}
+
+// DeleteCert removes the certificate for the key name, leaving the key.
+func DeleteCert(dir *SSHDir, name string) error {
+	if _, err := readCert(dir, name); err != nil {
+		return err
+	}
+	if err := os.Remove(dir.Path(name + "-cert.pub")); err != nil {
+		return fmt.Errorf("delete certificate: %w", err)
+	}
+	return nil
+}
+
+func readCert(dir *SSHDir, name string) (*gossh.Certificate, error) {
+	data, err := os.ReadFile(dir.Path(name + "-cert.pub"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("certificate not found: %s", name)
+		}
+		return nil, fmt.Errorf("read certificate: %w", err)
+	}
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", name)
+	}
+	return cert, nil
+}
+
+// caNames maps the fingerprint of each marked CA to its name, so
+// certificates can name the CA that signed them.
+func caNames(dir *SSHDir) map[string]string {
+	names := make(map[string]string)
+	cas, err := ListCAs(dir)
+	if err != nil {
+		return names
+	}
+	for _, ca := range cas {
+		names[ca.Fingerprint] = ca.Name
+	}
+	return names
+}
+
+// certInfo describes cert, checking its validity window against now.
+func certInfo(name string, cert *gossh.Certificate, cas map[string]string, now time.Time) *model.Certificate {
+	c := &model.Certificate{
+		Name:          name,
+		Type:          "user",
+		KeyType:       keyTypeLabel(cert),
+		KeyID:         cert.KeyId,
+		Serial:        cert.Serial,
+		Principals:    cert.ValidPrincipals,
+		Fingerprint:   gossh.FingerprintSHA256(cert.Key),
+		CAFingerprint: gossh.FingerprintSHA256(cert.SignatureKey),
+		Status:        "valid",
+	}
+	if cert.CertType == gossh.HostCert {
+		c.Type = "host"
+	}
+	if c.Principals == nil {
+		c.Principals = []string{}
+	}
+	c.CA = cas[c.CAFingerprint]
+	if len(cert.CriticalOptions) > 0 {
+		c.CriticalOptions = cert.CriticalOptions
+	}
+	for e := range cert.Extensions {
+		c.Extensions = append(c.Extensions, e)
+	}
+	sort.Strings(c.Extensions)
+
+	if cert.ValidAfter != 0 {
+		c.ValidAfter = time.Unix(int64(cert.ValidAfter), 0)
+	}
+	if cert.ValidBefore != gossh.CertTimeInfinity {
+		c.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	switch {
+	case now.Before(c.ValidAfter):
+		c.Status = "not yet valid"
+	case !c.ValidBefore.IsZero() && !now.Before(c.ValidBefore):
+		c.Status = "expired"
+	case !c.ValidBefore.IsZero() && c.ValidBefore.Sub(now) < CertExpiryWarning:
+		c.Status = "expiring"
+	}
+	return c
+}
+
+// isCertOf reports whether name-cert.pub is a certificate and name is a key
+// it belongs with.
+func isCertOf(dir *SSHDir, name string) bool {
+	if !fileExists(dir.Path(name+".pub")) && !looksLikePrivateKey(dir.Path(name)) {
+		return false
+	}
+	_, err := readCert(dir, name)
+	return err == nil
+}
+
+// nameCertCAs fills in the name of the signing CA on the certificates of
+// keys, where it is a key marked here.
+func nameCertCAs(dir *SSHDir, keys []model.SSHKey) {
+	var cas map[string]string
+	for i := range keys {
+		if keys[i].Certificate == nil {
+			continue
+		}
+		if cas == nil {
+			cas = caNames(dir)
+		}
+		keys[i].Certificate.CA = cas[keys[i].Certificate.CAFingerprint]
+	}
+}
+
+func saveCAs(dir *SSHDir, marked map[string]time.Time) error {
+	if err := os.MkdirAll(dir.HistoryDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(marked)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(CAsPath(dir), data, 0600, keepMode)
+}
+
+func loadCAs(dir *SSHDir) (map[string]time.Time, error) {
+	marked := make(map[string]time.Time)
+	data, err := os.ReadFile(CAsPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return marked, nil
+		}
+		return nil, fmt.Errorf("read CA list: %w", err)
+	}
+	if err := json.Unmarshal(data, &marked); err != nil {
+		return nil, fmt.Errorf("parse CA list: %w", err)
+	}
+	return marked, nil
+}
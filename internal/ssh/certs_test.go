@@ -0,0 +1,281 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestCA generates a key named ca in dir, encrypted with passphrase when
+// it's not empty, and marks it as a CA.
+func newTestCA(t *testing.T, dir *SSHDir, keyType, passphrase string) gossh.PublicKey {
+	t.Helper()
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "ca", Type: keyType, Bits: 2048, Comment: "ca@test", Passphrase: passphrase}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if err := MarkCA(dir, "ca"); err != nil {
+		t.Fatalf("MarkCA failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.Path("ca.pub"))
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatalf("parse CA key failed: %v", err)
+	}
+	return pub
+}
+
+// checkCert reads name-cert.pub and verifies it was signed by ca for
+// principal.
+func checkCert(t *testing.T, dir *SSHDir, name string, ca gossh.PublicKey, principal string) *gossh.Certificate {
+	t.Helper()
+	cert, err := readCert(dir, name)
+	if err != nil {
+		t.Fatalf("readCert failed: %v", err)
+	}
+	if !bytes.Equal(cert.SignatureKey.Marshal(), ca.Marshal()) {
+		t.Errorf("expected cert signed by the CA")
+	}
+	checker := &gossh.CertChecker{SupportedCriticalOptions: []string{"force-command", "verify-required"}}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		t.Errorf("CheckCert failed: %v", err)
+	}
+	return cert
+}
+
+func TestSignUserCert(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	ca := newTestCA(t, dir, "ed25519", "secret")
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519", Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	req := model.CertRequest{
+		CA:          "ca",
+		Key:         "id_ed25519",
+		Type:        "user",
+		Principals:  []string{"deploy", "root"},
+		Serial:      42,
+		ValidAfter:  time.Now().Add(-time.Minute),
+		ValidBefore: time.Now().Add(30 * 24 * time.Hour),
+		CriticalOptions: map[string]string{
+			"force-command":  "/usr/bin/uptime",
+			"source-address": "10.0.0.0/8,192.168.1.5",
+		},
+	}
+	if _, err := SignCert(dir, req); err != ErrPassphraseRequired {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	req.Passphrase = "wrong"
+	if _, err := SignCert(dir, req); err != ErrWrongPassphrase {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	req.Passphrase = "secret"
+	info, err := SignCert(dir, req)
+	if err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	if info.Type != "user" || info.CA != "ca" || info.KeyID != "id_ed25519" || info.Status != "valid" || info.KeyType != "ED25519-CERT" {
+		t.Errorf("unexpected cert info %+v", info)
+	}
+	if len(info.Extensions) != len(defaultUserExtensions) {
+		t.Errorf("expected default extensions, got %v", info.Extensions)
+	}
+
+	cert := checkCert(t, dir, "id_ed25519", ca, "deploy")
+	if cert.CertType != gossh.UserCert || cert.Serial != 42 {
+		t.Errorf("unexpected cert %+v", cert)
+	}
+	if cert.CriticalOptions["force-command"] != "/usr/bin/uptime" || cert.CriticalOptions["source-address"] != "10.0.0.0/8,192.168.1.5" {
+		t.Errorf("unexpected critical options %v", cert.CriticalOptions)
+	}
+	if err := (&gossh.CertChecker{SupportedCriticalOptions: []string{"force-command"}}).CheckCert("admin", cert); err == nil {
+		t.Error("expected cert to be refused for another principal")
+	}
+	data, _ := os.ReadFile(dir.Path("id_ed25519-cert.pub"))
+	if !strings.HasPrefix(string(data), "ssh-ed25519-cert-v01@openssh.com ") || !strings.HasSuffix(string(data), " me@test\n") {
+		t.Errorf("unexpected cert file %q", data)
+	}
+
+	// No extensions at all, overwriting the first cert
+	req.Extensions = []string{}
+	req.CriticalOptions = nil
+	if info, err = SignCert(dir, req); err != nil || len(info.Extensions) != 0 {
+		t.Errorf("expected a cert without extensions, got %+v %v", info, err)
+	}
+}
+
+func TestSignHostCert(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	ca := newTestCA(t, dir, "rsa", "")
+	host, _ := newTestSigner(t)
+
+	info, err := SignCert(dir, model.CertRequest{
+		CA:         "ca",
+		Key:        "ssh_host_ed25519_key",
+		PublicKey:  string(gossh.MarshalAuthorizedKey(host.PublicKey())),
+		Type:       "host",
+		KeyID:      "web",
+		Principals: []string{"web.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	if info.Type != "host" || len(info.Extensions) != 0 || !info.ValidBefore.IsZero() || info.Fingerprint != gossh.FingerprintSHA256(host.PublicKey()) {
+		t.Errorf("unexpected cert info %+v", info)
+	}
+	cert := checkCert(t, dir, "ssh_host_ed25519_key", ca, "web.example.com")
+	if cert.CertType != gossh.HostCert || cert.Signature.Format != gossh.KeyAlgoRSASHA512 {
+		t.Errorf("expected an rsa-sha2-512 host cert, got %v %s", cert.CertType, cert.Signature.Format)
+	}
+
+	// A client trusting the CA accepts the host
+	checker := &gossh.CertChecker{IsHostAuthority: func(auth gossh.PublicKey, _ string) bool {
+		return bytes.Equal(auth.Marshal(), ca.Marshal())
+	}}
+	if err := checker.CheckHostKey("web.example.com:22", nil, cert); err != nil {
+		t.Errorf("CheckHostKey failed: %v", err)
+	}
+}
+
+func TestSignCertErrors(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	newTestCA(t, dir, "ed25519", "")
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	valid := model.CertRequest{CA: "ca", Key: "id_ed25519", Type: "user", Principals: []string{"me"}}
+
+	tests := []struct {
+		name   string
+		modify func(*model.CertRequest)
+	}{
+		{"not a CA", func(r *model.CertRequest) { r.CA = "id_ed25519" }},
+		{"no principals", func(r *model.CertRequest) { r.Principals = nil }},
+		{"bad principal", func(r *model.CertRequest) { r.Principals = []string{"a b"} }},
+		{"bad type", func(r *model.CertRequest) { r.Type = "both" }},
+		{"bad key name", func(r *model.CertRequest) { r.Key = "../id_ed25519" }},
+		{"missing key", func(r *model.CertRequest) { r.Key = "nope" }},
+		{"unknown option", func(r *model.CertRequest) { r.CriticalOptions = map[string]string{"no-pty": ""} }},
+		{"empty command", func(r *model.CertRequest) { r.CriticalOptions = map[string]string{"force-command": ""} }},
+		{"bad source", func(r *model.CertRequest) { r.CriticalOptions = map[string]string{"source-address": "10.0.0.0/33"} }},
+		{"host extensions", func(r *model.CertRequest) { r.Type = "host"; r.Extensions = []string{"permit-pty"} }},
+		{"backwards validity", func(r *model.CertRequest) {
+			r.ValidAfter = time.Now()
+			r.ValidBefore = time.Now().Add(-time.Hour)
+		}},
+	}
+	for _, tt := range tests {
+		req := valid
+		tt.modify(&req)
+		if _, err := SignCert(dir, req); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if _, err := os.Stat(dir.Path("id_ed25519-cert.pub")); !os.IsNotExist(err) {
+		t.Error("expected no cert written")
+	}
+	if _, err := SignCert(dir, model.CertRequest{CA: "id_ed25519", Key: "ca", Type: "user", Principals: []string{"me"}}); !errors.Is(err, ErrNotCA) {
+		t.Errorf("expected ErrNotCA, got %v", err)
+	}
+}
+
+func TestListCerts(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	newTestCA(t, dir, "ed25519", "")
+	for _, name := range []string{"id_a", "id_b"} {
+		if err := GenerateKey(dir, model.KeyGenRequest{Name: name, Type: "ed25519"}); err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if _, err := SignCert(dir, model.CertRequest{CA: "ca", Key: "id_a", Type: "user", Principals: []string{"me"}, ValidAfter: past, ValidBefore: past.Add(time.Hour)}); err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	if _, err := SignCert(dir, model.CertRequest{CA: "ca", Key: "id_b", Type: "user", Principals: []string{"me"}, ValidAfter: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	os.WriteFile(dir.Path("junk-cert.pub"), []byte("not a cert\n"), 0644)
+
+	certs, err := ListCerts(dir)
+	if err != nil {
+		t.Fatalf("ListCerts failed: %v", err)
+	}
+	if len(certs) != 2 || certs[0].Name != "id_a" || certs[1].Name != "id_b" {
+		t.Fatalf("expected certs for id_a and id_b, got %+v", certs)
+	}
+	if certs[0].Status != "expired" || certs[1].Status != "not yet valid" || certs[0].CA != "ca" {
+		t.Errorf("unexpected statuses %+v", certs)
+	}
+
+	// Unmarking the CA keeps its certs but no longer names it
+	if err := UnmarkCA(dir, "ca"); err != nil {
+		t.Fatalf("UnmarkCA failed: %v", err)
+	}
+	if cas, _ := ListCAs(dir); len(cas) != 0 {
+		t.Errorf("expected no CAs, got %+v", cas)
+	}
+	cert, err := GetCert(dir, "id_a")
+	if err != nil || cert.CA != "" || cert.CAFingerprint == "" {
+		t.Errorf("unexpected cert %+v %v", cert, err)
+	}
+
+	if err := DeleteCert(dir, "id_a"); err != nil {
+		t.Fatalf("DeleteCert failed: %v", err)
+	}
+	if !fileExists(dir.Path("id_a")) || fileExists(dir.Path("id_a-cert.pub")) {
+		t.Error("expected the cert deleted and the key kept")
+	}
+	if err := DeleteCert(dir, "junk"); err == nil {
+		t.Error("expected an error deleting a file that isn't a cert")
+	}
+}
+
+func TestListKeysCertificates(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	newTestCA(t, dir, "ed25519", "")
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_ed25519", Type: "ed25519"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if _, err := SignCert(dir, model.CertRequest{CA: "ca", Key: "id_ed25519", Type: "user", Principals: []string{"me"}, ValidBefore: time.Now().Add(24 * time.Hour)}); err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	// A certificate whose key isn't in the SSH dir
+	other, _ := newTestSigner(t)
+	if _, err := SignCert(dir, model.CertRequest{CA: "ca", Key: "lost", PublicKey: string(gossh.MarshalAuthorizedKey(other.PublicKey())), Type: "host", Principals: []string{"web"}}); err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+
+	keys, err := ListKeys(dir)
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	byName := make(map[string]model.SSHKey)
+	for _, k := range keys {
+		byName[k.Name] = k
+	}
+	if len(keys) != 3 || byName["id_ed25519-cert"].Name != "" {
+		t.Fatalf("expected ca, id_ed25519 and lost-cert, got %+v", keys)
+	}
+	if byName["ca"].Certificate != nil {
+		t.Error("expected no certificate on the CA key")
+	}
+	cert := byName["id_ed25519"].Certificate
+	if cert == nil || cert.Status != "expiring" || cert.CA != "ca" || cert.Fingerprint != byName["id_ed25519"].Fingerprint {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+	lost := byName["lost-cert"]
+	if lost.Certificate == nil || lost.Certificate.Type != "host" || lost.Certificate.CA != "ca" {
+		t.Errorf("expected the lone certificate inspected, got %+v", lost)
+	}
+
+	key, err := GetKey(dir, "id_ed25519")
+	if err != nil || key.Certificate == nil || key.Certificate.CA != "ca" {
+		t.Errorf("expected GetKey to include the certificate, got %+v %v", key, err)
+	}
+}
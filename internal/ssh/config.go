@@ -11,65 +11,65 @@ import (
 	"strings"
 
 	"github.com/holden/sshmasher/internal/model"
-	sshconfig "github.com/kevinburke/ssh_config"
 )
 
-// ListHosts parses the SSH config and returns all host entries.
+// ListHosts parses the SSH config, following Include directives, and returns
+// all host entries tagged with the file and line they were found on.
 func ListHosts(dir *SSHDir) ([]model.HostEntry, error) {
-	f, err := os.Open(dir.ConfigPath())
+	root, err := LoadConfigTree(dir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("open config: %w", err)
-	}
-	defer f.Close()
-
-	cfg, err := sshconfig.Decode(f)
-	if err != nil {
-		return nil, fmt.Errorf("parse config: %w", err)
+		return nil, err
 	}
+	return listHosts(dir, root), nil
+}
 
+// listHosts returns the host entries of an already loaded config tree.
+func listHosts(dir *SSHDir, root *ConfigFile) []model.HostEntry {
 	var hosts []model.HostEntry
-	for _, host := range cfg.Hosts {
-		patterns := host.Patterns
-		if len(patterns) == 0 {
-			continue
-		}
-
-		alias := patterns[0].String()
-		if alias == "*" {
-			continue // skip global wildcard
-		}
+	for _, cfg := range root.Files() {
+		for _, block := range cfg.Blocks() {
+			if !block.IsHost() {
+				continue
+			}
+			patterns := block.Patterns()
+			if len(patterns) == 0 {
+				continue
+			}
 
-		entry := model.HostEntry{
-			Alias:   alias,
-			Options: make(map[string]string),
-		}
+			alias := patterns[0]
+			if alias == "*" {
+				continue // skip global wildcard
+			}
 
-		for _, node := range host.Nodes {
-			kv, ok := node.(*sshconfig.KV)
-			if !ok {
-				continue
+			entry := model.HostEntry{
+				Alias: alias,
+				File:  dir.RelPath(cfg.Path),
+				Line:  cfg.LineNumber(block.Header),
 			}
-			switch strings.ToLower(kv.Key) {
-			case "hostname":
-				entry.HostName = kv.Value
-			case "user":
-				entry.User = kv.Value
-			case "port":
-				entry.Port = kv.Value
-			case "identityfile":
-				entry.IdentityFile = kv.Value
-			default:
-				entry.Options[kv.Key] = kv.Value
+
+			for _, kv := range block.Directives() {
+				switch strings.ToLower(kv.Key) {
+				case "hostname":
+					entry.HostName = kv.Value
+				case "user":
+					entry.User = kv.Value
+				case "port":
+					entry.Port = kv.Value
+				case "identityfile":
+					if entry.IdentityFile == "" {
+						entry.IdentityFile = kv.Value
+						continue
+					}
+					entry.Options = append(entry.Options, model.HostOption{Key: kv.Key, Value: kv.Value})
+				default:
+					entry.Options = append(entry.Options, model.HostOption{Key: kv.Key, Value: kv.Value})
+				}
 			}
-		}
 
-		hosts = append(hosts, entry)
+			hosts = append(hosts, entry)
+		}
 	}
-
-	return hosts, nil
+	return hosts
 }
 
 // GetHost returns a single host entry by alias.
@@ -86,44 +86,99 @@ func GetHost(dir *SSHDir, alias string) (*model.HostEntry, error) {
 	return nil, fmt.Errorf("host not found: %s", alias)
 }
 
-// AddHost appends a new host block to the SSH config file.
+// AddHost appends a new host block to host.File, or to the main config
+// when no file is given, in that file's indentation and line endings.
 func AddHost(dir *SSHDir, host model.HostEntry) error {
 	if err := dir.EnsureDir(); err != nil {
 		return err
 	}
 
-	block := formatHostBlock(host)
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return err
+	}
+	cfg, err := configFileIn(dir, root, host.File)
+	if err != nil {
+		return err
+	}
+	cfg.AppendBlock("Host "+host.Alias, hostDirectives(host))
+	return cfg.Save()
+}
 
-	f, err := os.OpenFile(dir.ConfigPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+// UpdateHost rewrites a host block in place, in whichever config file
+// defines it. Only the directives that change are touched; comments,
+// indentation and every other block are preserved byte for byte.
+// If host.File names a different config file, the block is moved there.
+// If version is not empty and the config tree no longer matches it (see
+// ConfigVersion), ErrConflict is returned.
+func UpdateHost(dir *SSHDir, host model.HostEntry, version string) error {
+	root, err := LoadConfigTree(dir)
 	if err != nil {
-		return fmt.Errorf("open config: %w", err)
+		return err
+	}
+	if version != "" && treeVersion(root) != version {
+		return ErrConflict
+	}
+	cfg, err := hostFileIn(root, host.Alias)
+	if err != nil {
+		return err
 	}
-	defer f.Close()
 
-	_, err = f.WriteString(block)
-	return err
+	if err := cfg.UpdateHost(host); err != nil {
+		return err
+	}
+	if host.File != "" && dir.ExpandPath(host.File) != cfg.Path {
+		return moveHost(dir, root, cfg, host)
+	}
+	return cfg.Save()
 }
 
-// UpdateHost replaces a host block in the config file.
-func UpdateHost(dir *SSHDir, host model.HostEntry) error {
-	content, err := os.ReadFile(dir.ConfigPath())
+// moveHost moves the already updated block for host from its file to
+// host.File, line for line, so its comments, extra patterns and layout come
+// along. The removal is saved first, and put back if saving the target
+// fails, so a failed move never leaves the host in both files.
+func moveHost(dir *SSHDir, root, from *ConfigFile, host model.HostEntry) error {
+	to, err := configFileIn(dir, root, host.File)
 	if err != nil {
-		return fmt.Errorf("read config: %w", err)
+		return err
+	}
+	b := from.FindHost(host.Alias)
+	if b == nil {
+		return fmt.Errorf("host not found: %s", host.Alias)
 	}
+	to.appendLines(from.removeBlock(b))
 
-	updated := replaceHostBlock(string(content), host.Alias, formatHostBlock(host))
-	return os.WriteFile(dir.ConfigPath(), []byte(updated), 0600)
+	original, _ := os.ReadFile(from.Path)
+	if err := from.Save(); err != nil {
+		return err
+	}
+	if err := to.Save(); err != nil {
+		if rerr := WriteFile(from.Path, original, 0600, from.Version); rerr != nil {
+			return fmt.Errorf("%w (and restoring %s failed: %v)", err, dir.RelPath(from.Path), rerr)
+		}
+		return err
+	}
+	return nil
 }
 
-// DeleteHost removes a host block from the config file.
-func DeleteHost(dir *SSHDir, alias string) error {
-	content, err := os.ReadFile(dir.ConfigPath())
+// DeleteHost removes a host block from whichever config file defines it.
+// A stale version fails with ErrConflict, as for UpdateHost.
+func DeleteHost(dir *SSHDir, alias, version string) error {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return err
+	}
+	if version != "" && treeVersion(root) != version {
+		return ErrConflict
+	}
+	cfg, err := hostFileIn(root, alias)
 	if err != nil {
-		return fmt.Errorf("read config: %w", err)
+		return err
 	}
-
-	updated := replaceHostBlock(string(content), alias, "")
-	return os.WriteFile(dir.ConfigPath(), []byte(updated), 0600)
+	if err := cfg.RemoveHost(alias); err != nil {
+		return err
+	}
+	return cfg.Save()
 }
 
 // WriteConfig overwrites the SSH config file with the given content.
@@ -131,79 +186,111 @@ func WriteConfig(dir *SSHDir, content string) error {
 	if err := dir.EnsureDir(); err != nil {
 		return err
 	}
-	return os.WriteFile(dir.ConfigPath(), []byte(content), 0600)
+	return WriteFile(dir.ConfigPath(), []byte(content), 0600, "")
 }
 
-func formatHostBlock(host model.HostEntry) string {
-	var b strings.Builder
-	b.WriteString(fmt.Sprintf("\nHost %s\n", host.Alias))
-	if host.HostName != "" {
-		b.WriteString(fmt.Sprintf("    HostName %s\n", host.HostName))
-	}
-	if host.User != "" {
-		b.WriteString(fmt.Sprintf("    User %s\n", host.User))
+// WriteConfigFile overwrites the main config or one of its included files.
+// A non-empty version makes the write fail with ErrConflict if the file no
+// longer has that FileVersion.
+func WriteConfigFile(dir *SSHDir, file, content, version string) error {
+	if err := dir.EnsureDir(); err != nil {
+		return err
 	}
-	if host.Port != "" {
-		b.WriteString(fmt.Sprintf("    Port %s\n", host.Port))
+	path, err := ConfigFilePath(dir, file)
+	if err != nil {
+		return err
 	}
-	if host.IdentityFile != "" {
-		b.WriteString(fmt.Sprintf("    IdentityFile %s\n", host.IdentityFile))
+	return WriteFile(path, []byte(content), 0600, version)
+}
+
+// hostDirectives lists the directives of a new block for host: its fields,
+// then its options in order. Empty values are left out.
+func hostDirectives(host model.HostEntry) [][2]string {
+	var directives [][2]string
+	for _, d := range [][2]string{
+		{"HostName", host.HostName},
+		{"User", host.User},
+		{"Port", host.Port},
+		{"IdentityFile", host.IdentityFile},
+	} {
+		if d[1] != "" {
+			directives = append(directives, d)
+		}
 	}
-	for k, v := range host.Options {
-		b.WriteString(fmt.Sprintf("    %s %s\n", k, v))
+	for _, o := range host.Options {
+		switch strings.ToLower(o.Key) {
+		case "hostname", "user", "port":
+			continue
+		}
+		if o.Value != "" {
+			directives = append(directives, [2]string{o.Key, o.Value})
+		}
 	}
-	return b.String()
+	return directives
 }
 
-// replaceHostBlock finds the "Host <alias>" block in content and replaces it with replacement.
-// If replacement is empty, the block is removed.
-// Handles multi-pattern Host lines like "Host foo bar" by checking if alias matches any pattern.
-func replaceHostBlock(content, alias, replacement string) string {
-	lines := strings.Split(content, "\n")
-	var result []string
-	inBlock := false
+// optionKeys returns the distinct keywords in opts in order of first
+// appearance, leaving out those that HostEntry carries as fields.
+func optionKeys(opts []model.HostOption) []string {
+	var keys []string
+	for _, k := range directiveKeys(opts) {
+		switch strings.ToLower(k) {
+		case "hostname", "user", "port", "identityfile":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
 
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		if strings.HasPrefix(trimmed, "Host ") {
-			blockPatterns := strings.TrimSpace(strings.TrimPrefix(trimmed, "Host "))
-			patterns := strings.Fields(blockPatterns)
-			aliasMatched := false
-			for _, p := range patterns {
-				if p == alias {
-					aliasMatched = true
-					break
-				}
+// directiveKeys returns the distinct keywords in opts in order of first
+// appearance, compared case-insensitively as ssh does.
+func directiveKeys(opts []model.HostOption) []string {
+	var keys []string
+	for _, o := range opts {
+		seen := false
+		for _, k := range keys {
+			if strings.EqualFold(k, o.Key) {
+				seen = true
+				break
 			}
+		}
+		if !seen {
+			keys = append(keys, o.Key)
+		}
+	}
+	return keys
+}
 
-			if aliasMatched {
-				inBlock = true
-				continue
-			} else if inBlock {
-				inBlock = false
-				if replacement != "" {
-					result = append(result, strings.TrimSpace(replacement))
-					result = append(result, "")
-					replacement = ""
-				}
+// optionValues returns the non-empty values for key in opts, in order, and
+// whether key was named at all.
+func optionValues(opts []model.HostOption, key string) ([]string, bool) {
+	var values []string
+	named := false
+	for _, o := range opts {
+		if strings.EqualFold(o.Key, key) {
+			named = true
+			if o.Value != "" {
+				values = append(values, o.Value)
 			}
-		} else if inBlock && strings.HasPrefix(trimmed, "Host ") {
-			inBlock = false
 		}
+	}
+	return values, named
+}
 
-		if inBlock {
+// ParseHostOptions parses "Key value" lines (as typed into an editor) into an
+// ordered option list, keeping repeated keywords. Blank lines and comments
+// are ignored.
+func ParseHostOptions(text string) []model.HostOption {
+	var opts []model.HostOption
+	for _, raw := range strings.Split(text, "\n") {
+		l := parseConfigLine(strings.TrimRight(raw, "\r"))
+		if l.Key == "" || l.Value == "" {
 			continue
 		}
-
-		result = append(result, line)
-	}
-
-	if inBlock && replacement != "" {
-		result = append(result, strings.TrimSpace(replacement))
+		opts = append(opts, model.HostOption{Key: l.Key, Value: l.Value})
 	}
-
-	return strings.Join(result, "\n")
+	return opts
 }
 
 // KeyRefCount returns a map of key names to the number of config entries that reference them.
@@ -218,6 +305,10 @@ func KeyRefCount(dir *SSHDir) (map[string]int, error) {
 		if host.IdentityFile != "" {
 			refCount[host.IdentityFile]++
 		}
+		extra, _ := optionValues(host.Options, "IdentityFile")
+		for _, f := range extra {
+			refCount[f]++
+		}
 	}
 	return refCount, nil
 }
@@ -412,35 +503,19 @@ func getLinuxTerminal() string {
 
 // getTerminalFromConfig reads terminal preference from ~/.config/sshmasher/config
 func getTerminalFromConfig() string {
-	home, err := os.UserHomeDir()
+	cfg, err := LoadAppConfig()
 	if err != nil {
+		log.Printf("[DEBUG] Error reading config file: %v", err)
 		return ""
 	}
-	
-	configPath := filepath.Join(home, ".config", "sshmasher", "config")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("[DEBUG] Error reading config file: %v", err)
-		}
+	if cfg.Terminal == "" {
 		return ""
 	}
-	
-	// Parse config file looking for terminal= setting
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "terminal=") {
-			term := strings.TrimPrefix(line, "terminal=")
-			term = strings.TrimSpace(term)
-			// Verify the terminal exists
-			if _, err := exec.LookPath(term); err == nil {
-				return term
-			}
-			log.Printf("[DEBUG] Config specifies terminal '%s' but it's not in PATH", term)
-		}
+	// Verify the terminal exists
+	if _, err := exec.LookPath(cfg.Terminal); err == nil {
+		return cfg.Terminal
 	}
-	
+	log.Printf("[DEBUG] Config specifies terminal '%s' but it's not in PATH", cfg.Terminal)
 	return ""
 }
 
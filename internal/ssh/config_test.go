@@ -1,7 +1,9 @@
 package ssh
 
 import (
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/holden/sshmasher/internal/model"
@@ -85,6 +87,20 @@ func TestAddHost(t *testing.T) {
 	}
 }
 
+func TestAddHostKeepsLineEndings(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host old\r\n\tHostName old.example.com\r\n"), 0600)
+
+	if err := AddHost(dir, model.HostEntry{Alias: "new", HostName: "new.example.com", User: "me"}); err != nil {
+		t.Fatalf("AddHost failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	want := "Host old\r\n\tHostName old.example.com\r\n\r\nHost new\r\n\tHostName new.example.com\r\n\tUser me\r\n"
+	if string(data) != want {
+		t.Fatalf("unexpected config:\n%q", data)
+	}
+}
+
 func TestGetHost(t *testing.T) {
 	dir := NewSSHDir(t.TempDir())
 	configContent := `Host target
@@ -123,7 +139,7 @@ Host remove
 `
 	os.WriteFile(dir.ConfigPath(), []byte(configContent), 0600)
 
-	if err := DeleteHost(dir, "remove"); err != nil {
+	if err := DeleteHost(dir, "remove", ""); err != nil {
 		t.Fatalf("DeleteHost failed: %v", err)
 	}
 
@@ -139,6 +155,33 @@ Host remove
 	}
 }
 
+func TestHostEditsRejectStaleVersion(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host web\n    HostName web.example.com\n"), 0600)
+
+	version, err := ConfigVersion(dir)
+	if err != nil {
+		t.Fatalf("ConfigVersion failed: %v", err)
+	}
+	os.WriteFile(dir.ConfigPath(), []byte("Host web\n    HostName other.example.com\n"), 0600)
+
+	if err := UpdateHost(dir, model.HostEntry{Alias: "web", HostName: "new.example.com"}, version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateHost with a stale version = %v, want ErrConflict", err)
+	}
+	if err := DeleteHost(dir, "web", version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("DeleteHost with a stale version = %v, want ErrConflict", err)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	if !strings.Contains(string(data), "other.example.com") {
+		t.Fatalf("config changed despite the conflict:\n%s", data)
+	}
+
+	version, _ = ConfigVersion(dir)
+	if err := UpdateHost(dir, model.HostEntry{Alias: "web", HostName: "new.example.com"}, version); err != nil {
+		t.Fatalf("UpdateHost with the current version failed: %v", err)
+	}
+}
+
 func TestUpdateHost(t *testing.T) {
 	dir := NewSSHDir(t.TempDir())
 	configContent := `Host edit
@@ -154,7 +197,7 @@ func TestUpdateHost(t *testing.T) {
 		Port:     "2222",
 	}
 
-	if err := UpdateHost(dir, updated); err != nil {
+	if err := UpdateHost(dir, updated, ""); err != nil {
 		t.Fatalf("UpdateHost failed: %v", err)
 	}
 
@@ -187,7 +230,7 @@ Host other
 		User:     "newuser",
 	}
 
-	if err := UpdateHost(dir, updated); err != nil {
+	if err := UpdateHost(dir, updated, ""); err != nil {
 		t.Fatalf("UpdateHost failed: %v", err)
 	}
 
@@ -218,7 +261,7 @@ Host keep
 `
 	os.WriteFile(dir.ConfigPath(), []byte(configContent), 0600)
 
-	if err := DeleteHost(dir, "foo"); err != nil {
+	if err := DeleteHost(dir, "foo", ""); err != nil {
 		t.Fatalf("DeleteHost failed: %v", err)
 	}
 
@@ -250,3 +293,71 @@ func TestWriteConfig(t *testing.T) {
 		t.Fatalf("content mismatch: got %q", string(data))
 	}
 }
+
+func TestHostRepeatedOptionsRoundTrip(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	configContent := `Host tunnel
+    HostName tunnel.example.com
+    IdentityFile ~/.ssh/id_ed25519
+    LocalForward 8080 localhost:80
+    IdentityFile ~/.ssh/id_rsa
+    LocalForward 8443 localhost:443
+    SendEnv LANG
+    SendEnv LC_*
+`
+	os.WriteFile(dir.ConfigPath(), []byte(configContent), 0600)
+
+	host, err := GetHost(dir, "tunnel")
+	if err != nil {
+		t.Fatalf("GetHost failed: %v", err)
+	}
+	if host.IdentityFile != "~/.ssh/id_ed25519" {
+		t.Fatalf("expected first identity file, got '%s'", host.IdentityFile)
+	}
+	want := []model.HostOption{
+		{Key: "LocalForward", Value: "8080 localhost:80"},
+		{Key: "IdentityFile", Value: "~/.ssh/id_rsa"},
+		{Key: "LocalForward", Value: "8443 localhost:443"},
+		{Key: "SendEnv", Value: "LANG"},
+		{Key: "SendEnv", Value: "LC_*"},
+	}
+	if len(host.Options) != len(want) {
+		t.Fatalf("expected %d options, got %+v", len(want), host.Options)
+	}
+	for i := range want {
+		if host.Options[i] != want[i] {
+			t.Fatalf("option %d: expected %+v, got %+v", i, want[i], host.Options[i])
+		}
+	}
+
+	// Saving the host unchanged must not reorder or drop anything.
+	if err := UpdateHost(dir, *host, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	if string(data) != configContent {
+		t.Fatalf("config changed on unchanged save:\n%s", data)
+	}
+
+	// A new host keeps its options in the given order.
+	copyHost := *host
+	copyHost.Alias = "tunnel2"
+	copyHost.File = ""
+	if err := AddHost(dir, copyHost); err != nil {
+		t.Fatalf("AddHost failed: %v", err)
+	}
+	added, err := GetHost(dir, "tunnel2")
+	if err != nil {
+		t.Fatalf("GetHost failed: %v", err)
+	}
+	for i := range want {
+		if added.Options[i] != want[i] {
+			t.Fatalf("added option %d: expected %+v, got %+v", i, want[i], added.Options[i])
+		}
+	}
+
+	refs, _ := KeyRefCount(dir)
+	if refs["~/.ssh/id_rsa"] != 2 {
+		t.Fatalf("expected extra identity file to be counted, got %v", refs)
+	}
+}
@@ -0,0 +1,529 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// ConfigFile is a lossless, editable view of an ssh_config file.
+// Every line is kept verbatim, and edits only rewrite the lines they touch,
+// so Bytes() on an unmodified file returns exactly the bytes that were parsed.
+type ConfigFile struct {
+	Path  string
+	Lines []*ConfigLine
+
+	// Includes maps each Include line to the files it pulled in, and Err
+	// records why a file could not be included. Both are set by LoadConfigTree.
+	Includes map[*ConfigLine][]*ConfigFile
+	Err      error
+
+	// Version is the FileVersion of the contents LoadConfigFile read. Save
+	// refuses to overwrite the file if it has changed since.
+	Version string
+}
+
+// ConfigLine is a single line of an ssh_config file.
+// Blank and comment lines have an empty Key.
+type ConfigLine struct {
+	Raw   string // exact text, without the trailing "\n"
+	Key   string // keyword as written (e.g. "HostName", "hostname")
+	Value string // value as written, without any trailing comment
+
+	indent  string // leading whitespace
+	sep     string // separator between key and value (" ", "=", " = ")
+	trailer string // trailing whitespace and comment after the value
+	cr      bool   // line ended with "\r\n"
+}
+
+// ConfigBlock is a contiguous run of lines introduced by a Host or Match
+// header. The implicit global section before the first header has a nil Header.
+type ConfigBlock struct {
+	Header *ConfigLine
+	Lines  []*ConfigLine // body lines, excluding the header
+	start  int           // index of the header (or first body line) in ConfigFile.Lines
+}
+
+// ParseConfig builds a ConfigFile from raw ssh_config content.
+func ParseConfig(path string, data []byte) *ConfigFile {
+	f := &ConfigFile{Path: path}
+	if len(data) == 0 {
+		return f
+	}
+	for _, raw := range strings.Split(string(data), "\n") {
+		f.Lines = append(f.Lines, parseConfigLine(raw))
+	}
+	return f
+}
+
+// LoadConfigFile reads and parses the file at path.
+// A missing file yields an empty ConfigFile.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	f := ParseConfig(path, data)
+	f.Version = contentVersion(data)
+	return f, nil
+}
+
+// Bytes serializes the file. Untouched lines are reproduced byte for byte.
+func (f *ConfigFile) Bytes() []byte {
+	raws := make([]string, len(f.Lines))
+	for i, l := range f.Lines {
+		raws[i] = l.Raw
+	}
+	return []byte(strings.Join(raws, "\n"))
+}
+
+// Save atomically writes the file back to its path. It returns ErrConflict
+// if the file was loaded from disk and has changed there since.
+func (f *ConfigFile) Save() error {
+	data := f.Bytes()
+	if err := WriteFile(f.Path, data, 0600, f.Version); err != nil {
+		return err
+	}
+	f.Version = contentVersion(data)
+	return nil
+}
+
+// LineNumber returns the 1-based line number of l, or 0 if it is not in the file.
+func (f *ConfigFile) LineNumber(l *ConfigLine) int {
+	for i, line := range f.Lines {
+		if line == l {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Blocks splits the file into its global section and Host/Match blocks.
+// The global section is always returned first, even when it is empty.
+func (f *ConfigFile) Blocks() []ConfigBlock {
+	blocks := []ConfigBlock{{start: 0}}
+	for i, l := range f.Lines {
+		if l.IsHeader() {
+			blocks = append(blocks, ConfigBlock{Header: l, start: i})
+			continue
+		}
+		cur := &blocks[len(blocks)-1]
+		cur.Lines = append(cur.Lines, l)
+	}
+	return blocks
+}
+
+// FindHost returns the first Host block with a pattern equal to alias.
+func (f *ConfigFile) FindHost(alias string) *ConfigBlock {
+	for _, b := range f.Blocks() {
+		if !b.IsHost() {
+			continue
+		}
+		for _, p := range b.Patterns() {
+			if p == alias {
+				return &b
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateHost rewrites the directives of the block matching host.Alias in place.
+// Fields set to an empty string are removed from the block. Every keyword named
+// in host.Options has its lines replaced by the given values in order, so
+// repeated directives keep their order; an option with an empty value removes
+// the keyword. Keywords not named in host.Options are left untouched.
+func (f *ConfigFile) UpdateHost(host model.HostEntry) error {
+	b := f.FindHost(host.Alias)
+	if b == nil {
+		return fmt.Errorf("host not found: %s", host.Alias)
+	}
+
+	f.setDirective(b.Header, "HostName", host.HostName)
+	f.setDirective(b.Header, "User", host.User)
+	f.setDirective(b.Header, "Port", host.Port)
+
+	// Extra IdentityFile options follow the primary one from the form field.
+	if extra, named := optionValues(host.Options, "IdentityFile"); named {
+		var values []string
+		if host.IdentityFile != "" {
+			values = append(values, host.IdentityFile)
+		}
+		f.setDirectives(b.Header, "IdentityFile", append(values, extra...))
+	} else {
+		f.setDirective(b.Header, "IdentityFile", host.IdentityFile)
+	}
+
+	for _, key := range optionKeys(host.Options) {
+		values, _ := optionValues(host.Options, key)
+		f.setDirectives(b.Header, key, values)
+	}
+	return nil
+}
+
+// RemoveHost deletes the block matching alias.
+func (f *ConfigFile) RemoveHost(alias string) error {
+	b := f.FindHost(alias)
+	if b == nil {
+		return fmt.Errorf("host not found: %s", alias)
+	}
+	f.removeBlock(b)
+	return nil
+}
+
+// AppendBlock adds a new block at the end of the file, separated from the
+// previous content by a blank line. Directives are written in the given order.
+func (f *ConfigFile) AppendBlock(header string, directives [][2]string) *ConfigLine {
+	f.openBlock()
+	head := f.newRaw(header)
+	f.Lines = append(f.Lines, head)
+	indent := f.blockIndent(&ConfigBlock{})
+	for _, d := range directives {
+		f.Lines = append(f.Lines, f.newLine(indent, d[0], d[1]))
+	}
+	f.Lines = append(f.Lines, &ConfigLine{})
+	return head
+}
+
+// appendLines adds lines taken from another file, such as a block returned
+// by removeBlock, at the end of the file as AppendBlock would. Their text is
+// kept as is apart from the line ending, which follows this file's.
+func (f *ConfigFile) appendLines(lines []*ConfigLine) {
+	f.openBlock()
+	for _, l := range lines {
+		f.Lines = append(f.Lines, f.newRaw(strings.TrimSuffix(l.Raw, "\r")))
+	}
+	f.Lines = append(f.Lines, &ConfigLine{})
+}
+
+// openBlock prepares the end of the file for a new block: the empty element
+// left by a trailing newline is dropped so it can be re-added last, and a
+// blank line separates the block from any previous content.
+func (f *ConfigFile) openBlock() {
+	if n := len(f.Lines); n > 0 && f.Lines[n-1].Raw == "" {
+		f.Lines = f.Lines[:n-1]
+	}
+	if n := len(f.Lines); n > 0 && !f.Lines[n-1].IsBlank() {
+		f.Lines = append(f.Lines, f.newRaw(""))
+	}
+}
+
+// removeBlock deletes b along with the blank line that separated it from the
+// previous block, and returns its header and body lines. Comments that sit
+// directly above the next header are kept, since they usually describe that
+// block.
+func (f *ConfigFile) removeBlock(b *ConfigBlock) []*ConfigLine {
+	// Keep trailing unindented comments and blank lines for the next block.
+	end := len(b.Lines)
+	for end > 0 {
+		l := b.Lines[end-1]
+		if l.Key != "" || (l.indent != "" && !l.IsBlank()) {
+			break
+		}
+		end--
+	}
+
+	start := b.start
+	stop := b.start + 1 + end
+	if start > 0 && f.Lines[start-1].IsBlank() {
+		start--
+	} else if start == 0 {
+		for stop < len(f.Lines)-1 && f.Lines[stop].IsBlank() {
+			stop++
+		}
+	}
+
+	removed := append([]*ConfigLine{b.Header}, b.Lines[:end]...)
+	f.Lines = append(f.Lines[:start], f.Lines[stop:]...)
+	return removed
+}
+
+// blockFor returns the block introduced by header, if it is still in the file.
+func (f *ConfigFile) blockFor(header *ConfigLine) *ConfigBlock {
+	for _, b := range f.Blocks() {
+		if b.Header == header {
+			return &b
+		}
+	}
+	return nil
+}
+
+// setDirective sets key to value within the block introduced by header. The
+// first existing line for key is rewritten in place; an empty value removes
+// every line for key; a missing key is inserted after the block's last directive.
+func (f *ConfigFile) setDirective(header *ConfigLine, key, value string) {
+	b := f.blockFor(header)
+	if b == nil {
+		return
+	}
+
+	if value == "" {
+		f.setDirectives(header, key, nil)
+		return
+	}
+
+	for _, l := range b.Lines {
+		if strings.EqualFold(l.Key, key) {
+			l.SetValue(value)
+			return
+		}
+	}
+
+	at := b.start + 1
+	for i, l := range b.Lines {
+		if l.Key != "" {
+			at = b.start + 2 + i
+		}
+	}
+	line := f.newLine(f.blockIndent(b), key, value)
+	f.Lines = append(f.Lines[:at], append([]*ConfigLine{line}, f.Lines[at:]...)...)
+}
+
+// setDirectives replaces every line for key in the block introduced by header
+// with values, in order. Existing lines are rewritten in place, surplus lines
+// are removed, and extra values are inserted after the last existing line for
+// key, or after the block's last directive.
+func (f *ConfigFile) setDirectives(header *ConfigLine, key string, values []string) {
+	b := f.blockFor(header)
+	if b == nil {
+		return
+	}
+
+	var existing []*ConfigLine
+	at, afterKey := b.start+1, -1
+	for i, l := range b.Lines {
+		if l.Key != "" {
+			at = b.start + 2 + i
+		}
+		if strings.EqualFold(l.Key, key) {
+			existing = append(existing, l)
+			afterKey = b.start + 2 + i
+		}
+	}
+	if afterKey >= 0 {
+		at = afterKey
+	}
+
+	for i, l := range existing {
+		if i < len(values) {
+			l.SetValue(values[i])
+		}
+	}
+	if len(existing) > len(values) {
+		drop := existing[len(values):]
+		kept := f.Lines[:0]
+		for _, l := range f.Lines {
+			if !containsLine(drop, l) {
+				kept = append(kept, l)
+			}
+		}
+		f.Lines = kept
+		return
+	}
+
+	var lines []*ConfigLine
+	for _, v := range values[len(existing):] {
+		lines = append(lines, f.newLine(f.blockIndent(b), key, v))
+	}
+	f.Lines = append(f.Lines[:at], append(lines, f.Lines[at:]...)...)
+}
+
+func containsLine(lines []*ConfigLine, l *ConfigLine) bool {
+	for _, x := range lines {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+// blockIndent returns the indentation used by directives in b, falling back
+// to the first indented directive in the file, then to four spaces.
+func (f *ConfigFile) blockIndent(b *ConfigBlock) string {
+	for _, l := range b.Lines {
+		if l.Key != "" {
+			return l.indent
+		}
+	}
+	for _, l := range f.Lines {
+		if l.Key != "" && l.indent != "" {
+			return l.indent
+		}
+	}
+	return "    "
+}
+
+// newLine creates a directive line using the file's line-ending convention.
+func (f *ConfigFile) newLine(indent, key, value string) *ConfigLine {
+	return f.newRaw(indent + key + " " + value)
+}
+
+// newRaw parses text as a new line, adding "\r" if the file uses CRLF endings.
+func (f *ConfigFile) newRaw(text string) *ConfigLine {
+	if len(f.Lines) > 0 && f.Lines[0].cr {
+		text += "\r"
+	}
+	return parseConfigLine(text)
+}
+
+// IsBlank reports whether the line contains only whitespace.
+func (l *ConfigLine) IsBlank() bool {
+	return strings.TrimSpace(l.Raw) == ""
+}
+
+// IsComment reports whether the line is a full-line comment.
+func (l *ConfigLine) IsComment() bool {
+	return strings.HasPrefix(strings.TrimSpace(l.Raw), "#")
+}
+
+// IsHeader reports whether the line starts a Host or Match block.
+func (l *ConfigLine) IsHeader() bool {
+	return strings.EqualFold(l.Key, "Host") || strings.EqualFold(l.Key, "Match")
+}
+
+// Args splits the value into whitespace-separated arguments, honouring
+// double quotes the way OpenSSH does.
+func (l *ConfigLine) Args() []string {
+	return splitConfigArgs(l.Value)
+}
+
+// SetValue replaces the value while keeping the keyword spelling, indentation,
+// separator, trailing comment and line ending exactly as they were.
+func (l *ConfigLine) SetValue(value string) {
+	if l.sep == "" {
+		l.sep = " "
+	}
+	l.Value = value
+	l.Raw = l.indent + l.Key + l.sep + value + l.trailer
+	if l.cr {
+		l.Raw += "\r"
+	}
+}
+
+// IsHost reports whether the block is introduced by a Host line.
+func (b ConfigBlock) IsHost() bool {
+	return b.Header != nil && strings.EqualFold(b.Header.Key, "Host")
+}
+
+// IsMatch reports whether the block is introduced by a Match line.
+func (b ConfigBlock) IsMatch() bool {
+	return b.Header != nil && strings.EqualFold(b.Header.Key, "Match")
+}
+
+// Patterns returns the header's arguments (host patterns or match criteria).
+func (b ConfigBlock) Patterns() []string {
+	if b.Header == nil {
+		return nil
+	}
+	return b.Header.Args()
+}
+
+// Directives returns the body lines that carry a keyword.
+func (b ConfigBlock) Directives() []*ConfigLine {
+	var out []*ConfigLine
+	for _, l := range b.Lines {
+		if l.Key != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// parseConfigLine splits a raw line into its parts. Anything that doesn't
+// look like a directive is treated as opaque text and kept as-is.
+func parseConfigLine(raw string) *ConfigLine {
+	l := &ConfigLine{Raw: raw}
+	text := raw
+	if strings.HasSuffix(text, "\r") {
+		l.cr = true
+		text = text[:len(text)-1]
+	}
+
+	rest := strings.TrimLeft(text, " \t")
+	l.indent = text[:len(text)-len(rest)]
+	if rest == "" || rest[0] == '#' {
+		return l
+	}
+
+	i := 0
+	for i < len(rest) && rest[i] != ' ' && rest[i] != '\t' && rest[i] != '=' {
+		i++
+	}
+	key := rest[:i]
+	rest = rest[i:]
+
+	// Separator: whitespace with at most one '='.
+	j := 0
+	seenEq := false
+	for j < len(rest) {
+		c := rest[j]
+		if c == ' ' || c == '\t' {
+			j++
+			continue
+		}
+		if c == '=' && !seenEq {
+			seenEq = true
+			j++
+			continue
+		}
+		break
+	}
+	l.Key = key
+	l.sep = rest[:j]
+	value, trailer := splitConfigTrailer(rest[j:])
+	l.Value = value
+	l.trailer = trailer
+	return l
+}
+
+// splitConfigTrailer separates a value from trailing whitespace and any
+// comment. As in OpenSSH, '#' starts a comment only at the beginning of an
+// unquoted word.
+func splitConfigTrailer(s string) (value, trailer string) {
+	inQuote := false
+	end := len(s)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			inQuote = !inQuote
+			continue
+		}
+		if c == '#' && !inQuote && i > 0 && (s[i-1] == ' ' || s[i-1] == '\t') {
+			end = i
+			break
+		}
+	}
+	value = strings.TrimRight(s[:end], " \t")
+	return value, s[len(value):]
+}
+
+// splitConfigArgs splits a value into arguments, treating double-quoted
+// sections as single arguments and removing the quotes.
+func splitConfigArgs(s string) []string {
+	var args []string
+	var cur strings.Builder
+	inQuote, inArg := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
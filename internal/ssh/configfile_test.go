@@ -0,0 +1,226 @@
+package ssh
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestConfigRoundTripGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "config", "*.conf"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no config fixtures found")
+	}
+
+	for _, path := range files {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read fixture: %v", err)
+			}
+			got := ParseConfig(path, data).Bytes()
+			if !bytes.Equal(got, data) {
+				t.Fatalf("round trip not byte-identical:\n--- want\n%q\n--- got\n%q", data, got)
+			}
+		})
+	}
+}
+
+func TestConfigEditGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		edit    func(*ConfigFile) error
+	}{
+		{
+			name:    "update-second-pattern",
+			fixture: "developer.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:        "bastion",
+					HostName:     "bastion2.corp.example.com",
+					User:         "jdoe",
+					IdentityFile: "~/.ssh/id_work",
+					Options:      []model.HostOption{{Key: "Compression", Value: "yes"}, {Key: "ForwardAgent", Value: "yes"}},
+				})
+			},
+		},
+		{
+			name:    "update-lowercase-equals",
+			fixture: "developer.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:    "pi",
+					HostName: "192.168.1.43",
+					Port:     "2022",
+				})
+			},
+		},
+		{
+			name:    "update-repeated-options",
+			fixture: "developer.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:        "work-db",
+					HostName:     "10.20.0.15",
+					User:         "postgres",
+					IdentityFile: "~/.ssh/id_work",
+					Options: []model.HostOption{
+						{Key: "IdentityFile", Value: "~/.ssh/id_work_old"},
+						{Key: "LocalForward", Value: "5433 localhost:5432"},
+						{Key: "LocalForward", Value: "6390 localhost:6379"},
+						{Key: "LocalForward", Value: "9200 localhost:9200"},
+						{Key: "ProxyJump", Value: ""},
+					},
+				})
+			},
+		},
+		{
+			name:    "delete-middle",
+			fixture: "developer.conf",
+			edit:    func(f *ConfigFile) error { return f.RemoveHost("work-db") },
+		},
+		{
+			name:    "delete-first",
+			fixture: "match.conf",
+			edit:    func(f *ConfigFile) error { return f.RemoveHost("jump") },
+		},
+		{
+			name:    "update-crlf",
+			fixture: "crlf.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:    "legacy",
+					HostName: "legacy.example.com",
+					User:     "root",
+					Port:     "2222",
+				})
+			},
+		},
+		{
+			name:    "update-trailing-comment",
+			fixture: "no-trailing-newline.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:    "nonewline",
+					HostName: "no-newline.example.com",
+					User:     "you",
+					Port:     "2201",
+				})
+			},
+		},
+		{
+			name:    "update-uppercase-keywords",
+			fixture: "quirks.conf",
+			edit: func(f *ConfigFile) error {
+				return f.UpdateHost(model.HostEntry{
+					Alias:    "Upper",
+					HostName: "upper2.example.com",
+					User:     "tabbed",
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "config", tt.fixture))
+			if err != nil {
+				t.Fatalf("read fixture: %v", err)
+			}
+			f := ParseConfig(tt.fixture, data)
+			if err := tt.edit(f); err != nil {
+				t.Fatalf("edit failed: %v", err)
+			}
+			got := f.Bytes()
+
+			golden := filepath.Join("testdata", "config", "edits", tt.name+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("write golden: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("edit output mismatch:\n--- want\n%s\n--- got\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestConfigUpdateKeepsComments(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	configContent := `Host commented
+    # primary address
+    HostName old.example.com
+    User olduser # service account
+`
+	os.WriteFile(dir.ConfigPath(), []byte(configContent), 0600)
+
+	if err := UpdateHost(dir, model.HostEntry{Alias: "commented", HostName: "new.example.com", User: "olduser"}, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(dir.ConfigPath())
+	want := `Host commented
+    # primary address
+    HostName new.example.com
+    User olduser # service account
+`
+	if string(data) != want {
+		t.Fatalf("unexpected config:\n%s", data)
+	}
+}
+
+func TestConfigUpdateHostNotFound(t *testing.T) {
+	f := ParseConfig("config", []byte("Host a\n    HostName a\n"))
+	if err := f.UpdateHost(model.HostEntry{Alias: "missing"}); err == nil {
+		t.Fatal("expected error for missing host")
+	}
+	if err := f.RemoveHost("missing"); err == nil {
+		t.Fatal("expected error for missing host")
+	}
+}
+
+func TestParseConfigLine(t *testing.T) {
+	tests := []struct {
+		raw   string
+		key   string
+		value string
+	}{
+		{"Host foo bar", "Host", "foo bar"},
+		{"  hostname=10.0.0.1", "hostname", "10.0.0.1"},
+		{"\tUser = admin", "User", "admin"},
+		{"Host=eq", "Host", "eq"},
+		{"IdentityFile \"~/my keys/id\" # note", "IdentityFile", "\"~/my keys/id\""},
+		{"ProxyCommand ssh -W %h:%p jump#1", "ProxyCommand", "ssh -W %h:%p jump#1"},
+		{"# comment", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		l := parseConfigLine(tt.raw)
+		if l.Key != tt.key || l.Value != tt.value {
+			t.Errorf("parseConfigLine(%q) = (%q, %q), want (%q, %q)", tt.raw, l.Key, l.Value, tt.key, tt.value)
+		}
+	}
+
+	args := parseConfigLine(`Host "quoted name" other`).Args()
+	if len(args) != 2 || args[0] != "quoted name" || args[1] != "other" {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
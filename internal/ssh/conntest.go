@@ -0,0 +1,631 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultTestTimeout bounds a connection test when the host sets no
+// ConnectTimeout.
+const defaultTestTimeout = 10 * time.Second
+
+// testStages are the steps of a connection test, in order.
+var testStages = []string{"dns", "tcp", "banner", "kex", "hostkey", "auth"}
+
+// defaultIdentities are the keys ssh tries when a host sets no IdentityFile.
+var defaultIdentities = []string{"id_rsa", "id_ecdsa", "id_ecdsa_sk", "id_ed25519", "id_ed25519_sk", "id_xmss"}
+
+// errSkipAuth stops the handshake after host key verification when
+// credentials should not be offered.
+var errSkipAuth = errors.New("authentication skipped")
+
+// TestOptions controls TestConnection.
+type TestOptions struct {
+	// Timeout bounds the whole test. Defaults to the host's ConnectTimeout,
+	// or 10s.
+	Timeout time.Duration
+	// AgentSocket overrides IdentityAgent and SSH_AUTH_SOCK; "none" disables
+	// the agent.
+	AgentSocket string
+	// SkipAuth stops after host key verification without offering any keys.
+	SkipAuth bool
+	// Resolve is passed to ResolveHost when reading the host's config.
+	Resolve ResolveOptions
+}
+
+// TestConnection connects to host the way ssh would, using its effective
+// HostName, Port, User and IdentityFile settings plus the agent, and reports
+// each stage separately: DNS, TCP connect, the server's version banner, key
+// exchange, host key verification against known_hosts, and authentication.
+// Keys protected by a passphrase are only used through the agent; passwords
+// are never sent. ProxyJump and ProxyCommand are not followed.
+//
+// The error is only non-nil when the config can't be read; connection
+// failures are reported in the result.
+func TestConnection(dir *SSHDir, host string, opts TestOptions) (*model.ConnTestResult, error) {
+	cfg, err := ResolveHost(dir, host, opts.Resolve)
+	if err != nil {
+		return nil, err
+	}
+	t := &connTest{
+		dir:  dir,
+		opts: opts,
+		cfg:  cfg,
+		res: &model.ConnTestResult{
+			Host:     host,
+			HostName: resolvedValue(cfg, "hostname"),
+			Port:     resolvedValue(cfg, "port"),
+			User:     resolvedValue(cfg, "user"),
+			Time:     time.Now(),
+		},
+	}
+	t.run()
+	return t.res, nil
+}
+
+// connTest holds the state of one TestConnection run.
+type connTest struct {
+	dir  *SSHDir
+	opts TestOptions
+	cfg  *model.ResolvedConfig
+	res  *model.ConnTestResult
+
+	attempts   []*probeSigner
+	agentConn  net.Conn
+	hostKey    *model.ConnTestStage
+	hostKeyAt  time.Time
+	hostKeyErr error
+}
+
+func (t *connTest) run() {
+	start := time.Now()
+	defer func() {
+		if t.agentConn != nil {
+			t.agentConn.Close()
+		}
+		t.res.Duration = time.Since(start)
+		t.res.OK = true
+		for _, s := range t.res.Stages {
+			if s.Status == "fail" {
+				t.res.OK = false
+			}
+		}
+		for _, name := range testStages[len(t.res.Stages):] {
+			t.res.Stages = append(t.res.Stages, model.ConnTestStage{Name: name, Status: "skip"})
+		}
+	}()
+
+	for _, kw := range []string{"ProxyJump", "ProxyCommand"} {
+		if v := resolvedValue(t.cfg, strings.ToLower(kw)); v != "" && v != "none" {
+			t.res.Notes = append(t.res.Notes, fmt.Sprintf("%s %s is not followed; testing a direct connection", kw, v))
+		}
+	}
+
+	timeout := t.opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTestTimeout
+		if secs, err := strconv.Atoi(resolvedValue(t.cfg, "connecttimeout")); err == nil && secs > 0 {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+	deadline := start.Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// DNS
+	begin := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, t.res.HostName)
+	if err != nil {
+		t.stage("dns", "fail", err.Error(), time.Since(begin))
+		return
+	}
+	t.stage("dns", "ok", strings.Join(addrs, ", "), time.Since(begin))
+
+	// TCP, trying each address in turn like ssh does
+	begin = time.Now()
+	var conn net.Conn
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, t.res.Port))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.stage("tcp", "fail", err.Error(), time.Since(begin))
+		return
+	}
+	t.res.Address = conn.RemoteAddr().String()
+	t.stage("tcp", "ok", "connected to "+t.res.Address, time.Since(begin))
+	conn.SetDeadline(deadline)
+
+	// Banner, key exchange, host key and auth all happen in the handshake;
+	// the recorder and callbacks mark where each one ended.
+	begin = time.Now()
+	rec := &recordConn{Conn: conn}
+	config := &gossh.ClientConfig{
+		User:              t.res.User,
+		HostKeyCallback:   t.verifyHostKey,
+		HostKeyAlgorithms: t.knownHostKeyAlgorithms(conn.RemoteAddr()),
+		BannerCallback: func(message string) error {
+			t.res.Banner = strings.TrimSpace(message)
+			return nil
+		},
+	}
+	if !t.opts.SkipAuth {
+		config.Auth = t.authMethods()
+	}
+	client, chans, reqs, err := gossh.NewClientConn(rec, net.JoinHostPort(t.res.HostName, t.res.Port), config)
+	end := time.Now()
+	if err == nil {
+		go gossh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(gossh.Prohibited, "connection test")
+			}
+		}()
+		defer client.Close()
+	} else {
+		conn.Close()
+	}
+
+	identAt, ident := rec.ident()
+	if identAt.IsZero() {
+		detail := handshakeError(err)
+		if first := rec.firstLine(); first != "" {
+			detail = fmt.Sprintf("not an SSH server: got %q", first)
+		}
+		t.stage("banner", "fail", detail, end.Sub(begin))
+		return
+	}
+	t.res.ServerVersion = ident
+	t.stage("banner", "ok", ident, identAt.Sub(begin))
+	rec.serverAlgorithms(&t.res.Algorithms)
+
+	if t.hostKeyAt.IsZero() {
+		t.stage("kex", "fail", handshakeError(err), end.Sub(identAt))
+		return
+	}
+	if client != nil {
+		if meta, ok := client.(gossh.AlgorithmsConnMetadata); ok {
+			algs := meta.Algorithms()
+			t.res.Algorithms.KeyExchange = algs.KeyExchange
+			t.res.Algorithms.HostKey = algs.HostKey
+			t.res.Algorithms.Cipher = algs.Write.Cipher
+			t.res.Algorithms.MAC = algs.Write.MAC
+		}
+	}
+	kex := "server offers " + strings.Join(t.res.Algorithms.ServerKex, ", ")
+	if a := t.res.Algorithms; a.KeyExchange != "" {
+		kex = fmt.Sprintf("%s, %s, %s", a.KeyExchange, a.HostKey, a.Cipher)
+	}
+	t.stage("kex", "ok", kex, t.hostKeyAt.Sub(identAt))
+
+	t.res.Stages = append(t.res.Stages, *t.hostKey)
+	if t.hostKeyErr != nil || t.opts.SkipAuth {
+		return
+	}
+
+	t.finishAuth(err)
+	if err != nil {
+		t.stage("auth", "fail", handshakeError(err), end.Sub(t.hostKeyAt))
+		return
+	}
+	t.res.AuthMethod = "publickey"
+	detail := "publickey"
+	for _, a := range t.res.Auth {
+		if a.Result == "accepted" {
+			detail = "publickey with " + a.Key
+		}
+	}
+	t.stage("auth", "ok", detail, end.Sub(t.hostKeyAt))
+}
+
+// stage records a finished stage.
+func (t *connTest) stage(name, status, detail string, d time.Duration) {
+	t.res.Stages = append(t.res.Stages, model.ConnTestStage{Name: name, Status: status, Detail: detail, Duration: d})
+}
+
+// verifyHostKey checks the server's host key against known_hosts, under
+// HostKeyAlias when set. Unknown keys are a warning unless
+// StrictHostKeyChecking is yes; changed or revoked keys end the test before
+// any credentials are offered.
+func (t *connTest) verifyHostKey(_ string, remote net.Addr, key gossh.PublicKey) error {
+	t.hostKeyAt = time.Now()
+	fp := gossh.FingerprintSHA256(key)
+	t.res.HostKey = key.Type() + " " + fp
+
+	status, detail := "ok", "matches known_hosts"
+	if cb, err := knownhosts.New(t.dir.KnownHostsPath()); err != nil {
+		status, detail = "warn", "no known_hosts file"
+	} else if err := cb(net.JoinHostPort(t.knownHostsName(), t.res.Port), remote, key); err != nil {
+		var keyErr *knownhosts.KeyError
+		var revoked *knownhosts.RevokedError
+		switch {
+		case errors.As(err, &revoked):
+			status, detail = "fail", fmt.Sprintf("%s is revoked in %s:%d", fp, t.dir.RelPath(revoked.Revoked.Filename), revoked.Revoked.Line)
+		case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			w := keyErr.Want[0]
+			status, detail = "fail", fmt.Sprintf("host key %s does not match known_hosts (%s:%d); it may have been replaced, or the connection intercepted", fp, t.dir.RelPath(w.Filename), w.Line)
+		case errors.As(err, &keyErr):
+			status, detail = "warn", fmt.Sprintf("%s is not in known_hosts", fp)
+		default:
+			status, detail = "fail", err.Error()
+		}
+	}
+	if status == "warn" && strings.EqualFold(resolvedValue(t.cfg, "stricthostkeychecking"), "yes") {
+		status = "fail"
+		detail += " and StrictHostKeyChecking is yes"
+	}
+
+	t.hostKey = &model.ConnTestStage{Name: "hostkey", Status: status, Detail: detail, Duration: time.Since(t.hostKeyAt)}
+	if status == "fail" {
+		t.hostKeyErr = errors.New(detail)
+		return t.hostKeyErr
+	}
+	if t.opts.SkipAuth {
+		return errSkipAuth
+	}
+	return nil
+}
+
+// knownHostsName is the name the host key is looked up under.
+func (t *connTest) knownHostsName() string {
+	if alias := resolvedValue(t.cfg, "hostkeyalias"); alias != "" {
+		return alias
+	}
+	return t.res.HostName
+}
+
+// knownHostKeyAlgorithms prefers the key types already in known_hosts for
+// this host, as ssh does, so a server with several host keys presents the
+// one we can verify.
+func (t *connTest) knownHostKeyAlgorithms(remote net.Addr) []string {
+	cb, err := knownhosts.New(t.dir.KnownHostsPath())
+	if err != nil {
+		return nil
+	}
+	// Any key not in the file makes the callback list the known ones
+	probe, _ := gossh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	var keyErr *knownhosts.KeyError
+	if err := cb(net.JoinHostPort(t.knownHostsName(), t.res.Port), remote, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	seen := make(map[string]bool)
+	for _, k := range keyErr.Want {
+		types := []string{k.Key.Type()}
+		if k.Key.Type() == gossh.KeyAlgoRSA {
+			types = []string{gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSA}
+		}
+		for _, typ := range types {
+			if !seen[typ] {
+				seen[typ] = true
+				algos = append(algos, typ)
+			}
+		}
+	}
+	return algos
+}
+
+// authMethods gathers the agent's keys and the host's identity files into
+// one publickey method, recording an attempt for each key.
+func (t *connTest) authMethods() []gossh.AuthMethod {
+	identitiesOnly := strings.EqualFold(resolvedValue(t.cfg, "identitiesonly"), "yes")
+
+	var files []string
+	for _, o := range t.cfg.Options {
+		if o.Key == "identityfile" && o.Value != "none" {
+			files = append(files, o.Value)
+		}
+	}
+	explicit := len(files) > 0
+	if !explicit {
+		for _, name := range defaultIdentities {
+			files = append(files, "~/.ssh/"+name)
+		}
+	}
+
+	// Load identity files first so IdentitiesOnly can filter the agent
+	var fileSigners []*probeSigner
+	wanted := make(map[string]bool)
+	for _, f := range files {
+		path := t.dir.ExpandPath(f)
+		attempt := &model.AuthAttempt{Key: f, Source: "file"}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if explicit {
+				attempt.Result, attempt.Reason = "skipped", "file not found"
+				t.res.Auth = append(t.res.Auth, *attempt)
+			}
+			continue
+		}
+		signer, err := gossh.ParsePrivateKey(data)
+		var missing *gossh.PassphraseMissingError
+		switch {
+		case errors.As(err, &missing):
+			attempt.Fingerprint = gossh.FingerprintSHA256(missing.PublicKey)
+			wanted[attempt.Fingerprint] = true
+			attempt.Result, attempt.Reason = "skipped", "protected by a passphrase; add it to the agent to test it"
+			fileSigners = append(fileSigners, &probeSigner{attempt: attempt})
+			continue
+		case err != nil:
+			attempt.Result, attempt.Reason = "skipped", err.Error()
+			t.res.Auth = append(t.res.Auth, *attempt)
+			continue
+		}
+		as, ok := signer.(gossh.AlgorithmSigner)
+		if !ok {
+			attempt.Result, attempt.Reason = "skipped", "unsupported key"
+			t.res.Auth = append(t.res.Auth, *attempt)
+			continue
+		}
+		attempt.Fingerprint = gossh.FingerprintSHA256(signer.PublicKey())
+		wanted[attempt.Fingerprint] = true
+		fileSigners = append(fileSigners, &probeSigner{AlgorithmSigner: as, attempt: attempt})
+	}
+
+	// ssh offers agent keys before identity files, skipping duplicates
+	seen := make(map[string]bool)
+	for _, s := range t.agentSigners() {
+		fp := s.attempt.Fingerprint
+		if identitiesOnly && !wanted[fp] {
+			continue
+		}
+		seen[fp] = true
+		t.attempts = append(t.attempts, s)
+	}
+	for _, s := range fileSigners {
+		if seen[s.attempt.Fingerprint] {
+			continue
+		}
+		seen[s.attempt.Fingerprint] = true
+		t.attempts = append(t.attempts, s)
+	}
+
+	return []gossh.AuthMethod{gossh.PublicKeysCallback(func() ([]gossh.Signer, error) {
+		var signers []gossh.Signer
+		for _, s := range t.attempts {
+			if s.AlgorithmSigner != nil {
+				signers = append(signers, s)
+			}
+		}
+		return signers, nil
+	})}
+}
+
+// agentSigners lists the keys held by the agent at IdentityAgent or
+// SSH_AUTH_SOCK.
+func (t *connTest) agentSigners() []*probeSigner {
+	sock := t.opts.AgentSocket
+	if sock == "" {
+		sock = resolvedValue(t.cfg, "identityagent")
+	}
+	switch {
+	case sock == "" || sock == "SSH_AUTH_SOCK":
+		sock = os.Getenv("SSH_AUTH_SOCK")
+	case strings.HasPrefix(sock, "$"):
+		sock = os.Getenv(strings.Trim(sock, "${}"))
+	}
+	if sock == "" || sock == "none" {
+		return nil
+	}
+	conn, err := net.Dial("unix", t.dir.ExpandPath(sock))
+	if err != nil {
+		t.res.Notes = append(t.res.Notes, "agent unavailable: "+err.Error())
+		return nil
+	}
+	// Agent keys sign during the handshake, so run closes the connection
+	t.agentConn = conn
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		t.res.Notes = append(t.res.Notes, "agent unavailable: "+err.Error())
+		return nil
+	}
+	var probes []*probeSigner
+	for _, s := range signers {
+		as, ok := s.(gossh.AlgorithmSigner)
+		if !ok {
+			continue
+		}
+		attempt := &model.AuthAttempt{Source: "agent", Fingerprint: gossh.FingerprintSHA256(s.PublicKey())}
+		attempt.Key = attempt.Fingerprint
+		if ak, ok := s.PublicKey().(*agent.Key); ok && ak.Comment != "" {
+			attempt.Key = ak.Comment
+		}
+		probes = append(probes, &probeSigner{AlgorithmSigner: as, attempt: attempt})
+	}
+	return probes
+}
+
+// finishAuth turns what each probe saw into its attempt result.
+func (t *connTest) finishAuth(err error) {
+	var lastSigned *probeSigner
+	for _, s := range t.attempts {
+		if s.signed {
+			lastSigned = s
+		}
+	}
+	for _, s := range t.attempts {
+		a := s.attempt
+		switch {
+		case a.Result != "":
+		case s == lastSigned && err == nil:
+			a.Result = "accepted"
+		case s.signed:
+			a.Result, a.Reason = "rejected", "server rejected the signature"
+		case s.offered:
+			a.Result, a.Reason = "rejected", "server refused the key"
+		default:
+			a.Result = "untried"
+		}
+		t.res.Auth = append(t.res.Auth, *a)
+	}
+}
+
+// probeSigner wraps a key offered during a test to see how far the server
+// let it get: offered (public key sent) and signed (server accepted the key).
+type probeSigner struct {
+	gossh.AlgorithmSigner
+	attempt *model.AuthAttempt
+
+	mu      sync.Mutex
+	offered bool
+	signed  bool
+}
+
+func (s *probeSigner) PublicKey() gossh.PublicKey {
+	s.mu.Lock()
+	s.offered = true
+	s.mu.Unlock()
+	return s.AlgorithmSigner.PublicKey()
+}
+
+func (s *probeSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	s.mu.Lock()
+	s.signed = true
+	s.mu.Unlock()
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// recordConn keeps the first bytes the server sends so the test can tell
+// when its version banner arrived and what algorithms its KEXINIT offered.
+type recordConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	buf     []byte
+	identAt time.Time
+}
+
+const recordLimit = 64 * 1024
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if len(c.buf) < recordLimit {
+		c.buf = append(c.buf, p[:n]...)
+		if c.identAt.IsZero() && c.identEnd() > 0 {
+			c.identAt = time.Now()
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// identEnd returns the offset just past the SSH- version line, or 0.
+func (c *recordConn) identEnd() int {
+	off := 0
+	for {
+		i := strings.IndexByte(string(c.buf[off:]), '\n')
+		if i < 0 {
+			return 0
+		}
+		if strings.HasPrefix(string(c.buf[off:]), "SSH-") {
+			return off + i + 1
+		}
+		off += i + 1
+	}
+}
+
+// ident returns when the version banner arrived and its text.
+func (c *recordConn) ident() (time.Time, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.identEnd()
+	if end == 0 {
+		return time.Time{}, ""
+	}
+	start := strings.LastIndex(string(c.buf[:end-1]), "\n") + 1
+	return c.identAt, strings.TrimRight(string(c.buf[start:end]), "\r\n")
+}
+
+// firstLine returns the first line received, for servers that aren't SSH.
+func (c *recordConn) firstLine() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line, _, _ := strings.Cut(string(c.buf), "\n")
+	line = strings.TrimSpace(line)
+	if len(line) > 80 {
+		line = line[:80]
+	}
+	return line
+}
+
+// serverAlgorithms parses the server's KEXINIT, the first packet after the
+// banner, into the algorithms it offers.
+func (c *recordConn) serverAlgorithms(algs *model.ConnAlgorithms) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.buf[c.identEnd():]
+	if len(b) < 5 {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(b))
+	if length < 2 || len(b) < 4+length || int(b[4]) >= length {
+		return
+	}
+	payload := b[5 : 4+length-int(b[4])]
+	const msgKexInit = 20
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return
+	}
+	payload = payload[17:]
+
+	var lists [6][]string
+	for i := range lists {
+		if len(payload) < 4 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(payload))
+		if len(payload) < 4+n {
+			return
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(payload[4:4+n]), ",")
+		}
+		payload = payload[4+n:]
+	}
+	// kex, host key, ciphers and MACs client to server, then server to client
+	algs.ServerKex = lists[0]
+	algs.ServerHostKeys = lists[1]
+	algs.ServerCiphers = lists[2]
+	algs.ServerMACs = lists[4]
+}
+
+// handshakeError strips the prefix x/crypto adds to every handshake error.
+func handshakeError(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := strings.TrimPrefix(err.Error(), "ssh: handshake failed: ")
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		msg = "timed out"
+	}
+	return msg
+}
+
+// resolvedValue returns the first effective value of key, or "".
+func resolvedValue(cfg *model.ResolvedConfig, key string) string {
+	for _, o := range cfg.Options {
+		if o.Key == key {
+			return o.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,248 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startTestServer runs an in-process SSH server on loopback that accepts
+// only the authorized key, and returns its port.
+func startTestServer(t *testing.T, hostKey gossh.Signer, authorized gossh.PublicKey) string {
+	t.Helper()
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if authorized != nil && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+		BannerCallback: func(gossh.ConnMetadata) string { return "Authorized use only\n" },
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sconn, chans, reqs, err := gossh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(gossh.Prohibited, "test server")
+				}
+				sconn.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func newTestSigner(t *testing.T) (gossh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %v", err)
+	}
+	return signer, priv
+}
+
+func writeTestKey(t *testing.T, dir *SSHDir, name string, priv ed25519.PrivateKey, passphrase string) {
+	t.Helper()
+	var block *pem.Block
+	var err error
+	if passphrase != "" {
+		block, err = gossh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	} else {
+		block, err = gossh.MarshalPrivateKey(priv, "")
+	}
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey failed: %v", err)
+	}
+	if err := os.WriteFile(dir.Path(name), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+}
+
+// connTestDir sets up a config with host "srv" pointing at port, using key
+// id_test, and a known_hosts entry for knownKey (if any).
+func connTestDir(t *testing.T, port string, knownKey gossh.PublicKey) *SSHDir {
+	t.Helper()
+	dir := NewSSHDir(t.TempDir())
+	config := fmt.Sprintf("Host srv\n    HostName 127.0.0.1\n    Port %s\n    User tester\n    IdentityFile ~/.ssh/id_test\n", port)
+	if err := os.WriteFile(dir.ConfigPath(), []byte(config), 0600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+	if knownKey != nil {
+		line := fmt.Sprintf("[127.0.0.1]:%s %s", port, gossh.MarshalAuthorizedKey(knownKey))
+		if err := os.WriteFile(dir.KnownHostsPath(), []byte(line), 0644); err != nil {
+			t.Fatalf("write known_hosts failed: %v", err)
+		}
+	}
+	return dir
+}
+
+func stageStatus(res *model.ConnTestResult) string {
+	var parts []string
+	for _, s := range res.Stages {
+		parts = append(parts, s.Name+"="+s.Status)
+	}
+	return strings.Join(parts, " ")
+}
+
+var testOpts = TestOptions{Timeout: 5 * time.Second, AgentSocket: "none"}
+
+func TestConnectionSuccess(t *testing.T) {
+	hostKey, _ := newTestSigner(t)
+	userKey, userPriv := newTestSigner(t)
+	port := startTestServer(t, hostKey, userKey.PublicKey())
+	dir := connTestDir(t, port, hostKey.PublicKey())
+	writeTestKey(t, dir, "id_test", userPriv, "")
+
+	res, err := TestConnection(dir, "srv", testOpts)
+	if err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	if !res.OK {
+		t.Fatalf("expected success, got %s: %+v", stageStatus(res), res.Stages)
+	}
+	if got := stageStatus(res); got != "dns=ok tcp=ok banner=ok kex=ok hostkey=ok auth=ok" {
+		t.Errorf("unexpected stages: %s", got)
+	}
+	if !strings.HasPrefix(res.ServerVersion, "SSH-2.0-") {
+		t.Errorf("unexpected server version %q", res.ServerVersion)
+	}
+	if res.Banner != "Authorized use only" {
+		t.Errorf("unexpected banner %q", res.Banner)
+	}
+	if res.Algorithms.KeyExchange == "" || len(res.Algorithms.ServerKex) == 0 {
+		t.Errorf("expected negotiated and offered algorithms, got %+v", res.Algorithms)
+	}
+	if res.AuthMethod != "publickey" || len(res.Auth) != 1 || res.Auth[0].Result != "accepted" {
+		t.Errorf("expected id_test accepted, got %+v", res.Auth)
+	}
+}
+
+func TestConnectionAuthRejected(t *testing.T) {
+	hostKey, _ := newTestSigner(t)
+	_, userPriv := newTestSigner(t)
+	port := startTestServer(t, hostKey, nil)
+	dir := connTestDir(t, port, hostKey.PublicKey())
+	writeTestKey(t, dir, "id_test", userPriv, "")
+
+	res, _ := TestConnection(dir, "srv", testOpts)
+	if res.OK {
+		t.Fatal("expected failure")
+	}
+	if got := stageStatus(res); got != "dns=ok tcp=ok banner=ok kex=ok hostkey=ok auth=fail" {
+		t.Errorf("unexpected stages: %s", got)
+	}
+	if len(res.Auth) != 1 || res.Auth[0].Result != "rejected" {
+		t.Errorf("expected id_test rejected, got %+v", res.Auth)
+	}
+}
+
+func TestConnectionHostKey(t *testing.T) {
+	hostKey, _ := newTestSigner(t)
+	otherKey, _ := newTestSigner(t)
+	userKey, userPriv := newTestSigner(t)
+	port := startTestServer(t, hostKey, userKey.PublicKey())
+
+	// Unknown host: warn and carry on
+	dir := connTestDir(t, port, nil)
+	writeTestKey(t, dir, "id_test", userPriv, "")
+	res, _ := TestConnection(dir, "srv", testOpts)
+	if got := stageStatus(res); got != "dns=ok tcp=ok banner=ok kex=ok hostkey=warn auth=ok" || !res.OK {
+		t.Errorf("unknown host: unexpected stages %s", got)
+	}
+
+	// Changed host key: stop before offering keys
+	dir = connTestDir(t, port, otherKey.PublicKey())
+	writeTestKey(t, dir, "id_test", userPriv, "")
+	res, _ = TestConnection(dir, "srv", testOpts)
+	if got := stageStatus(res); got != "dns=ok tcp=ok banner=ok kex=ok hostkey=fail auth=skip" {
+		t.Errorf("changed key: unexpected stages %s", got)
+	}
+	if len(res.Auth) != 0 {
+		t.Errorf("changed key: no keys should be offered, got %+v", res.Auth)
+	}
+
+	// SkipAuth stops after a verified host key
+	dir = connTestDir(t, port, hostKey.PublicKey())
+	opts := testOpts
+	opts.SkipAuth = true
+	res, _ = TestConnection(dir, "srv", opts)
+	if got := stageStatus(res); got != "dns=ok tcp=ok banner=ok kex=ok hostkey=ok auth=skip" || !res.OK {
+		t.Errorf("skip auth: unexpected stages %s", got)
+	}
+}
+
+func TestConnectionEncryptedKey(t *testing.T) {
+	hostKey, _ := newTestSigner(t)
+	userKey, userPriv := newTestSigner(t)
+	port := startTestServer(t, hostKey, userKey.PublicKey())
+	dir := connTestDir(t, port, hostKey.PublicKey())
+	writeTestKey(t, dir, "id_test", userPriv, "secret")
+
+	res, _ := TestConnection(dir, "srv", testOpts)
+	if len(res.Auth) != 1 || res.Auth[0].Result != "skipped" || !strings.Contains(res.Auth[0].Reason, "passphrase") {
+		t.Errorf("expected encrypted key skipped, got %+v", res.Auth)
+	}
+}
+
+func TestConnectionFailures(t *testing.T) {
+	// Nothing listening
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	res, _ := TestConnection(connTestDir(t, port, nil), "srv", testOpts)
+	if got := stageStatus(res); got != "dns=ok tcp=fail banner=skip kex=skip hostkey=skip auth=skip" {
+		t.Errorf("refused: unexpected stages %s", got)
+	}
+
+	// Something that isn't SSH
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		conn.Close()
+	}()
+	_, port, _ = net.SplitHostPort(ln.Addr().String())
+	res, _ = TestConnection(connTestDir(t, port, nil), "srv", testOpts)
+	if res.Stages[2].Status != "fail" || !strings.Contains(res.Stages[2].Detail, "not an SSH server") {
+		t.Errorf("not ssh: unexpected banner stage %+v", res.Stages[2])
+	}
+}
@@ -0,0 +1,193 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrConflict is returned by WriteFile when the file changed on disk after
+// the caller read it.
+var ErrConflict = errors.New("file changed on disk since it was loaded")
+
+var (
+	hooksMu    sync.Mutex
+	writeHooks []func(path string, before, after []byte)
+)
+
+// OnFileWrite registers fn to be called after every WriteFile or UpdateFile
+// that changes a file, with the path as given and the old and new contents.
+func OnFileWrite(fn func(path string, before, after []byte)) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	writeHooks = append(writeHooks, fn)
+}
+
+// modePolicy says what mode writeAtomic gives a file that already exists.
+type modePolicy int
+
+const (
+	keepMode  modePolicy = iota // keep the file's current mode
+	forceMode                   // always use perm, e.g. 0600 for private keys
+)
+
+// FileVersion returns a tag identifying the current contents of path, for
+// use as an ETag. A missing file has the same version as an empty one.
+func FileVersion(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return contentVersion(data), nil
+}
+
+func contentVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WriteFile replaces path with data atomically while holding the advisory
+// lock on path's directory. If version is not empty and the file no longer
+// matches it, nothing is written and ErrConflict is returned.
+func WriteFile(path string, data []byte, perm os.FileMode, version string) error {
+	return UpdateFile(path, perm, func(old []byte) ([]byte, error) {
+		if version != "" && contentVersion(old) != version {
+			return nil, ErrConflict
+		}
+		return data, nil
+	})
+}
+
+// UpdateFile reads path, passes its contents to fn and atomically writes
+// the result, holding the advisory lock throughout so concurrent edits
+// cannot interleave. A missing file is passed to fn as nil.
+func UpdateFile(path string, perm os.FileMode, fn func(old []byte) ([]byte, error)) error {
+	before, after, err := updateFile(path, perm, keepMode, fn)
+	if err != nil || bytes.Equal(before, after) {
+		return err
+	}
+
+	hooksMu.Lock()
+	hooks := writeHooks
+	hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(path, before, after)
+	}
+	return nil
+}
+
+// updateFile is UpdateFile without the write hooks. It returns the contents
+// before and after the write, which is made with the given mode policy.
+func updateFile(path string, perm os.FileMode, mode modePolicy, fn func(old []byte) ([]byte, error)) (before, after []byte, err error) {
+	// Write through symlinks (e.g. a dotfiles-managed config) rather than
+	// replacing the link with a regular file.
+	target := path
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		target = resolved
+	}
+
+	unlock, err := lockDir(filepath.Dir(target))
+	if err != nil {
+		return nil, nil, fmt.Errorf("lock %s: %w", filepath.Base(target), err)
+	}
+	defer unlock()
+
+	before, err = os.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	after, err = fn(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, writeAtomic(target, after, perm, mode)
+}
+
+// writeAtomic writes data to a temp file next to path, syncs it and renames
+// it over path, so readers see either the old or the new file and never a
+// partial one. An existing file keeps its owner, and its mode unless mode is
+// forceMode; either way the mode is set on the temp file before the rename,
+// so the new contents are never readable with a looser one.
+// writeNew creates path with data and perm, like writeAtomic, but never
+// replaces an existing file: it fails with an fs.ErrExist error instead.
+func writeNew(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return linkNew(tmp.Name(), path)
+}
+
+// linkNew moves the file at from to path, failing with an fs.ErrExist error
+// rather than replacing path if it exists. Unlike os.Rename, the link can't
+// clobber a file created since the caller last looked.
+func linkNew(from, path string) error {
+	if err := os.Link(from, path); err != nil {
+		return err
+	}
+	os.Remove(from)
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func writeAtomic(path string, data []byte, perm os.FileMode, mode modePolicy) error {
+	info, statErr := os.Stat(path)
+	if statErr == nil && mode == keepMode {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if statErr == nil {
+		if err := chownLike(tmp, info); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package ssh
+
+import (
+	"os"
+	"sync"
+)
+
+var dirLocks sync.Map // dir -> *sync.Mutex
+
+// lockDir serializes writes within this process. Without flock (Windows),
+// edits from other programs are caught by the version check alone.
+func lockDir(dir string) (func(), error) {
+	mu, _ := dirLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock, nil
+}
+
+// chownLike is a no-op: there is no Unix owner to preserve.
+func chownLike(f *os.File, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir is a no-op: directories cannot be opened for syncing here.
+func syncDir(dir string) {}
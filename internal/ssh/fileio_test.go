@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileKeepsModeAndSymlinks(t *testing.T) {
+	base := t.TempDir()
+	target := filepath.Join(base, "dotfiles-config")
+	os.WriteFile(target, []byte("old"), 0640)
+	link := filepath.Join(base, "config")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	if err := WriteFile(link, []byte("new"), 0600, ""); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("symlink replaced: %v", err)
+	}
+	data, _ := os.ReadFile(target)
+	if string(data) != "new" {
+		t.Fatalf("target not written: %q", data)
+	}
+	if fi, _ := os.Stat(target); fi.Mode().Perm() != 0640 {
+		t.Fatalf("mode not preserved: %v", fi.Mode().Perm())
+	}
+
+	entries, _ := os.ReadDir(base)
+	if len(entries) != 2 {
+		t.Fatalf("temp file left behind: %v", entries)
+	}
+}
+
+func TestUpdateFileForceMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "id_test")
+	os.WriteFile(path, []byte("old"), 0644)
+
+	_, _, err := updateFile(path, 0600, forceMode, func([]byte) ([]byte, error) {
+		return []byte("new"), nil
+	})
+	if err != nil {
+		t.Fatalf("updateFile failed: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Fatalf("mode not forced: %v", fi.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Fatalf("file not written: %q", data)
+	}
+}
+
+func TestWriteFileDetectsConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(path, []byte("v1"), 0600)
+
+	version, err := FileVersion(path)
+	if err != nil {
+		t.Fatalf("FileVersion failed: %v", err)
+	}
+	os.WriteFile(path, []byte("v2 from another editor"), 0600)
+
+	if err := WriteFile(path, []byte("stale"), 0600, version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "v2 from another editor" {
+		t.Fatalf("newer content overwritten: %q", data)
+	}
+
+	current, _ := FileVersion(path)
+	if err := WriteFile(path, []byte("v3"), 0600, current); err != nil {
+		t.Fatalf("WriteFile with current version failed: %v", err)
+	}
+}
+
+func TestUpdateFileSerializesWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := UpdateFile(path, 0644, func(old []byte) ([]byte, error) {
+				return append(old, fmt.Sprintf("line %d\n", i)...), nil
+			})
+			if err != nil {
+				t.Errorf("UpdateFile failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 20 {
+		t.Fatalf("expected 20 lines, got %d:\n%s", n, data)
+	}
+}
+
+func TestConfigFileSaveConflict(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host a\n    HostName a\n"), 0600)
+
+	cfg, err := LoadConfigFile(dir.ConfigPath())
+	if err != nil {
+		t.Fatalf("LoadConfigFile failed: %v", err)
+	}
+	os.WriteFile(dir.ConfigPath(), []byte("Host b\n    HostName b\n"), 0600)
+
+	if err := cfg.RemoveHost("a"); err != nil {
+		t.Fatalf("RemoveHost failed: %v", err)
+	}
+	if err := cfg.Save(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
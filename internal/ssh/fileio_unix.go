@@ -0,0 +1,49 @@
+//go:build unix
+
+package ssh
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive flock on dir. Locking the directory rather than
+// the file keeps the lock valid across the rename that replaces the file, and
+// leaves no lock files behind in ~/.ssh.
+func lockDir(dir string) (func(), error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// chownLike gives f the owner and group of info, for files edited as root
+// on behalf of another user. Files we already own are left alone; any other
+// chown failure is returned, so the edit is abandoned rather than leaving
+// the file owned by the wrong user.
+func chownLike(f *os.File, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) == os.Getuid() && int(st.Gid) == os.Getgid() {
+		return nil
+	}
+	return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// syncDir flushes a rename in dir to disk.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
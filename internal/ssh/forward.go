@@ -0,0 +1,345 @@
+package ssh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// forwardKeys maps forward types to their config keywords.
+var forwardKeys = map[string]string{
+	"local":   "LocalForward",
+	"remote":  "RemoteForward",
+	"dynamic": "DynamicForward",
+}
+
+// ParseForward parses the value of a LocalForward, RemoteForward or
+// DynamicForward directive into a typed record, e.g.
+// `LocalForward 127.0.0.1:5433 db.internal:5432` or `DynamicForward 1080`.
+func ParseForward(key, value string) (model.Forward, error) {
+	var f model.Forward
+	switch strings.ToLower(key) {
+	case "localforward":
+		f.Type = "local"
+	case "remoteforward":
+		f.Type = "remote"
+	case "dynamicforward":
+		f.Type = "dynamic"
+	default:
+		return f, fmt.Errorf("not a forward directive: %s", key)
+	}
+
+	args := splitConfigArgs(value)
+	if len(args) == 0 || len(args) > 2 {
+		return f, fmt.Errorf("invalid %s: %q", key, value)
+	}
+
+	var err error
+	if isSocketPath(args[0]) {
+		f.BindSocket = args[0]
+	} else if f.BindAddress, f.BindPort, err = splitForwardAddr(args[0], true); err != nil {
+		return f, fmt.Errorf("invalid %s bind %q: %w", key, args[0], err)
+	}
+
+	if len(args) == 2 {
+		if isSocketPath(args[1]) {
+			f.TargetSocket = args[1]
+		} else if f.TargetHost, f.TargetPort, err = splitForwardAddr(args[1], false); err != nil {
+			return f, fmt.Errorf("invalid %s target %q: %w", key, args[1], err)
+		}
+	}
+	return f, ValidateForward(f)
+}
+
+// FormatForward returns the config keyword and value for f.
+func FormatForward(f model.Forward) (key, value string) {
+	value = ForwardBind(f)
+	if target := ForwardTarget(f); target != "" {
+		value += " " + target
+	}
+	return ForwardKey(f.Type), value
+}
+
+// ForwardKey returns the config keyword for a forward type, e.g.
+// "LocalForward" for "local", or "" for an unknown type.
+func ForwardKey(typ string) string {
+	return forwardKeys[typ]
+}
+
+// ForwardBind returns the listening side of f as written in the config.
+func ForwardBind(f model.Forward) string {
+	if f.BindSocket != "" {
+		return f.BindSocket
+	}
+	return joinForwardAddr(f.BindAddress, f.BindPort)
+}
+
+// ForwardTarget returns the destination side of f as written in the config,
+// or "" when it has none.
+func ForwardTarget(f model.Forward) string {
+	if f.TargetSocket != "" {
+		return f.TargetSocket
+	}
+	if f.TargetHost == "" {
+		return ""
+	}
+	return joinForwardAddr(f.TargetHost, f.TargetPort)
+}
+
+// ValidateForward checks port ranges and that the target matches the type:
+// local forwards need one, dynamic forwards must not have one, and a remote
+// forward without a target acts as a SOCKS proxy.
+func ValidateForward(f model.Forward) error {
+	if _, ok := forwardKeys[f.Type]; !ok {
+		return fmt.Errorf("unknown forward type: %s", f.Type)
+	}
+	if f.BindSocket == "" {
+		// Port 0 asks the server to allocate a remote port.
+		min := 1
+		if f.Type == "remote" {
+			min = 0
+		}
+		if f.BindPort < min || f.BindPort > 65535 {
+			return fmt.Errorf("bind port out of range: %d", f.BindPort)
+		}
+	}
+
+	hasTarget := f.TargetSocket != "" || f.TargetHost != ""
+	switch {
+	case f.Type == "local" && !hasTarget:
+		return fmt.Errorf("local forward requires a target")
+	case f.Type == "dynamic" && hasTarget:
+		return fmt.Errorf("dynamic forward cannot have a target")
+	}
+	if f.TargetHost != "" && (f.TargetPort < 1 || f.TargetPort > 65535) {
+		return fmt.Errorf("target port out of range: %d", f.TargetPort)
+	}
+	return nil
+}
+
+// ListForwards returns the forwards of the host with the given alias, in
+// file order. Forwards that bind a local port also used by another forward
+// in any host are flagged in Conflicts.
+func ListForwards(dir *SSHDir, alias string) ([]model.Forward, error) {
+	hosts, err := ListHosts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// GetHost returns the first block for an alias, so later duplicates are ignored.
+	var aliases []string
+	all := make(map[string][]model.Forward)
+	for _, h := range hosts {
+		if _, seen := all[h.Alias]; !seen {
+			aliases = append(aliases, h.Alias)
+			all[h.Alias], _ = hostForwards(h)
+		}
+	}
+	forwards, ok := all[alias]
+	if !ok {
+		return nil, fmt.Errorf("host not found: %s", alias)
+	}
+
+	for i := range forwards {
+		for _, a := range aliases {
+			for _, other := range all[a] {
+				if a == alias && other.ID == forwards[i].ID {
+					continue
+				}
+				if localPortsCollide(forwards[i], other) {
+					forwards[i].Conflicts = append(forwards[i].Conflicts, fmt.Sprintf("%s#%d", a, other.ID))
+				}
+			}
+		}
+	}
+	return forwards, nil
+}
+
+// AddForward appends a forward to the host's existing forwards.
+func AddForward(dir *SSHDir, alias string, f model.Forward) error {
+	if err := ValidateForward(f); err != nil {
+		return err
+	}
+	host, err := GetHost(dir, alias)
+	if err != nil {
+		return err
+	}
+	key, value := FormatForward(f)
+	host.Options = append(host.Options, model.HostOption{Key: key, Value: value})
+	return UpdateHost(dir, *host, "")
+}
+
+// UpdateForward replaces the forward with f.ID, which may change its type.
+// If version is not empty and the config tree no longer matches it (see
+// ConfigVersion), ErrConflict is returned.
+func UpdateForward(dir *SSHDir, alias string, f model.Forward, version string) error {
+	if err := ValidateForward(f); err != nil {
+		return err
+	}
+	return editForward(dir, alias, f.ID, version, func(opts []model.HostOption, i int) []model.HostOption {
+		key, value := FormatForward(f)
+		opts[i] = model.HostOption{Key: key, Value: value}
+		return opts
+	})
+}
+
+// DeleteForward removes the forward with the given ID. A stale version fails
+// with ErrConflict, as for UpdateForward.
+func DeleteForward(dir *SSHDir, alias string, id int, version string) error {
+	return editForward(dir, alias, id, version, func(opts []model.HostOption, i int) []model.HostOption {
+		return append(opts[:i], opts[i+1:]...)
+	})
+}
+
+// editForward applies edit to the option holding forward id and saves the
+// host. Forward keywords that no longer appear are marked for removal so
+// UpdateHost drops their lines. The host is read and written from a single
+// load of the tree, so a change on disk after the version check still fails
+// the save.
+func editForward(dir *SSHDir, alias string, id int, version string, edit func([]model.HostOption, int) []model.HostOption) error {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return err
+	}
+	if version != "" && treeVersion(root) != version {
+		return ErrConflict
+	}
+
+	var host *model.HostEntry
+	for _, h := range listHosts(dir, root) {
+		if h.Alias == alias {
+			host = &h
+			break
+		}
+	}
+	cfg, err := hostFileIn(root, alias)
+	if err != nil {
+		return err
+	}
+	if host == nil {
+		return fmt.Errorf("host not found: %s", alias)
+	}
+	forwards, idx := hostForwards(*host)
+	if id < 1 || id > len(forwards) {
+		return fmt.Errorf("forward not found: %d", id)
+	}
+
+	before := append([]model.HostOption(nil), host.Options...)
+	host.Options = edit(host.Options, idx[id-1])
+	for _, key := range forwardKeys {
+		if _, had := optionValues(before, key); !had {
+			continue
+		}
+		if _, has := optionValues(host.Options, key); !has {
+			host.Options = append(host.Options, model.HostOption{Key: key})
+		}
+	}
+	if err := cfg.UpdateHost(*host); err != nil {
+		return err
+	}
+	return cfg.Save()
+}
+
+// hostForwards parses the forward options of h, returning them along with
+// their indexes in h.Options. Unparseable values are skipped.
+func hostForwards(h model.HostEntry) ([]model.Forward, []int) {
+	var forwards []model.Forward
+	var idx []int
+	for i, o := range h.Options {
+		if _, isForward := forwardTypeOf(o.Key); !isForward {
+			continue
+		}
+		f, err := ParseForward(o.Key, o.Value)
+		if err != nil {
+			continue
+		}
+		f.ID = len(forwards) + 1
+		forwards = append(forwards, f)
+		idx = append(idx, i)
+	}
+	return forwards, idx
+}
+
+func forwardTypeOf(key string) (string, bool) {
+	for t, k := range forwardKeys {
+		if strings.EqualFold(k, key) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// localPortsCollide reports whether a and b both listen on the same local TCP
+// port. Remote forwards listen on the server and never collide locally.
+func localPortsCollide(a, b model.Forward) bool {
+	if a.Type == "remote" || b.Type == "remote" || a.BindSocket != "" || b.BindSocket != "" {
+		return false
+	}
+	if a.BindPort != b.BindPort {
+		return false
+	}
+	x, y := normalizeBindAddr(a.BindAddress), normalizeBindAddr(b.BindAddress)
+	return x == "*" || y == "*" || x == y
+}
+
+// normalizeBindAddr folds the spellings of loopback and wildcard addresses.
+// An empty bind address means loopback unless GatewayPorts is set.
+func normalizeBindAddr(addr string) string {
+	switch strings.ToLower(addr) {
+	case "", "localhost", "127.0.0.1", "::1":
+		return "localhost"
+	case "*", "0.0.0.0", "::":
+		return "*"
+	}
+	return strings.ToLower(addr)
+}
+
+// splitForwardAddr parses "[addr]:port", "addr:port", "addr/port" or, for
+// bind addresses, a bare port.
+func splitForwardAddr(s string, bind bool) (string, int, error) {
+	var host, port string
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 || !strings.HasPrefix(s[end+1:], ":") {
+			return "", 0, fmt.Errorf("malformed address")
+		}
+		host, port = s[1:end], s[end+2:]
+	case strings.Contains(s, "/"):
+		i := strings.LastIndex(s, "/")
+		host, port = s[:i], s[i+1:]
+	case strings.Contains(s, ":"):
+		i := strings.LastIndex(s, ":")
+		host, port = s[:i], s[i+1:]
+	case bind:
+		port = s
+	default:
+		return "", 0, fmt.Errorf("expected host:port")
+	}
+	if !bind && host == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, n, nil
+}
+
+func joinForwardAddr(host string, port int) string {
+	p := strconv.Itoa(port)
+	switch {
+	case host == "":
+		return p
+	case strings.Contains(host, ":"):
+		return "[" + host + "]:" + p
+	default:
+		return host + ":" + p
+	}
+}
+
+func isSocketPath(s string) bool {
+	return strings.HasPrefix(s, "/") || strings.HasPrefix(s, "~")
+}
@@ -0,0 +1,126 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       model.Forward
+	}{
+		{"LocalForward", "5433 localhost:5432", model.Forward{Type: "local", BindPort: 5433, TargetHost: "localhost", TargetPort: 5432}},
+		{"localforward", "127.0.0.1:8080 web:80", model.Forward{Type: "local", BindAddress: "127.0.0.1", BindPort: 8080, TargetHost: "web", TargetPort: 80}},
+		{"LocalForward", "[::1]:8443 [fd00::1]:443", model.Forward{Type: "local", BindAddress: "::1", BindPort: 8443, TargetHost: "fd00::1", TargetPort: 443}},
+		{"LocalForward", "/tmp/pg.sock /var/run/postgresql/.s.PGSQL.5432", model.Forward{Type: "local", BindSocket: "/tmp/pg.sock", TargetSocket: "/var/run/postgresql/.s.PGSQL.5432"}},
+		{"RemoteForward", "0 localhost:22", model.Forward{Type: "remote", TargetHost: "localhost", TargetPort: 22}},
+		{"RemoteForward", "1080", model.Forward{Type: "remote", BindPort: 1080}},
+		{"DynamicForward", "*:1080", model.Forward{Type: "dynamic", BindAddress: "*", BindPort: 1080}},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.key, tt.value)
+		if err != nil {
+			t.Errorf("ParseForward(%s %s) failed: %v", tt.key, tt.value, err)
+			continue
+		}
+		if got.Type != tt.want.Type || got.BindAddress != tt.want.BindAddress || got.BindPort != tt.want.BindPort ||
+			got.BindSocket != tt.want.BindSocket || got.TargetHost != tt.want.TargetHost ||
+			got.TargetPort != tt.want.TargetPort || got.TargetSocket != tt.want.TargetSocket {
+			t.Errorf("ParseForward(%s %s) = %+v, want %+v", tt.key, tt.value, got, tt.want)
+		}
+		if _, value := FormatForward(got); value != tt.value {
+			t.Errorf("FormatForward round trip: got %q, want %q", value, tt.value)
+		}
+	}
+
+	invalid := [][2]string{
+		{"LocalForward", "8080"},
+		{"LocalForward", "70000 localhost:80"},
+		{"LocalForward", "0 localhost:80"},
+		{"LocalForward", "8080 localhost:0"},
+		{"LocalForward", "8080 localhost"},
+		{"DynamicForward", "1080 localhost:80"},
+		{"Port", "22"},
+	}
+	for _, tt := range invalid {
+		if _, err := ParseForward(tt[0], tt[1]); err == nil {
+			t.Errorf("expected error for %s %s", tt[0], tt[1])
+		}
+	}
+}
+
+func TestForwardCRUD(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	configContent := `Host db
+    HostName db.example.com
+    LocalForward 5433 localhost:5432
+    ProxyJump bastion
+    LocalForward 6380 localhost:6379
+
+Host web
+    HostName web.example.com
+    DynamicForward 0.0.0.0:6380
+`
+	os.WriteFile(dir.ConfigPath(), []byte(configContent), 0600)
+
+	forwards, err := ListForwards(dir, "db")
+	if err != nil {
+		t.Fatalf("ListForwards failed: %v", err)
+	}
+	if len(forwards) != 2 {
+		t.Fatalf("expected 2 forwards, got %+v", forwards)
+	}
+	if len(forwards[0].Conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", forwards[0].Conflicts)
+	}
+	if len(forwards[1].Conflicts) != 1 || forwards[1].Conflicts[0] != "web#1" {
+		t.Fatalf("expected collision with web#1, got %v", forwards[1].Conflicts)
+	}
+
+	err = AddForward(dir, "db", model.Forward{Type: "remote", BindPort: 9000, TargetHost: "localhost", TargetPort: 9000})
+	if err != nil {
+		t.Fatalf("AddForward failed: %v", err)
+	}
+	version, err := ConfigVersion(dir)
+	if err != nil {
+		t.Fatalf("ConfigVersion failed: %v", err)
+	}
+	err = UpdateForward(dir, "db", model.Forward{ID: 1, Type: "local", BindPort: 15432, TargetHost: "localhost", TargetPort: 5432}, version)
+	if err != nil {
+		t.Fatalf("UpdateForward failed: %v", err)
+	}
+	if err := DeleteForward(dir, "db", 2, version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict deleting with a stale version, got %v", err)
+	}
+	if err := DeleteForward(dir, "db", 2, ""); err != nil {
+		t.Fatalf("DeleteForward failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(dir.ConfigPath())
+	want := `Host db
+    HostName db.example.com
+    LocalForward 15432 localhost:5432
+    ProxyJump bastion
+    RemoteForward 9000 localhost:9000
+
+Host web
+`
+	if !strings.HasPrefix(string(data), want) {
+		t.Fatalf("unexpected config:\n%s", data)
+	}
+
+	if err := DeleteForward(dir, "db", 5, ""); err == nil {
+		t.Fatal("expected error for missing forward")
+	}
+	if err := AddForward(dir, "db", model.Forward{Type: "local", BindPort: 99999}); err == nil {
+		t.Fatal("expected validation error")
+	}
+	if _, err := ListForwards(dir, "missing"); err == nil {
+		t.Fatal("expected error for missing host")
+	}
+}
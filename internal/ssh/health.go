@@ -0,0 +1,210 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+const (
+	defaultHealthWorkers = 8
+	defaultHealthTimeout = 5 * time.Second
+)
+
+// DefaultHealthKeep is how many results are kept per host by default.
+const DefaultHealthKeep = 20
+
+var healthMu sync.Mutex
+
+// HealthOptions controls a CheckHosts run.
+type HealthOptions struct {
+	Workers     int           // hosts probed at once; defaults to 8
+	Timeout     time.Duration // per host; defaults to 5s
+	Auth        bool          // also try to authenticate
+	Keep        int           // results kept per host; defaults to 20
+	AgentSocket string        // passed to TestConnection
+}
+
+// HealthPath returns the file holding recent health check results.
+func HealthPath(dir *SSHDir) string {
+	return filepath.Join(dir.HistoryDir(), "health.json")
+}
+
+// CheckHosts probes every concrete host in the config (wildcard patterns are
+// skipped) with a bounded pool of workers, calling report from one goroutine
+// at a time as each host finishes. Without opts.Auth the probe stops after
+// host key verification, so no keys are offered. Results are added to the
+// health log. It returns early, without waiting for hosts already being
+// probed, if ctx is cancelled.
+func CheckHosts(ctx context.Context, dir *SSHDir, opts HealthOptions, report func(model.HealthCheck)) error {
+	aliases, err := HealthHosts(dir)
+	if err != nil {
+		return err
+	}
+	if opts.Workers < 1 {
+		opts.Workers = defaultHealthWorkers
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultHealthTimeout
+	}
+
+	jobs := make(chan string)
+	results := make(chan model.HealthCheck)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers && i < len(aliases); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for alias := range jobs {
+				results <- checkHost(dir, alias, opts)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, alias := range aliases {
+			select {
+			case jobs <- alias:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var checks []model.HealthCheck
+	defer func() {
+		// Keep what finished even when the run was cut short
+		if err := recordHealth(dir, checks, opts.Keep); err != nil {
+			fmt.Fprintf(os.Stderr, "health: %v\n", err)
+		}
+	}()
+	for {
+		select {
+		case c, ok := <-results:
+			if !ok {
+				return nil
+			}
+			checks = append(checks, c)
+			report(c)
+		case <-ctx.Done():
+			// Let the workers finish in the background
+			go func() {
+				for range results {
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+}
+
+// HealthHosts lists the config hosts CheckHosts probes: every alias that
+// isn't a wildcard pattern.
+func HealthHosts(dir *SSHDir) ([]string, error) {
+	hosts, err := ListHosts(dir)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, h := range hosts {
+		if !strings.ContainsAny(h.Alias, "*?!") {
+			aliases = append(aliases, h.Alias)
+		}
+	}
+	return aliases, nil
+}
+
+// checkHost probes one host and sums up the connection test.
+func checkHost(dir *SSHDir, alias string, opts HealthOptions) model.HealthCheck {
+	c := model.HealthCheck{Host: alias, Time: time.Now()}
+	res, err := TestConnection(dir, alias, TestOptions{Timeout: opts.Timeout, AgentSocket: opts.AgentSocket, SkipAuth: !opts.Auth})
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	for _, s := range res.Stages {
+		switch s.Name {
+		case "tcp":
+			c.Latency = s.Duration
+		case "banner":
+			c.Reachable = s.Status == "ok"
+		case "hostkey":
+			c.HostKey = s.Status
+		case "auth":
+			if opts.Auth {
+				c.Auth = s.Status
+			}
+		}
+		if s.Status == "fail" && c.Error == "" {
+			c.Error = s.Detail
+		}
+	}
+	c.Duration = res.Duration
+	return c
+}
+
+// HealthHistory returns the recent results for each host, oldest first.
+func HealthHistory(dir *SSHDir) (map[string][]model.HealthCheck, error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	return loadHealth(dir)
+}
+
+// recordHealth appends checks to the health log, keeping the last keep
+// results for each host.
+func recordHealth(dir *SSHDir, checks []model.HealthCheck, keep int) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	if keep < 1 {
+		keep = DefaultHealthKeep
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	log, err := loadHealth(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range checks {
+		h := append(log[c.Host], c)
+		if len(h) > keep {
+			h = h[len(h)-keep:]
+		}
+		log[c.Host] = h
+	}
+
+	if err := os.MkdirAll(dir.HistoryDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(HealthPath(dir), data, 0600, keepMode)
+}
+
+func loadHealth(dir *SSHDir) (map[string][]model.HealthCheck, error) {
+	log := make(map[string][]model.HealthCheck)
+	data, err := os.ReadFile(HealthPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return log, nil
+		}
+		return nil, fmt.Errorf("read health log: %w", err)
+	}
+	if err := json.Unmarshal(data, &log); err != nil {
+		return nil, fmt.Errorf("parse health log: %w", err)
+	}
+	return log, nil
+}
@@ -0,0 +1,70 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestCheckHosts(t *testing.T) {
+	hostKey, _ := newTestSigner(t)
+	userKey, userPriv := newTestSigner(t)
+	up1 := startTestServer(t, hostKey, userKey.PublicKey())
+	up2 := startTestServer(t, hostKey, userKey.PublicKey())
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, down, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	dir := NewSSHDir(t.TempDir())
+	config := ""
+	for alias, port := range map[string]string{"up1": up1, "up2": up2, "down": down} {
+		config += fmt.Sprintf("Host %s\n    HostName 127.0.0.1\n    Port %s\n    IdentityFile ~/.ssh/id_test\n", alias, port)
+	}
+	config += "Host *.corp\n    User admin\n"
+	os.WriteFile(dir.ConfigPath(), []byte(config), 0600)
+	writeTestKey(t, dir, "id_test", userPriv, "")
+
+	opts := HealthOptions{Workers: 2, Timeout: 2 * time.Second, Auth: true, Keep: 3, AgentSocket: "none"}
+	var mu sync.Mutex
+	got := make(map[string]model.HealthCheck)
+	err := CheckHosts(context.Background(), dir, opts, func(c model.HealthCheck) {
+		mu.Lock()
+		got[c.Host] = c
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("CheckHosts failed: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 hosts checked (wildcards skipped), got %+v", got)
+	}
+	if c := got["up1"]; !c.Reachable || c.HostKey != "warn" || c.Auth != "ok" {
+		t.Errorf("up1: unexpected result %+v", c)
+	}
+	if c := got["down"]; c.Reachable || c.Error == "" {
+		t.Errorf("down: unexpected result %+v", c)
+	}
+
+	// Without auth no keys are offered, and only the last Keep results stay
+	opts.Auth = false
+	for i := 0; i < 3; i++ {
+		CheckHosts(context.Background(), dir, opts, func(c model.HealthCheck) {
+			if c.Auth != "" {
+				t.Errorf("auth tested without opting in: %+v", c)
+			}
+		})
+	}
+	history, err := HealthHistory(dir)
+	if err != nil {
+		t.Fatalf("HealthHistory failed: %v", err)
+	}
+	if len(history["up2"]) != 3 || history["up2"][2].Auth != "" {
+		t.Errorf("expected last 3 results for up2, got %+v", history["up2"])
+	}
+}
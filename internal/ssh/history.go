@@ -0,0 +1,497 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+const (
+	// maxHistoryPerFile caps how many changes are kept for each file.
+	maxHistoryPerFile = 100
+
+	// historyContext is how many unchanged lines a recorded change keeps
+	// around each hunk.
+	historyContext = 3
+)
+
+var (
+	historyMu      sync.Mutex
+	historyEnabled = make(map[string]bool)
+)
+
+// EnableHistory records every change WriteFile and UpdateFile make to files
+// in dir in its history journal, so they can be undone later.
+func EnableHistory(dir *SSHDir) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if historyEnabled[dir.Base] {
+		return
+	}
+	historyEnabled[dir.Base] = true
+
+	OnFileWrite(func(path string, before, after []byte) {
+		if rel := dir.RelPath(path); rel != path {
+			if err := RecordHistory(dir, rel, string(before), string(after)); err != nil {
+				fmt.Fprintf(os.Stderr, "history: %v\n", err)
+			}
+		}
+	})
+}
+
+// HistoryPath returns the journal file.
+func HistoryPath(dir *SSHDir) string {
+	return filepath.Join(dir.HistoryDir(), "history.json")
+}
+
+// RecordHistory appends a change to file (relative to the SSH dir) to the
+// journal, as the hunks that turn before into after. A new change discards
+// the file's undone changes, which can no longer be redone.
+func RecordHistory(dir *SSHDir, file, before, after string) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	entries, err := loadHistory(dir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	kept := entries[:0]
+	count := 0
+	for _, e := range entries {
+		if e.ID >= next {
+			next = e.ID + 1
+		}
+		if e.File == file {
+			if e.Undone {
+				continue
+			}
+			count++
+		}
+		kept = append(kept, e)
+	}
+	entries = append(kept, model.HistoryEntry{
+		ID:            next,
+		File:          file,
+		Time:          time.Now(),
+		BeforeVersion: contentVersion([]byte(before)),
+		AfterVersion:  contentVersion([]byte(after)),
+		Hunks:         diffHunks(DiffLines(before, after), historyContext),
+	})
+
+	// Drop the file's oldest changes beyond the cap.
+	if drop := count + 1 - maxHistoryPerFile; drop > 0 {
+		kept = entries[:0]
+		for _, e := range entries {
+			if e.File == file && drop > 0 {
+				drop--
+				continue
+			}
+			kept = append(kept, e)
+		}
+		entries = kept
+	}
+	return saveHistory(dir, entries)
+}
+
+// ListHistory returns recorded changes newest first, for one file or for
+// all files when file is "".
+func ListHistory(dir *SSHDir, file string) ([]model.HistoryEntry, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	entries, err := loadHistory(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []model.HistoryEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if file == "" || entries[i].File == file {
+			out = append(out, entries[i])
+		}
+	}
+	return out, nil
+}
+
+// GetHistory returns a single recorded change.
+func GetHistory(dir *SSHDir, id int) (*model.HistoryEntry, error) {
+	entries, err := ListHistory(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.ID == id {
+			return &e, nil
+		}
+	}
+	return nil, fmt.Errorf("change not found: %d", id)
+}
+
+// Undo restores file to its state before its most recent change. It fails
+// with ErrConflict if the file was edited outside the app since.
+func Undo(dir *SSHDir, file string) (*model.HistoryEntry, error) {
+	return stepHistory(dir, file, true)
+}
+
+// Redo reapplies the change to file most recently undone.
+func Redo(dir *SSHDir, file string) (*model.HistoryEntry, error) {
+	return stepHistory(dir, file, false)
+}
+
+func stepHistory(dir *SSHDir, file string, undo bool) (*model.HistoryEntry, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	entries, err := loadHistory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file's undone changes always trail its applied ones, so the undo
+	// target is the last applied change and the redo target the first
+	// undone one.
+	target := -1
+	for i, e := range entries {
+		if e.File != file {
+			continue
+		}
+		if undo && !e.Undone {
+			target = i
+		}
+		if !undo && e.Undone {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		if undo {
+			return nil, fmt.Errorf("nothing to undo for %s", file)
+		}
+		return nil, fmt.Errorf("nothing to redo for %s", file)
+	}
+
+	e := &entries[target]
+	from := e.AfterVersion
+	if !undo {
+		from = e.BeforeVersion
+	}
+	if err := restoreFile(dir, file, from, e.Hunks, undo); err != nil {
+		return nil, err
+	}
+	e.Undone = undo
+	return e, saveHistory(dir, entries)
+}
+
+// RevertChange undoes a single change, even if later changes were made to the
+// same file since, by reversing just the lines it touched. The revert is
+// recorded as a new change. Reverting the latest change is the same as Undo.
+func RevertChange(dir *SSHDir, id int) error {
+	e, err := GetHistory(dir, id)
+	if err != nil {
+		return err
+	}
+	if e.Undone {
+		return fmt.Errorf("change %d is already undone", id)
+	}
+
+	latest, err := ListHistory(dir, e.File)
+	if err != nil {
+		return err
+	}
+	for _, l := range latest {
+		if l.Undone {
+			continue
+		}
+		if l.ID == id {
+			_, err := Undo(dir, e.File)
+			return err
+		}
+		break
+	}
+
+	path := dir.ExpandPath(e.File)
+	return UpdateFile(path, 0600, func(current []byte) ([]byte, error) {
+		// Later hunks first, so earlier ones are still where they were
+		lines := splitLines(string(current))
+		for i := len(e.Hunks) - 1; i >= 0; i-- {
+			before, after := hunkSides(e.Hunks[i])
+			var ok bool
+			if lines, ok = patchLines(lines, after, before); !ok {
+				return nil, fmt.Errorf("change %d overlaps later edits to %s and cannot be reverted on its own", id, e.File)
+			}
+		}
+		return []byte(strings.Join(lines, "\n")), nil
+	})
+}
+
+// restoreFile applies hunks to file, backwards when reverse is set, provided
+// the file is still at version from. The write bypasses the history hooks.
+func restoreFile(dir *SSHDir, file, from string, hunks []model.DiffHunk, reverse bool) error {
+	_, _, err := updateFile(dir.ExpandPath(file), 0600, keepMode, func(current []byte) ([]byte, error) {
+		if contentVersion(current) != from {
+			return nil, ErrConflict
+		}
+		lines, ok := applyHunks(splitLines(string(current)), hunks, reverse)
+		if !ok {
+			return nil, ErrConflict
+		}
+		return []byte(strings.Join(lines, "\n")), nil
+	})
+	return err
+}
+
+func loadHistory(dir *SSHDir) ([]model.HistoryEntry, error) {
+	data, err := os.ReadFile(HistoryPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	var entries []model.HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse history: %w", err)
+	}
+	return entries, nil
+}
+
+func saveHistory(dir *SSHDir, entries []model.HistoryEntry) error {
+	if err := os.MkdirAll(dir.HistoryDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(HistoryPath(dir), data, 0600, keepMode)
+}
+
+// DiffLines returns a line diff from before to after.
+func DiffLines(before, after string) []model.DiffLine {
+	a, b := splitLines(before), splitLines(after)
+
+	var prefix, suffix []model.DiffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, model.DiffLine{Op: " ", Text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]model.DiffLine{{Op: " ", Text: a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// Longest common subsequence over the changed middle. Very large
+	// rewrites are shown as a block replace instead.
+	var middle []model.DiffLine
+	if len(a)*len(b) > 1_000_000 {
+		for _, l := range a {
+			middle = append(middle, model.DiffLine{Op: "-", Text: l})
+		}
+		for _, l := range b {
+			middle = append(middle, model.DiffLine{Op: "+", Text: l})
+		}
+	} else {
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				middle = append(middle, model.DiffLine{Op: " ", Text: a[i]})
+				i++
+				j++
+			case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+				middle = append(middle, model.DiffLine{Op: "+", Text: b[j]})
+				j++
+			default:
+				middle = append(middle, model.DiffLine{Op: "-", Text: a[i]})
+				i++
+			}
+		}
+	}
+
+	out := append(prefix, middle...)
+	return append(out, suffix...)
+}
+
+// DiffContext trims a diff to the changed lines and n unchanged lines
+// around each of them.
+func DiffContext(diff []model.DiffLine, n int) []model.DiffLine {
+	keep := contextMask(diff, n)
+	var out []model.DiffLine
+	for i, d := range diff {
+		if keep[i] {
+			out = append(out, d)
+		} else if i > 0 && keep[i-1] {
+			out = append(out, model.DiffLine{Op: "…"})
+		}
+	}
+	return out
+}
+
+// contextMask marks the changed lines of diff and the n unchanged lines
+// around each of them.
+func contextMask(diff []model.DiffLine, n int) []bool {
+	keep := make([]bool, len(diff))
+	for i, d := range diff {
+		if d.Op == " " {
+			continue
+		}
+		for j := max(0, i-n); j <= min(len(diff)-1, i+n); j++ {
+			keep[j] = true
+		}
+	}
+	return keep
+}
+
+// diffHunks splits a diff into hunks of its changed lines with n unchanged
+// lines of context.
+func diffHunks(diff []model.DiffLine, n int) []model.DiffHunk {
+	keep := contextMask(diff, n)
+	var hunks []model.DiffHunk
+	line := 0
+	for i, d := range diff {
+		if keep[i] {
+			if i == 0 || !keep[i-1] {
+				hunks = append(hunks, model.DiffHunk{Line: line})
+			}
+			h := &hunks[len(hunks)-1]
+			h.Lines = append(h.Lines, d)
+		}
+		if d.Op != "+" {
+			line++
+		}
+	}
+	return hunks
+}
+
+// HunkDiff joins a recorded change's hunks into one diff, with "…" where
+// unchanged lines were left out, as DiffContext does.
+func HunkDiff(hunks []model.DiffHunk) []model.DiffLine {
+	var out []model.DiffLine
+	for i, h := range hunks {
+		if i > 0 {
+			out = append(out, model.DiffLine{Op: "…"})
+		}
+		out = append(out, h.Lines...)
+	}
+	return out
+}
+
+// hunkSides returns the lines of h before and after the change.
+func hunkSides(h model.DiffHunk) (before, after []string) {
+	for _, d := range h.Lines {
+		if d.Op != "+" {
+			before = append(before, d.Text)
+		}
+		if d.Op != "-" {
+			after = append(after, d.Text)
+		}
+	}
+	return before, after
+}
+
+// applyHunks applies hunks to lines, or undoes them when reverse is set.
+// Each hunk must sit exactly where it was recorded.
+func applyHunks(lines []string, hunks []model.DiffHunk, reverse bool) ([]string, bool) {
+	var out []string
+	at := 0
+	shift := 0 // lines added less lines removed by the hunks so far
+	for _, h := range hunks {
+		start := h.Line
+		if reverse {
+			start += shift
+		}
+		if start < at || start > len(lines) {
+			return nil, false
+		}
+		out = append(out, lines[at:start]...)
+		at = start
+		for _, d := range h.Lines {
+			removed, added := d.Op == "-", d.Op == "+"
+			if reverse {
+				removed, added = added, removed
+			}
+			if added {
+				out = append(out, d.Text)
+				continue
+			}
+			if at >= len(lines) || lines[at] != d.Text {
+				return nil, false
+			}
+			if !removed {
+				out = append(out, d.Text)
+			}
+			at++
+		}
+		for _, d := range h.Lines {
+			switch d.Op {
+			case "+":
+				shift++
+			case "-":
+				shift--
+			}
+		}
+	}
+	return append(out, lines[at:]...), true
+}
+
+// patchLines applies the change from -> to onto current. The changed region
+// of from, plus up to two lines of context on each side, must appear exactly
+// once in current.
+func patchLines(current, from, to []string) ([]string, bool) {
+	p := 0
+	for p < len(from) && p < len(to) && from[p] == to[p] {
+		p++
+	}
+	s := 0
+	for s < len(from)-p && s < len(to)-p && from[len(from)-1-s] == to[len(to)-1-s] {
+		s++
+	}
+
+	before := min(p, 2)
+	after := min(s, 2)
+	anchor := from[p-before : len(from)-s+after]
+
+	at := -1
+	for i := 0; i+len(anchor) <= len(current); i++ {
+		if slices.Equal(current[i:i+len(anchor)], anchor) {
+			if at >= 0 {
+				return nil, false
+			}
+			at = i
+		}
+	}
+	if at < 0 {
+		return nil, false
+	}
+
+	out := append([]string{}, current[:at+before]...)
+	out = append(out, to[p:len(to)-s]...)
+	return append(out, current[at+len(anchor)-after:]...), true
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
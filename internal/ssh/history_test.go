@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestHistoryUndoRedo(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	EnableHistory(dir)
+
+	if err := AddHost(dir, model.HostEntry{Alias: "web", HostName: "web.example.com"}); err != nil {
+		t.Fatalf("AddHost failed: %v", err)
+	}
+	if err := UpdateHost(dir, model.HostEntry{Alias: "web", HostName: "web2.example.com"}, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+	entries, err := ListHistory(dir, "config")
+	if err != nil {
+		t.Fatalf("ListHistory failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != 2 {
+		t.Fatalf("expected 2 changes newest first, got %+v", entries)
+	}
+
+	if _, err := Undo(dir, "config"); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	host, _ := GetHost(dir, "web")
+	if host == nil || host.HostName != "web.example.com" {
+		t.Fatalf("undo did not restore HostName: %+v", host)
+	}
+
+	if _, err := Redo(dir, "config"); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	host, _ = GetHost(dir, "web")
+	if host == nil || host.HostName != "web2.example.com" {
+		t.Fatalf("redo did not reapply HostName: %+v", host)
+	}
+	if _, err := Redo(dir, "config"); err == nil {
+		t.Fatal("expected nothing to redo")
+	}
+
+	// Undoing over an edit made outside the app is refused.
+	os.WriteFile(dir.ConfigPath(), []byte("Host other\n"), 0600)
+	if _, err := Undo(dir, "config"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
+
+func TestHistoryNewChangeClearsRedo(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	EnableHistory(dir)
+
+	WriteKnownHosts(dir, "a ssh-ed25519 AAAA\n", "")
+	WriteKnownHosts(dir, "b ssh-ed25519 AAAA\n", "")
+	if _, err := Undo(dir, "known_hosts"); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	WriteKnownHosts(dir, "c ssh-ed25519 AAAA\n", "")
+
+	if _, err := Redo(dir, "known_hosts"); err == nil {
+		t.Fatal("expected redo stack to be cleared by a new change")
+	}
+	entries, _ := ListHistory(dir, "known_hosts")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(entries))
+	}
+}
+
+func TestRevertChange(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	EnableHistory(dir)
+
+	WriteConfig(dir, "Host a\n    User one\n\nHost b\n    User one\n")
+	WriteConfig(dir, "Host a\n    User two\n\nHost b\n    User one\n")
+	WriteConfig(dir, "Host a\n    User two\n\nHost b\n    User three\n")
+
+	// Revert the middle change only; host b keeps its later edit.
+	entries, _ := ListHistory(dir, "config")
+	if err := RevertChange(dir, entries[1].ID); err != nil {
+		t.Fatalf("RevertChange failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	if string(data) != "Host a\n    User one\n\nHost b\n    User three\n" {
+		t.Fatalf("unexpected config after revert:\n%s", data)
+	}
+
+	// The revert is itself a change that can be undone.
+	if _, err := Undo(dir, "config"); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	data, _ = os.ReadFile(dir.ConfigPath())
+	if !strings.Contains(string(data), "User two") {
+		t.Fatalf("undo of revert failed:\n%s", data)
+	}
+}
+
+func TestHistoryStoresChangedLines(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	EnableHistory(dir)
+
+	var lines []string
+	for i := range 50 {
+		lines = append(lines, fmt.Sprintf("Host h%d\n    User u%d", i, i))
+	}
+	before := strings.Join(lines, "\n") + "\n"
+	after := strings.Replace(strings.Replace(before, "User u3\n", "User x3\n", 1), "User u40\n", "User x40\n", 1)
+	WriteConfig(dir, before)
+	WriteConfig(dir, after)
+
+	entries, _ := ListHistory(dir, "config")
+	e := entries[0]
+	if len(e.Hunks) != 2 {
+		t.Fatalf("expected 2 hunks, got %+v", e.Hunks)
+	}
+	for _, h := range e.Hunks {
+		if len(h.Lines) > 2*historyContext+2 {
+			t.Errorf("hunk keeps %d lines, expected only the change and its context", len(h.Lines))
+		}
+	}
+
+	if _, err := Undo(dir, "config"); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if data, _ := os.ReadFile(dir.ConfigPath()); string(data) != before {
+		t.Fatalf("undo did not restore the config:\n%s", data)
+	}
+	if _, err := Redo(dir, "config"); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	if data, _ := os.ReadFile(dir.ConfigPath()); string(data) != after {
+		t.Fatalf("redo did not reapply the change:\n%s", data)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := DiffLines("a\nb\nc\nd", "a\nc\nx\nd")
+	var got []string
+	for _, d := range diff {
+		got = append(got, d.Op+d.Text)
+	}
+	if strings.Join(got, ",") != " a,-b, c,+x, d" {
+		t.Fatalf("unexpected diff: %v", got)
+	}
+}
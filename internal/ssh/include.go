@@ -0,0 +1,257 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// maxIncludeDepth matches OpenSSH's READCONF_MAX_DEPTH.
+const maxIncludeDepth = 16
+
+// LoadConfigTree loads the main config and, recursively, every file pulled in
+// by Include directives. Globs are expanded relative to the SSH directory and
+// sorted, as OpenSSH does. Missing files are ignored; files that would form a
+// cycle or exceed the depth limit are recorded with Err set.
+func LoadConfigTree(dir *SSHDir) (*ConfigFile, error) {
+	return loadConfigTree(dir, dir.ConfigPath(), nil, LoadConfigFile)
+}
+
+// loadConfigTree reads path and its includes with load, which lets callers
+// substitute unsaved content for a file.
+func loadConfigTree(dir *SSHDir, path string, stack []string, load func(string) (*ConfigFile, error)) (*ConfigFile, error) {
+	f, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	stack = append(stack, filepath.Clean(path))
+	f.Includes = make(map[*ConfigLine][]*ConfigFile)
+
+	for _, l := range f.Lines {
+		if !strings.EqualFold(l.Key, "Include") {
+			continue
+		}
+		for _, target := range includeTargets(dir, l) {
+			switch {
+			case containsPath(stack, target):
+				f.Includes[l] = append(f.Includes[l], &ConfigFile{Path: target, Err: fmt.Errorf("include cycle")})
+			case len(stack) >= maxIncludeDepth:
+				f.Includes[l] = append(f.Includes[l], &ConfigFile{Path: target, Err: fmt.Errorf("include nested too deeply")})
+			default:
+				child, err := loadConfigTree(dir, target, stack, load)
+				if err != nil {
+					child = &ConfigFile{Path: target, Err: err}
+				}
+				f.Includes[l] = append(f.Includes[l], child)
+			}
+		}
+	}
+	return f, nil
+}
+
+// includeTargets expands the glob patterns of an Include line into the
+// regular files they match, in sorted order.
+func includeTargets(dir *SSHDir, l *ConfigLine) []string {
+	var targets []string
+	for _, arg := range l.Args() {
+		matches, err := filepath.Glob(dir.ExpandPath(arg))
+		if err != nil {
+			continue
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				targets = append(targets, filepath.Clean(m))
+			}
+		}
+	}
+	return targets
+}
+
+// includedPath reports whether path matches an Include pattern anywhere in
+// the config tree, so a fragment counts as config even while it is being
+// created or removed.
+func includedPath(dir *SSHDir, path string) bool {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range root.Files() {
+		for _, l := range f.Lines {
+			if !strings.EqualFold(l.Key, "Include") {
+				continue
+			}
+			for _, arg := range l.Args() {
+				if ok, _ := filepath.Match(dir.ExpandPath(arg), path); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Files returns f and every successfully loaded file it includes, depth
+// first in the order ssh reads them. A file included twice is listed once.
+func (f *ConfigFile) Files() []*ConfigFile {
+	var out []*ConfigFile
+	seen := make(map[string]bool)
+	var walk func(*ConfigFile)
+	walk = func(cf *ConfigFile) {
+		if cf.Err != nil || seen[cf.Path] {
+			return
+		}
+		seen[cf.Path] = true
+		out = append(out, cf)
+		for _, l := range cf.Lines {
+			for _, child := range cf.Includes[l] {
+				walk(child)
+			}
+		}
+	}
+	walk(f)
+	return out
+}
+
+// ConfigVersion returns a tag identifying the contents of every file in the
+// config tree, for use as an ETag by edits that address Match blocks or
+// forwards by position. A per-file version is not enough: a block added to
+// an earlier file shifts the IDs in an unchanged later one.
+func ConfigVersion(dir *SSHDir) (string, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return "", err
+	}
+	return treeVersion(root), nil
+}
+
+func treeVersion(root *ConfigFile) string {
+	h := sha256.New()
+	for _, f := range root.Files() {
+		fmt.Fprintf(h, "%s\x00%s\n", f.Path, f.Version)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// ConfigFileTree returns the include hierarchy rooted at the main config.
+func ConfigFileTree(dir *SSHDir) (*model.ConfigFileNode, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	node := buildFileNode(dir, root, 0)
+	return &node, nil
+}
+
+func buildFileNode(dir *SSHDir, f *ConfigFile, line int) model.ConfigFileNode {
+	node := model.ConfigFileNode{Path: dir.RelPath(f.Path), Line: line}
+	if f.Err != nil {
+		node.Error = f.Err.Error()
+		return node
+	}
+	for _, b := range f.Blocks() {
+		if b.IsHost() {
+			node.Hosts++
+		}
+	}
+	for i, l := range f.Lines {
+		for _, child := range f.Includes[l] {
+			node.Children = append(node.Children, buildFileNode(dir, child, i+1))
+		}
+	}
+	return node
+}
+
+// ListConfigFiles returns the main config and every included file, relative
+// to the SSH directory, in the order ssh reads them.
+func ListConfigFiles(dir *SSHDir) ([]string, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range root.Files() {
+		files = append(files, dir.RelPath(f.Path))
+	}
+	return files, nil
+}
+
+// ConfigFilePath resolves a file name from the UI or API to an absolute path.
+// An empty name means the main config; anything else must be the main config
+// or a file reachable through Include, so arbitrary paths cannot be written.
+func ConfigFilePath(dir *SSHDir, file string) (string, error) {
+	if file == "" {
+		return dir.ConfigPath(), nil
+	}
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return "", err
+	}
+	f, err := configFileIn(dir, root, file)
+	if err != nil {
+		return "", err
+	}
+	return f.Path, nil
+}
+
+// configFileIn is ConfigFilePath for an already loaded tree, returning the
+// loaded file so an edit can be saved against the version it was read at.
+func configFileIn(dir *SSHDir, root *ConfigFile, file string) (*ConfigFile, error) {
+	if file == "" {
+		return root, nil
+	}
+	want := dir.ExpandPath(file)
+	for _, f := range root.Files() {
+		if f.Path == want {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("not a config file: %s", file)
+}
+
+// hostFileIn returns the first file in root's read order that defines alias.
+func hostFileIn(root *ConfigFile, alias string) (*ConfigFile, error) {
+	for _, f := range root.Files() {
+		if f.FindHost(alias) != nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("host not found: %s", alias)
+}
+
+// findMatchFile returns the file holding the Match block with the given
+// global ID, along with the block's ID within that file. If version is not
+// empty and the tree no longer matches it, ErrConflict is returned.
+func findMatchFile(dir *SSHDir, id int, version string) (*ConfigFile, int, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version != "" && treeVersion(root) != version {
+		return nil, 0, ErrConflict
+	}
+	local := id
+	for _, f := range root.Files() {
+		n := len(f.Matches())
+		if local >= 1 && local <= n {
+			return f, local, nil
+		}
+		local -= n
+	}
+	return nil, 0, fmt.Errorf("match block not found: %d", id)
+}
+
+func containsPath(paths []string, p string) bool {
+	for _, s := range paths {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
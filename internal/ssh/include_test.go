@@ -0,0 +1,221 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// writeIncludeFixture creates a main config that includes config.d/*.conf,
+// where one included file includes a nested file and another loops back.
+func writeIncludeFixture(t *testing.T) *SSHDir {
+	t.Helper()
+	dir := NewSSHDir(t.TempDir())
+	os.MkdirAll(dir.Path("config.d"), 0700)
+
+	os.WriteFile(dir.ConfigPath(), []byte(`Include config.d/*.conf
+
+Host main
+    HostName main.example.com
+`), 0600)
+	os.WriteFile(dir.Path("config.d/10-work.conf"), []byte(`Host work
+    HostName work.example.com
+    User me
+
+Include ~/.ssh/nested.conf
+`), 0600)
+	os.WriteFile(dir.Path("config.d/20-loop.conf"), []byte(`Include config
+Host loop
+    HostName loop.example.com
+`), 0600)
+	os.WriteFile(dir.Path("nested.conf"), []byte(`Match host *.nested
+    User nested
+`), 0600)
+	return dir
+}
+
+func TestListHostsFollowsIncludes(t *testing.T) {
+	dir := writeIncludeFixture(t)
+
+	hosts, err := ListHosts(dir)
+	if err != nil {
+		t.Fatalf("ListHosts failed: %v", err)
+	}
+
+	var got []string
+	for _, h := range hosts {
+		got = append(got, fmt.Sprintf("%s@%s:%d", h.Alias, h.File, h.Line))
+	}
+	want := "main@config:3 work@config.d/10-work.conf:1 loop@config.d/20-loop.conf:2"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("unexpected hosts:\n got %s\nwant %s", strings.Join(got, " "), want)
+	}
+
+	matches, err := ListMatches(dir)
+	if err != nil {
+		t.Fatalf("ListMatches failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].File != "nested.conf" {
+		t.Fatalf("expected match from nested.conf, got %+v", matches)
+	}
+}
+
+func TestConfigFileTreeDetectsCycles(t *testing.T) {
+	dir := writeIncludeFixture(t)
+
+	tree, err := ConfigFileTree(dir)
+	if err != nil {
+		t.Fatalf("ConfigFileTree failed: %v", err)
+	}
+	if tree.Path != "config" || len(tree.Children) != 2 {
+		t.Fatalf("unexpected root: %+v", tree)
+	}
+	work := tree.Children[0]
+	if work.Path != "config.d/10-work.conf" || work.Line != 1 || work.Hosts != 1 {
+		t.Fatalf("unexpected work node: %+v", work)
+	}
+	if len(work.Children) != 1 || work.Children[0].Path != "nested.conf" {
+		t.Fatalf("expected nested include, got %+v", work.Children)
+	}
+	loop := tree.Children[1]
+	if len(loop.Children) != 1 || loop.Children[0].Error != "include cycle" {
+		t.Fatalf("expected cycle to be reported, got %+v", loop.Children)
+	}
+
+	files, err := ListConfigFiles(dir)
+	if err != nil {
+		t.Fatalf("ListConfigFiles failed: %v", err)
+	}
+	if strings.Join(files, ",") != "config,config.d/10-work.conf,nested.conf,config.d/20-loop.conf" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+}
+
+func TestEditHostInIncludedFile(t *testing.T) {
+	dir := writeIncludeFixture(t)
+
+	if err := UpdateHost(dir, model.HostEntry{Alias: "work", HostName: "work2.example.com", User: "me"}, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.Path("config.d/10-work.conf"))
+	if !strings.Contains(string(data), "HostName work2.example.com") {
+		t.Fatalf("included file not updated:\n%s", data)
+	}
+
+	if err := AddHost(dir, model.HostEntry{Alias: "extra", HostName: "extra.example.com", File: "config.d/20-loop.conf"}); err != nil {
+		t.Fatalf("AddHost failed: %v", err)
+	}
+	host, err := GetHost(dir, "extra")
+	if err != nil {
+		t.Fatalf("GetHost failed: %v", err)
+	}
+	if host.File != "config.d/20-loop.conf" {
+		t.Fatalf("expected host in 20-loop.conf, got %s", host.File)
+	}
+
+	if err := DeleteHost(dir, "work", ""); err != nil {
+		t.Fatalf("DeleteHost failed: %v", err)
+	}
+	if _, err := GetHost(dir, "work"); err == nil {
+		t.Fatal("expected work to be deleted")
+	}
+}
+
+func TestMoveHostBetweenFiles(t *testing.T) {
+	dir := writeIncludeFixture(t)
+
+	host := model.HostEntry{Alias: "main", HostName: "main.example.com", File: "config.d/10-work.conf"}
+	if err := UpdateHost(dir, host, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+
+	moved, err := GetHost(dir, "main")
+	if err != nil {
+		t.Fatalf("GetHost failed: %v", err)
+	}
+	if moved.File != "config.d/10-work.conf" {
+		t.Fatalf("expected host moved to 10-work.conf, got %s", moved.File)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	if strings.Contains(string(data), "Host main") {
+		t.Fatalf("host still in main config:\n%s", data)
+	}
+}
+
+func TestMoveHostKeepsBlockVerbatim(t *testing.T) {
+	dir := writeIncludeFixture(t)
+	os.WriteFile(dir.ConfigPath(), []byte(`Include config.d/*.conf
+
+Host main main-alias
+	HostName main.example.com
+	# reached through the bastion
+	ProxyJump bastion
+	SendEnv LANG
+`), 0600)
+	os.WriteFile(dir.Path("config.d/10-work.conf"), []byte("Host work\r\n    HostName work.example.com\r\n"), 0600)
+
+	// No options field: directives the form doesn't carry stay as they are
+	host := model.HostEntry{Alias: "main", HostName: "new.example.com", File: "config.d/10-work.conf"}
+	if err := UpdateHost(dir, host, ""); err != nil {
+		t.Fatalf("UpdateHost failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(dir.Path("config.d/10-work.conf"))
+	want := "Host work\r\n    HostName work.example.com\r\n\r\n" +
+		"Host main main-alias\r\n\tHostName new.example.com\r\n\t# reached through the bastion\r\n\tProxyJump bastion\r\n\tSendEnv LANG\r\n"
+	if string(data) != want {
+		t.Fatalf("unexpected target file:\n%q", data)
+	}
+	data, _ = os.ReadFile(dir.ConfigPath())
+	if string(data) != "Include config.d/*.conf\n" {
+		t.Fatalf("unexpected source file:\n%q", data)
+	}
+}
+
+func TestMoveHostConflictLeavesTarget(t *testing.T) {
+	dir := writeIncludeFixture(t)
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		t.Fatalf("LoadConfigTree failed: %v", err)
+	}
+	target, _ := os.ReadFile(dir.Path("config.d/10-work.conf"))
+
+	// Someone edits the main config after it was loaded
+	data, _ := os.ReadFile(dir.ConfigPath())
+	os.WriteFile(dir.ConfigPath(), append(data, "# edited\n"...), 0600)
+
+	host := model.HostEntry{Alias: "main", HostName: "main.example.com", File: "config.d/10-work.conf"}
+	if err := moveHost(dir, root, root, host); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if after, _ := os.ReadFile(dir.Path("config.d/10-work.conf")); string(after) != string(target) {
+		t.Fatalf("target file changed by a failed move:\n%s", after)
+	}
+}
+
+func TestConfigFilePathRejectsUnknownFiles(t *testing.T) {
+	dir := writeIncludeFixture(t)
+
+	if _, err := ConfigFilePath(dir, "known_hosts"); err == nil {
+		t.Fatal("expected error for non-config file")
+	}
+	if _, err := ConfigFilePath(dir, "../outside.conf"); err == nil {
+		t.Fatal("expected error for path outside the include tree")
+	}
+	path, err := ConfigFilePath(dir, "nested.conf")
+	if err != nil {
+		t.Fatalf("ConfigFilePath failed: %v", err)
+	}
+	if path != filepath.Join(dir.Base, "nested.conf") {
+		t.Fatalf("unexpected path: %s", path)
+	}
+
+	if err := AddHost(dir, model.HostEntry{Alias: "x", HostName: "x", File: "authorized_keys"}); err == nil {
+		t.Fatal("expected AddHost to reject non-config file")
+	}
+}
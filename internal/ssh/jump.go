@@ -0,0 +1,286 @@
+package ssh
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// sshArgFlags are the ssh options that take an argument, used to find the
+// destination in a `ProxyCommand ssh ...` line.
+const sshArgFlags = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// AnalyzeJumps builds the jump host graph for every host in the config from
+// each host's effective ProxyJump or `ProxyCommand ssh -W` setting, so jumps
+// set by wildcard Host or Match blocks are included. It reports cycles, hops
+// that look like aliases but are not defined, and hops whose host key is
+// missing from known_hosts.
+func AnalyzeJumps(dir *SSHDir) (*model.JumpGraph, error) {
+	hosts, err := ListHosts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &jumpAnalyzer{
+		dir:     dir,
+		defined: make(map[string]bool),
+		infos:   make(map[string]*jumpInfo),
+		known:   make(map[string]bool),
+		cycles:  make(map[string][]string),
+	}
+	var aliases []string
+	for _, h := range hosts {
+		if strings.ContainsAny(h.Alias, "*?!") || a.defined[h.Alias] {
+			continue
+		}
+		a.defined[h.Alias] = true
+		aliases = append(aliases, h.Alias)
+	}
+
+	graph := &model.JumpGraph{}
+	for _, alias := range aliases {
+		graph.Routes = append(graph.Routes, a.route(alias))
+	}
+	for _, key := range sortedKeys(a.cycles) {
+		graph.Cycles = append(graph.Cycles, a.cycles[key])
+	}
+	return graph, nil
+}
+
+type jumpInfo struct {
+	via      string
+	source   string
+	hops     []model.JumpHop
+	hostName string
+	port     string
+}
+
+type jumpAnalyzer struct {
+	dir     *SSHDir
+	defined map[string]bool
+	infos   map[string]*jumpInfo
+	known   map[string]bool
+	cycles  map[string][]string
+}
+
+func (a *jumpAnalyzer) route(alias string) model.JumpRoute {
+	info := a.info(alias)
+	route := model.JumpRoute{Host: alias, Via: info.via, Source: info.source, Hops: info.hops}
+
+	var cycle []string
+	route.Path = a.path(alias, nil, &cycle)
+	if route.Path == nil {
+		route.Issues = append(route.Issues, "jump cycle: "+strings.Join(cycle, " → "))
+	}
+
+	for i, hop := range info.hops {
+		if hop.Alias == alias {
+			route.Issues = append(route.Issues, fmt.Sprintf("%s jumps through itself", alias))
+			continue
+		}
+		if !hop.Defined && looksLikeAlias(hop.Alias) {
+			route.Issues = append(route.Issues, "undefined alias: "+hop.Alias)
+		}
+		if !hop.Known {
+			route.Issues = append(route.Issues, fmt.Sprintf("host key for hop %d (%s) not in known_hosts", i+1, knownHostsTarget(hop.HostName, hop.Port)))
+		}
+	}
+	return route
+}
+
+// path returns the hosts ssh connects through to reach name, ending with
+// name itself. Only the first hop is resolved recursively: ssh connects to it
+// with its own config, and tunnels the remaining hops through it. A cycle
+// returns nil and is recorded.
+func (a *jumpAnalyzer) path(name string, stack []string, cycle *[]string) []string {
+	for i, s := range stack {
+		if s == name {
+			*cycle = append(append([]string{}, stack[i:]...), name)
+			a.recordCycle(stack[i:])
+			return nil
+		}
+	}
+
+	info := a.info(name)
+	if len(info.hops) == 0 {
+		return []string{name}
+	}
+	p := a.path(info.hops[0].Alias, append(stack, name), cycle)
+	if p == nil {
+		return nil
+	}
+	for _, hop := range info.hops[1:] {
+		p = append(p, hop.Alias)
+	}
+	return append(p, name)
+}
+
+// recordCycle stores a cycle once, however many hosts lead into it.
+func (a *jumpAnalyzer) recordCycle(members []string) {
+	start := 0
+	for i, m := range members {
+		if m < members[start] {
+			start = i
+		}
+	}
+	rotated := append(append([]string{}, members[start:]...), members[:start]...)
+	rotated = append(rotated, rotated[0])
+	a.cycles[strings.Join(rotated, " ")] = rotated
+}
+
+// info resolves name's effective config once and parses its jump settings.
+func (a *jumpAnalyzer) info(name string) *jumpInfo {
+	if info, ok := a.infos[name]; ok {
+		return info
+	}
+	// Cache before parsing hops so a cycle ends here instead of recursing.
+	info := &jumpInfo{hostName: name, port: "22"}
+	a.infos[name] = info
+
+	res, err := ResolveHost(a.dir, name, ResolveOptions{})
+	if err != nil {
+		return info
+	}
+	var jump, command *model.ResolvedOption
+	for i, o := range res.Options {
+		switch o.Key {
+		case "hostname":
+			info.hostName = o.Value
+		case "port":
+			info.port = o.Value
+		case "proxyjump":
+			jump = &res.Options[i]
+		case "proxycommand":
+			command = &res.Options[i]
+		}
+	}
+
+	// The resolver keeps only whichever of the two was set first, as ssh does.
+	switch {
+	case jump != nil && !strings.EqualFold(jump.Value, "none"):
+		info.via = "ProxyJump"
+		info.source = fmt.Sprintf("%s:%d", jump.File, jump.Line)
+		for _, spec := range strings.Split(jump.Value, ",") {
+			info.hops = append(info.hops, a.hop(strings.TrimSpace(spec)))
+		}
+	case command != nil:
+		if spec := proxyCommandDestination(command.Value); spec != "" {
+			info.via = "ProxyCommand"
+			info.source = fmt.Sprintf("%s:%d", command.File, command.Line)
+			info.hops = append(info.hops, a.hop(spec))
+		}
+	}
+	return info
+}
+
+// hop parses a [user@]host[:port] spec and checks its host key.
+func (a *jumpAnalyzer) hop(spec string) model.JumpHop {
+	host, port := parseJumpSpec(spec)
+	info := a.info(host)
+	hop := model.JumpHop{Spec: spec, Alias: host, Defined: a.defined[host], HostName: info.hostName, Port: info.port}
+	if port != "" {
+		hop.Port = port
+	}
+
+	target := knownHostsTarget(hop.HostName, hop.Port)
+	known, ok := a.known[target]
+	if !ok {
+		entries, err := LookupKnownHost(a.dir, hop.HostName, hop.Port)
+		known = err == nil && len(entries) > 0
+		a.known[target] = known
+	}
+	hop.Known = known
+	return hop
+}
+
+// parseJumpSpec splits a ProxyJump hop, "[user@]host[:port]" or
+// "ssh://[user@]host[:port]", into host and port.
+func parseJumpSpec(spec string) (host, port string) {
+	spec = strings.TrimPrefix(spec, "ssh://")
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		spec = spec[i+1:]
+	}
+	if strings.HasPrefix(spec, "[") {
+		if end := strings.Index(spec, "]"); end > 0 {
+			return spec[1:end], strings.TrimPrefix(spec[end+1:], ":")
+		}
+	}
+	if strings.Count(spec, ":") == 1 {
+		i := strings.Index(spec, ":")
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// proxyCommandDestination returns the destination of a `ProxyCommand ssh ...`
+// line as a jump spec, or "" when the command isn't a plain ssh invocation
+// (nc, cloudflared, or a destination built from % tokens).
+func proxyCommandDestination(command string) string {
+	args := splitConfigArgs(command)
+	if len(args) == 0 || filepath.Base(args[0]) != "ssh" {
+		return ""
+	}
+
+	var dest, user, port string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || len(arg) < 2 {
+			if dest == "" {
+				dest = arg
+			}
+			continue
+		}
+		flag := arg[1]
+		if !strings.ContainsRune(sshArgFlags, rune(flag)) {
+			continue
+		}
+		value := arg[2:]
+		if value == "" && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		switch flag {
+		case 'l':
+			user = value
+		case 'p':
+			port = value
+		}
+	}
+
+	if dest == "" || strings.Contains(dest, "%") {
+		return ""
+	}
+	if user != "" && !strings.Contains(dest, "@") {
+		dest = user + "@" + dest
+	}
+	if port != "" {
+		dest += ":" + port
+	}
+	return dest
+}
+
+// looksLikeAlias reports whether a hop name is meant to be a config alias
+// rather than a DNS name or address.
+func looksLikeAlias(name string) bool {
+	return name != "localhost" && !strings.ContainsAny(name, ".:")
+}
+
+// knownHostsTarget formats a host the way known_hosts stores it.
+func knownHostsTarget(host, port string) string {
+	if port == "" || port == "22" {
+		return host
+	}
+	return fmt.Sprintf("[%s]:%s", host, port)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestAnalyzeJumps(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte(`Host bastion
+    HostName bastion.example.com
+    Port 2222
+
+Host inner
+    HostName 10.0.0.2
+    ProxyJump bastion
+
+Host deep
+    HostName 10.0.1.3
+    ProxyJump inner,admin@edge.example.com:2200
+
+Host legacy
+    HostName 10.0.0.9
+    ProxyCommand ssh -q -W %h:%p -l ops bastion
+
+Host loop1
+    ProxyJump loop2
+
+Host loop2
+    ProxyJump loop1
+
+Host ghost
+    ProxyJump nosuchalias
+`), 0600)
+	os.WriteFile(dir.KnownHostsPath(), []byte(`[bastion.example.com]:2222 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+10.0.0.2 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+`), 0644)
+
+	graph, err := AnalyzeJumps(dir)
+	if err != nil {
+		t.Fatalf("AnalyzeJumps failed: %v", err)
+	}
+	routes := make(map[string]model.JumpRoute)
+	for _, r := range graph.Routes {
+		routes[r.Host] = r
+	}
+
+	if r := routes["bastion"]; r.Via != "" || len(r.Path) != 1 || len(r.Issues) != 0 {
+		t.Fatalf("expected direct route for bastion, got %+v", r)
+	}
+	if r := routes["inner"]; strings.Join(r.Path, ",") != "bastion,inner" || len(r.Issues) != 0 || r.Source != "config:7" {
+		t.Fatalf("unexpected inner route: %+v", r)
+	}
+
+	deep := routes["deep"]
+	if strings.Join(deep.Path, ",") != "bastion,inner,edge.example.com,deep" {
+		t.Fatalf("unexpected deep path: %v", deep.Path)
+	}
+	if len(deep.Hops) != 2 || deep.Hops[1].Port != "2200" || deep.Hops[1].Known {
+		t.Fatalf("unexpected deep hops: %+v", deep.Hops)
+	}
+	if len(deep.Issues) != 1 || !strings.Contains(deep.Issues[0], "[edge.example.com]:2200") {
+		t.Fatalf("expected unknown host key issue, got %v", deep.Issues)
+	}
+
+	legacy := routes["legacy"]
+	if legacy.Via != "ProxyCommand" || len(legacy.Hops) != 1 || legacy.Hops[0].Spec != "ops@bastion" || !legacy.Hops[0].Known {
+		t.Fatalf("unexpected legacy route: %+v", legacy)
+	}
+
+	if r := routes["loop1"]; r.Path != nil || !strings.Contains(strings.Join(r.Issues, ";"), "jump cycle: loop1 → loop2 → loop1") {
+		t.Fatalf("expected cycle for loop1, got %+v", r)
+	}
+	if len(graph.Cycles) != 1 || strings.Join(graph.Cycles[0], ",") != "loop1,loop2,loop1" {
+		t.Fatalf("expected a single recorded cycle, got %v", graph.Cycles)
+	}
+
+	if r := routes["ghost"]; !strings.Contains(strings.Join(r.Issues, ";"), "undefined alias: nosuchalias") {
+		t.Fatalf("expected undefined alias, got %+v", r)
+	}
+}
+
+func TestAnalyzeJumpsWildcardSelfJump(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte(`Host bastion
+    HostName bastion.example.com
+
+Host *
+    ProxyJump bastion
+`), 0600)
+
+	graph, err := AnalyzeJumps(dir)
+	if err != nil {
+		t.Fatalf("AnalyzeJumps failed: %v", err)
+	}
+	if len(graph.Routes) != 1 {
+		t.Fatalf("expected one route, got %+v", graph.Routes)
+	}
+	issues := strings.Join(graph.Routes[0].Issues, ";")
+	if !strings.Contains(issues, "bastion jumps through itself") || !strings.Contains(issues, "jump cycle") {
+		t.Fatalf("expected self-jump to be reported, got %s", issues)
+	}
+}
+
+func TestProxyCommandDestination(t *testing.T) {
+	tests := map[string]string{
+		"ssh -W %h:%p jump":                  "jump",
+		"ssh -q -W %h:%p -p 2222 -l me jump": "me@jump:2222",
+		"/usr/bin/ssh jump -W %h:%p":         "jump",
+		"nc -X 5 -x proxy:1080 %h %p":        "",
+		"ssh -W %h:%p %r@%h.jump":            "",
+	}
+	for cmd, want := range tests {
+		if got := proxyCommandDestination(cmd); got != want {
+			t.Errorf("proxyCommandDestination(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+}
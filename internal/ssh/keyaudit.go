@@ -0,0 +1,187 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// DefaultKeyMaxAge is how old a key can get before the audit flags it,
+// unless the app config sets keyaudit.max-age.
+const DefaultKeyMaxAge = 2 * 365 * 24 * time.Hour
+
+// KeyAuditCheck is a check run by AuditKeys. Penalty is taken off the key's
+// score of 100 when the check fails.
+type KeyAuditCheck struct {
+	ID          string
+	Severity    string
+	Penalty     int
+	Description string
+}
+
+// KeyAuditChecks is the catalogue of key audit checks.
+var KeyAuditChecks = []KeyAuditCheck{
+	{"dsa", SeverityError, 60, "DSA key; OpenSSH has disabled DSA since 7.0"},
+	{"rsa-weak", SeverityError, 50, "RSA key shorter than 2048 bits"},
+	{"rsa-size", SeverityWarning, 25, "RSA key shorter than 3072 bits"},
+	{"ecdsa", SeverityInfo, 10, "ECDSA key where policy prefers Ed25519"},
+	{"unencrypted", SeverityWarning, 20, "Private key has no passphrase"},
+	{"permissions", SeverityError, 40, "Private key is readable by other users"},
+	{"pub-permissions", SeverityWarning, 10, "Public key is writable by other users"},
+	{"old", SeverityWarning, 10, "Key is older than the maximum age"},
+	{"unused", SeverityInfo, 5, "No config host uses the key as an IdentityFile"},
+}
+
+// KeyAuditOptions sets the policy AuditKeys checks against.
+type KeyAuditOptions struct {
+	// MaxAge flags keys modified longer ago than this. Zero means
+	// DefaultKeyMaxAge and a negative value turns the check off.
+	MaxAge time.Duration
+	// PreferEd25519 flags ECDSA keys.
+	PreferEd25519 bool
+	// Disabled lists check IDs to skip, usually AppConfig.KeyAuditDisabled.
+	Disabled []string
+}
+
+// KeyAuditOptionsFromConfig returns the key audit policy set in the app
+// config.
+func KeyAuditOptionsFromConfig(cfg *AppConfig) KeyAuditOptions {
+	return KeyAuditOptions{
+		MaxAge:        time.Duration(cfg.KeyMaxAgeDays) * 24 * time.Hour,
+		PreferEd25519: cfg.PreferEd25519,
+		Disabled:      cfg.KeyAuditDisabled,
+	}
+}
+
+// AuditKeys scores every key in the SSH directory.
+func AuditKeys(dir *SSHDir, opts KeyAuditOptions) (*model.KeyAuditReport, error) {
+	keys, err := ListKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	refCount, err := KeyRefCount(dir)
+	if err != nil {
+		refCount = make(map[string]int)
+	}
+	return ScoreKeys(dir, keys, refCount, opts), nil
+}
+
+// ScoreKeys audits keys already listed by ListKeys, with refCount from
+// KeyRefCount. IdentityFile values like ~/.ssh/id_rsa count towards the key
+// they resolve to.
+func ScoreKeys(dir *SSHDir, keys []model.SSHKey, refCount map[string]int, opts KeyAuditOptions) *model.KeyAuditReport {
+	if opts.MaxAge == 0 {
+		opts.MaxAge = DefaultKeyMaxAge
+	}
+	refs := make(map[string]int)
+	for file, n := range refCount {
+		refs[dir.RelPath(dir.ExpandPath(file))] += n
+	}
+	report := &model.KeyAuditReport{
+		Time:          time.Now(),
+		Score:         100,
+		Keys:          []model.KeyAudit{},
+		Counts:        make(map[string]int),
+		PreferEd25519: opts.PreferEd25519,
+	}
+	if opts.MaxAge > 0 {
+		report.MaxAgeDays = int(opts.MaxAge / (24 * time.Hour))
+	}
+
+	total := 0
+	for _, key := range keys {
+		a := auditKey(dir, key, refs[key.Name], opts)
+		for _, f := range a.Findings {
+			report.Counts[f.Check]++
+		}
+		total += a.Score
+		report.Keys = append(report.Keys, a)
+	}
+	if len(keys) > 0 {
+		report.Score = total / len(keys)
+	}
+	report.Grade = keyGrade(report.Score)
+	return report
+}
+
+// auditKey runs every enabled check against one key.
+func auditKey(dir *SSHDir, key model.SSHKey, refs int, opts KeyAuditOptions) model.KeyAudit {
+	a := model.KeyAudit{
+		Name:        key.Name,
+		Type:        key.Type,
+		Bits:        key.Bits,
+		Fingerprint: key.Fingerprint,
+		Score:       100,
+		Findings:    []model.KeyFinding{},
+	}
+	flag := func(id, format string, args ...any) {
+		if slices.Contains(opts.Disabled, id) {
+			return
+		}
+		for _, c := range KeyAuditChecks {
+			if c.ID == id {
+				a.Score -= c.Penalty
+				a.Findings = append(a.Findings, model.KeyFinding{Check: id, Severity: c.Severity, Message: fmt.Sprintf(format, args...)})
+			}
+		}
+	}
+
+	switch {
+	case key.Type == "ssh-dss":
+		flag("dsa", "DSA keys are disabled by default since OpenSSH 7.0; replace it with Ed25519")
+	case key.Type == "ssh-rsa" && key.Bits > 0 && key.Bits < 2048:
+		flag("rsa-weak", "RSA key is only %d bits; replace it with Ed25519 or RSA 3072+", key.Bits)
+	case key.Type == "ssh-rsa" && key.Bits > 0 && key.Bits < 3072:
+		flag("rsa-size", "RSA key is %d bits; 3072 or more is recommended", key.Bits)
+	case opts.PreferEd25519 && strings.HasPrefix(key.Type, "ecdsa-"):
+		flag("ecdsa", "ECDSA P-%d key; policy prefers Ed25519", key.Bits)
+	}
+
+	if key.Private != nil && !key.Private.Encrypted {
+		flag("unencrypted", "Private key is not protected by a passphrase")
+	}
+
+	// Unix permissions mean nothing on Windows
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(dir.Path(key.Name)); err == nil && key.HasPrivate && info.Mode().Perm()&0077 != 0 {
+			flag("permissions", "Private key mode is %04o; ssh refuses keys other users can read, use 0600", info.Mode().Perm())
+		}
+		if info, err := os.Stat(dir.Path(key.Name + ".pub")); err == nil && info.Mode().Perm()&0022 != 0 {
+			flag("pub-permissions", "Public key mode is %04o; other users could replace it, use 0644", info.Mode().Perm())
+		}
+	}
+
+	if opts.MaxAge > 0 && !key.ModTime.IsZero() {
+		if age := time.Since(key.ModTime); age > opts.MaxAge {
+			flag("old", "Key is %d days old; rotate keys older than %d days", int(age.Hours()/24), int(opts.MaxAge.Hours()/24))
+		}
+	}
+
+	if refs == 0 {
+		flag("unused", "No host in the SSH config uses this key")
+	}
+
+	a.Score = max(a.Score, 0)
+	a.Grade = keyGrade(a.Score)
+	return a
+}
+
+// keyGrade turns a score into a letter grade.
+func keyGrade(score int) string {
+	switch {
+	case score >= 90:
+		return "A"
+	case score >= 75:
+		return "B"
+	case score >= 60:
+		return "C"
+	case score >= 40:
+		return "D"
+	}
+	return "F"
+}
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func findingChecks(a model.KeyAudit) map[string]bool {
+	checks := make(map[string]bool)
+	for _, f := range a.Findings {
+		checks[f.Check] = true
+	}
+	return checks
+}
+
+func TestAuditKeys(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	for _, req := range []model.KeyGenRequest{
+		{Name: "id_ed25519", Type: "ed25519", Passphrase: "secret"},
+		{Name: "id_rsa", Type: "rsa", Bits: 2048},
+		{Name: "id_ecdsa", Type: "ecdsa", Passphrase: "secret"},
+	} {
+		req.Comment = "me@test"
+		if err := GenerateKey(dir, req); err != nil {
+			t.Fatalf("GenerateKey(%s) failed: %v", req.Name, err)
+		}
+	}
+	config := "Host a\n    IdentityFile ~/.ssh/id_ed25519\nHost b\n    IdentityFile ~/.ssh/id_ecdsa\n"
+	if err := os.WriteFile(dir.ConfigPath(), []byte(config), 0600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+	os.Chmod(dir.Path("id_rsa"), 0644)
+	old := time.Now().Add(-3 * 365 * 24 * time.Hour)
+	os.Chtimes(dir.Path("id_rsa.pub"), old, old)
+
+	report, err := AuditKeys(dir, KeyAuditOptions{PreferEd25519: true})
+	if err != nil {
+		t.Fatalf("AuditKeys failed: %v", err)
+	}
+	audits := make(map[string]model.KeyAudit)
+	for _, a := range report.Keys {
+		audits[a.Name] = a
+	}
+
+	if a := audits["id_ed25519"]; a.Score != 100 || a.Grade != "A" || len(a.Findings) != 0 {
+		t.Errorf("expected a clean ed25519 key, got %+v", a)
+	}
+	if checks := findingChecks(audits["id_ecdsa"]); len(checks) != 1 || !checks["ecdsa"] {
+		t.Errorf("expected only the ecdsa finding, got %+v", audits["id_ecdsa"].Findings)
+	}
+	want := []string{"rsa-size", "unencrypted", "old", "unused"}
+	if runtime.GOOS != "windows" {
+		want = append(want, "permissions")
+	}
+	rsa := audits["id_rsa"]
+	checks := findingChecks(rsa)
+	for _, id := range want {
+		if !checks[id] {
+			t.Errorf("expected %s finding for id_rsa, got %+v", id, rsa.Findings)
+		}
+	}
+	if rsa.Score >= 40 || rsa.Grade != "F" {
+		t.Errorf("expected a failing score for id_rsa, got %d %s", rsa.Score, rsa.Grade)
+	}
+	if report.Counts["rsa-size"] != 1 || report.MaxAgeDays != 730 {
+		t.Errorf("unexpected report summary: %+v", report)
+	}
+	if report.Score != (audits["id_ed25519"].Score+audits["id_ecdsa"].Score+rsa.Score)/3 {
+		t.Errorf("expected the average score, got %d", report.Score)
+	}
+
+	// Disabled checks and the default policy
+	report, _ = AuditKeys(dir, KeyAuditOptions{MaxAge: -1, Disabled: []string{"unused", "permissions"}})
+	for _, a := range report.Keys {
+		checks := findingChecks(a)
+		if checks["ecdsa"] || checks["old"] || checks["unused"] || checks["permissions"] {
+			t.Errorf("%s: unexpected findings %+v", a.Name, a.Findings)
+		}
+	}
+}
+
+func TestKeyAuditConfig(t *testing.T) {
+	cfg := parseAppConfig("keyaudit.max-age=90\nkeyaudit.prefer-ed25519=true\nkeyaudit.disable=unused, old\n")
+	opts := KeyAuditOptionsFromConfig(cfg)
+	if opts.MaxAge != 90*24*time.Hour || !opts.PreferEd25519 || len(opts.Disabled) != 2 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if opts := KeyAuditOptionsFromConfig(parseAppConfig("keyaudit.max-age=off\n")); opts.MaxAge >= 0 {
+		t.Errorf("expected the age check off, got %v", opts.MaxAge)
+	}
+}
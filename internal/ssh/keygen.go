@@ -0,0 +1,305 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultRSABits   = 3072
+	defaultECDSABits = 256
+)
+
+// GenerateKey creates a new key pair in-process and writes it in OpenSSH
+// format, encrypted with bcrypt-pbkdf and aes256-ctr when a passphrase is
+// given. Security key types (ed25519-sk, ecdsa-sk), and every type when the
+// app config sets keygen=ssh-keygen, go through ssh-keygen instead.
+func GenerateKey(dir *SSHDir, req model.KeyGenRequest) error {
+	if err := dir.EnsureDir(); err != nil {
+		return err
+	}
+
+	// Don't overwrite existing keys. This only saves generating a key for
+	// nothing: the files are created exclusively, which catches a key that
+	// appears in the meantime.
+	if fileExists(dir.Path(req.Name)) || fileExists(dir.Path(req.Name+".pub")) {
+		return fmt.Errorf("key already exists: %s", req.Name)
+	}
+	if req.Comment == "" {
+		req.Comment = defaultKeyComment()
+	}
+
+	if strings.HasSuffix(req.Type, "-sk") {
+		return generateKeyExec(dir, req)
+	}
+	if cfg, err := LoadAppConfig(); err == nil && cfg.KeyGen == "ssh-keygen" {
+		return generateKeyExec(dir, req)
+	}
+
+	key, err := newPrivateKey(req.Type, req.Bits)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(dir, req.Name, key, req.Comment, req.Passphrase)
+}
+
+// newPrivateKey generates a key of the given type. Bits is the RSA modulus
+// size or the ECDSA curve size; 0 picks ssh-keygen's default.
+func newPrivateKey(keyType string, bits int) (crypto.PrivateKey, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "rsa":
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		if bits < 1024 || bits > 16384 {
+			return nil, fmt.Errorf("invalid RSA key size %d: must be between 1024 and 16384", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ECDSA key size %d: must be 256, 384 or 521", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", keyType)
+}
+
+// writeKeyPair writes key as name (0600) and its public half as name.pub
+// (0644), both in OpenSSH format.
+func writeKeyPair(dir *SSHDir, name string, key crypto.PrivateKey, comment, passphrase string) error {
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		return fmt.Errorf("unsupported key: %w", err)
+	}
+	priv, err := marshalPrivateKey(key, comment, passphrase)
+	if err != nil {
+		return err
+	}
+	pub := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(signer.PublicKey())))
+	if comment != "" {
+		pub += " " + comment
+	}
+
+	if err := writeNew(dir.Path(name), priv, 0600); err != nil {
+		return keyWriteError(name, "private", err)
+	}
+	if err := writeNew(dir.Path(name+".pub"), []byte(pub+"\n"), 0644); err != nil {
+		os.Remove(dir.Path(name))
+		return keyWriteError(name, "public", err)
+	}
+	return dir.SetKeyPermissions(name)
+}
+
+// keyWriteError reports a failure to create the private or public half of
+// the key name, telling apart a key that already exists.
+func keyWriteError(name, half string, err error) error {
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("key already exists: %s", name)
+	}
+	return fmt.Errorf("write %s key: %w", half, err)
+}
+
+// marshalPrivateKey encodes key as an OpenSSH private key, encrypted when
+// passphrase isn't empty.
+func marshalPrivateKey(key crypto.PrivateKey, comment, passphrase string) ([]byte, error) {
+	var block *pem.Block
+	var err error
+	if passphrase != "" {
+		block, err = gossh.MarshalPrivateKeyWithPassphrase(key, comment, []byte(passphrase))
+	} else {
+		block, err = gossh.MarshalPrivateKey(key, comment)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// generateKeyExec runs ssh-keygen to generate the key pair. The key is
+// created without a passphrase, so it never appears on the command line,
+// and encrypted afterwards in-process. Until then it sits unencrypted in a
+// private (0700) temp dir next to the keys, and is only linked into place
+// once it is in its final form.
+//
+// Security key private keys are handles that Go can't parse, so they can't
+// be encrypted this way and are refused with a passphrase.
+func generateKeyExec(dir *SSHDir, req model.KeyGenRequest) error {
+	if req.Passphrase != "" && strings.HasSuffix(req.Type, "-sk") {
+		return fmt.Errorf("can't set a passphrase on a %s key here; generate it without one, then run ssh-keygen -p", req.Type)
+	}
+
+	privPath := dir.Path(req.Name)
+	tmpDir, err := os.MkdirTemp(filepath.Dir(privPath), ".keygen-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyPath := filepath.Join(tmpDir, "key")
+	args := []string{"-q", "-t", req.Type, "-f", keyPath, "-N", "", "-C", req.Comment}
+	if req.Bits > 0 && (req.Type == "rsa" || req.Type == "ecdsa") {
+		args = append(args, "-b", fmt.Sprintf("%d", req.Bits))
+	}
+
+	cmd := exec.Command("ssh-keygen", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen failed: %s: %w", string(output), err)
+	}
+
+	if req.Passphrase != "" {
+		if err := encryptKeyFile(keyPath, req.Comment, req.Passphrase); err != nil {
+			return err
+		}
+	}
+	if err := linkNew(keyPath, privPath); err != nil {
+		return keyWriteError(req.Name, "private", err)
+	}
+	if err := linkNew(keyPath+".pub", privPath+".pub"); err != nil {
+		os.Remove(privPath)
+		return keyWriteError(req.Name, "public", err)
+	}
+	return dir.SetKeyPermissions(req.Name)
+}
+
+// encryptKeyFile re-encodes the unencrypted private key at path with a
+// passphrase.
+func encryptKeyFile(path, comment, passphrase string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read private key: %w", err)
+	}
+	key, err := gossh.ParseRawPrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("can't add a passphrase to this key: %w", err)
+	}
+	priv, err := marshalPrivateKey(key, comment, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, priv, 0600, forceMode)
+}
+
+// ErrPassphraseRequired and ErrWrongPassphrase report a missing or
+// incorrect passphrase for an encrypted private key.
+var (
+	ErrPassphraseRequired = errors.New("this key is encrypted; enter its current passphrase")
+	ErrWrongPassphrase    = errors.New("incorrect passphrase")
+)
+
+// KeyEncrypted reports whether the private key name is protected by a
+// passphrase.
+func KeyEncrypted(dir *SSHDir, name string) (bool, error) {
+	data, err := os.ReadFile(dir.Path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Errorf("private key not found: %s", name)
+		}
+		return false, fmt.Errorf("read private key: %w", err)
+	}
+	_, err = gossh.ParseRawPrivateKey(data)
+	var missing *gossh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("parse private key: %w", err)
+	}
+	return false, nil
+}
+
+// ChangePassphrase decrypts the private key name with oldPassphrase and
+// rewrites it in OpenSSH format encrypted with newPassphrase, like
+// ssh-keygen -p. oldPassphrase is ignored for unencrypted keys and an empty
+// newPassphrase removes the passphrase. The key is replaced atomically with
+// mode 0600 and, unlike config edits, never copied into the edit history.
+func ChangePassphrase(dir *SSHDir, name, oldPassphrase, newPassphrase string) error {
+	path := dir.Path(name)
+	if !fileExists(path) {
+		return fmt.Errorf("private key not found: %s", name)
+	}
+
+	comment := keyComment(dir, name)
+	_, _, err := updateFile(path, 0600, forceMode, func(data []byte) ([]byte, error) {
+		key, err := decryptPrivateKey(data, oldPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		if comment == "" {
+			// No .pub to take it from; keep the one in the key itself
+			comment = privateKeyComment(data, oldPassphrase)
+		}
+		return marshalPrivateKey(key, comment, newPassphrase)
+	})
+	return err
+}
+
+// decryptPrivateKey parses a private key, with passphrase if it is
+// encrypted. passphrase is ignored for unencrypted keys.
+func decryptPrivateKey(data []byte, passphrase string) (crypto.PrivateKey, error) {
+	key, err := gossh.ParseRawPrivateKey(data)
+	var missing *gossh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		key, err = gossh.ParseRawPrivateKeyWithPassphrase(data, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	return key, nil
+}
+
+// keyComment returns the comment of the key name from its .pub file, since
+// the raw private key parsers drop it.
+func keyComment(dir *SSHDir, name string) string {
+	data, err := os.ReadFile(dir.Path(name + ".pub"))
+	if err != nil {
+		return ""
+	}
+	_, comment, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return ""
+	}
+	return comment
+}
+
+// defaultKeyComment is the user@host comment ssh-keygen uses.
+func defaultKeyComment() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return currentUsername()
+	}
+	return currentUsername() + "@" + host
+}
@@ -0,0 +1,215 @@
+package ssh
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// checkKeyRoundTrip parses the generated private key with passphrase and
+// checks it matches the .pub file.
+func checkKeyRoundTrip(t *testing.T, dir *SSHDir, name, passphrase string) {
+	t.Helper()
+	data, err := os.ReadFile(dir.Path(name))
+	if err != nil {
+		t.Fatalf("read private key: %v", err)
+	}
+	var raw interface{}
+	if passphrase != "" {
+		raw, err = gossh.ParseRawPrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		raw, err = gossh.ParseRawPrivateKey(data)
+	}
+	if err != nil {
+		t.Fatalf("%s: ParseRawPrivateKey failed: %v", name, err)
+	}
+	signer, err := gossh.NewSignerFromKey(raw)
+	if err != nil {
+		t.Fatalf("%s: NewSignerFromKey failed: %v", name, err)
+	}
+
+	pubData, _ := os.ReadFile(dir.Path(name + ".pub"))
+	pub, comment, _, _, err := gossh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		t.Fatalf("%s: parse public key: %v", name, err)
+	}
+	if string(pub.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Errorf("%s: public key does not match private key", name)
+	}
+	if comment != "me@test" {
+		t.Errorf("%s: expected comment me@test, got %q", name, comment)
+	}
+}
+
+func TestGenerateKeyNative(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	tests := []model.KeyGenRequest{
+		{Name: "ed", Type: "ed25519"},
+		{Name: "ed_pass", Type: "ed25519", Passphrase: "correct horse"},
+		{Name: "rsa", Type: "rsa", Bits: 2048},
+		{Name: "rsa_pass", Type: "rsa", Bits: 2048, Passphrase: "correct horse"},
+		{Name: "ec256", Type: "ecdsa"},
+		{Name: "ec384", Type: "ecdsa", Bits: 384, Passphrase: "correct horse"},
+		{Name: "ec521", Type: "ecdsa", Bits: 521},
+	}
+	for _, req := range tests {
+		req.Comment = "me@test"
+		if err := GenerateKey(dir, req); err != nil {
+			t.Fatalf("GenerateKey(%s) failed: %v", req.Name, err)
+		}
+		checkKeyRoundTrip(t, dir, req.Name, req.Passphrase)
+	}
+
+	// Encrypted keys use bcrypt-pbkdf and aes256-ctr, and need the passphrase
+	data, _ := os.ReadFile(dir.Path("ed_pass"))
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(string(block.Bytes), "aes256-ctr") || !strings.Contains(string(block.Bytes), "bcrypt") {
+		t.Error("expected aes256-ctr/bcrypt encrypted key")
+	}
+	var missing *gossh.PassphraseMissingError
+	if _, err := gossh.ParseRawPrivateKey(data); !errors.As(err, &missing) {
+		t.Errorf("expected PassphraseMissingError, got %v", err)
+	}
+	if _, err := gossh.ParseRawPrivateKeyWithPassphrase(data, []byte("wrong")); err == nil {
+		t.Error("expected wrong passphrase to fail")
+	}
+
+	info, _ := os.Stat(dir.Path("rsa_pass"))
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected private key perm 0600, got %o", info.Mode().Perm())
+	}
+}
+
+func TestGenerateKeyInvalid(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	for _, req := range []model.KeyGenRequest{
+		{Name: "a", Type: "dsa"},
+		{Name: "b", Type: "rsa", Bits: 512},
+		{Name: "c", Type: "ecdsa", Bits: 255},
+		{Name: "d", Type: "ed25519-sk", Passphrase: "secret"},
+	} {
+		if err := GenerateKey(dir, req); err == nil {
+			t.Errorf("expected error for %+v", req)
+		}
+		if fileExists(dir.Path(req.Name)) {
+			t.Errorf("key file left behind for %+v", req)
+		}
+	}
+}
+
+func TestWriteKeyPairKeepsExistingKey(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	key, err := newPrivateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("newPrivateKey failed: %v", err)
+	}
+
+	// A key that appears after GenerateKey's check is neither replaced nor
+	// paired with a new half
+	for _, existing := range []string{"race", "race.pub"} {
+		os.WriteFile(dir.Path(existing), []byte("theirs\n"), 0600)
+		err := writeKeyPair(dir, "race", key, "me@test", "")
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("%s: expected an existing-key error, got %v", existing, err)
+		}
+		if data, _ := os.ReadFile(dir.Path(existing)); string(data) != "theirs\n" {
+			t.Errorf("%s was replaced: %q", existing, data)
+		}
+		entries, _ := os.ReadDir(dir.Base)
+		if len(entries) != 1 {
+			t.Errorf("%s: expected only the existing file, got %v", existing, entries)
+		}
+		os.Remove(dir.Path(existing))
+	}
+}
+
+func TestGenerateKeyExec(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	dir := NewSSHDir(t.TempDir())
+	req := model.KeyGenRequest{Name: "exec", Type: "ed25519", Comment: "me@test", Passphrase: "correct horse"}
+	if err := generateKeyExec(dir, req); err != nil {
+		t.Fatalf("generateKeyExec failed: %v", err)
+	}
+	checkKeyRoundTrip(t, dir, "exec", req.Passphrase)
+
+	// The unencrypted key only ever existed in a temp dir, now removed
+	entries, _ := os.ReadDir(dir.Base)
+	if len(entries) != 2 {
+		t.Errorf("expected only the key pair, got %v", entries)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id", Type: "ed25519", Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	os.Chmod(dir.Path("id"), 0644)
+
+	// Add a passphrase to an unencrypted key
+	if err := ChangePassphrase(dir, "id", "", "first"); err != nil {
+		t.Fatalf("ChangePassphrase (add) failed: %v", err)
+	}
+	checkKeyRoundTrip(t, dir, "id", "first")
+	if enc, err := KeyEncrypted(dir, "id"); err != nil || !enc {
+		t.Errorf("expected encrypted key, got %v, %v", enc, err)
+	}
+	info, _ := os.Stat(dir.Path("id"))
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected private key perm 0600, got %o", info.Mode().Perm())
+	}
+
+	// The current passphrase is required to change it
+	if err := ChangePassphrase(dir, "id", "", "second"); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if err := ChangePassphrase(dir, "id", "wrong", "second"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	checkKeyRoundTrip(t, dir, "id", "first")
+
+	if err := ChangePassphrase(dir, "id", "first", "second"); err != nil {
+		t.Fatalf("ChangePassphrase (change) failed: %v", err)
+	}
+	checkKeyRoundTrip(t, dir, "id", "second")
+
+	// An empty new passphrase removes it
+	if err := ChangePassphrase(dir, "id", "second", ""); err != nil {
+		t.Fatalf("ChangePassphrase (remove) failed: %v", err)
+	}
+	checkKeyRoundTrip(t, dir, "id", "")
+	if enc, _ := KeyEncrypted(dir, "id"); enc {
+		t.Error("expected unencrypted key")
+	}
+
+	if err := ChangePassphrase(dir, "missing", "", "x"); err == nil {
+		t.Error("expected error for missing key")
+	}
+}
+
+func TestChangePassphraseKeepsPrivateKeyComment(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	for _, typ := range []string{"ed25519", "rsa", "ecdsa"} {
+		name := "id_" + typ
+		if err := GenerateKey(dir, model.KeyGenRequest{Name: name, Type: typ, Bits: map[string]int{"rsa": 1024}[typ], Comment: "me@test", Passphrase: "first"}); err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		os.Remove(dir.Path(name + ".pub"))
+
+		if err := ChangePassphrase(dir, name, "first", "second"); err != nil {
+			t.Fatalf("%s: ChangePassphrase failed: %v", typ, err)
+		}
+		data, _ := os.ReadFile(dir.Path(name))
+		if got := privateKeyComment(data, "second"); got != "me@test" {
+			t.Errorf("%s: expected comment me@test, got %q", typ, got)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	opensshMagic = "openssh-key-v1\x00"
+	puttyMagic   = "PuTTY-User-Key-File-"
+)
+
+// PEM private key block types and the format each one is reported as.
+var pemKeyFormats = map[string]string{
+	"RSA PRIVATE KEY": "PEM PKCS#1",
+	"EC PRIVATE KEY":  "PEM SEC1",
+	"DSA PRIVATE KEY": "PEM DSA",
+	"PRIVATE KEY":     "PKCS#8",
+}
+
+// Object identifiers found in encrypted PKCS#8 keys.
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	pkcs8Ciphers = map[string]string{
+		"2.16.840.1.101.3.4.1.2":  "aes128-cbc",
+		"2.16.840.1.101.3.4.1.22": "aes192-cbc",
+		"2.16.840.1.101.3.4.1.42": "aes256-cbc",
+		"1.2.840.113549.3.7":      "des-ede3-cbc",
+	}
+)
+
+// looksLikePrivateKey reports whether the file at path starts like a PEM or
+// PuTTY private key, without reading all of it.
+func looksLikePrivateKey(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte(puttyMagic)) {
+		return true
+	}
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	return bytes.HasPrefix(line, []byte("-----BEGIN ")) && bytes.Contains(line, []byte("PRIVATE KEY-----"))
+}
+
+// inspectPrivateKey reads the format and encryption of a private key, and
+// its public half where that can be had without the passphrase: derived
+// from the key itself when it's unencrypted, otherwise from the copy
+// OpenSSH and PuTTY files carry in the clear. Encrypted PEM keys have none.
+func inspectPrivateKey(data []byte) (*model.PrivateKeyInfo, gossh.PublicKey, error) {
+	if bytes.HasPrefix(data, []byte(puttyMagic)) {
+		return inspectPuTTYKey(data)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("not a private key")
+	}
+	info := &model.PrivateKeyInfo{}
+	var pub gossh.PublicKey
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		var err error
+		pub, err = inspectOpenSSHKey(block.Bytes, info)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "ENCRYPTED PRIVATE KEY":
+		info.Format = "PKCS#8"
+		info.Encrypted = true
+		inspectPKCS8Encryption(block.Bytes, info)
+	default:
+		format, ok := pemKeyFormats[block.Type]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported private key type %q", block.Type)
+		}
+		info.Format = format
+		// Legacy OpenSSL encryption: the key is derived with one round of MD5
+		if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+			info.Encrypted = true
+			info.Cipher, _, _ = strings.Cut(block.Headers["DEK-Info"], ",")
+			info.KDF = "md5"
+			info.Rounds = 1
+		}
+	}
+
+	if !info.Encrypted {
+		if raw, err := gossh.ParseRawPrivateKey(data); err == nil {
+			if signer, err := gossh.NewSignerFromKey(raw); err == nil {
+				pub = signer.PublicKey()
+			}
+		}
+	}
+	return info, pub, nil
+}
+
+// inspectOpenSSHKey reads the header of an openssh-key-v1 container: the
+// cipher, KDF and its rounds, and the first public key, which is stored
+// unencrypted.
+func inspectOpenSSHKey(b []byte, info *model.PrivateKeyInfo) (gossh.PublicKey, error) {
+	if !bytes.HasPrefix(b, []byte(opensshMagic)) {
+		return nil, errors.New("invalid OpenSSH private key")
+	}
+	var w struct {
+		CipherName string
+		KdfName    string
+		KdfOpts    string
+		NumKeys    uint32
+		PubKey     []byte
+		Rest       []byte `ssh:"rest"`
+	}
+	if err := gossh.Unmarshal(b[len(opensshMagic):], &w); err != nil {
+		return nil, fmt.Errorf("invalid OpenSSH private key: %w", err)
+	}
+
+	info.Format = "OpenSSH"
+	if w.CipherName != "none" {
+		info.Encrypted = true
+		info.Cipher = w.CipherName
+		info.KDF = w.KdfName
+		var opts struct {
+			Salt   string
+			Rounds uint32
+		}
+		if w.KdfName == "bcrypt" && gossh.Unmarshal([]byte(w.KdfOpts), &opts) == nil {
+			info.Rounds = int(opts.Rounds)
+		}
+	}
+	if pub, err := gossh.ParsePublicKey(w.PubKey); err == nil {
+		return pub, nil
+	}
+	return nil, nil
+}
+
+// openSSHFieldCount is how many fields each key type has in the private
+// section of an openssh-key-v1 container, before the comment.
+var openSSHFieldCount = map[string]int{
+	gossh.KeyAlgoRSA:      6, // n, e, d, iqmp, p, q
+	gossh.KeyAlgoDSA:      5, // p, q, g, y, x
+	gossh.KeyAlgoED25519:  2, // public, private
+	gossh.KeyAlgoECDSA256: 3, // curve, public, private
+	gossh.KeyAlgoECDSA384: 3,
+	gossh.KeyAlgoECDSA521: 3,
+}
+
+// privateKeyComment returns the comment stored in an OpenSSH private key,
+// decrypting it with passphrase if needed, since the x/crypto parsers drop
+// it. Other formats have no comment and return "".
+func privateKeyComment(data []byte, passphrase string) string {
+	block, _ := pem.Decode(data)
+	if block == nil || !bytes.HasPrefix(block.Bytes, []byte(opensshMagic)) {
+		return ""
+	}
+	var w struct {
+		CipherName string
+		KdfName    string
+		KdfOpts    string
+		NumKeys    uint32
+		PubKey     []byte
+		PrivKey    []byte
+	}
+	if err := gossh.Unmarshal(block.Bytes[len(opensshMagic):], &w); err != nil {
+		return ""
+	}
+	priv := w.PrivKey
+	if w.CipherName != "none" {
+		var err error
+		if priv, err = decryptOpenSSHSection(w.CipherName, w.KdfName, w.KdfOpts, priv, passphrase); err != nil {
+			return ""
+		}
+	}
+
+	var section struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := gossh.Unmarshal(priv, &section); err != nil || section.Check1 != section.Check2 {
+		return ""
+	}
+	n, ok := openSSHFieldCount[section.KeyType]
+	if !ok {
+		return ""
+	}
+	rest := section.Rest
+	for i := 0; i <= n; i++ {
+		if len(rest) < 4 {
+			return ""
+		}
+		size := int(rest[0])<<24 | int(rest[1])<<16 | int(rest[2])<<8 | int(rest[3])
+		if size > len(rest)-4 {
+			return ""
+		}
+		if i == n {
+			return string(rest[4 : 4+size])
+		}
+		rest = rest[4+size:]
+	}
+	return ""
+}
+
+// decryptOpenSSHSection decrypts the private section of an openssh-key-v1
+// container with the bcrypt KDF and AES, as ssh-keygen writes it.
+func decryptOpenSSHSection(cipherName, kdfName, kdfOpts string, data []byte, passphrase string) ([]byte, error) {
+	if kdfName != "bcrypt" || passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+	var opts struct {
+		Salt   string
+		Rounds uint32
+	}
+	if err := gossh.Unmarshal([]byte(kdfOpts), &opts); err != nil {
+		return nil, err
+	}
+	k, err := bcryptPBKDF([]byte(passphrase), []byte(opts.Salt), int(opts.Rounds), 32+aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(k[:32])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	switch cipherName {
+	case "aes256-ctr":
+		cipher.NewCTR(c, k[32:]).XORKeyStream(out, data)
+	case "aes256-cbc":
+		if len(data)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid encrypted private key length")
+		}
+		cipher.NewCBCDecrypter(c, k[32:]).CryptBlocks(out, data)
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", cipherName)
+	}
+	return out, nil
+}
+
+// inspectPKCS8Encryption fills in the cipher and PBKDF2 iterations of an
+// encrypted PKCS#8 key, as written by OpenSSL and ssh-keygen -m PKCS8.
+func inspectPKCS8Encryption(der []byte, info *model.PrivateKeyInfo) {
+	var enc struct {
+		Algo pkix.AlgorithmIdentifier
+		Data []byte
+	}
+	if _, err := asn1.Unmarshal(der, &enc); err != nil {
+		return
+	}
+	if !enc.Algo.Algorithm.Equal(oidPBES2) {
+		info.Cipher = enc.Algo.Algorithm.String()
+		return
+	}
+
+	var params struct {
+		KDF    pkix.AlgorithmIdentifier
+		Scheme pkix.AlgorithmIdentifier
+	}
+	if _, err := asn1.Unmarshal(enc.Algo.Parameters.FullBytes, &params); err != nil {
+		return
+	}
+	info.Cipher = params.Scheme.Algorithm.String()
+	if name, ok := pkcs8Ciphers[info.Cipher]; ok {
+		info.Cipher = name
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		info.KDF = params.KDF.Algorithm.String()
+		return
+	}
+	info.KDF = "pbkdf2"
+	var kdf struct {
+		Salt       []byte
+		Iterations int
+	}
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err == nil {
+		info.Rounds = kdf.Iterations
+	}
+}
+
+// inspectPuTTYKey reads the headers of a PuTTY .ppk file and its public key
+// lines, which are never encrypted.
+func inspectPuTTYKey(data []byte) (*model.PrivateKeyInfo, gossh.PublicKey, error) {
+	info := &model.PrivateKeyInfo{Format: "PuTTY"}
+	var version string
+	var pub gossh.PublicKey
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ": ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(key, puttyMagic):
+			version = strings.TrimPrefix(key, puttyMagic)
+		case key == "Encryption":
+			if value != "none" {
+				info.Encrypted = true
+				info.Cipher = value
+			}
+		case key == "Key-Derivation":
+			info.KDF = strings.ToLower(value)
+		case key == "Argon2-Passes":
+			info.Rounds, _ = strconv.Atoi(value)
+		case key == "Public-Lines":
+			n, _ := strconv.Atoi(value)
+			var b64 strings.Builder
+			for i := 0; i < n && sc.Scan(); i++ {
+				b64.WriteString(strings.TrimSpace(sc.Text()))
+			}
+			if blob, err := base64.StdEncoding.DecodeString(b64.String()); err == nil {
+				pub, _ = gossh.ParsePublicKey(blob)
+			}
+		}
+	}
+	if version == "" {
+		return nil, nil, errors.New("invalid PuTTY private key")
+	}
+	// Version 2 files derive the key from one SHA-1 hash of the passphrase
+	if info.Encrypted && info.KDF == "" && version == "2" {
+		info.KDF = "sha1"
+		info.Rounds = 1
+	}
+	return info, pub, nil
+}
+
+// keyBits returns the size of a public key in bits: the RSA modulus or DSA
+// prime length, or the curve size.
+func keyBits(pub gossh.PublicKey) int {
+	if cert, ok := pub.(*gossh.Certificate); ok {
+		return keyBits(cert.Key)
+	}
+	if cpk, ok := pub.(gossh.CryptoPublicKey); ok {
+		switch k := cpk.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return k.N.BitLen()
+		case *ecdsa.PublicKey:
+			return k.Curve.Params().BitSize
+		case ed25519.PublicKey:
+			return 256
+		case *dsa.PublicKey:
+			return k.P.BitLen()
+		}
+	}
+	switch pub.Type() {
+	case gossh.KeyAlgoSKED25519, gossh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	return 0
+}
+
+// keyTypeLabel is the short key type ssh-keygen prints, e.g. ED25519 or
+// ECDSA-SK.
+func keyTypeLabel(pub gossh.PublicKey) string {
+	t := pub.Type()
+	cert := ""
+	if c, ok := pub.(*gossh.Certificate); ok {
+		t = c.Key.Type()
+		cert = "-CERT"
+	}
+	var label string
+	switch {
+	case t == gossh.KeyAlgoRSA:
+		label = "RSA"
+	case t == gossh.KeyAlgoDSA:
+		label = "DSA"
+	case t == gossh.KeyAlgoED25519:
+		label = "ED25519"
+	case t == gossh.KeyAlgoSKED25519:
+		label = "ED25519-SK"
+	case t == gossh.KeyAlgoSKECDSA256:
+		label = "ECDSA-SK"
+	case strings.HasPrefix(t, "ecdsa-"):
+		label = "ECDSA"
+	default:
+		label = strings.ToUpper(t)
+	}
+	return label + cert
+}
+
+// fingerprintMD5 returns the legacy MD5 fingerprint in ssh-keygen -E md5
+// form.
+func fingerprintMD5(pub gossh.PublicKey) string {
+	sum := md5.Sum(pub.Marshal())
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return "MD5:" + strings.Join(hex, ":")
+}
+
+// Randomart field size and symbols, as in OpenSSH's sshkey.c.
+const (
+	randomartWidth  = 17
+	randomartHeight = 9
+	randomartChars  = " .o+=*BOX@%&#/^SE"
+)
+
+// randomart draws the SHA256 "drunken bishop" visual fingerprint shown by
+// ssh-keygen -lv.
+func randomart(pub gossh.PublicKey) string {
+	digest := sha256.Sum256(pub.Marshal())
+	var field [randomartWidth][randomartHeight]int
+	top := len(randomartChars) - 1
+
+	x, y := randomartWidth/2, randomartHeight/2
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = max(0, min(x, randomartWidth-1))
+			y = max(0, min(y, randomartHeight-1))
+			if field[x][y] < top-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomartWidth/2][randomartHeight/2] = top - 1
+	field[x][y] = top
+
+	title := fmt.Sprintf("[%s %d]", keyTypeLabel(pub), keyBits(pub))
+	if len(title) >= randomartWidth {
+		title = "[" + keyTypeLabel(pub) + "]"
+	}
+	var sb strings.Builder
+	sb.WriteString(randomartBorder(title) + "\n")
+	for y := 0; y < randomartHeight; y++ {
+		sb.WriteByte('|')
+		for x := 0; x < randomartWidth; x++ {
+			sb.WriteByte(randomartChars[min(field[x][y], top)])
+		}
+		sb.WriteString("|\n")
+	}
+	sb.WriteString(randomartBorder("[SHA256]"))
+	return sb.String()
+}
+
+// randomartBorder is a +---[label]---+ line, with the label centred the way
+// ssh-keygen does it.
+func randomartBorder(label string) string {
+	pad := (randomartWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", pad) + label + strings.Repeat("-", randomartWidth-pad-len(label)) + "+"
+}
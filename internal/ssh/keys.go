@@ -1,18 +1,21 @@
 package ssh
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/holden/sshmasher/internal/model"
 	gossh "golang.org/x/crypto/ssh"
 )
 
-// ListKeys scans the SSH directory for key pairs and returns metadata about each.
+// ListKeys scans the SSH directory for key pairs and returns metadata about
+// each, including private keys that have no .pub file.
 func ListKeys(dir *SSHDir) ([]model.SSHKey, error) {
 	entries, err := os.ReadDir(dir.Base)
 	if err != nil {
@@ -22,66 +25,43 @@ func ListKeys(dir *SSHDir) ([]model.SSHKey, error) {
 		return nil, fmt.Errorf("read ssh dir: %w", err)
 	}
 
-	// Collect .pub files, then check for corresponding private keys
+	// Collect .pub files and orphaned private keys; parseKeyPair picks up
+	// the private half of each pair
 	var keys []model.SSHKey
 	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pub") {
+		if entry.IsDir() {
 			continue
 		}
 
-		name := strings.TrimSuffix(entry.Name(), ".pub")
+		name, isPub := strings.CutSuffix(entry.Name(), ".pub")
+		if !isPub && (fileExists(dir.Path(name+".pub")) || !looksLikePrivateKey(dir.Path(name))) {
+			continue
+		}
+		if base, ok := strings.CutSuffix(name, "-cert"); ok && isPub && isCertOf(dir, base) {
+			continue // shown with its key
+		}
 		key, err := parseKeyPair(dir, name)
 		if err != nil {
 			continue // skip unparseable keys
 		}
 		keys = append(keys, *key)
 	}
+	nameCertCAs(dir, keys)
 	return keys, nil
 }
 
 // GetKey returns detailed info for a specific key by name.
 func GetKey(dir *SSHDir, name string) (*model.SSHKey, error) {
-	pubPath := dir.Path(name + ".pub")
-	if _, err := os.Stat(pubPath); err != nil {
+	if !fileExists(dir.Path(name+".pub")) && !looksLikePrivateKey(dir.Path(name)) {
 		return nil, fmt.Errorf("key not found: %s", name)
 	}
-	return parseKeyPair(dir, name)
-}
-
-// GenerateKey runs ssh-keygen to generate a new key pair.
-func GenerateKey(dir *SSHDir, req model.KeyGenRequest) error {
-	if err := dir.EnsureDir(); err != nil {
-		return err
-	}
-
-	keyPath := dir.Path(req.Name)
-
-	// Don't overwrite existing keys
-	if _, err := os.Stat(keyPath); err == nil {
-		return fmt.Errorf("key already exists: %s", req.Name)
-	}
-
-	args := []string{
-		"-t", req.Type,
-		"-f", keyPath,
-		"-N", req.Passphrase,
-	}
-
-	if req.Comment != "" {
-		args = append(args, "-C", req.Comment)
-	}
-
-	if req.Bits > 0 && (req.Type == "rsa" || req.Type == "ecdsa") {
-		args = append(args, "-b", fmt.Sprintf("%d", req.Bits))
-	}
-
-	cmd := exec.Command("ssh-keygen", args...)
-	output, err := cmd.CombinedOutput()
+	key, err := parseKeyPair(dir, name)
 	if err != nil {
-		return fmt.Errorf("ssh-keygen failed: %s: %w", string(output), err)
+		return nil, err
 	}
-
-	return dir.SetKeyPermissions(req.Name)
+	keys := []model.SSHKey{*key}
+	nameCertCAs(dir, keys)
+	return &keys[0], nil
 }
 
 // DeleteKey removes both private and public key files.
@@ -127,43 +107,81 @@ func UpdateKeyComment(dir *SSHDir, name, newComment string) error {
 	return nil
 }
 
+// parseKeyPair reads the key name from its .pub file and inspects the
+// private key next to it. Either half may be missing, but not both.
 func parseKeyPair(dir *SSHDir, name string) (*model.SSHKey, error) {
+	key := &model.SSHKey{Name: name}
+	var pubKey gossh.PublicKey
+
 	pubPath := dir.Path(name + ".pub")
 	pubData, err := os.ReadFile(pubPath)
-	if err != nil {
+	switch {
+	case err == nil:
+		var comment string
+		pubKey, comment, _, _, err = gossh.ParseAuthorizedKey(pubData)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		key.HasPublic = true
+		key.PublicKey = strings.TrimSpace(string(pubData))
+		key.Comment = comment
+	case !os.IsNotExist(err):
 		return nil, fmt.Errorf("read public key: %w", err)
 	}
 
-	pubKey, comment, _, _, err := gossh.ParseAuthorizedKey(pubData)
-	if err != nil {
-		return nil, fmt.Errorf("parse public key: %w", err)
-	}
-
-	info, _ := os.Stat(pubPath)
-	hash := sha256.Sum256(pubKey.Marshal())
-	fingerprint := "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
-
 	privPath := dir.Path(name)
-	hasPrivate := fileExists(privPath)
+	key.HasPrivate = fileExists(privPath)
+	if privData, err := os.ReadFile(privPath); err == nil {
+		info, privPub, err := inspectPrivateKey(privData)
+		switch {
+		case err != nil && pubKey == nil:
+			return nil, fmt.Errorf("parse private key: %w", err)
+		case err != nil:
+			// Not a key we can read; report the .pub alone
+		case pubKey == nil:
+			key.Private = info
+			pubKey = privPub
+			if pubKey != nil {
+				key.PublicKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pubKey)))
+			}
+		default:
+			key.Private = info
+			if privPub != nil {
+				matches := bytes.Equal(privPub.Marshal(), pubKey.Marshal())
+				info.Matches = &matches
+			}
+		}
+	}
+	if !key.HasPublic && !key.HasPrivate {
+		return nil, fmt.Errorf("key not found: %s", name)
+	}
 
-	var totalSize int64
-	if pubInfo, err := os.Stat(pubPath); err == nil {
-		totalSize += pubInfo.Size()
+	if pubKey != nil {
+		hash := sha256.Sum256(pubKey.Marshal())
+		key.Type = pubKey.Type()
+		key.Bits = keyBits(pubKey)
+		key.Fingerprint = "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+		key.FingerprintMD5 = fingerprintMD5(pubKey)
+		key.Randomart = randomart(pubKey)
 	}
-	if privInfo, err := os.Stat(privPath); err == nil {
-		totalSize += privInfo.Size()
+
+	// The key's certificate, or the key itself when it is a certificate
+	// with no key of its own next to it
+	if cert, ok := pubKey.(*gossh.Certificate); ok {
+		key.Certificate = certInfo(name, cert, nil, time.Now())
+	} else if cert, err := readCert(dir, name); err == nil {
+		key.Certificate = certInfo(name, cert, nil, time.Now())
 	}
 
-	return &model.SSHKey{
-		Name:        name,
-		Type:        pubKey.Type(),
-		Fingerprint: fingerprint,
-		PublicKey:   strings.TrimSpace(string(pubData)),
-		Comment:     comment,
-		HasPrivate:  hasPrivate,
-		ModTime:     info.ModTime(),
-		Size:        totalSize,
-	}, nil
+	for _, path := range []string{pubPath, privPath} {
+		if info, err := os.Stat(path); err == nil {
+			if key.ModTime.IsZero() {
+				key.ModTime = info.ModTime()
+			}
+			key.Size += info.Size()
+		}
+	}
+	return key, nil
 }
 
 func fileExists(path string) bool {
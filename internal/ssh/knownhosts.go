@@ -1,8 +1,11 @@
 package ssh
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -44,6 +47,7 @@ func FilterKnownHosts(entries []model.KnownHostEntry, search string) []model.Kno
 	var filtered []model.KnownHostEntry
 	for _, e := range entries {
 		if strings.Contains(strings.ToLower(e.Hosts), search) ||
+			strings.Contains(strings.ToLower(e.Marker), search) ||
 			strings.Contains(strings.ToLower(e.KeyType), search) ||
 			strings.Contains(strings.ToLower(e.Fingerprint), search) {
 			filtered = append(filtered, e)
@@ -52,29 +56,169 @@ func FilterKnownHosts(entries []model.KnownHostEntry, search string) []model.Kno
 	return filtered
 }
 
-// RemoveKnownHost removes the entry at the given 1-based line number.
-func RemoveKnownHost(dir *SSHDir, line int) error {
-	data, err := os.ReadFile(dir.KnownHostsPath())
-	if err != nil {
+// RemoveKnownHost removes the entry at the given 1-based line number. It
+// fails with ErrConflict, removing nothing, if version is set and the file
+// has changed since; see RevokeKnownHost.
+func RemoveKnownHost(dir *SSHDir, line int, version string) error {
+	if _, err := os.Stat(dir.KnownHostsPath()); err != nil {
 		return fmt.Errorf("read known_hosts: %w", err)
 	}
+	return UpdateFile(dir.KnownHostsPath(), 0644, func(data []byte) ([]byte, error) {
+		if version != "" && contentVersion(data) != version {
+			return nil, ErrConflict
+		}
+		lines := strings.Split(string(data), "\n")
+		if line < 1 || line > len(lines) {
+			return nil, fmt.Errorf("line %d out of range", line)
+		}
 
-	lines := strings.Split(string(data), "\n")
-	if line < 1 || line > len(lines) {
-		return fmt.Errorf("line %d out of range", line)
+		// Remove the line (1-based index)
+		lines = append(lines[:line-1], lines[line:]...)
+		return []byte(strings.Join(lines, "\n")), nil
+	})
+}
+
+// AddCertAuthority trusts the CA publicKey, an authorized_keys line, to sign
+// host certificates for hosts matching pattern (e.g. *.example.com) by
+// appending an @cert-authority line.
+func AddCertAuthority(dir *SSHDir, pattern, publicKey string) error {
+	if pattern == "" || strings.ContainsAny(pattern, " \t") {
+		return fmt.Errorf("invalid host pattern: %q", pattern)
+	}
+	pub, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return fmt.Errorf("parse CA key: %w", err)
+	}
+	if _, ok := pub.(*gossh.Certificate); ok {
+		return errors.New("a certificate cannot be a CA; give the CA's public key")
+	}
+	entry := fmt.Sprintf("@cert-authority %s %s", pattern, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pub))))
+	if comment != "" {
+		entry += " " + comment
 	}
 
-	// Remove the line (1-based index)
-	lines = append(lines[:line-1], lines[line:]...)
-	return os.WriteFile(dir.KnownHostsPath(), []byte(strings.Join(lines, "\n")), 0644)
+	if err := dir.EnsureDir(); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(pub.Marshal())
+	return UpdateFile(dir.KnownHostsPath(), 0644, func(data []byte) ([]byte, error) {
+		for i, line := range strings.Split(string(data), "\n") {
+			e := parseKnownHostLine(i+1, strings.TrimSpace(line))
+			if e.Marker == "@cert-authority" && e.Hosts == pattern && e.Key == key {
+				return nil, fmt.Errorf("CA already trusted for %s on line %d", pattern, i+1)
+			}
+		}
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			data = append(data, '\n')
+		}
+		return append(data, entry+"\n"...), nil
+	})
 }
 
-// WriteKnownHosts overwrites the known_hosts file.
-func WriteKnownHosts(dir *SSHDir, content string) error {
+// RevokeKnownHost marks the entry at the given 1-based line number as
+// @revoked, so ssh refuses its key for those hosts instead of trusting it.
+// A non-empty version makes it fail with ErrConflict if the file no longer
+// has that FileVersion, as the line may now hold another host's key.
+func RevokeKnownHost(dir *SSHDir, line int, version string) error {
+	if _, err := os.Stat(dir.KnownHostsPath()); err != nil {
+		return fmt.Errorf("read known_hosts: %w", err)
+	}
+	return UpdateFile(dir.KnownHostsPath(), 0644, func(data []byte) ([]byte, error) {
+		if version != "" && contentVersion(data) != version {
+			return nil, ErrConflict
+		}
+		lines := strings.Split(string(data), "\n")
+		if line < 1 || line > len(lines) {
+			return nil, fmt.Errorf("line %d out of range", line)
+		}
+		text := strings.TrimSpace(lines[line-1])
+		entry := parseKnownHostLine(line, text)
+		switch {
+		case text == "" || strings.HasPrefix(text, "#") || entry.KeyType == "":
+			return nil, fmt.Errorf("line %d is not a host key entry", line)
+		case entry.Marker != "":
+			return nil, fmt.Errorf("line %d is already marked %s", line, entry.Marker)
+		}
+		lines[line-1] = "@revoked " + text
+		return []byte(strings.Join(lines, "\n")), nil
+	})
+}
+
+// WriteKnownHosts overwrites the known_hosts file. A non-empty version makes
+// the write fail with ErrConflict if the file no longer has that FileVersion.
+func WriteKnownHosts(dir *SSHDir, content, version string) error {
 	if err := dir.EnsureDir(); err != nil {
 		return err
 	}
-	return os.WriteFile(dir.KnownHostsPath(), []byte(content), 0644)
+	return WriteFile(dir.KnownHostsPath(), []byte(content), 0644, version)
+}
+
+// ValidateKnownHosts checks known_hosts content line by line for entries ssh
+// cannot use: missing fields, unknown markers, malformed hashed hostnames and
+// keys that don't decode or don't match their key type.
+func ValidateKnownHosts(content string) []model.Diagnostic {
+	var diags []model.Diagnostic
+	report := func(line int, rule, format string, args ...any) {
+		diags = append(diags, model.Diagnostic{
+			Rule:     rule,
+			Severity: SeverityError,
+			File:     "known_hosts",
+			Line:     line,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if strings.HasPrefix(parts[0], "@") {
+			if parts[0] != "@cert-authority" && parts[0] != "@revoked" {
+				report(i+1, "unknown-marker", "unknown marker: %s", parts[0])
+				continue
+			}
+			parts = parts[1:]
+		}
+		if len(parts) < 3 {
+			report(i+1, "malformed-line", "expected hosts, key type and key")
+			continue
+		}
+
+		if strings.HasPrefix(parts[0], "|") && !validHashedHost(parts[0]) {
+			report(i+1, "malformed-hash", "malformed hashed hostname: %s", parts[0])
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			report(i+1, "undecodable-key", "key is not valid base64")
+			continue
+		}
+		pubKey, err := gossh.ParsePublicKey(keyBytes)
+		if err != nil {
+			report(i+1, "undecodable-key", "key cannot be parsed: %v", err)
+			continue
+		}
+		if pubKey.Type() != parts[1] {
+			report(i+1, "key-type-mismatch", "line says %s but the key is %s", parts[1], pubKey.Type())
+		}
+	}
+	return diags
+}
+
+// validHashedHost reports whether s has the |1|salt|hash form written by
+// HashKnownHosts.
+func validHashedHost(s string) bool {
+	fields := strings.Split(s, "|")
+	if len(fields) != 4 || fields[0] != "" || fields[1] != "1" {
+		return false
+	}
+	for _, f := range fields[2:] {
+		if _, err := base64.StdEncoding.DecodeString(f); err != nil || f == "" {
+			return false
+		}
+	}
+	return true
 }
 
 // LookupKnownHost searches for a hostname in known_hosts using ssh-keygen -F.
@@ -134,20 +278,65 @@ func AddKnownHost(dir *SSHDir, hostname string, port string) error {
 		return fmt.Errorf("ssh-keyscan failed: %s: %w", string(output), err)
 	}
 
-	// Remove existing entries for this host first
-	existing, _ := ListKnownHosts(dir)
-	var newContent strings.Builder
-	for _, entry := range existing {
-		// Skip entries matching this host
-		if !strings.Contains(entry.Hosts, hostname) {
-			newContent.WriteString(fmt.Sprintf("%s %s %s\n", entry.Hosts, entry.KeyType, entry.Key))
-		}
+	target := hostname
+	if port != "" && port != "22" {
+		target = fmt.Sprintf("[%s]:%s", hostname, port)
 	}
+	return UpdateFile(dir.KnownHostsPath(), 0644, func(data []byte) ([]byte, error) {
+		return replaceKnownHost(data, target, output), nil
+	})
+}
 
-	// Append new entries
-	newContent.WriteString(string(output))
+// replaceKnownHost drops host from the plain entries in data and appends
+// added. An entry that also names other hosts keeps them; every other line,
+// including comments and CA and revocation lines, is kept byte for byte.
+func replaceKnownHost(data []byte, host string, added []byte) []byte {
+	var out strings.Builder
+	for i, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			out.WriteString(line)
+			continue
+		}
+		entry := parseKnownHostLine(i+1, trimmed)
+		if entry.Marker != "" || entry.KeyType == "" {
+			out.WriteString(line)
+			continue
+		}
+		var others []string
+		for _, name := range strings.Split(entry.Hosts, ",") {
+			if !knownHostNames(name, host) {
+				others = append(others, name)
+			}
+		}
+		switch {
+		case len(others) == len(strings.Split(entry.Hosts, ",")):
+			out.WriteString(line)
+		case len(others) > 0:
+			// Only the host field changes; the key and comment stay
+			start := strings.Index(line, entry.Hosts)
+			out.WriteString(line[:start] + strings.Join(others, ",") + line[start+len(entry.Hosts):])
+		}
+	}
+	if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		out.WriteString("\n")
+	}
+	out.Write(added)
+	return []byte(out.String())
+}
 
-	return os.WriteFile(dir.KnownHostsPath(), []byte(newContent.String()), 0644)
+// knownHostNames reports whether the known_hosts host pattern p names host
+// ("name" or "[name]:port") exactly, hashing host for a hashed pattern.
+func knownHostNames(p, host string) bool {
+	if !validHashedHost(p) {
+		return p == host
+	}
+	fields := strings.Split(p, "|")
+	salt, _ := base64.StdEncoding.DecodeString(fields[2])
+	sum, _ := base64.StdEncoding.DecodeString(fields[3])
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), sum)
 }
 
 // MatchConfigHostsToKnownHosts uses ssh-keygen -F to lookup each config host
@@ -232,6 +421,10 @@ func parseKnownHostLine(lineNum int, line string) model.KnownHostEntry {
 	entry := model.KnownHostEntry{Line: lineNum}
 
 	parts := strings.Fields(line)
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "@") {
+		entry.Marker = parts[0]
+		parts = parts[1:]
+	}
 	if len(parts) < 3 {
 		entry.Hosts = line
 		return entry
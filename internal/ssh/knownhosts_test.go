@@ -1,8 +1,16 @@
 package ssh
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestListKnownHostsEmpty(t *testing.T) {
@@ -89,7 +97,11 @@ gitlab.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okW
 `
 	os.WriteFile(dir.KnownHostsPath(), []byte(content), 0644)
 
-	if err := RemoveKnownHost(dir, 2); err != nil {
+	if err := RemoveKnownHost(dir, 2, "stale"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale version, got %v", err)
+	}
+	version, _ := FileVersion(dir.KnownHostsPath())
+	if err := RemoveKnownHost(dir, 2, version); err != nil {
 		t.Fatalf("RemoveKnownHost failed: %v", err)
 	}
 
@@ -107,7 +119,7 @@ func TestRemoveKnownHostOutOfRange(t *testing.T) {
 	dir := NewSSHDir(t.TempDir())
 	os.WriteFile(dir.KnownHostsPath(), []byte("host ssh-rsa key\n"), 0644)
 
-	if err := RemoveKnownHost(dir, 5); err == nil {
+	if err := RemoveKnownHost(dir, 5, ""); err == nil {
 		t.Fatal("expected error for out of range line")
 	}
 }
@@ -116,7 +128,7 @@ func TestWriteKnownHosts(t *testing.T) {
 	dir := NewSSHDir(t.TempDir())
 	content := "host1 ssh-rsa key1\nhost2 ssh-ed25519 key2\n"
 
-	if err := WriteKnownHosts(dir, content); err != nil {
+	if err := WriteKnownHosts(dir, content, ""); err != nil {
 		t.Fatalf("WriteKnownHosts failed: %v", err)
 	}
 
@@ -146,3 +158,154 @@ func TestHashedKnownHost(t *testing.T) {
 		t.Fatal("expected IsHashed=true")
 	}
 }
+
+func TestReplaceKnownHost(t *testing.T) {
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	hashed := knownhosts.HashHostname("[example.com]:2222")
+	data := "# my servers\r\n" +
+		"myexample.com " + key + " kept comment\r\n" +
+		"example.com,10.0.0.1 " + key + " shared\n" +
+		hashed + " " + key + "\n" +
+		"@cert-authority *.example.com " + key + "\n" +
+		"[example.com]:2222 " + key
+	added := "[example.com]:2222 " + key + " new\n"
+
+	got := string(replaceKnownHost([]byte(data), "[example.com]:2222", []byte(added)))
+	want := "# my servers\r\n" +
+		"myexample.com " + key + " kept comment\r\n" +
+		"example.com,10.0.0.1 " + key + " shared\n" +
+		"@cert-authority *.example.com " + key + "\n" +
+		added
+	if got != want {
+		t.Fatalf("unexpected known_hosts:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Other names on a matching line keep their entry
+	got = string(replaceKnownHost([]byte(data), "example.com", nil))
+	if !strings.Contains(got, "10.0.0.1 "+key+" shared\n") || !strings.Contains(got, "myexample.com") {
+		t.Fatalf("unexpected known_hosts:\n%s", got)
+	}
+}
+
+func TestKnownHostMarkers(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	const key = "AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	content := "@cert-authority *.example.com ssh-ed25519 " + key + " ca@example.com\n" +
+		"@revoked old.example.com ssh-ed25519 " + key + "\n"
+	os.WriteFile(dir.KnownHostsPath(), []byte(content), 0644)
+
+	entries, err := ListKnownHosts(dir)
+	if err != nil {
+		t.Fatalf("ListKnownHosts failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Marker != "@cert-authority" || e.Hosts != "*.example.com" || e.KeyType != "ssh-ed25519" || e.Key != key || e.Fingerprint == "" {
+		t.Errorf("unexpected CA entry %+v", e)
+	}
+	if e := entries[1]; e.Marker != "@revoked" || e.Hosts != "old.example.com" {
+		t.Errorf("unexpected revoked entry %+v", e)
+	}
+	if got := FilterKnownHosts(entries, "revoked"); len(got) != 1 || got[0].Line != 2 {
+		t.Errorf("expected to find the revoked entry by marker, got %+v", got)
+	}
+}
+
+func TestAddCertAuthority(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	ca, _ := newTestSigner(t)
+	host, _ := newTestSigner(t)
+	os.WriteFile(dir.KnownHostsPath(), []byte("github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"), 0644)
+
+	caLine := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(ca.PublicKey()))) + " ca@example.com"
+	if err := AddCertAuthority(dir, "*.example.com", caLine); err != nil {
+		t.Fatalf("AddCertAuthority failed: %v", err)
+	}
+	if err := AddCertAuthority(dir, "*.example.com", caLine); err == nil {
+		t.Error("expected an error adding the same CA twice")
+	}
+	if err := AddCertAuthority(dir, "a b", caLine); err == nil {
+		t.Error("expected an error for a pattern with spaces")
+	}
+	if err := AddCertAuthority(dir, "*", "not a key"); err == nil {
+		t.Error("expected an error for a bad key")
+	}
+	entries, _ := ListKnownHosts(dir)
+	if len(entries) != 2 || entries[1].Marker != "@cert-authority" || entries[1].Line != 2 {
+		t.Fatalf("expected the CA appended on line 2, got %+v", entries)
+	}
+
+	// ssh trusts a host certificate signed by the CA for a matching host
+	cert := &gossh.Certificate{Key: host.PublicKey(), CertType: gossh.HostCert, ValidPrincipals: []string{"web.example.com"}, ValidBefore: gossh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("SignCert failed: %v", err)
+	}
+	cb, err := knownhosts.New(dir.KnownHostsPath())
+	if err != nil {
+		t.Fatalf("knownhosts.New failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	if err := cb("web.example.com:22", addr, cert); err != nil {
+		t.Errorf("expected the host cert to be trusted, got %v", err)
+	}
+	if err := cb("web.other.org:22", addr, cert); err == nil {
+		t.Error("expected the host cert to be refused outside the pattern")
+	}
+}
+
+func TestRevokeKnownHost(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	host, _ := newTestSigner(t)
+	content := "# servers\nweb.example.com " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(host.PublicKey()))) + " old key\n"
+	os.WriteFile(dir.KnownHostsPath(), []byte(content), 0644)
+
+	if err := RevokeKnownHost(dir, 1, ""); err == nil {
+		t.Error("expected an error revoking a comment")
+	}
+	if err := RevokeKnownHost(dir, 2, contentVersion([]byte("stale"))); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict for a stale version, got %v", err)
+	}
+	version, _ := FileVersion(dir.KnownHostsPath())
+	if err := RevokeKnownHost(dir, 2, version); err != nil {
+		t.Fatalf("RevokeKnownHost failed: %v", err)
+	}
+	if err := RevokeKnownHost(dir, 2, ""); err == nil {
+		t.Error("expected an error revoking twice")
+	}
+	data, _ := os.ReadFile(dir.KnownHostsPath())
+	if !strings.HasPrefix(strings.Split(string(data), "\n")[1], "@revoked web.example.com ssh-ed25519 ") || !strings.HasSuffix(string(data), " old key\n") {
+		t.Errorf("unexpected known_hosts %q", data)
+	}
+
+	cb, err := knownhosts.New(dir.KnownHostsPath())
+	if err != nil {
+		t.Fatalf("knownhosts.New failed: %v", err)
+	}
+	err = cb("web.example.com:22", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}, host.PublicKey())
+	var revoked *knownhosts.RevokedError
+	if !errors.As(err, &revoked) {
+		t.Errorf("expected the key to be revoked, got %v", err)
+	}
+}
+
+func TestValidateKnownHosts(t *testing.T) {
+	const key = "AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	content := `# comment
+github.com ssh-ed25519 ` + key + `
+@cert-authority *.corp ssh-ed25519 ` + key + `
+broken.example.com ssh-ed25519
+bad.example.com ssh-ed25519 not*base64
+rsa.example.com ssh-rsa ` + key + `
+|1|abc|def ssh-ed25519 ` + key + `
+@trusted host ssh-ed25519 ` + key + `
+`
+	var got []string
+	for _, d := range ValidateKnownHosts(content) {
+		got = append(got, fmt.Sprintf("%d %s", d.Line, d.Rule))
+	}
+	want := "4 malformed-line,5 undecodable-key,6 key-type-mismatch,7 malformed-hash,8 unknown-marker"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("unexpected problems:\n got %s\nwant %s", strings.Join(got, ","), want)
+	}
+}
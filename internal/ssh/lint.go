@@ -0,0 +1,477 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// Lint severities.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// LintRule is a check run by LintConfig. Register additional rules with
+// RegisterLintRule.
+type LintRule struct {
+	ID          string
+	Severity    string
+	Description string
+	Check       func(c *LintContext)
+}
+
+// LintContext gives a rule access to the parsed config and collects the
+// diagnostics it reports.
+type LintContext struct {
+	Dir   *SSHDir
+	Root  *ConfigFile
+	Files []*ConfigFile // Root and every included file, in read order
+
+	rule  *LintRule
+	diags []model.Diagnostic
+}
+
+// Report records a diagnostic for the current rule at line l of f.
+func (c *LintContext) Report(f *ConfigFile, l *ConfigLine, format string, args ...any) {
+	c.diags = append(c.diags, model.Diagnostic{
+		Rule:     c.rule.ID,
+		Severity: c.rule.Severity,
+		File:     c.Dir.RelPath(f.Path),
+		Line:     f.LineNumber(l),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// LintOptions controls a LintConfig run.
+type LintOptions struct {
+	// Disabled lists rule IDs to skip, usually AppConfig.LintDisabled.
+	Disabled []string
+	// File and Content lint unsaved editor text in place of File on disk.
+	// An empty File means the main config. Content is ignored when nil.
+	File    string
+	Content []byte
+}
+
+var lintRules = []LintRule{
+	{"missing-argument", SeverityError, "Directive has no value", lintMissingArgument},
+	{"invalid-port", SeverityError, "Port is not a number between 1 and 65535", lintInvalidPort},
+	{"invalid-match", SeverityError, "Match line has unknown or incomplete criteria", lintInvalidMatch},
+	{"invalid-forward", SeverityError, "LocalForward, RemoteForward or DynamicForward cannot be parsed", lintInvalidForward},
+	{"include-error", SeverityError, "Include forms a cycle or is nested too deeply", lintIncludeError},
+	{"unknown-keyword", SeverityWarning, "Keyword is not a known ssh_config option", lintUnknownKeyword},
+	{"deprecated-option", SeverityWarning, "Option is deprecated or no longer supported by OpenSSH", lintDeprecatedOption},
+	{"wildcard-before-specific", SeverityWarning, "Host * comes before specific hosts whose settings it overrides", lintWildcardBeforeSpecific},
+	{"missing-identity-file", SeverityWarning, "IdentityFile points at a key that does not exist", lintMissingIdentityFile},
+	{"strict-host-key-checking-off", SeverityWarning, "StrictHostKeyChecking is disabled", lintStrictHostKeyChecking},
+	{"forward-agent-wildcard", SeverityWarning, "ForwardAgent is enabled for wildcard hosts", lintForwardAgentWildcard},
+	{"duplicate-alias", SeverityWarning, "The same alias is defined by more than one Host block", lintDuplicateAlias},
+}
+
+// RegisterLintRule adds a rule to the catalogue run by LintConfig.
+func RegisterLintRule(r LintRule) {
+	lintRules = append(lintRules, r)
+}
+
+// LintRules returns the rule catalogue, marking rules in disabled as off.
+func LintRules(disabled []string) []model.LintRule {
+	out := make([]model.LintRule, 0, len(lintRules))
+	for _, r := range lintRules {
+		out = append(out, model.LintRule{
+			ID:          r.ID,
+			Severity:    r.Severity,
+			Description: r.Description,
+			Enabled:     !containsPath(disabled, r.ID),
+		})
+	}
+	return out
+}
+
+// LintConfig runs every enabled rule over the config and its includes and
+// returns the diagnostics in read order.
+func LintConfig(dir *SSHDir, opts LintOptions) ([]model.Diagnostic, error) {
+	load := LoadConfigFile
+	if opts.Content != nil {
+		target := dir.ConfigPath()
+		if opts.File != "" {
+			target = dir.ExpandPath(opts.File)
+		}
+		load = func(path string) (*ConfigFile, error) {
+			if path == target {
+				return ParseConfig(path, opts.Content), nil
+			}
+			return LoadConfigFile(path)
+		}
+	}
+	root, err := loadConfigTree(dir, dir.ConfigPath(), nil, load)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &LintContext{Dir: dir, Root: root, Files: root.Files()}
+	for i := range lintRules {
+		if containsPath(opts.Disabled, lintRules[i].ID) {
+			continue
+		}
+		c.rule = &lintRules[i]
+		c.rule.Check(c)
+	}
+
+	order := make(map[string]int)
+	for i, f := range c.Files {
+		order[dir.RelPath(f.Path)] = i
+	}
+	sort.SliceStable(c.diags, func(i, j int) bool {
+		a, b := c.diags[i], c.diags[j]
+		if order[a.File] != order[b.File] {
+			return order[a.File] < order[b.File]
+		}
+		return a.Line < b.Line
+	})
+	return c.diags, nil
+}
+
+// ValidateConfigFile lints content as the new text of a config file (the
+// main config when file is "") and returns the diagnostics for that file.
+func ValidateConfigFile(dir *SSHDir, file, content string, disabled []string) ([]model.Diagnostic, error) {
+	path, err := ConfigFilePath(dir, file)
+	if err != nil {
+		return nil, err
+	}
+	diags, err := LintConfig(dir, LintOptions{Disabled: disabled, File: file, Content: []byte(content)})
+	if err != nil {
+		return nil, err
+	}
+	rel := dir.RelPath(path)
+	var out []model.Diagnostic
+	for _, d := range diags {
+		if d.File == rel {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// HasErrors reports whether any diagnostic has error severity.
+func HasErrors(diags []model.Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// directives calls fn for every directive line in every file.
+func (c *LintContext) directives(fn func(f *ConfigFile, l *ConfigLine)) {
+	for _, f := range c.Files {
+		for _, l := range f.Lines {
+			if l.Key != "" {
+				fn(f, l)
+			}
+		}
+	}
+}
+
+// lintBlock is a block together with the file it lives in.
+type lintBlock struct {
+	file  *ConfigFile
+	block ConfigBlock
+}
+
+// blocks returns every block in the order ssh reads them, with included
+// files' blocks following the block that includes them.
+func (c *LintContext) blocks() []lintBlock {
+	var out []lintBlock
+	seen := make(map[string]bool)
+	var walk func(*ConfigFile)
+	walk = func(f *ConfigFile) {
+		if f.Err != nil || seen[f.Path] {
+			return
+		}
+		seen[f.Path] = true
+		for _, b := range f.Blocks() {
+			out = append(out, lintBlock{f, b})
+			for _, l := range b.Lines {
+				for _, child := range f.Includes[l] {
+					walk(child)
+				}
+			}
+		}
+	}
+	walk(c.Root)
+	return out
+}
+
+func lintMissingArgument(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if l.Value == "" {
+			c.Report(f, l, "%s requires an argument", l.Key)
+		}
+	})
+}
+
+func lintInvalidPort(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if !strings.EqualFold(l.Key, "Port") || l.Value == "" {
+			return
+		}
+		if n, err := strconv.Atoi(l.Value); err != nil || n < 1 || n > 65535 {
+			c.Report(f, l, "invalid port: %s", l.Value)
+		}
+	})
+}
+
+func lintInvalidMatch(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if !strings.EqualFold(l.Key, "Match") || l.Value == "" {
+			return
+		}
+		criteria, err := ParseMatchCriteria(l.Value)
+		if err == nil {
+			err = ValidateMatchCriteria(criteria)
+		}
+		if err != nil {
+			c.Report(f, l, "%v", err)
+		}
+	})
+}
+
+func lintInvalidForward(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if _, ok := forwardTypeOf(l.Key); !ok || l.Value == "" {
+			return
+		}
+		if _, err := ParseForward(l.Key, l.Value); err != nil {
+			c.Report(f, l, "%v", err)
+		}
+	})
+}
+
+func lintIncludeError(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		for _, child := range f.Includes[l] {
+			if child.Err != nil {
+				c.Report(f, l, "Include %s: %v", c.Dir.RelPath(child.Path), child.Err)
+			}
+		}
+	})
+}
+
+func lintUnknownKeyword(c *LintContext) {
+	// IgnoreUnknown patterns suppress errors for keywords ssh doesn't know.
+	var ignore []string
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if strings.EqualFold(l.Key, "IgnoreUnknown") {
+			ignore = append(ignore, l.Value)
+		}
+	})
+
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		key := strings.ToLower(l.Key)
+		if knownKeywords[key] || deprecatedOptions[key] != "" {
+			return
+		}
+		for _, list := range ignore {
+			if matchPatternList(key, list, true) == 1 {
+				return
+			}
+		}
+		c.Report(f, l, "unknown keyword: %s", l.Key)
+	})
+}
+
+func lintDeprecatedOption(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if msg := deprecatedOptions[strings.ToLower(l.Key)]; msg != "" {
+			c.Report(f, l, "%s is deprecated: %s", l.Key, msg)
+		}
+	})
+}
+
+func lintWildcardBeforeSpecific(c *LintContext) {
+	blocks := c.blocks()
+	for i, wb := range blocks {
+		if !wb.block.IsHost() || strings.Join(wb.block.Patterns(), " ") != "*" {
+			continue
+		}
+		set := make(map[string]bool)
+		for _, l := range wb.block.Directives() {
+			set[strings.ToLower(l.Key)] = true
+		}
+
+		// keyword -> later hosts whose value for it is ignored
+		shadowed := make(map[string][]string)
+		var keys []string
+		for _, later := range blocks[i+1:] {
+			if !later.block.IsHost() {
+				continue
+			}
+			for _, l := range later.block.Directives() {
+				key := strings.ToLower(l.Key)
+				if !set[key] || multiValued[key] {
+					continue
+				}
+				if _, ok := shadowed[key]; !ok {
+					keys = append(keys, key)
+				}
+				shadowed[key] = append(shadowed[key], later.block.Patterns()[0])
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		var parts []string
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s (%s)", k, strings.Join(shadowed[k], ", ")))
+		}
+		c.Report(wb.file, wb.block.Header, "Host * comes first, so its values win over later hosts: %s", strings.Join(parts, "; "))
+	}
+}
+
+func lintMissingIdentityFile(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if !strings.EqualFold(l.Key, "IdentityFile") || l.Value == "" {
+			return
+		}
+		args := l.Args()
+		if len(args) == 0 || strings.EqualFold(args[0], "none") || strings.Contains(args[0], "%") {
+			return
+		}
+		if _, err := os.Stat(c.Dir.ExpandPath(args[0])); err == nil || c.Dir.IsKeyFile(args[0]) {
+			return
+		}
+		c.Report(f, l, "identity file not found: %s", args[0])
+	})
+}
+
+func lintStrictHostKeyChecking(c *LintContext) {
+	c.directives(func(f *ConfigFile, l *ConfigLine) {
+		if !strings.EqualFold(l.Key, "StrictHostKeyChecking") {
+			return
+		}
+		switch strings.ToLower(l.Value) {
+		case "no", "off":
+			c.Report(f, l, "StrictHostKeyChecking %s accepts any host key, which allows man-in-the-middle attacks", l.Value)
+		}
+	})
+}
+
+func lintForwardAgentWildcard(c *LintContext) {
+	for _, lb := range c.blocks() {
+		scope := wildcardScope(lb.block)
+		if scope == "" {
+			continue
+		}
+		for _, l := range lb.block.Directives() {
+			if strings.EqualFold(l.Key, "ForwardAgent") && !strings.EqualFold(l.Value, "no") {
+				c.Report(lb.file, l, "ForwardAgent is enabled for %s; forward the agent only to hosts you trust", scope)
+			}
+		}
+	}
+}
+
+// wildcardScope describes the hosts a block applies to when that includes
+// hosts not named explicitly, or returns "" for blocks naming specific hosts.
+func wildcardScope(b ConfigBlock) string {
+	switch {
+	case b.Header == nil:
+		return "every host"
+	case b.IsHost():
+		for _, p := range b.Patterns() {
+			if !strings.HasPrefix(p, "!") && strings.ContainsAny(p, "*?") {
+				return "Host " + b.Header.Value
+			}
+		}
+	case b.IsMatch():
+		criteria, _ := ParseMatchCriteria(b.Header.Value)
+		for _, cr := range criteria {
+			if cr.Keyword == "all" || (!cr.Negated && (cr.Keyword == "host" || cr.Keyword == "originalhost") && strings.ContainsAny(cr.Value, "*?")) {
+				return "Match " + b.Header.Value
+			}
+		}
+	}
+	return ""
+}
+
+func lintDuplicateAlias(c *LintContext) {
+	type location struct {
+		file string
+		line int
+	}
+	first := make(map[string]location)
+	for _, lb := range c.blocks() {
+		if !lb.block.IsHost() {
+			continue
+		}
+		for _, p := range lb.block.Patterns() {
+			if strings.HasPrefix(p, "!") || strings.ContainsAny(p, "*?") {
+				continue
+			}
+			if loc, ok := first[p]; ok {
+				c.Report(lb.file, lb.block.Header, "alias %s is already defined at %s:%d; only unset options here apply", p, loc.file, loc.line)
+				continue
+			}
+			first[p] = location{c.Dir.RelPath(lb.file.Path), lb.file.LineNumber(lb.block.Header)}
+		}
+	}
+}
+
+// knownKeywords are the ssh_config keywords of OpenSSH 9.x, plus a few added
+// by common vendor patches (Apple's UseKeychain, Debian's GSSAPI options).
+var knownKeywords = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, k := range strings.Fields(`
+		Host Match Include AddKeysToAgent AddressFamily BatchMode BindAddress
+		BindInterface CanonicalDomains CanonicalizeFallbackLocal CanonicalizeHostname
+		CanonicalizeMaxDots CanonicalizePermittedCNAMEs CASignatureAlgorithms
+		CertificateFile ChannelTimeout CheckHostIP Ciphers ClearAllForwardings
+		Compression ConnectionAttempts ConnectTimeout ControlMaster ControlPath
+		ControlPersist DynamicForward EnableEscapeCommandline EnableSSHKeysign
+		EscapeChar ExitOnForwardFailure FingerprintHash ForkAfterAuthentication
+		ForwardAgent ForwardX11 ForwardX11Timeout ForwardX11Trusted GatewayPorts
+		GlobalKnownHostsFile GSSAPIAuthentication GSSAPIDelegateCredentials
+		HashKnownHosts HostbasedAcceptedAlgorithms HostbasedAuthentication
+		HostKeyAlgorithms HostKeyAlias HostName IdentitiesOnly IdentityAgent
+		IdentityFile IgnoreUnknown IPQoS KbdInteractiveAuthentication
+		KbdInteractiveDevices KexAlgorithms KnownHostsCommand LocalCommand
+		LocalForward LogLevel LogVerbose MACs NoHostAuthenticationForLocalhost
+		NumberOfPasswordPrompts ObscureKeystrokeTiming PasswordAuthentication
+		PermitLocalCommand PermitRemoteOpen PKCS11Provider Port
+		PreferredAuthentications ProxyCommand ProxyJump ProxyUseFdpass
+		PubkeyAcceptedAlgorithms PubkeyAuthentication RekeyLimit RemoteCommand
+		RemoteForward RequestTTY RequiredRSASize RevokedHostKeys SecurityKeyProvider
+		SendEnv ServerAliveCountMax ServerAliveInterval SessionType SetEnv StdinNull
+		StreamLocalBindMask StreamLocalBindUnlink StrictHostKeyChecking
+		SyslogFacility Tag TCPKeepAlive KeepAlive Tunnel TunnelDevice UpdateHostKeys
+		User UserKnownHostsFile VerifyHostKeyDNS VisualHostKey XAuthLocation
+		UseKeychain GSSAPIKeyExchange GSSAPIClientIdentity GSSAPIServerIdentity
+		GSSAPIRenewalForcesRekey GSSAPITrustDns
+	`) {
+		m[strings.ToLower(k)] = true
+	}
+	return m
+}()
+
+// deprecatedOptions maps deprecated or removed keywords to advice.
+var deprecatedOptions = map[string]string{
+	"protocol":                        "SSH protocol 1 was removed in OpenSSH 7.6; delete this line",
+	"useroaming":                      "roaming support was removed after CVE-2016-0777; delete this line",
+	"rsaauthentication":               "it only applied to protocol 1; delete this line",
+	"rhostsrsaauthentication":         "it only applied to protocol 1; delete this line",
+	"cipher":                          "it only applied to protocol 1; use Ciphers",
+	"compressionlevel":                "it only applied to protocol 1; delete this line",
+	"useprivilegedport":               "it is no longer supported; delete this line",
+	"fallbacktorsh":                   "rsh support was removed; delete this line",
+	"usersh":                          "rsh support was removed; delete this line",
+	"dsaauthentication":               "it was an alias for PubkeyAuthentication; use that instead",
+	"challengeresponseauthentication": "use KbdInteractiveAuthentication",
+	"pubkeyacceptedkeytypes":          "renamed to PubkeyAcceptedAlgorithms",
+	"hostbasedkeytypes":               "renamed to HostbasedAcceptedAlgorithms",
+	"smartcarddevice":                 "renamed to PKCS11Provider",
+}
@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+const lintFixture = `IgnoreUnknown AddKeysToKeychain
+Host *
+    User shared
+    ForwardAgent yes
+    AddKeysToKeychain yes
+    Protocol 2
+
+Host web
+    HostName web.example.com
+    User deploy
+    Port 99999
+    IdentityFile ~/.ssh/missing_key
+    StrictHostKeyChecking no
+    LocalForward 8080
+
+Host web
+    Bogus value
+
+Match host *.corp bogus
+    ForwardAgent yes
+
+Include broken.conf
+`
+
+func lintSummary(t *testing.T, dir *SSHDir, opts LintOptions) []string {
+	t.Helper()
+	diags, err := LintConfig(dir, opts)
+	if err != nil {
+		t.Fatalf("LintConfig failed: %v", err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%s:%d %s", d.File, d.Line, d.Rule))
+	}
+	return got
+}
+
+func TestLintConfig(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte(lintFixture), 0600)
+	os.WriteFile(dir.Path("broken.conf"), []byte("Include config\n"), 0600)
+
+	got := lintSummary(t, dir, LintOptions{})
+	want := []string{
+		"config:2 wildcard-before-specific",
+		"config:4 forward-agent-wildcard",
+		"config:6 deprecated-option",
+		"config:11 invalid-port",
+		"config:12 missing-identity-file",
+		"config:13 strict-host-key-checking-off",
+		"config:14 invalid-forward",
+		"config:16 duplicate-alias",
+		"config:17 unknown-keyword",
+		"config:19 invalid-match",
+		"config:20 forward-agent-wildcard",
+		"broken.conf:1 include-error",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diagnostics:\n got %s\nwant %s", strings.Join(got, "\n    "), strings.Join(want, "\n     "))
+	}
+}
+
+func TestLintConfigDisabledRules(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host a\n    StrictHostKeyChecking no\n    Protocol 2\n"), 0600)
+
+	got := lintSummary(t, dir, LintOptions{Disabled: []string{"strict-host-key-checking-off"}})
+	if strings.Join(got, ",") != "config:3 deprecated-option" {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+
+	for _, r := range LintRules([]string{"deprecated-option"}) {
+		if r.Enabled == (r.ID == "deprecated-option") {
+			t.Fatalf("rule %s enabled=%v", r.ID, r.Enabled)
+		}
+	}
+}
+
+func TestLintConfigContentOverride(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Include extra.conf\nHost a\n    HostName a\n"), 0600)
+	os.WriteFile(dir.Path("extra.conf"), []byte("Host b\n    HostName b\n"), 0600)
+
+	got := lintSummary(t, dir, LintOptions{File: "extra.conf", Content: []byte("Host b\n    Port\n")})
+	if strings.Join(got, ",") != "extra.conf:2 missing-argument" {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+
+	// The file on disk is untouched and still clean.
+	if got := lintSummary(t, dir, LintOptions{}); len(got) != 0 {
+		t.Fatalf("expected no diagnostics, got %v", got)
+	}
+}
+
+func TestParseAppConfig(t *testing.T) {
+	cfg := parseAppConfig("# comment\nterminal = kitty\nlint.disable=unknown-keyword, duplicate-alias,\n")
+	if cfg.Terminal != "kitty" {
+		t.Fatalf("unexpected terminal: %q", cfg.Terminal)
+	}
+	if strings.Join(cfg.LintDisabled, ",") != "unknown-keyword,duplicate-alias" {
+		t.Fatalf("unexpected lint.disable: %v", cfg.LintDisabled)
+	}
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host a\n    HostName a\n"), 0600)
+
+	diags, err := ValidateConfigFile(dir, "", "Host a\n    Port abc\n    Protocol 2\n", nil)
+	if err != nil {
+		t.Fatalf("ValidateConfigFile failed: %v", err)
+	}
+	if len(diags) != 2 || !HasErrors(diags) {
+		t.Fatalf("expected an error and a warning, got %+v", diags)
+	}
+	if HasErrors(diags[1:]) {
+		t.Fatalf("expected only a warning after the error, got %+v", diags[1:])
+	}
+
+	if _, err := ValidateConfigFile(dir, "known_hosts", "", nil); err == nil {
+		t.Fatal("expected error for non-config file")
+	}
+}
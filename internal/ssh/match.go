@@ -0,0 +1,282 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// matchArgCount lists the Match criteria OpenSSH understands and whether
+// each one takes an argument.
+var matchArgCount = map[string]bool{
+	"all":          false,
+	"canonical":    false,
+	"final":        false,
+	"exec":         true,
+	"host":         true,
+	"originalhost": true,
+	"user":         true,
+	"localuser":    true,
+	"localnetwork": true,
+	"tagged":       true,
+}
+
+// ListMatches parses the SSH config, following Include directives, and
+// returns all Match blocks. IDs are numbered across files in read order.
+func ListMatches(dir *SSHDir) ([]model.MatchBlock, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []model.MatchBlock
+	for _, cfg := range root.Files() {
+		for _, block := range cfg.Matches() {
+			m := model.MatchBlock{
+				ID:      len(matches) + 1,
+				File:    dir.RelPath(cfg.Path),
+				Line:    cfg.LineNumber(block.Header),
+				Options: []model.HostOption{},
+			}
+			// Keep unparseable criteria visible rather than hiding the block.
+			m.Criteria, _ = ParseMatchCriteria(block.Header.Value)
+			for _, kv := range block.Directives() {
+				m.Options = append(m.Options, model.HostOption{Key: kv.Key, Value: kv.Value})
+			}
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+// GetMatch returns a single Match block by its 1-based ID.
+func GetMatch(dir *SSHDir, id int) (*model.MatchBlock, error) {
+	matches, err := ListMatches(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		if m.ID == id {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("match block not found: %d", id)
+}
+
+// AddMatch appends a new Match block to m.File, or to the main config when
+// no file is given.
+func AddMatch(dir *SSHDir, m model.MatchBlock) error {
+	if err := ValidateMatchCriteria(m.Criteria); err != nil {
+		return err
+	}
+	if err := dir.EnsureDir(); err != nil {
+		return err
+	}
+
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return err
+	}
+	cfg, err := configFileIn(dir, root, m.File)
+	if err != nil {
+		return err
+	}
+	var directives [][2]string
+	for _, o := range m.Options {
+		if o.Value != "" {
+			directives = append(directives, [2]string{o.Key, o.Value})
+		}
+	}
+	cfg.AppendBlock("Match "+FormatMatchCriteria(m.Criteria), directives)
+	return cfg.Save()
+}
+
+// UpdateMatch rewrites the criteria and options of the Match block with m.ID,
+// in whichever config file defines it.
+// Keywords missing from m.Options are removed from the block; repeated ones
+// are written in the given order. If version is not empty and the config
+// tree no longer matches it (see ConfigVersion), ErrConflict is returned.
+func UpdateMatch(dir *SSHDir, m model.MatchBlock, version string) error {
+	if err := ValidateMatchCriteria(m.Criteria); err != nil {
+		return err
+	}
+
+	cfg, local, err := findMatchFile(dir, m.ID, version)
+	if err != nil {
+		return err
+	}
+	m.ID = local
+	if err := cfg.UpdateMatch(m); err != nil {
+		return err
+	}
+	return cfg.Save()
+}
+
+// DeleteMatch removes the Match block with the given ID from the config file.
+// A stale version fails with ErrConflict, as for UpdateMatch.
+func DeleteMatch(dir *SSHDir, id int, version string) error {
+	cfg, local, err := findMatchFile(dir, id, version)
+	if err != nil {
+		return err
+	}
+	if err := cfg.RemoveMatch(local); err != nil {
+		return err
+	}
+	return cfg.Save()
+}
+
+// Matches returns the file's Match blocks in order.
+func (f *ConfigFile) Matches() []ConfigBlock {
+	var out []ConfigBlock
+	for _, b := range f.Blocks() {
+		if b.IsMatch() {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// FindMatch returns the Match block with the given 1-based ID.
+func (f *ConfigFile) FindMatch(id int) *ConfigBlock {
+	matches := f.Matches()
+	if id < 1 || id > len(matches) {
+		return nil
+	}
+	return &matches[id-1]
+}
+
+// UpdateMatch rewrites the Match block with m.ID in place. The header is only
+// touched when the criteria actually change.
+func (f *ConfigFile) UpdateMatch(m model.MatchBlock) error {
+	b := f.FindMatch(m.ID)
+	if b == nil {
+		return fmt.Errorf("match block not found: %d", m.ID)
+	}
+
+	if current, err := ParseMatchCriteria(b.Header.Value); err != nil || !equalCriteria(current, m.Criteria) {
+		b.Header.SetValue(FormatMatchCriteria(m.Criteria))
+	}
+
+	for _, kv := range b.Directives() {
+		if _, named := optionValues(m.Options, kv.Key); !named {
+			f.setDirectives(b.Header, kv.Key, nil)
+		}
+	}
+	for _, key := range directiveKeys(m.Options) {
+		values, _ := optionValues(m.Options, key)
+		f.setDirectives(b.Header, key, values)
+	}
+	return nil
+}
+
+// RemoveMatch deletes the Match block with the given ID.
+func (f *ConfigFile) RemoveMatch(id int) error {
+	b := f.FindMatch(id)
+	if b == nil {
+		return fmt.Errorf("match block not found: %d", id)
+	}
+	f.removeBlock(b)
+	return nil
+}
+
+// ParseMatchCriteria parses the arguments of a Match line,
+// e.g. `host *.corp !user root exec "test -f ~/.vpn"`.
+func ParseMatchCriteria(s string) ([]model.MatchCriterion, error) {
+	args := splitConfigArgs(s)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("match criteria required")
+	}
+
+	var criteria []model.MatchCriterion
+	for i := 0; i < len(args); i++ {
+		c := model.MatchCriterion{Keyword: strings.ToLower(args[i])}
+		if strings.HasPrefix(c.Keyword, "!") {
+			c.Negated = true
+			c.Keyword = c.Keyword[1:]
+		}
+
+		needsArg, ok := matchArgCount[c.Keyword]
+		if !ok {
+			return criteria, fmt.Errorf("unknown match criterion: %s", args[i])
+		}
+		if needsArg {
+			if i+1 >= len(args) {
+				return criteria, fmt.Errorf("match criterion %s requires an argument", c.Keyword)
+			}
+			i++
+			c.Value = args[i]
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria, nil
+}
+
+// FormatMatchCriteria renders criteria back into Match line arguments,
+// quoting values that contain whitespace.
+func FormatMatchCriteria(criteria []model.MatchCriterion) string {
+	parts := make([]string, 0, len(criteria)*2)
+	for _, c := range criteria {
+		kw := c.Keyword
+		if c.Negated {
+			kw = "!" + kw
+		}
+		parts = append(parts, kw)
+		if c.Value != "" {
+			v := c.Value
+			if strings.ContainsAny(v, " \t") {
+				v = "\"" + v + "\""
+			}
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ValidateMatchCriteria reports criteria that OpenSSH would reject: none at
+// all, an unknown keyword, a missing argument, or "all" alongside anything
+// but a leading canonical or final.
+func ValidateMatchCriteria(criteria []model.MatchCriterion) error {
+	if len(criteria) == 0 {
+		return fmt.Errorf("match criteria required")
+	}
+	for i, c := range criteria {
+		needsArg, ok := matchArgCount[c.Keyword]
+		if !ok {
+			return fmt.Errorf("unknown match criterion: %s", c.Keyword)
+		}
+		if needsArg && c.Value == "" {
+			return fmt.Errorf("match criterion %s requires an argument", c.Keyword)
+		}
+		if c.Keyword == "all" && !allAllowed(criteria, i) {
+			return fmt.Errorf("'all' cannot be combined with other Match attributes")
+		}
+	}
+	return nil
+}
+
+// allAllowed reports whether "all" may stand at index i: last, and after
+// nothing but canonical or final.
+func allAllowed(criteria []model.MatchCriterion, i int) bool {
+	if i != len(criteria)-1 {
+		return false
+	}
+	for _, c := range criteria[:i] {
+		if c.Keyword != "canonical" && c.Keyword != "final" {
+			return false
+		}
+	}
+	return true
+}
+
+func equalCriteria(a, b []model.MatchCriterion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
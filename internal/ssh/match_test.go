@@ -0,0 +1,206 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestParseMatchCriteria(t *testing.T) {
+	criteria, err := ParseMatchCriteria(`host *.internal !host legacy.internal exec "test -f ~/.vpn-up"`)
+	if err != nil {
+		t.Fatalf("ParseMatchCriteria failed: %v", err)
+	}
+	want := []model.MatchCriterion{
+		{Keyword: "host", Value: "*.internal"},
+		{Keyword: "host", Negated: true, Value: "legacy.internal"},
+		{Keyword: "exec", Value: "test -f ~/.vpn-up"},
+	}
+	if !equalCriteria(criteria, want) {
+		t.Fatalf("unexpected criteria: %+v", criteria)
+	}
+
+	if got := FormatMatchCriteria(criteria); got != `host *.internal !host legacy.internal exec "test -f ~/.vpn-up"` {
+		t.Fatalf("FormatMatchCriteria round trip mismatch: %s", got)
+	}
+
+	if _, err := ParseMatchCriteria("all"); err != nil {
+		t.Fatalf("expected 'all' to parse: %v", err)
+	}
+	if _, err := ParseMatchCriteria("bogus foo"); err == nil {
+		t.Fatal("expected error for unknown criterion")
+	}
+	if _, err := ParseMatchCriteria("host"); err == nil {
+		t.Fatal("expected error for missing argument")
+	}
+	if _, err := ParseMatchCriteria(""); err == nil {
+		t.Fatal("expected error for empty criteria")
+	}
+
+	for s, valid := range map[string]bool{
+		"all":           true,
+		"final all":     true,
+		"canonical all": true,
+		"host a all":    false,
+		"all user me":   false,
+	} {
+		criteria, err := ParseMatchCriteria(s)
+		if err != nil {
+			t.Fatalf("ParseMatchCriteria(%q) failed: %v", s, err)
+		}
+		if err := ValidateMatchCriteria(criteria); (err == nil) != valid {
+			t.Errorf("ValidateMatchCriteria(%q) = %v, want valid %v", s, err, valid)
+		}
+	}
+}
+
+func TestListMatches(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	data, err := os.ReadFile(filepath.Join("testdata", "config", "match.conf"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	os.WriteFile(dir.ConfigPath(), data, 0600)
+
+	matches, err := ListMatches(dir)
+	if err != nil {
+		t.Fatalf("ListMatches failed: %v", err)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("expected 3 match blocks, got %d", len(matches))
+	}
+	if matches[0].Line != 5 {
+		t.Fatalf("expected first match on line 5, got %d", matches[0].Line)
+	}
+	if len(matches[0].Options) != 2 || matches[0].Options[0] != (model.HostOption{Key: "ProxyJump", Value: "jump"}) {
+		t.Fatalf("expected ProxyJump 'jump' first, got %+v", matches[0].Options)
+	}
+	if matches[1].Criteria[0].Keyword != "originalhost" || matches[1].Criteria[1].Value != "ci" {
+		t.Fatalf("unexpected criteria: %+v", matches[1].Criteria)
+	}
+
+	// Match blocks must not leak into the host list.
+	hosts, _ := ListHosts(dir)
+	if len(hosts) != 1 || hosts[0].Alias != "jump" {
+		t.Fatalf("expected only 'jump' host, got %+v", hosts)
+	}
+}
+
+func TestAddUpdateDeleteMatch(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Host a\n    HostName a.example.com\n"), 0600)
+
+	m := model.MatchBlock{
+		Criteria: []model.MatchCriterion{{Keyword: "host", Value: "*.corp"}},
+		Options:  []model.HostOption{{Key: "ProxyJump", Value: "a"}, {Key: "User", Value: "me"}},
+	}
+	if err := AddMatch(dir, m); err != nil {
+		t.Fatalf("AddMatch failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(dir.ConfigPath())
+	want := "Host a\n    HostName a.example.com\n\nMatch host *.corp\n    ProxyJump a\n    User me\n"
+	if string(data) != want {
+		t.Fatalf("unexpected config after add:\n%q", data)
+	}
+
+	m.ID = 1
+	m.Criteria = append(m.Criteria, model.MatchCriterion{Keyword: "user", Negated: true, Value: "root"})
+	m.Options = []model.HostOption{{Key: "ProxyJump", Value: "b"}}
+	version, err := ConfigVersion(dir)
+	if err != nil {
+		t.Fatalf("ConfigVersion failed: %v", err)
+	}
+	if err := UpdateMatch(dir, m, version); err != nil {
+		t.Fatalf("UpdateMatch failed: %v", err)
+	}
+
+	data, _ = os.ReadFile(dir.ConfigPath())
+	want = "Host a\n    HostName a.example.com\n\nMatch host *.corp !user root\n    ProxyJump b\n"
+	if string(data) != want {
+		t.Fatalf("unexpected config after update:\n%q", data)
+	}
+
+	if err := DeleteMatch(dir, 1, version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict deleting with a stale version, got %v", err)
+	}
+	if err := DeleteMatch(dir, 1, ""); err != nil {
+		t.Fatalf("DeleteMatch failed: %v", err)
+	}
+	data, _ = os.ReadFile(dir.ConfigPath())
+	if string(data) != "Host a\n    HostName a.example.com\n" {
+		t.Fatalf("unexpected config after delete:\n%q", data)
+	}
+
+	if err := DeleteMatch(dir, 1, ""); err == nil {
+		t.Fatal("expected error deleting missing match")
+	}
+}
+
+func TestUpdateMatchRepeatedOptions(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	config := "Match host *.corp\n" +
+		"    IdentityFile ~/.ssh/a\n" +
+		"    SendEnv LANG\n" +
+		"    IdentityFile ~/.ssh/b\n" +
+		"    SendEnv LC_*\n" +
+		"    LocalForward 8080 localhost:80\n" +
+		"    LocalForward 8443 localhost:443\n"
+	os.WriteFile(dir.ConfigPath(), []byte(config), 0600)
+
+	m, err := GetMatch(dir, 1)
+	if err != nil {
+		t.Fatalf("GetMatch failed: %v", err)
+	}
+	want := []model.HostOption{
+		{Key: "IdentityFile", Value: "~/.ssh/a"},
+		{Key: "SendEnv", Value: "LANG"},
+		{Key: "IdentityFile", Value: "~/.ssh/b"},
+		{Key: "SendEnv", Value: "LC_*"},
+		{Key: "LocalForward", Value: "8080 localhost:80"},
+		{Key: "LocalForward", Value: "8443 localhost:443"},
+	}
+	if len(m.Options) != len(want) {
+		t.Fatalf("expected %d options, got %+v", len(want), m.Options)
+	}
+	for i := range want {
+		if m.Options[i] != want[i] {
+			t.Fatalf("option %d: expected %+v, got %+v", i, want[i], m.Options[i])
+		}
+	}
+
+	// Saving the block unchanged leaves the file alone
+	if err := UpdateMatch(dir, *m, ""); err != nil {
+		t.Fatalf("UpdateMatch failed: %v", err)
+	}
+	data, _ := os.ReadFile(dir.ConfigPath())
+	if string(data) != config {
+		t.Fatalf("expected config unchanged, got:\n%s", data)
+	}
+
+	// Dropping one of a repeated keyword keeps the others
+	m.Options = append(m.Options[:2], model.HostOption{Key: "LocalForward", Value: "8080 localhost:80"}, model.HostOption{Key: "IdentityFile", Value: "~/.ssh/c"})
+	if err := UpdateMatch(dir, *m, ""); err != nil {
+		t.Fatalf("UpdateMatch failed: %v", err)
+	}
+	data, _ = os.ReadFile(dir.ConfigPath())
+	wantConfig := "Match host *.corp\n" +
+		"    IdentityFile ~/.ssh/a\n" +
+		"    SendEnv LANG\n" +
+		"    IdentityFile ~/.ssh/c\n" +
+		"    LocalForward 8080 localhost:80\n"
+	if string(data) != wantConfig {
+		t.Fatalf("unexpected config after update:\n%s", data)
+	}
+}
+
+func TestAddMatchRejectsInvalidCriteria(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	m := model.MatchBlock{Criteria: []model.MatchCriterion{{Keyword: "exec"}}}
+	if err := AddMatch(dir, m); err == nil {
+		t.Fatal("expected error for exec without command")
+	}
+}
@@ -0,0 +1,360 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// multiValued lists keywords where ssh accumulates every value it reads
+// instead of keeping the first one.
+var multiValued = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+	"sendenv":         true,
+}
+
+// exclusive pairs keywords where setting one makes ssh ignore the other.
+var exclusive = map[string]string{
+	"proxyjump":    "proxycommand",
+	"proxycommand": "proxyjump",
+}
+
+// ResolveOptions controls how ResolveHost evaluates Match criteria that
+// depend on the local environment.
+type ResolveOptions struct {
+	// LocalUser is matched by "Match localuser" and is the default User.
+	// Defaults to the user running the process.
+	LocalUser string
+	// Exec evaluates "Match exec" commands. When nil, exec criteria are
+	// not run and never match.
+	Exec func(command string) bool
+}
+
+// ResolveHost computes the effective configuration ssh would use to connect
+// to host, the way `ssh -G` does: files are read in order following Include,
+// Host and Match blocks are evaluated against the destination, and the first
+// value seen for each keyword wins. Each value records the file and line that
+// set it, and the chain lists every block evaluated along the way.
+func ResolveHost(dir *SSHDir, host string, opts ResolveOptions) (*model.ResolvedConfig, error) {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return nil, fmt.Errorf("host required")
+	}
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LocalUser == "" {
+		opts.LocalUser = currentUsername()
+	}
+
+	r := &resolver{
+		dir:    dir,
+		host:   strings.ToLower(host),
+		opts:   opts,
+		values: make(map[string][]model.ResolvedOption),
+	}
+	r.readFile(root, true, false)
+
+	if canon := r.first("canonicalizehostname"); canon == "yes" || canon == "always" {
+		r.wantFinal = true
+	}
+	if r.wantFinal {
+		// ssh pins HostName to the expanded name and reads the files again;
+		// settings from the first pass are kept.
+		if vals, ok := r.values["hostname"]; ok {
+			vals[0].Value = r.hostname()
+		}
+		r.final = true
+		r.readFile(root, true, false)
+	}
+
+	res := &model.ResolvedConfig{Host: host, Chain: r.chain}
+	if vals, ok := r.values["hostname"]; ok {
+		vals[0].Value = r.hostname()
+	} else {
+		r.values["hostname"] = []model.ResolvedOption{{Key: "hostname", Value: r.host}}
+	}
+	if _, ok := r.values["port"]; !ok {
+		r.values["port"] = []model.ResolvedOption{{Key: "port", Value: "22"}}
+	}
+	if _, ok := r.values["user"]; !ok {
+		r.values["user"] = []model.ResolvedOption{{Key: "user", Value: opts.LocalUser}}
+	}
+
+	keys := make([]string, 0, len(r.values))
+	for k := range r.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res.Options = append(res.Options, r.values[k]...)
+	}
+	return res, nil
+}
+
+type resolver struct {
+	dir       *SSHDir
+	host      string
+	opts      ResolveOptions
+	final     bool
+	wantFinal bool
+	values    map[string][]model.ResolvedOption
+	chain     []model.ResolveStep
+}
+
+// readFile applies f's directives. active is the state inherited from the
+// including file; nevermatch is set when the Include sat in a block that did
+// not apply, in which case nothing in f may apply either.
+func (r *resolver) readFile(f *ConfigFile, active, nevermatch bool) {
+	rel := r.dir.RelPath(f.Path)
+	step := -1
+
+	for _, l := range f.Lines {
+		if l.Key == "" {
+			continue
+		}
+		switch strings.ToLower(l.Key) {
+		case "host":
+			active = !nevermatch && r.matchHost(l.Args())
+			step = r.addStep(model.ResolveStep{Header: "Host " + l.Value, File: rel, Line: f.LineNumber(l), Matched: active})
+		case "match":
+			s := model.ResolveStep{Header: "Match " + l.Value, File: rel, Line: f.LineNumber(l)}
+			if nevermatch {
+				active = false
+			} else {
+				active, s.Note = r.matchCriteria(l.Value)
+			}
+			s.Matched = active
+			step = r.addStep(s)
+		case "include":
+			for _, child := range f.Includes[l] {
+				if child.Err == nil {
+					r.readFile(child, active, nevermatch || !active)
+				}
+			}
+		default:
+			if !active {
+				continue
+			}
+			if step < 0 {
+				step = r.addStep(model.ResolveStep{File: rel, Matched: true})
+			}
+			r.set(&r.chain[step], l, rel, f.LineNumber(l))
+		}
+	}
+}
+
+func (r *resolver) addStep(s model.ResolveStep) int {
+	s.Final = r.final
+	r.chain = append(r.chain, s)
+	return len(r.chain) - 1
+}
+
+// set records a directive unless an earlier block already set the keyword.
+func (r *resolver) set(step *model.ResolveStep, l *ConfigLine, file string, line int) {
+	key := strings.ToLower(l.Key)
+	if !multiValued[key] {
+		_, set := r.values[key]
+		if _, other := r.values[exclusive[key]]; set || other {
+			step.Shadowed = append(step.Shadowed, key)
+			return
+		}
+		r.values[key] = []model.ResolvedOption{{Key: key, Value: l.Value, File: file, Line: line}}
+		step.Applied = append(step.Applied, key)
+		return
+	}
+
+	// Files and forwards are deduplicated; SendEnv is appended as is, so a
+	// final pass repeats it just like ssh -G shows.
+	vals := []string{l.Value}
+	if key == "sendenv" {
+		vals = l.Args()
+	}
+	for _, v := range vals {
+		if key != "sendenv" && containsValue(r.values[key], v) {
+			continue
+		}
+		r.values[key] = append(r.values[key], model.ResolvedOption{Key: key, Value: v, File: file, Line: line})
+	}
+	step.Applied = append(step.Applied, key)
+}
+
+func (r *resolver) first(key string) string {
+	if vals := r.values[key]; len(vals) > 0 {
+		return strings.ToLower(vals[0].Value)
+	}
+	return ""
+}
+
+// hostname returns the name ssh will connect to: HostName with %h expanded,
+// or the destination itself.
+func (r *resolver) hostname() string {
+	vals, ok := r.values["hostname"]
+	if !ok {
+		return r.host
+	}
+	v := strings.NewReplacer("%h", r.host, "%%", "%").Replace(vals[0].Value)
+	return strings.ToLower(v)
+}
+
+// matchHost evaluates the patterns of a Host line. A negated pattern that
+// matches rejects the block regardless of the other patterns. The final pass
+// matches against the expanded HostName rather than the destination.
+func (r *resolver) matchHost(patterns []string) bool {
+	name := r.host
+	if r.final {
+		name = r.hostname()
+	}
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if matchPattern(name, strings.ToLower(p)) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchCriteria evaluates the arguments of a Match line. Every criterion must
+// hold for the block to apply. The note explains criteria that could not be
+// evaluated.
+func (r *resolver) matchCriteria(value string) (bool, string) {
+	criteria, err := ParseMatchCriteria(value)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	result := true
+	var notes []string
+	for _, c := range criteria {
+		var ok bool
+		switch c.Keyword {
+		case "all":
+			ok = true
+		case "canonical", "final":
+			if c.Keyword == "final" {
+				r.wantFinal = true
+			}
+			ok = r.final
+		case "host":
+			ok = matchPatternList(r.hostname(), c.Value, true) == 1
+		case "originalhost":
+			ok = matchPatternList(r.host, c.Value, true) == 1
+		case "user":
+			u := r.opts.LocalUser
+			if vals, set := r.values["user"]; set {
+				u = vals[0].Value
+			}
+			ok = matchPatternList(u, c.Value, false) == 1
+		case "localuser":
+			ok = matchPatternList(r.opts.LocalUser, c.Value, false) == 1
+		case "tagged":
+			ok = matchPatternList(r.first("tag"), c.Value, false) == 1
+		case "exec":
+			// Like ssh, skip commands once the result is already decided.
+			if !result {
+				continue
+			}
+			if r.opts.Exec == nil {
+				notes = append(notes, "exec not evaluated")
+				ok = c.Negated
+			} else {
+				ok = r.opts.Exec(c.Value)
+			}
+		default:
+			notes = append(notes, c.Keyword+" not evaluated")
+			ok = c.Negated
+		}
+		if ok == c.Negated {
+			result = false
+		}
+	}
+	return result, strings.Join(notes, "; ")
+}
+
+// matchPatternList matches s against a comma-separated list of patterns, as
+// OpenSSH's match_pattern_list does: 1 if a pattern matches, -1 if a negated
+// pattern matches, 0 otherwise.
+func matchPatternList(s, list string, fold bool) int {
+	if fold {
+		s = strings.ToLower(s)
+		list = strings.ToLower(list)
+	}
+	got := 0
+	for _, p := range strings.Split(list, ",") {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if matchPattern(s, p) {
+			if negated {
+				return -1
+			}
+			got = 1
+		}
+	}
+	return got
+}
+
+// matchPattern reports whether s matches pattern, where '*' matches any
+// run of characters and '?' matches exactly one.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return s == ""
+}
+
+func containsValue(opts []model.ResolvedOption, v string) bool {
+	for _, o := range opts {
+		if o.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
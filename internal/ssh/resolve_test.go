@@ -0,0 +1,201 @@
+package ssh
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The *.ssh-G files in testdata/resolve were captured with
+//
+//	ssh -G -F ~/.ssh/config <host>
+//
+// after copying config and config.d into an otherwise empty ~/.ssh, as root.
+func TestResolveHostMatchesSSHG(t *testing.T) {
+	base, _ := filepath.Abs(filepath.Join("testdata", "resolve"))
+	dir := NewSSHDir(base)
+
+	fixtures, _ := filepath.Glob(filepath.Join(base, "*.ssh-G"))
+	if len(fixtures) == 0 {
+		t.Fatal("no ssh -G fixtures found")
+	}
+	// ssh -G prints every option, so only the keywords the config sets are
+	// expected to be resolved, and only where a block set them.
+	configured := configKeywords(t, dir)
+	for _, fixture := range fixtures {
+		host := strings.TrimSuffix(filepath.Base(fixture), ".ssh-G")
+		t.Run(host, func(t *testing.T) {
+			want := readSSHG(t, fixture)
+
+			res, err := ResolveHost(dir, host, ResolveOptions{LocalUser: "root"})
+			if err != nil {
+				t.Fatalf("ResolveHost failed: %v", err)
+			}
+			got := make(map[string][]string)
+			for _, o := range res.Options {
+				got[o.Key] = append(got[o.Key], o.Value)
+			}
+			for key, vals := range got {
+				if strings.Join(vals, "|") != strings.Join(want[key], "|") {
+					t.Errorf("%s: got %q, ssh -G has %q", key, vals, want[key])
+				}
+			}
+			for key, vals := range want {
+				if _, ok := got[key]; !ok && configured[key] && strings.Join(vals, "|") != sshGDefaults[key] {
+					t.Errorf("%s: missing, ssh -G has %q", key, vals)
+				}
+			}
+		})
+	}
+}
+
+// sshGDefaults are the values ssh -G prints for configured keywords when no
+// block sets them for the host, joined with "|".
+var sshGDefaults = map[string]string{
+	"forwardagent":          "no",
+	"stricthostkeychecking": "ask",
+	"identityfile":          "~/.ssh/id_rsa|~/.ssh/id_ecdsa|~/.ssh/id_ecdsa_sk|~/.ssh/id_ed25519|~/.ssh/id_ed25519_sk|~/.ssh/id_xmss|~/.ssh/id_dsa",
+}
+
+// configKeywords returns the lowercased keywords set anywhere in dir's
+// config tree, other than Host, Match and Include.
+func configKeywords(t *testing.T, dir *SSHDir) map[string]bool {
+	t.Helper()
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		t.Fatalf("LoadConfigTree failed: %v", err)
+	}
+	keys := make(map[string]bool)
+	for _, f := range root.Files() {
+		for _, l := range f.Lines {
+			switch key := strings.ToLower(l.Key); key {
+			case "", "host", "match", "include":
+			default:
+				keys[key] = true
+			}
+		}
+	}
+	return keys
+}
+
+// readSSHG parses ssh -G output, undoing the normalizations ssh applies when
+// printing so values compare equal to what the config says.
+func readSSHG(t *testing.T, path string) map[string][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	defer f.Close()
+
+	out := make(map[string][]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), " ")
+		switch key {
+		case "localforward", "remoteforward", "dynamicforward":
+			value = strings.NewReplacer("[", "", "]", "").Replace(value)
+		}
+		switch value {
+		case "true":
+			value = "yes"
+		case "false":
+			value = "no"
+		}
+		out[key] = append(out[key], value)
+	}
+	return out
+}
+
+func TestResolveHostChain(t *testing.T) {
+	base, _ := filepath.Abs(filepath.Join("testdata", "resolve"))
+	dir := NewSSHDir(base)
+
+	res, err := ResolveHost(dir, "web2", ResolveOptions{LocalUser: "root"})
+	if err != nil {
+		t.Fatalf("ResolveHost failed: %v", err)
+	}
+
+	// The final pass (triggered by "Match final") matches Host lines against
+	// web2.prod.example.com, so "Host !web2 web*" applies there.
+	var compression, port bool
+	for _, o := range res.Options {
+		switch o.Key {
+		case "compression":
+			compression = true
+			if o.Value != "yes" || o.File != "config" || o.Line != 2 {
+				t.Fatalf("expected compression from config:2, got %+v", o)
+			}
+		case "port":
+			port = true
+			if o.Value != "2201" || o.File != "config" || o.Line != 12 {
+				t.Fatalf("expected port from config:12, got %+v", o)
+			}
+		}
+	}
+	if !compression || !port {
+		t.Fatalf("missing options: %+v", res.Options)
+	}
+
+	var sawWeb2 bool
+	for _, s := range res.Chain {
+		switch {
+		case s.Header == "Host web2" && !s.Final:
+			sawWeb2 = true
+			if !s.Matched || s.File != "config.d/10-bastion.conf" || len(s.Shadowed) != 1 || s.Shadowed[0] != "compression" {
+				t.Fatalf("unexpected web2 step: %+v", s)
+			}
+		case s.Header == "Host !web2 web*" && s.Matched != s.Final:
+			t.Fatalf("negated pattern should only reject the first pass: %+v", s)
+		}
+	}
+	if !sawWeb2 {
+		t.Fatalf("web2 block missing from chain: %+v", res.Chain)
+	}
+}
+
+func TestResolveHostExec(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Match exec \"test -f /vpn\"\n    ProxyJump vpn\n"), 0600)
+
+	res, err := ResolveHost(dir, "x", ResolveOptions{LocalUser: "me"})
+	if err != nil {
+		t.Fatalf("ResolveHost failed: %v", err)
+	}
+	if res.Chain[0].Matched || res.Chain[0].Note != "exec not evaluated" {
+		t.Fatalf("expected unevaluated exec, got %+v", res.Chain[0])
+	}
+
+	res, _ = ResolveHost(dir, "x", ResolveOptions{LocalUser: "me", Exec: func(cmd string) bool { return cmd == "test -f /vpn" }})
+	if !res.Chain[0].Matched || res.Chain[0].Applied[0] != "proxyjump" {
+		t.Fatalf("expected exec to match, got %+v", res.Chain[0])
+	}
+
+	if _, err := ResolveHost(dir, " ", ResolveOptions{}); err == nil {
+		t.Fatal("expected error for empty host")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		s, pattern string
+		want       bool
+	}{
+		{"web1", "web*", true},
+		{"web1", "web?", true},
+		{"web12", "web?", false},
+		{"a.prod.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"", "*", true},
+	}
+	for _, c := range cases {
+		if got := matchPattern(c.s, c.pattern); got != c.want {
+			t.Errorf("matchPattern(%q, %q) = %v", c.s, c.pattern, got)
+		}
+	}
+	if matchPatternList("DB.corp", "*.corp,!db.corp", true) != -1 {
+		t.Error("expected negated match")
+	}
+}
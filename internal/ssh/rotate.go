@@ -0,0 +1,186 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// RotateOptions controls RotateKey.
+type RotateOptions struct {
+	DryRun     bool      // only plan the rotation; nothing is written
+	Passphrase string    // for the successor; empty leaves it unencrypted
+	Now        time.Time // dates the successor's name; defaults to now
+}
+
+// dateSuffix matches the -YYYYMMDD suffix a previous rotation added.
+var dateSuffix = regexp.MustCompile(`-\d{8}$`)
+
+// identityEdit is a config file with its IdentityFile lines repointed, not
+// yet saved.
+type identityEdit struct {
+	cfg    *ConfigFile
+	change model.RotationFile
+}
+
+// RotateKey replaces the key name with a successor of the same type and
+// comment, named after it with today's date (id_ed25519-20261016). It takes
+// a backup to roll back to, generates the successor, repoints every
+// IdentityFile in the config and its includes, and moves the old pair into
+// the retired folder. With opts.DryRun it returns the plan, including the
+// config diff, without changing anything.
+func RotateKey(dir *SSHDir, name string, opts RotateOptions) (*model.KeyRotation, error) {
+	key, err := GetKey(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if !key.HasPrivate {
+		return nil, fmt.Errorf("key %s has no private key to rotate", name)
+	}
+	keyType, bits, err := successorType(key)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	plan := &model.KeyRotation{
+		OldName: name,
+		Type:    keyType,
+		Bits:    bits,
+		Comment: key.Comment,
+		Files:   []model.RotationFile{},
+		DryRun:  opts.DryRun,
+	}
+	plan.NewName = freeName(dateSuffix.ReplaceAllString(name, "")+"-"+opts.Now.Format("20060102"), func(n string) bool {
+		return fileExists(dir.Path(n)) || fileExists(dir.Path(n+".pub"))
+	})
+	archive := freeName(filepath.Join(dir.RetiredDir(), name), func(p string) bool {
+		return fileExists(p) || fileExists(p+".pub")
+	})
+	plan.Archive = dir.RelPath(archive)
+
+	edits, err := repointIdentityFiles(dir, name, plan.NewName)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range edits {
+		plan.Files = append(plan.Files, e.change)
+	}
+	if opts.DryRun {
+		return plan, nil
+	}
+
+	plan.Backup, err = createBackup(dir)
+	if err != nil {
+		return nil, fmt.Errorf("back up before rotating: %w", err)
+	}
+	req := model.KeyGenRequest{Name: plan.NewName, Type: keyType, Bits: bits, Comment: key.Comment, Passphrase: opts.Passphrase}
+	if err := GenerateKey(dir, req); err != nil {
+		return nil, err
+	}
+	for _, e := range edits {
+		if err := e.cfg.Save(); err != nil {
+			return nil, fmt.Errorf("update %s: %w; restore backup %s to roll back", e.change.File, err, plan.Backup)
+		}
+	}
+	if err := archiveKeyPair(dir, name, archive); err != nil {
+		return nil, fmt.Errorf("%w; restore backup %s to roll back", err, plan.Backup)
+	}
+	return plan, nil
+}
+
+// successorType picks the GenerateKey type and size for a key's successor:
+// the same as the key, except that RSA keys get at least 3072 bits and DSA
+// keys, which can no longer be generated, are replaced with Ed25519.
+func successorType(key *model.SSHKey) (string, int, error) {
+	switch {
+	case key.Type == "ssh-ed25519":
+		return "ed25519", 0, nil
+	case key.Type == "ssh-rsa":
+		return "rsa", max(key.Bits, defaultRSABits), nil
+	case strings.HasPrefix(key.Type, "ecdsa-sha2-"):
+		return "ecdsa", key.Bits, nil
+	case strings.HasPrefix(key.Type, "sk-ssh-ed25519"):
+		return "ed25519-sk", 0, nil
+	case strings.HasPrefix(key.Type, "sk-ecdsa-"):
+		return "ecdsa-sk", 0, nil
+	case key.Type == "ssh-dss":
+		return "ed25519", 0, nil
+	case key.Type == "":
+		return "", 0, fmt.Errorf("can't tell the type of %s without its public key", key.Name)
+	}
+	return "", 0, fmt.Errorf("can't rotate %s keys", key.Type)
+}
+
+// repointIdentityFiles changes every IdentityFile that resolves to the key
+// oldName, in the config and the files it includes, to use newName instead.
+// The edits are returned unsaved, each with its diff.
+func repointIdentityFiles(dir *SSHDir, oldName, newName string) ([]identityEdit, error) {
+	root, err := LoadConfigTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	oldPath := dir.Path(oldName)
+
+	var edits []identityEdit
+	for _, f := range root.Files() {
+		before := string(f.Bytes())
+		var lines []int
+		for i, l := range f.Lines {
+			if !strings.EqualFold(l.Key, "IdentityFile") {
+				continue
+			}
+			args := l.Args()
+			if len(args) != 1 || !strings.HasSuffix(args[0], oldName) || dir.ExpandPath(args[0]) != oldPath {
+				continue
+			}
+			arg := strings.TrimSuffix(args[0], oldName) + newName
+			l.SetValue(strings.Replace(l.Value, args[0], arg, 1))
+			lines = append(lines, i+1)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		edits = append(edits, identityEdit{cfg: f, change: model.RotationFile{
+			File:  dir.RelPath(f.Path),
+			Lines: lines,
+			Diff:  DiffContext(DiffLines(before, string(f.Bytes())), 2),
+		}})
+	}
+	return edits, nil
+}
+
+// archiveKeyPair moves the key name, its .pub and any certificate to
+// archive (a path in the retired folder).
+func archiveKeyPair(dir *SSHDir, name, archive string) error {
+	if err := os.MkdirAll(filepath.Dir(archive), 0700); err != nil {
+		return fmt.Errorf("create retired folder: %w", err)
+	}
+	for _, suffix := range []string{"", ".pub", "-cert.pub"} {
+		from := dir.Path(name + suffix)
+		if !fileExists(from) {
+			continue
+		}
+		if err := os.Rename(from, archive+suffix); err != nil {
+			return fmt.Errorf("archive %s: %w", name+suffix, err)
+		}
+	}
+	return nil
+}
+
+// freeName returns name, or name-2, name-3... if taken reports it in use.
+func freeName(name string, taken func(string) bool) string {
+	candidate := name
+	for i := 2; taken(candidate); i++ {
+		candidate = name + "-" + strconv.Itoa(i)
+	}
+	return candidate
+}
@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func rotateTestDir(t *testing.T) *SSHDir {
+	t.Helper()
+	dir := NewSSHDir(filepath.Join(t.TempDir(), ".ssh"))
+	if err := GenerateKey(dir, model.KeyGenRequest{Name: "id_work", Type: "rsa", Bits: 2048, Comment: "me@test"}); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	config := "Include conf.d/*\n\nHost a\n    IdentityFile ~/.ssh/id_work\n\nHost b\n    IdentityFile id_other\n"
+	if err := os.WriteFile(dir.ConfigPath(), []byte(config), 0600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+	os.MkdirAll(dir.Path("conf.d"), 0700)
+	included := "Host c\n    IdentityFile \"~/.ssh/id_work\" # work key\n"
+	if err := os.WriteFile(dir.Path("conf.d/hosts"), []byte(included), 0600); err != nil {
+		t.Fatalf("write include failed: %v", err)
+	}
+	return dir
+}
+
+func TestRotateKeyDryRun(t *testing.T) {
+	dir := rotateTestDir(t)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	before, _ := os.ReadFile(dir.ConfigPath())
+
+	plan, err := RotateKey(dir, "id_work", RotateOptions{DryRun: true, Now: now})
+	if err != nil {
+		t.Fatalf("RotateKey failed: %v", err)
+	}
+	if plan.NewName != "id_work-20261016" || plan.Type != "rsa" || plan.Bits != 3072 || plan.Comment != "me@test" {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if plan.Archive != filepath.Join("retired", "id_work") || plan.Backup != "" {
+		t.Errorf("unexpected archive %q or backup %q", plan.Archive, plan.Backup)
+	}
+	if len(plan.Files) != 2 || plan.Files[0].File != "config" || plan.Files[1].File != filepath.Join("conf.d", "hosts") {
+		t.Fatalf("expected config and conf.d/hosts to change, got %+v", plan.Files)
+	}
+	var added []string
+	for _, d := range plan.Files[1].Diff {
+		if d.Op == "+" {
+			added = append(added, d.Text)
+		}
+	}
+	if len(added) != 1 || added[0] != "    IdentityFile \"~/.ssh/id_work-20261016\" # work key" {
+		t.Errorf("unexpected diff %+v", plan.Files[1].Diff)
+	}
+
+	// Nothing changed on disk
+	after, _ := os.ReadFile(dir.ConfigPath())
+	if string(after) != string(before) || fileExists(dir.Path("id_work-20261016")) || !fileExists(dir.Path("id_work")) {
+		t.Error("dry run changed files")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := rotateTestDir(t)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+
+	plan, err := RotateKey(dir, "id_work", RotateOptions{Now: now, Passphrase: "secret"})
+	if err != nil {
+		t.Fatalf("RotateKey failed: %v", err)
+	}
+	if plan.Backup == "" || !fileExists(filepath.Join(dir.BackupDir(), plan.Backup)) {
+		t.Errorf("expected a backup, got %q", plan.Backup)
+	}
+	checkKeyRoundTrip(t, dir, "id_work-20261016", "secret")
+
+	config, _ := os.ReadFile(dir.ConfigPath())
+	if !strings.Contains(string(config), "IdentityFile ~/.ssh/id_work-20261016\n") || !strings.Contains(string(config), "IdentityFile id_other") {
+		t.Errorf("unexpected config after rotation:\n%s", config)
+	}
+	included, _ := os.ReadFile(dir.Path("conf.d/hosts"))
+	if !strings.Contains(string(included), "\"~/.ssh/id_work-20261016\" # work key") {
+		t.Errorf("unexpected include after rotation:\n%s", included)
+	}
+
+	if fileExists(dir.Path("id_work")) || fileExists(dir.Path("id_work.pub")) {
+		t.Error("old key pair left in place")
+	}
+	if !fileExists(filepath.Join(dir.RetiredDir(), "id_work")) || !fileExists(filepath.Join(dir.RetiredDir(), "id_work.pub")) {
+		t.Error("old key pair not archived")
+	}
+
+	// Rotating the successor replaces the date rather than adding another
+	plan, err = RotateKey(dir, "id_work-20261016", RotateOptions{DryRun: true, Now: now.AddDate(1, 0, 0)})
+	if err != nil {
+		t.Fatalf("RotateKey failed: %v", err)
+	}
+	if plan.NewName != "id_work-20271016" {
+		t.Errorf("expected id_work-20271016, got %s", plan.NewName)
+	}
+}
+
+func TestRotateKeyErrors(t *testing.T) {
+	dir := rotateTestDir(t)
+	if _, err := RotateKey(dir, "missing", RotateOptions{DryRun: true}); err == nil {
+		t.Error("expected error for a missing key")
+	}
+	os.Remove(dir.Path("id_work"))
+	if _, err := RotateKey(dir, "id_work", RotateOptions{DryRun: true}); err == nil {
+		t.Error("expected error for a key without its private half")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // SSHDir provides operations rooted at a given SSH directory.
@@ -42,11 +43,59 @@ func (d *SSHDir) KnownHostsPath() string {
 	return d.Path("known_hosts")
 }
 
+// ExpandPath resolves a path the way ssh does for the user config: "~" is the
+// home directory, "~/.ssh" maps to this SSH directory, and relative paths are
+// relative to the SSH directory.
+func (d *SSHDir) ExpandPath(p string) string {
+	switch {
+	case p == "~/.ssh" || strings.HasPrefix(p, "~/.ssh/"):
+		return filepath.Join(d.Base, strings.TrimPrefix(p, "~/.ssh"))
+	case p == "~" || strings.HasPrefix(p, "~/"):
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = filepath.Dir(d.Base)
+		}
+		return filepath.Join(home, strings.TrimPrefix(p, "~"))
+	case filepath.IsAbs(p):
+		return filepath.Clean(p)
+	default:
+		return filepath.Join(d.Base, p)
+	}
+}
+
+// RelPath returns p relative to the SSH directory when it lives inside it,
+// otherwise p unchanged.
+func (d *SSHDir) RelPath(p string) string {
+	rel, err := filepath.Rel(d.Base, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return rel
+}
+
 // BackupDir returns the path to the backup directory (outside ~/.ssh).
 func (d *SSHDir) BackupDir() string {
 	return filepath.Join(filepath.Dir(d.Base), ".ssh_backups")
 }
 
+// HistoryDir returns the path to the undo history journal, kept next to the
+// backup directory.
+func (d *SSHDir) HistoryDir() string {
+	return filepath.Join(filepath.Dir(d.Base), ".ssh_history")
+}
+
+// RetiredDir returns the folder rotated-out keys are archived to, inside the
+// SSH directory so they keep its permissions.
+func (d *SSHDir) RetiredDir() string {
+	return d.Path("retired")
+}
+
+// AgentSocketPath returns the default socket for the built-in agent, outside
+// ~/.ssh so backups and the file watcher never see it.
+func (d *SSHDir) AgentSocketPath() string {
+	return filepath.Join(filepath.Dir(d.Base), ".sshmasher-agent.sock")
+}
+
 // EnsureDir creates the SSH directory if it doesn't exist with 0700 permissions.
 func (d *SSHDir) EnsureDir() error {
 	return os.MkdirAll(d.Base, 0700)
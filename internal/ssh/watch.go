@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/holden/sshmasher/internal/model"
+)
+
+// watchDebounce gathers the burst of events an editor save produces (write
+// temp file, rename, chmod) into one change.
+const watchDebounce = 150 * time.Millisecond
+
+// Watcher reports changes to files in an SSH dir, whoever made them.
+type Watcher struct {
+	dir  *SSHDir
+	fsw  *fsnotify.Watcher
+	mu   sync.Mutex
+	subs map[chan model.FileEvent]struct{}
+}
+
+var (
+	watchersMu sync.Mutex
+	watchers   = make(map[string]*Watcher)
+)
+
+// Watch returns the watcher for dir, starting it on first use so the web
+// handlers and the desktop app share one.
+func Watch(dir *SSHDir) (*Watcher, error) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	if w, ok := watchers[dir.Base]; ok {
+		return w, nil
+	}
+	w, err := NewWatcher(dir)
+	if err != nil {
+		return nil, err
+	}
+	watchers[dir.Base] = w
+	return w, nil
+}
+
+// NewWatcher watches dir's base and its subdirectories (such as config.d)
+// for changes.
+func NewWatcher(dir *SSHDir) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("start watcher: %w", err)
+	}
+	if err := fsw.Add(dir.Base); err != nil {
+		fsw.Close()
+		return nil, fmt.Errorf("watch %s: %w", dir.Base, err)
+	}
+	entries, _ := os.ReadDir(dir.Base)
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			fsw.Add(filepath.Join(dir.Base, e.Name()))
+		}
+	}
+
+	w := &Watcher{dir: dir, fsw: fsw, subs: make(map[chan model.FileEvent]struct{})}
+	go w.run()
+	return w, nil
+}
+
+// Subscribe returns a channel of changes and a func to stop receiving them.
+// Changes are dropped for subscribers that fall behind.
+func (w *Watcher) Subscribe() (<-chan model.FileEvent, func()) {
+	ch := make(chan model.FileEvent, 16)
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		if _, ok := w.subs[ch]; ok {
+			delete(w.subs, ch)
+			close(ch)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Close stops the watcher and closes all subscriptions.
+func (w *Watcher) Close() error {
+	watchersMu.Lock()
+	if watchers[w.dir.Base] == w {
+		delete(watchers, w.dir.Base)
+	}
+	watchersMu.Unlock()
+	return w.fsw.Close()
+}
+
+func (w *Watcher) run() {
+	pending := make(map[string]map[string]bool)
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				w.closeSubs()
+				return
+			}
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && filepath.Dir(ev.Name) == w.dir.Base {
+					w.fsw.Add(ev.Name)
+					continue
+				}
+			}
+			kind := ChangeKind(w.dir, ev.Name)
+			if kind == "" {
+				continue
+			}
+			if pending[kind] == nil {
+				pending[kind] = make(map[string]bool)
+			}
+			pending[kind][w.dir.RelPath(ev.Name)] = true
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			for kind, files := range pending {
+				ev := model.FileEvent{Kind: kind}
+				for f := range files {
+					ev.Files = append(ev.Files, f)
+				}
+				w.broadcast(ev)
+			}
+			pending = make(map[string]map[string]bool)
+		case _, ok := <-w.fsw.Errors:
+			if !ok {
+				w.closeSubs()
+				return
+			}
+		}
+	}
+}
+
+func (w *Watcher) broadcast(ev model.FileEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (w *Watcher) closeSubs() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		delete(w.subs, ch)
+		close(ch)
+	}
+}
+
+// ChangeKind says which view a change to path affects: "config",
+// "knownhosts" or "keys". It returns "" for files SSHmasher doesn't show,
+// such as editor swap files, the temp files of atomic writes and files in
+// subdirectories that aren't included in the config.
+func ChangeKind(dir *SSHDir, path string) string {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") || strings.HasSuffix(name, ".swp") {
+		return ""
+	}
+	switch {
+	case filepath.Dir(path) == dir.RetiredDir():
+		return "keys"
+	case filepath.Dir(path) != dir.Base:
+		if includedPath(dir, path) {
+			return "config"
+		}
+		return ""
+	case name == "config" || strings.HasSuffix(name, ".conf"):
+		return "config"
+	case strings.HasPrefix(name, "known_hosts"):
+		return "knownhosts"
+	case strings.HasPrefix(name, "authorized_keys") || name == "environment" || name == "rc":
+		return ""
+	}
+	return "keys"
+}
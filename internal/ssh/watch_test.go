@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/holden/sshmasher/internal/model"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	w, err := NewWatcher(dir)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	defer w.Close()
+	changes, stop := w.Subscribe()
+	defer stop()
+
+	next := func() model.FileEvent {
+		t.Helper()
+		select {
+		case ev := <-changes:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for change")
+		}
+		return model.FileEvent{}
+	}
+
+	os.WriteFile(dir.ConfigPath(), []byte("Include config.d/*\nHost a\n"), 0600)
+	if ev := next(); ev.Kind != "config" || len(ev.Files) != 1 || ev.Files[0] != "config" {
+		t.Errorf("unexpected config change: %+v", ev)
+	}
+
+	os.WriteFile(dir.KnownHostsPath(), []byte(""), 0600)
+	if ev := next(); ev.Kind != "knownhosts" {
+		t.Errorf("unexpected known_hosts change: %+v", ev)
+	}
+
+	// New subdirectories are watched for included config
+	os.Mkdir(dir.Path("config.d"), 0700)
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir.Path("config.d"), "work"), []byte("Host w\n"), 0600)
+	if ev := next(); ev.Kind != "config" || ev.Files[0] != filepath.Join("config.d", "work") {
+		t.Errorf("unexpected config.d change: %+v", ev)
+	}
+}
+
+func TestChangeKind(t *testing.T) {
+	dir := NewSSHDir(t.TempDir())
+	os.WriteFile(dir.ConfigPath(), []byte("Include config.d/*\n"), 0600)
+	tests := map[string]string{
+		"config":          "config",
+		"work.conf":       "config",
+		"config.d/work":   "config",
+		"retired/id_old":  "keys",
+		"notes/todo":      "",
+		".keygen-1/key":   "",
+		"known_hosts":     "knownhosts",
+		"known_hosts.old": "knownhosts",
+		"id_ed25519":      "keys",
+		"id_ed25519.pub":  "keys",
+		"authorized_keys": "",
+		".config.tmp-123": "",
+		".config.swp":     "",
+		"config~":         "",
+	}
+	for name, want := range tests {
+		if got := ChangeKind(dir, dir.Path(name)); got != want {
+			t.Errorf("ChangeKind(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -54,6 +54,32 @@ function copyPublicKey(btn) {
     });
 }
 
+// Raw editor saves rejected by validation (422) come back with the editor and
+// its problems, so swap them in instead of treating them as errors.
+document.addEventListener("htmx:beforeSwap", function(evt) {
+    if (evt.detail.xhr.status === 422) {
+        evt.detail.shouldSwap = true;
+        evt.detail.isError = false;
+    }
+});
+
+// Move the raw editor cursor to the line in el's data-line attribute
+function gotoRawLine(el) {
+    const form = el.closest("form");
+    const editor = form && form.querySelector("textarea.raw-editor");
+    if (!editor) return false;
+
+    const lines = editor.value.split("\n");
+    const line = Math.min(parseInt(el.dataset.line, 10), lines.length);
+    let start = 0;
+    for (let i = 0; i < line - 1; i++) {
+        start += lines[i].length + 1;
+    }
+    editor.focus();
+    editor.setSelectionRange(start, start + lines[line - 1].length);
+    return false;
+}
+
 // Listen for HTMX response errors and show alert
 document.addEventListener("htmx:responseError", function(evt) {
     const msg = evt.detail.xhr.responseText || "An error occurred";
@@ -80,3 +106,107 @@ function showAlert(message, type) {
 document.addEventListener("showAlert", function(evt) {
     showAlert(evt.detail.message, evt.detail.type || "success");
 });
+
+// Containers that show each kind of file, and the endpoint that re-renders
+// them, refreshed when the files change on disk (e.g. edited in vim).
+const liveTargets = {
+    keys: [["#keys-table", "/api/keys"]],
+    config: [
+        ["#config-content", "/api/config/hosts"],
+        ["#config-matches", "/api/config/matches"],
+        ["#config-files", "/api/config/files"],
+        ["#config-lint", "/api/config/lint"],
+    ],
+    knownhosts: [["#knownhosts-content", "/api/knownhosts"]],
+};
+
+function refreshChanged(change) {
+    const search = document.querySelector('input[name="search"]');
+    const values = search && search.value ? { search: search.value } : {};
+
+    (liveTargets[change.kind] || []).forEach(function([selector, url]) {
+        const target = document.querySelector(selector);
+        if (!target) return;
+        // Don't clobber an open raw editor; saving it reports the conflict.
+        if (target.querySelector("textarea.raw-editor")) {
+            showAlert(change.files.join(", ") + " changed on disk. Reload the editor to see the new content.", "info");
+            return;
+        }
+        htmx.ajax("GET", url, { target: target, swap: "innerHTML", values: values });
+    });
+}
+
+// Subscribe to file changes: Wails runtime events in the desktop app,
+// Server-Sent Events in the browser.
+(function() {
+    if (window.runtime && window.runtime.EventsOn) {
+        window.runtime.EventsOn("ssh:change", refreshChanged);
+        return;
+    }
+    if (!window.EventSource) return;
+    const source = new EventSource("/api/events");
+    source.addEventListener("change", function(evt) {
+        refreshChanged(JSON.parse(evt.data));
+    });
+})();
+
+// Probe every host on the health page, replacing each row as its result
+// streams in.
+function runHealthChecks(btn) {
+    const auth = document.getElementById("health-auth").checked;
+    const source = new EventSource("/api/health/run?html=1" + (auth ? "&auth=1" : ""));
+    btn.disabled = true;
+    btn.setAttribute("aria-busy", "true");
+    document.querySelectorAll(".health-table tbody tr").forEach(function(tr) {
+        tr.classList.add("health-pending");
+    });
+
+    function finish() {
+        // Close before the server ends the stream, or EventSource reconnects
+        // and runs the checks again.
+        source.close();
+        btn.disabled = false;
+        btn.removeAttribute("aria-busy");
+        document.querySelectorAll(".health-pending").forEach(function(tr) {
+            tr.classList.remove("health-pending");
+        });
+    }
+
+    source.addEventListener("result", function(evt) {
+        const tbody = document.createElement("tbody");
+        tbody.innerHTML = evt.data;
+        const row = tbody.firstElementChild;
+        const old = row && document.getElementById(row.id);
+        if (old) old.replaceWith(row);
+    });
+    source.addEventListener("error", function(evt) {
+        if (evt.data) showAlert(evt.data, "error");
+        finish();
+    });
+    source.addEventListener("done", finish);
+}
+
+// Stream the built-in agent's signing requests into the log on the agent
+// page, replacing a row when its request finishes.
+(function() {
+    const log = document.getElementById("agent-log");
+    if (!log || !window.EventSource) return;
+    const source = new EventSource("/api/agent/builtin/events?html=1");
+    source.addEventListener("request", function(evt) {
+        const tbody = document.createElement("tbody");
+        tbody.innerHTML = evt.data;
+        const row = tbody.firstElementChild;
+        if (!row) return;
+        htmx.process(row);
+        const old = document.getElementById(row.id);
+        if (old) {
+            old.replaceWith(row);
+        } else {
+            log.prepend(row);
+            while (log.children.length > 100) log.lastElementChild.remove();
+        }
+        if (row.classList.contains("agent-pending")) {
+            showAlert("A signature with " + row.children[1].textContent + " is waiting for your approval", "info");
+        }
+    });
+})();